@@ -0,0 +1,714 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// Leg is the call leg of the B2BUA.
+type Leg int
+
+const (
+	// LegA is the incoming leg, the B2BUA is UAS on it.
+	LegA Leg = iota
+	// LegB is the outgoing leg, the B2BUA is UAC on it.
+	LegB
+)
+
+func (leg Leg) String() string {
+	if leg == LegA {
+		return "A"
+	}
+
+	return "B"
+}
+
+func (leg Leg) peer() Leg {
+	if leg == LegA {
+		return LegB
+	}
+
+	return LegA
+}
+
+type CallState int
+
+const (
+	CallTrying CallState = iota
+	CallEstablished
+	CallTerminated
+)
+
+func (state CallState) String() string {
+	switch state {
+	case CallTrying:
+		return "Trying"
+	case CallEstablished:
+		return "Established"
+	case CallTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// RequestRewriter alters the request before it is sent to the leg, origin is the request received on the other leg.
+type RequestRewriter func(call *Call, leg Leg, req, origin sip.Request)
+
+// ResponseRewriter alters the response before it is sent to the leg,
+// origin is the response received on the other leg, it is nil for responses generated by the B2BUA.
+type ResponseRewriter func(call *Call, leg Leg, res, origin sip.Response)
+
+// b2buaMethods are in-dialog requests bridged between the legs,
+// BYE terminates the dialog and the other leg is released after it.
+var b2buaMethods = []sip.RequestMethod{sip.INVITE, sip.UPDATE, sip.INFO}
+
+// B2BUAConfig describes the B2BUA, zero values are replaced with defaults.
+type B2BUAConfig struct {
+	// Host and Port the B2BUA is reached at, they are sent in Via and Contact headers of both legs.
+	Host string
+	Port sip.Port
+	// Transport of the outgoing leg, UDP by default.
+	Transport string
+	// RewriteRequest is called on every request bridged to the leg, e.g. to alter SDP offer.
+	RewriteRequest RequestRewriter
+	// RewriteResponse is called on every response bridged to the leg, e.g. to alter SDP answer.
+	RewriteResponse ResponseRewriter
+}
+
+// B2BUA is back-to-back user agent - RFC 3261 6, RFC 7092.
+// Incoming INVITE is answered after the outgoing one to the located target,
+// CANCEL, re-INVITE, UPDATE, INFO and BYE are mapped between the legs.
+// Both legs are released when any of them is terminated.
+type B2BUA struct {
+	srv     Server
+	locator Locator
+	config  B2BUAConfig
+
+	mu    sync.RWMutex
+	calls map[string]*Call
+
+	log log.Logger
+}
+
+// NewB2BUA creates B2BUA and registers it as INVITE request handler.
+func NewB2BUA(srv Server, locator Locator, config B2BUAConfig, logger log.Logger) (*B2BUA, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("b2bua: host is required")
+	}
+	if config.Transport == "" {
+		config.Transport = "UDP"
+	}
+	if config.Port == 0 {
+		config.Port = sip.DefaultPort(config.Transport)
+	}
+
+	b := &B2BUA{
+		srv:     srv,
+		locator: locator,
+		config:  config,
+		calls:   make(map[string]*Call),
+	}
+	b.log = logger.WithPrefix("gosip.B2BUA")
+
+	if err := srv.OnRequestWithContext(sip.INVITE, b.Handle); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *B2BUA) Log() log.Logger {
+	return b.log
+}
+
+// Call returns the active call by Call-ID of any leg.
+func (b *B2BUA) Call(callID string) (*Call, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	call, ok := b.calls[callID]
+
+	return call, ok
+}
+
+// Calls returns all active calls.
+func (b *B2BUA) Calls() []*Call {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	calls := make([]*Call, 0, len(b.calls)/2)
+	for callID, call := range b.calls {
+		if callID == call.CallID(LegA) {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+func (b *B2BUA) put(call *Call) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, callID := range call.callIDs {
+		b.calls[callID] = call
+	}
+}
+
+func (b *B2BUA) drop(call *Call) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, callID := range call.callIDs {
+		if b.calls[callID] == call {
+			delete(b.calls, callID)
+		}
+	}
+}
+
+// Handle bridges the incoming INVITE, it can be used as request handler of the server.
+// CANCEL of the incoming INVITE is answered by the server and cancels the outgoing one.
+func (b *B2BUA) Handle(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	logger := b.Log().WithFields(req.Fields())
+
+	if tx == nil {
+		return
+	}
+	// in-dialog requests of the bridged calls are handled by the dialogs
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		b.respond(req, 481, "Call/Transaction Does Not Exist")
+		return
+	}
+
+	call, err := b.newCall(req)
+	if err != nil {
+		logger.Warnf("create call failed: %s", err)
+		b.respond(req, 400, "Bad Request")
+		return
+	}
+	b.put(call)
+
+	targets, err := b.locator.Locate(ctx, req)
+	if err != nil {
+		logger.Warnf("locate call targets failed: %s", err)
+		b.reject(call, 500, "Server Internal Error", nil)
+		return
+	}
+	if len(targets) == 0 {
+		b.reject(call, 480, "Temporarily Unavailable", nil)
+		return
+	}
+
+	dlg, err := b.dial(ctx, call, targets)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the server has answered 487 on CANCEL
+			call.terminate()
+			return
+		}
+
+		logger.Debugf("outgoing leg failed: %s", err)
+		var reqErr *sip.RequestError
+		switch {
+		case errors.As(err, &reqErr) && reqErr.Response != nil:
+			b.reject(call, reqErr.Response.StatusCode(), reqErr.Response.Reason(), reqErr.Response)
+		case isTimeoutError(err):
+			b.reject(call, 408, "Request Timeout", nil)
+		default:
+			b.reject(call, 503, "Service Unavailable", nil)
+		}
+		return
+	}
+
+	call.setDialog(LegB, dlg)
+	if err := dlg.Ack(); err != nil {
+		logger.Warnf("send ACK failed: %s", err)
+	}
+	if ctx.Err() != nil {
+		// CANCEL has crossed 2xx of the outgoing leg
+		b.release(call)
+		return
+	}
+
+	if err := b.answer(call, dlg.SipDialog().Response()); err != nil {
+		logger.Warnf("answer incoming leg failed: %s", err)
+		b.release(call)
+		return
+	}
+
+	b.bridge(call)
+}
+
+// dial sends the outgoing INVITE to the targets in order until one of them answers with 2xx.
+func (b *B2BUA) dial(ctx context.Context, call *Call, targets []sip.Uri) (Dialog, error) {
+	var err error
+	for _, target := range targets {
+		var dlg Dialog
+		dlg, err = b.srv.Invite(ctx, b.newInvite(call, target), WithResponseHandler(func(res sip.Response, _ sip.Request) {
+			if res.IsProvisional() && res.StatusCode() > 100 {
+				b.relayProvisional(call, res)
+			}
+		}))
+		if err == nil {
+			return dlg, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && reqErr.Code >= 600 {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// newInvite creates the outgoing INVITE, it keeps the caller identity and the session description.
+func (b *B2BUA) newInvite(call *Call, target sip.Uri) sip.Request {
+	origin := call.invite
+	transport := b.config.Transport
+	if tp, ok := target.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+		transport = tp.String()
+	}
+
+	port := b.config.Port
+	callID := sip.CallID(call.callIDs[LegB])
+	maxForwards := sip.MaxForwards(70)
+	if mf, ok := getMaxForwards(origin); ok && mf > 0 {
+		maxForwards = mf - 1
+	}
+
+	call.mu.Lock()
+	call.seq++
+	seq := call.seq
+	call.mu.Unlock()
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       transport,
+			Host:            b.config.Host,
+			Port:            &port,
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}},
+		&sip.FromHeader{
+			DisplayName: call.from.DisplayName,
+			Address:     call.from.Address.Clone(),
+			Params:      sip.NewParams().Add("tag", sip.String{Str: call.fromTag}),
+		},
+		&sip.ToHeader{
+			DisplayName: call.to.DisplayName,
+			Address:     call.to.Address.Clone(),
+		},
+		&callID,
+		&sip.CSeq{SeqNo: seq, MethodName: sip.INVITE},
+		&maxForwards,
+		&sip.ContactHeader{Address: b.contact(call.from.Address)},
+	}
+
+	req := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.INVITE, target.Clone(), "SIP/2.0", hdrs, "", nil)
+	sip.CopyHeaders("Content-Type", origin, req)
+	req.SetBody(origin.Body(), true)
+	req.SetTransport(transport)
+
+	b.rewriteRequest(call, LegB, req, origin)
+
+	return req
+}
+
+// contact returns Contact URI of the B2BUA with the user part of the uri.
+func (b *B2BUA) contact(uri sip.Uri) sip.Uri {
+	port := b.config.Port
+	contact := &sip.SipUri{
+		FHost:      b.config.Host,
+		FPort:      &port,
+		FUriParams: sip.NewParams(),
+		FHeaders:   sip.NewParams(),
+	}
+	if uri != nil && uri.User() != nil {
+		contact.FUser = uri.User()
+	}
+
+	return contact
+}
+
+// newResponse creates response on the incoming INVITE from the response of the outgoing leg.
+func (b *B2BUA) newResponse(call *Call, status sip.StatusCode, reason string, origin sip.Response) sip.Response {
+	var body string
+	if origin != nil {
+		body = origin.Body()
+	}
+	res := sip.NewResponseFromRequest("", call.invite, status, reason, body)
+	if origin != nil {
+		sip.CopyHeaders("Content-Type", origin, res)
+	}
+	if to, ok := res.To(); ok {
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		to.Params.Add("tag", sip.String{Str: call.toTag})
+	}
+	if status < 300 {
+		res.AppendHeader(&sip.ContactHeader{Address: b.contact(call.to.Address)})
+	}
+
+	b.rewriteResponse(call, LegA, res, origin)
+
+	return res
+}
+
+func (b *B2BUA) relayProvisional(call *Call, origin sip.Response) {
+	if call.State() != CallTrying {
+		return
+	}
+
+	res := b.newResponse(call, origin.StatusCode(), origin.Reason(), origin)
+	if _, err := b.srv.Respond(res); err != nil {
+		b.Log().WithFields(res.Fields()).Warnf("relay '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+// answer sends 2xx on the incoming INVITE and takes the created dialog.
+func (b *B2BUA) answer(call *Call, origin sip.Response) error {
+	res := b.newResponse(call, origin.StatusCode(), origin.Reason(), origin)
+	if _, err := b.srv.Respond(res); err != nil {
+		return err
+	}
+
+	fromTag, _ := call.from.Params.Get("tag")
+	id := sip.MakeDialogID(call.callIDs[LegA], call.toTag, fromTag.String())
+
+	dlg, ok := b.srv.GetDialog(id)
+	if !ok {
+		return fmt.Errorf("dialog %s not found", id)
+	}
+	call.setDialog(LegA, dlg)
+
+	return nil
+}
+
+// reject sends final non-2xx response on the incoming INVITE and terminates the call.
+func (b *B2BUA) reject(call *Call, status sip.StatusCode, reason string, origin sip.Response) {
+	defer call.terminate()
+
+	res := b.newResponse(call, status, reason, origin)
+	if _, err := b.srv.Respond(res); err != nil {
+		b.Log().WithFields(res.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+func (b *B2BUA) respond(req sip.Request, status sip.StatusCode, reason string) {
+	res := sip.NewResponseFromRequest("", req, status, reason, "")
+	ensureToTag(res)
+	if _, err := b.srv.Respond(res); err != nil {
+		b.Log().WithFields(req.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+// bridge maps in-dialog requests between the legs and releases the call when any of legs is terminated.
+func (b *B2BUA) bridge(call *Call) {
+	for _, leg := range []Leg{LegA, LegB} {
+		dlg := call.Dialog(leg)
+		for _, method := range b2buaMethods {
+			dlg.OnRequest(method, b.forward(call, leg.peer()))
+		}
+		dlg.OnRequest(sip.ACK, b.forwardAck(call, leg.peer()))
+	}
+	call.setState(CallEstablished)
+
+	go func() {
+		select {
+		case <-call.Dialog(LegA).Done():
+		case <-call.Dialog(LegB).Done():
+		}
+
+		b.release(call)
+	}()
+}
+
+// forward returns handler sending the in-dialog request to the leg and its response back.
+func (b *B2BUA) forward(call *Call, leg Leg) RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		logger := b.Log().WithFields(req.Fields())
+
+		dlg := call.Dialog(leg)
+		out, err := dlg.SipDialog().NewRequest(req.Method(), req.Body())
+		if err != nil {
+			logger.Warnf("create request to leg %s failed: %s", leg, err)
+			b.respond(req, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		sip.CopyHeaders("Content-Type", req, out)
+		b.rewriteRequest(call, leg, out, req)
+
+		ctx, cancel := context.WithTimeout(call.ctx, serverTimers(b.srv).TimerB)
+		defer cancel()
+
+		res, err := b.srv.RequestWithContext(ctx, out)
+		if res != nil {
+			dlg.SipDialog().ReceiveResponse(res)
+			if out.IsInvite() && res.IsSuccess() {
+				// the leg is acknowledged with ACK of the peer leg, it carries the answer on delayed offer
+				call.holdAck(leg, out, res)
+			}
+		}
+
+		var reqErr *sip.RequestError
+		switch {
+		case err == nil:
+		case errors.As(err, &reqErr) && reqErr.Response != nil:
+			res = reqErr.Response
+		case isTimeoutError(err):
+			b.relayResponse(call, leg.peer(), req, 408, "Request Timeout", nil)
+			b.release(call)
+			return
+		default:
+			logger.Warnf("send request to leg %s failed: %s", leg, err)
+			b.relayResponse(call, leg.peer(), req, 503, "Service Unavailable", nil)
+			return
+		}
+
+		b.relayResponse(call, leg.peer(), req, res.StatusCode(), res.Reason(), res)
+		// the leg has lost the dialog - RFC 3261 12.2.1.2
+		if res.StatusCode() == 481 || res.StatusCode() == 408 {
+			b.release(call)
+		}
+	}
+}
+
+// forwardAck returns handler acknowledging 2xx response on re-INVITE held for the leg
+// with the body of ACK received from the peer leg.
+func (b *B2BUA) forwardAck(call *Call, leg Leg) RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		// retransmitted ACK finds nothing held
+		if held, ok := call.takeAck(leg); ok {
+			b.ack(call, leg, held.invite, held.res, req)
+		}
+	}
+}
+
+// ack acknowledges 2xx response on re-INVITE sent to the leg, the body is copied from the origin ACK.
+func (b *B2BUA) ack(call *Call, leg Leg, invite sip.Request, res sip.Response, origin sip.Request) {
+	ack := sip.NewAckRequest("", invite, res, origin.Body(), nil)
+	sip.CopyHeaders("Content-Type", origin, ack)
+	b.rewriteRequest(call, leg, ack, origin)
+	if dst := invite.Destination(); dst != "" {
+		ack.SetDestination(dst)
+	}
+	if err := b.srv.Send(ack); err != nil {
+		b.Log().WithFields(ack.Fields()).Warnf("send ACK failed: %s", err)
+	}
+}
+
+func (b *B2BUA) relayResponse(call *Call, leg Leg, req sip.Request, status sip.StatusCode, reason string, origin sip.Response) {
+	var body string
+	if origin != nil {
+		body = origin.Body()
+	}
+	res := sip.NewResponseFromRequest("", req, status, reason, body)
+	if origin != nil {
+		sip.CopyHeaders("Content-Type", origin, res)
+	}
+	if req.IsInvite() && status < 300 {
+		res.AppendHeader(&sip.ContactHeader{Address: call.Dialog(leg).SipDialog().LocalTarget().Clone()})
+	}
+
+	b.rewriteResponse(call, leg, res, origin)
+
+	if _, err := b.srv.Respond(res); err != nil {
+		b.Log().WithFields(res.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+// release sends BYE to the legs still in dialog and terminates the call.
+func (b *B2BUA) release(call *Call) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimers(b.srv).TimerF)
+	defer cancel()
+
+	if err := call.Hangup(ctx); err != nil {
+		b.Log().WithFields(call.invite.Fields()).Debugf("hangup call failed: %s", err)
+	}
+}
+
+func (b *B2BUA) rewriteRequest(call *Call, leg Leg, req, origin sip.Request) {
+	if b.config.RewriteRequest != nil {
+		b.config.RewriteRequest(call, leg, req, origin)
+	}
+}
+
+func (b *B2BUA) rewriteResponse(call *Call, leg Leg, res, origin sip.Response) {
+	if b.config.RewriteResponse != nil {
+		b.config.RewriteResponse(call, leg, res, origin)
+	}
+}
+
+// Call is the pair of legs bridged by the B2BUA.
+type Call struct {
+	b2bua   *B2BUA
+	invite  sip.Request
+	callIDs [2]string
+	from    *sip.FromHeader
+	to      *sip.ToHeader
+	fromTag string
+	toTag   string
+
+	mu      sync.RWMutex
+	state   CallState
+	seq     uint32
+	dialogs [2]Dialog
+	acks    [2]*heldAck
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (b *B2BUA) newCall(invite sip.Request) (*Call, error) {
+	callID, ok := invite.CallID()
+	if !ok {
+		return nil, fmt.Errorf("missing Call-ID header")
+	}
+	from, ok := invite.From()
+	if !ok || from.Params == nil || !from.Params.Has("tag") {
+		return nil, fmt.Errorf("missing From header tag")
+	}
+	to, ok := invite.To()
+	if !ok {
+		return nil, fmt.Errorf("missing To header")
+	}
+
+	call := &Call{
+		b2bua:   b,
+		invite:  invite,
+		callIDs: [2]string{string(*callID), util.RandString(32)},
+		from:    from.Clone().(*sip.FromHeader),
+		to:      to.Clone().(*sip.ToHeader),
+		fromTag: util.RandString(10),
+		toTag:   util.RandString(10),
+	}
+	call.ctx, call.cancel = context.WithCancel(context.Background())
+
+	return call, nil
+}
+
+// CallID returns Call-ID of the leg.
+func (call *Call) CallID(leg Leg) string {
+	return call.callIDs[leg]
+}
+
+// Invite returns the incoming INVITE of the call.
+func (call *Call) Invite() sip.Request {
+	return call.invite
+}
+
+func (call *Call) State() CallState {
+	call.mu.RLock()
+	defer call.mu.RUnlock()
+
+	return call.state
+}
+
+func (call *Call) setState(state CallState) {
+	call.mu.Lock()
+	call.state = state
+	call.mu.Unlock()
+}
+
+// Dialog returns dialog of the leg, it is nil until the call is established.
+func (call *Call) Dialog(leg Leg) Dialog {
+	call.mu.RLock()
+	defer call.mu.RUnlock()
+
+	return call.dialogs[leg]
+}
+
+func (call *Call) setDialog(leg Leg, dlg Dialog) {
+	call.mu.Lock()
+	call.dialogs[leg] = dlg
+	call.mu.Unlock()
+}
+
+// heldAck is 2xx response on re-INVITE sent to the leg waiting for ACK of the peer leg.
+type heldAck struct {
+	invite sip.Request
+	res    sip.Response
+}
+
+func (call *Call) holdAck(leg Leg, invite sip.Request, res sip.Response) {
+	call.mu.Lock()
+	call.acks[leg] = &heldAck{invite: invite, res: res}
+	call.mu.Unlock()
+}
+
+func (call *Call) takeAck(leg Leg) (*heldAck, bool) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	held := call.acks[leg]
+	call.acks[leg] = nil
+
+	return held, held != nil
+}
+
+// Done is closed when the call is terminated.
+func (call *Call) Done() <-chan struct{} {
+	return call.ctx.Done()
+}
+
+// Hangup sends BYE to the legs still in dialog and terminates the call.
+func (call *Call) Hangup(ctx context.Context) error {
+	call.mu.Lock()
+	if call.state == CallTerminated {
+		call.mu.Unlock()
+		return nil
+	}
+	call.state = CallTerminated
+	call.mu.Unlock()
+	defer call.terminate()
+
+	var errs []error
+	for _, leg := range []Leg{LegA, LegB} {
+		dlg := call.Dialog(leg)
+		if dlg == nil {
+			continue
+		}
+
+		select {
+		case <-dlg.Done():
+			continue
+		default:
+		}
+		if err := dlg.Bye(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("leg %s: %w", leg, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+func (call *Call) terminate() {
+	call.once.Do(func() {
+		call.setState(CallTerminated)
+		call.b2bua.drop(call)
+		call.cancel()
+	})
+}
+
+func isTimeoutError(err error) bool {
+	var txErr transaction.TxError
+	return errors.As(err, &txErr) && txErr.Timeout()
+}
@@ -0,0 +1,399 @@
+package gosip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// Dialog is an INVITE dialog bound to the server that has created it.
+// In-dialog requests received by the server are routed to the matching dialog
+// before the server level request handlers.
+type Dialog interface {
+	ID() string
+	// SipDialog returns underlying dialog state.
+	SipDialog() *sip.Dialog
+	// Ack sends ACK on 2xx response to INVITE, UAC side only.
+	Ack() error
+	// Bye sends BYE request and terminates the dialog.
+	Bye(ctx context.Context) error
+	// Request sends in-dialog request with the next local CSeq.
+	Request(
+		ctx context.Context,
+		method sip.RequestMethod,
+		body string,
+		headers ...sip.Header,
+	) (sip.Response, error)
+	// OnRequest registers handler for in-dialog requests of the certain method.
+	// Requests without dialog handler fall back to the server handlers,
+	// except BYE which is answered with 200 OK and terminates the dialog.
+	// re-INVITE and UPDATE are answered as session refresh if ExtensionTimer is enabled.
+	OnRequest(method sip.RequestMethod, handler RequestHandler)
+	// OnSessionExpired registers handler called when the session timer expires
+	// and the dialog is terminated with BYE - RFC 4028 10.
+	OnSessionExpired(handler func())
+	// Done is closed when the dialog is terminated.
+	Done() <-chan struct{}
+}
+
+type dialog struct {
+	srv *server
+	sd  *sip.Dialog
+	// timer profile of the dialog transactions
+	timers transaction.Timers
+
+	hmu       sync.RWMutex
+	handlers  map[sip.RequestMethod]RequestHandler
+	onExpired func()
+
+	mu         sync.Mutex
+	acked      bool
+	resTimer   timing.Timer
+	resTimeout time.Duration
+	resElapsed time.Duration
+	session    *sessionTimer
+
+	done     chan struct{}
+	doneOnce sync.Once
+
+	log log.Logger
+}
+
+func newDialog(srv *server, sd *sip.Dialog, timers transaction.Timers) *dialog {
+	dlg := &dialog{
+		srv:      srv,
+		sd:       sd,
+		timers:   timers,
+		handlers: make(map[sip.RequestMethod]RequestHandler),
+		done:     make(chan struct{}),
+	}
+	dlg.log = srv.Log().WithFields(sd.Fields())
+
+	return dlg
+}
+
+func (dlg *dialog) String() string {
+	if dlg == nil {
+		return "<nil>"
+	}
+
+	return dlg.sd.String()
+}
+
+func (dlg *dialog) Log() log.Logger {
+	return dlg.log
+}
+
+func (dlg *dialog) ID() string {
+	return dlg.sd.ID()
+}
+
+func (dlg *dialog) SipDialog() *sip.Dialog {
+	return dlg.sd
+}
+
+func (dlg *dialog) Done() <-chan struct{} {
+	return dlg.done
+}
+
+func (dlg *dialog) OnRequest(method sip.RequestMethod, handler RequestHandler) {
+	dlg.hmu.Lock()
+	dlg.handlers[method] = handler
+	dlg.hmu.Unlock()
+}
+
+func (dlg *dialog) OnSessionExpired(handler func()) {
+	dlg.hmu.Lock()
+	dlg.onExpired = handler
+	dlg.hmu.Unlock()
+}
+
+func (dlg *dialog) Ack() error {
+	ack, err := dlg.sd.NewAck("")
+	if err != nil {
+		return err
+	}
+
+	if err := dlg.srv.Send(ack); err != nil {
+		return fmt.Errorf("%s send ACK failed: %w", dlg, err)
+	}
+
+	dlg.mu.Lock()
+	dlg.acked = true
+	dlg.mu.Unlock()
+
+	return nil
+}
+
+// resendAck sends the same ACK once again on retransmitted 2xx - RFC 3261 13.2.2.4.
+func (dlg *dialog) resendAck() {
+	ack, ok := dlg.sd.Ack()
+	if !ok {
+		return
+	}
+
+	if err := dlg.srv.Send(ack); err != nil {
+		dlg.Log().Warnf("resend ACK failed: %s", err)
+	}
+}
+
+func (dlg *dialog) Bye(ctx context.Context) error {
+	defer dlg.terminate()
+
+	_, err := dlg.Request(ctx, sip.BYE, "")
+
+	return err
+}
+
+func (dlg *dialog) Request(
+	ctx context.Context,
+	method sip.RequestMethod,
+	body string,
+	headers ...sip.Header,
+) (sip.Response, error) {
+	if method == sip.ACK {
+		return nil, fmt.Errorf("%s ACK must be sent with Ack method", dlg)
+	}
+
+	req, err := dlg.sd.NewRequest(method, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		req.AppendHeader(header)
+	}
+
+	res, err := dlg.srv.RequestWithContext(ctx, req)
+	if res != nil {
+		dlg.sd.ReceiveResponse(res)
+	}
+
+	return res, err
+}
+
+func (dlg *dialog) handleRequest(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	req sip.Request,
+	tx sip.ServerTransaction,
+) {
+	logger := dlg.Log().WithFields(req.Fields())
+	logger.Debug("routing incoming in-dialog SIP request...")
+
+	if req.IsAck() {
+		dlg.confirm()
+
+		if handler, ok := dlg.handler(sip.ACK); ok {
+			handler(req, tx)
+		}
+
+		return
+	}
+
+	if err := dlg.sd.ReceiveRequest(req); err != nil {
+		logger.Warn(err)
+
+		res := sip.NewResponseFromRequest("", req, 500, "Server Internal Error", "")
+		if _, err := dlg.srv.Respond(res); err != nil {
+			logger.Errorf("respond '500 Server Internal Error' failed: %s", err)
+		}
+
+		return
+	}
+
+	if handler, ok := dlg.handler(req.Method()); ok {
+		handler(req, tx)
+
+		if req.Method() == sip.BYE {
+			dlg.terminate()
+		}
+
+		return
+	}
+
+	if req.Method() == sip.BYE {
+		res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+		if _, err := dlg.srv.Respond(res); err != nil {
+			logger.Errorf("respond '200 OK' on BYE failed: %s", err)
+		}
+
+		dlg.terminate()
+
+		return
+	}
+
+	if dlg.srv.timers != nil && isSessionRefresh(req.Method()) {
+		dlg.answerRefresh(req)
+
+		return
+	}
+
+	dlg.srv.routeRequest(ctx, cancel, req, tx)
+}
+
+func (dlg *dialog) handler(method sip.RequestMethod) (RequestHandler, bool) {
+	dlg.hmu.RLock()
+	defer dlg.hmu.RUnlock()
+
+	handler, ok := dlg.handlers[method]
+
+	return handler, ok
+}
+
+// retransmit2xx starts retransmission of 2xx response on the UAS side until ACK arrives - RFC 3261 13.3.1.4.
+func (dlg *dialog) retransmit2xx() {
+	res := dlg.sd.Response()
+	if res == nil || dlg.srv.tp.IsReliable(res.Transport()) {
+		return
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	dlg.resTimeout = dlg.timers.T1
+	dlg.resTimer = timing.AfterFunc(dlg.resTimeout, dlg.on2xxTimer)
+}
+
+func (dlg *dialog) on2xxTimer() {
+	select {
+	case <-dlg.done:
+		return
+	default:
+	}
+
+	dlg.mu.Lock()
+	if dlg.acked {
+		dlg.mu.Unlock()
+		return
+	}
+
+	dlg.resElapsed += dlg.resTimeout
+	if dlg.resElapsed >= dlg.timers.TimerH {
+		dlg.mu.Unlock()
+
+		dlg.Log().Warn("ACK on 2xx response was not received, terminating dialog")
+
+		ctx, cancel := context.WithTimeout(context.Background(), dlg.timers.TimerF)
+		defer cancel()
+		if err := dlg.Bye(ctx); err != nil {
+			dlg.Log().Debugf("send BYE on missing ACK failed: %s", err)
+		}
+
+		return
+	}
+
+	dlg.resTimeout *= 2
+	if dlg.resTimeout > dlg.timers.T2 {
+		dlg.resTimeout = dlg.timers.T2
+	}
+	dlg.resTimer.Reset(dlg.resTimeout)
+	dlg.mu.Unlock()
+
+	if err := dlg.srv.Send(dlg.sd.Response()); err != nil {
+		dlg.Log().Warnf("resend 2xx response failed: %s", err)
+	}
+}
+
+func (dlg *dialog) confirm() {
+	dlg.mu.Lock()
+	dlg.acked = true
+	if dlg.resTimer != nil {
+		dlg.resTimer.Stop()
+		dlg.resTimer = nil
+	}
+	dlg.mu.Unlock()
+}
+
+func (dlg *dialog) terminate() {
+	dlg.doneOnce.Do(func() {
+		dlg.confirm()
+		dlg.stopSessionTimer()
+		dlg.sd.SetState(sip.DialogStateTerminated)
+		dlg.srv.dialogs.drop(dlg.ID())
+		close(dlg.done)
+
+		dlg.Log().Debug("dialog terminated")
+	})
+}
+
+type dialogStore struct {
+	dialogs map[string]*dialog
+
+	mu sync.RWMutex
+}
+
+func newDialogStore() *dialogStore {
+	return &dialogStore{
+		dialogs: make(map[string]*dialog),
+	}
+}
+
+func (store *dialogStore) put(dlg *dialog) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.dialogs[dlg.ID()] = dlg
+}
+
+func (store *dialogStore) get(id string) (*dialog, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	dlg, ok := store.dialogs[id]
+	return dlg, ok
+}
+
+func (store *dialogStore) drop(id string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.dialogs[id]; !ok {
+		return false
+	}
+	delete(store.dialogs, id)
+	return true
+}
+
+// matchRequest finds dialog for the incoming in-dialog request.
+func (store *dialogStore) matchRequest(req sip.Request) (*dialog, bool) {
+	to, ok := req.To()
+	if !ok || to.Params == nil || !to.Params.Has("tag") {
+		return nil, false
+	}
+
+	id, err := sip.MakeDialogIDFromMessage(req)
+	if err != nil {
+		return nil, false
+	}
+
+	return store.get(id)
+}
+
+// matchResponse finds UAC dialog for the response received outside of client transaction.
+func (store *dialogStore) matchResponse(res sip.Response) (*dialog, bool) {
+	callID, ok := res.CallID()
+	if !ok {
+		return nil, false
+	}
+	from, ok := res.From()
+	if !ok || from.Params == nil {
+		return nil, false
+	}
+	to, ok := res.To()
+	if !ok || to.Params == nil {
+		return nil, false
+	}
+	fromTag, ok := from.Params.Get("tag")
+	if !ok || fromTag == nil {
+		return nil, false
+	}
+	toTag, ok := to.Params.Get("tag")
+	if !ok || toTag == nil {
+		return nil, false
+	}
+
+	return store.get(sip.MakeDialogID(string(*callID), fromTag.String(), toTag.String()))
+}
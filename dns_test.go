@@ -0,0 +1,42 @@
+package gosip_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// memoryDNS serves RFC 3263 lookups from the static records
+type memoryDNS struct {
+	naptr map[string][]*transport.NAPTR
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (dns *memoryDNS) LookupNAPTR(ctx context.Context, name string) ([]*transport.NAPTR, error) {
+	if records, ok := dns.naptr[name]; ok {
+		return records, nil
+	}
+	return nil, fmt.Errorf("no NAPTR records for %s", name)
+}
+
+func (dns *memoryDNS) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if records, ok := dns.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, fmt.Errorf("no SRV records for %s", name)
+}
+
+func (dns *memoryDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := dns.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
@@ -0,0 +1,152 @@
+package gb28181
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// bindingFieldPrefix prefixes hash fields of the registrar bindings,
+// other fields of the sips hash are kept for the device route.
+const bindingFieldPrefix = "contact:"
+
+type redisBinding struct {
+	Contact    string  `json:"contact"`
+	Q          float32 `json:"q"`
+	CallID     string  `json:"callId"`
+	CSeq       uint32  `json:"cseq"`
+	Source     string  `json:"source"`
+	Registered int64   `json:"rt"`
+	Expires    int64   `json:"exp"`
+}
+
+// RedisBindingStore keeps registrar bindings in the contact:* fields of the sips:<device ID> hash,
+// the route fields (from, send, rt, exp, addr) of the hash are left to RedisRouter.
+type RedisBindingStore struct {
+	client redis.Cmdable
+}
+
+func NewRedisBindingStore(client redis.Cmdable) *RedisBindingStore {
+	return &RedisBindingStore{client: client}
+}
+
+func bindingStoreKey(aor string) string {
+	id := aor
+	if uri, err := parser.ParseSipUri(aor); err == nil && uri.User() != nil {
+		id = uri.User().String()
+	}
+
+	return strings.Join([]string{SipSessionPrefix, id}, Delimiter)
+}
+
+func (s *RedisBindingStore) Bindings(aor string) ([]*gosip.Binding, error) {
+	ctx := context.Background()
+	key := bindingStoreKey(aor)
+	values, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	bindings := make([]*gosip.Binding, 0)
+	var expired []string
+	for field, value := range values {
+		if !strings.HasPrefix(field, bindingFieldPrefix) {
+			continue
+		}
+
+		binding, err := decodeBinding(aor, value)
+		if err != nil {
+			expired = append(expired, field)
+			continue
+		}
+		if !now.Before(binding.Expires) {
+			expired = append(expired, field)
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	if len(expired) > 0 {
+		s.client.HDel(ctx, key, expired...)
+	}
+
+	return bindings, nil
+}
+
+func (s *RedisBindingStore) Put(binding *gosip.Binding) error {
+	ctx := context.Background()
+	key := bindingStoreKey(binding.AOR)
+	field, value, err := encodeBinding(binding)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	expires := binding.Expires.Sub(binding.Registered)
+	if ttl > expires {
+		expires = ttl
+	}
+
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, field, value)
+		pipe.PExpire(ctx, key, expires)
+		return nil
+	})
+
+	return err
+}
+
+// Remove deletes only the binding field, the hash itself expires by its TTL or is removed by RedisRouter.
+func (s *RedisBindingStore) Remove(aor, key string) error {
+	return s.client.HDel(context.Background(), bindingStoreKey(aor), bindingFieldPrefix+key).Err()
+}
+
+// encodeBinding returns the hash field and value of the binding.
+func encodeBinding(binding *gosip.Binding) (string, string, error) {
+	value, err := json.Marshal(redisBinding{
+		Contact:    binding.Contact.String(),
+		Q:          binding.Q,
+		CallID:     binding.CallID,
+		CSeq:       binding.CSeq,
+		Source:     binding.Source,
+		Registered: binding.Registered.UnixMilli(),
+		Expires:    binding.Expires.UnixMilli(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return bindingFieldPrefix + binding.Key(), string(value), nil
+}
+
+// decodeBinding parses the hash value of the binding of the address-of-record.
+func decodeBinding(aor, value string) (*gosip.Binding, error) {
+	var rb redisBinding
+	if err := json.Unmarshal([]byte(value), &rb); err != nil {
+		return nil, err
+	}
+	contact, err := parser.ParseUri(rb.Contact)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gosip.Binding{
+		AOR:        aor,
+		Contact:    contact,
+		Q:          rb.Q,
+		CallID:     rb.CallID,
+		CSeq:       rb.CSeq,
+		Source:     rb.Source,
+		Registered: time.UnixMilli(rb.Registered),
+		Expires:    time.UnixMilli(rb.Expires),
+	}, nil
+}
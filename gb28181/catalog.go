@@ -0,0 +1,284 @@
+package gb28181
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+)
+
+// ErrCatalogTimeout is returned when not all parts of the catalog are received in SipConfig.CatalogTimeout.
+var ErrCatalogTimeout = errors.New("catalog is not complete")
+
+// CatalogResult is the outcome of the catalog query.
+// Incomplete catalog is merged into the device channels, nothing is removed.
+type CatalogResult struct {
+	SN       int
+	SumNum   int
+	Complete bool
+	Channels []*Channel
+	Added    []string
+	Removed  []string
+}
+
+// OnCatalog is called when the catalog query of the device is finished, complete or not.
+var OnCatalog func(device *GatewayDevice, result *CatalogResult)
+
+// catalogSync gathers parts of the catalog response with the SN.
+type catalogSync struct {
+	device *GatewayDevice
+	sn     int
+
+	mu       sync.Mutex
+	sumNum   int
+	items    []*manscdp.CatalogItem
+	seen     map[string]bool
+	timer    *time.Timer
+	finished bool
+
+	done   chan struct{}
+	result *CatalogResult
+	err    error
+}
+
+// syncCatalog returns the sync of the catalog response with the SN, it is started on the first call.
+func (d *GatewayDevice) syncCatalog(sn int) *catalogSync {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if s, ok := d.catalogs[sn]; ok {
+		return s
+	}
+	if d.catalogs == nil {
+		d.catalogs = make(map[int]*catalogSync)
+	}
+	s := &catalogSync{
+		device: d,
+		sn:     sn,
+		seen:   make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	s.timer = time.AfterFunc(SC.CatalogTimeout, func() {
+		s.finish(ErrCatalogTimeout)
+	})
+	d.catalogs[sn] = s
+
+	return s
+}
+
+func (d *GatewayDevice) removeCatalogSync(s *catalogSync) {
+	d.mu.Lock()
+	if d.catalogs[s.sn] == s {
+		delete(d.catalogs, s.sn)
+	}
+	d.mu.Unlock()
+}
+
+// add appends part of the catalog, the sync is finished when all SumNum items are received.
+func (s *catalogSync) add(res *manscdp.CatalogResponse) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	if res.SumNum > s.sumNum {
+		s.sumNum = res.SumNum
+	}
+	for _, item := range res.DeviceList.Items {
+		if !s.seen[item.DeviceID] {
+			s.seen[item.DeviceID] = true
+			s.items = append(s.items, item)
+		}
+	}
+	complete := len(s.items) >= s.sumNum
+	if !complete {
+		// big catalogs take long, the timeout is counted from the last part
+		s.timer.Reset(SC.CatalogTimeout)
+	}
+	s.mu.Unlock()
+
+	if complete {
+		s.finish(nil)
+	}
+}
+
+// stop marks the sync finished, it returns false if it is already finished.
+func (s *catalogSync) stop() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		return false
+	}
+	s.finished = true
+	s.timer.Stop()
+	s.device.removeCatalogSync(s)
+
+	return true
+}
+
+// abort finishes the sync without changes of the device channels.
+func (s *catalogSync) abort(err error) {
+	if !s.stop() {
+		return
+	}
+	s.err = err
+	close(s.done)
+}
+
+// finish applies received items to the device channels and wakes up waiters.
+func (s *catalogSync) finish(err error) {
+	if !s.stop() {
+		return
+	}
+	s.mu.Lock()
+	items := s.items
+	s.mu.Unlock()
+
+	result := s.device.applyCatalog(items, err == nil)
+	result.SN = s.sn
+	result.SumNum = s.sumNum
+	if err != nil {
+		logger.Infof("catalog %d of %s: %s, received %d of %d items", s.sn, s.device.DeviceID, err, len(items), s.sumNum)
+	}
+
+	s.result, s.err = result, err
+	close(s.done)
+
+	if OnCatalog != nil {
+		OnCatalog(s.device, result)
+	}
+}
+
+func (s *catalogSync) wait(ctx context.Context) (*CatalogResult, error) {
+	select {
+	case <-s.done:
+		return s.result, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// applyCatalog replaces the device channels by the complete catalog or merges incomplete one.
+// Known channels are updated in place to keep their invite state.
+func (d *GatewayDevice) applyCatalog(items []*manscdp.CatalogItem, complete bool) *CatalogResult {
+	d.mu.RLock()
+	added := make([]*Channel, 0)
+	for _, item := range items {
+		if _, ok := d.ChannelMap[item.DeviceID]; !ok {
+			added = append(added, newChannel(item))
+		}
+	}
+	d.mu.RUnlock()
+	// stored dialogs of the new channels are loaded out of the lock
+	for _, channel := range added {
+		if info := GetChannelInfo(channel.ChannelID); info != nil {
+			Session.cacheChannelInfo(channel.ChannelID, info)
+		}
+		channel.ChannelEx = &ChannelEx{device: d}
+	}
+
+	result := &CatalogResult{Complete: complete}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channels := make(map[string]*Channel, len(items)+1)
+	if complete {
+		// the device itself is not in the catalog
+		if channel, ok := d.ChannelMap[d.DeviceID]; ok {
+			channels[d.DeviceID] = channel
+		}
+	} else {
+		for id, channel := range d.ChannelMap {
+			channels[id] = channel
+		}
+	}
+	for _, channel := range added {
+		if _, ok := d.ChannelMap[channel.ChannelID]; !ok {
+			channels[channel.ChannelID] = channel
+			result.Added = append(result.Added, channel.ChannelID)
+		}
+	}
+	for _, item := range items {
+		if channel, ok := d.ChannelMap[item.DeviceID]; ok {
+			channel.update(item)
+			channels[item.DeviceID] = channel
+		}
+		result.Channels = append(result.Channels, channels[item.DeviceID])
+	}
+	for id := range d.ChannelMap {
+		if _, ok := channels[id]; !ok {
+			result.Removed = append(result.Removed, id)
+		}
+	}
+	d.ChannelMap = channels
+
+	return result
+}
+
+// applyCatalogEvents applies channel changes notified by the subscribed device.
+func (d *GatewayDevice) applyCatalogEvents(items []*manscdp.CatalogItem) {
+	for _, item := range items {
+		switch item.Event {
+		case manscdp.EventDel:
+			d.mu.Lock()
+			delete(d.ChannelMap, item.DeviceID)
+			d.mu.Unlock()
+		default:
+			d.mu.Lock()
+			channel, ok := d.ChannelMap[item.DeviceID]
+			if ok {
+				channel.update(item)
+			}
+			d.mu.Unlock()
+			if !ok {
+				d.UpdateChannels([]*Channel{newChannel(item)})
+			}
+		}
+	}
+}
+
+// QueryCatalog sends catalog query and waits for all parts of the response.
+// Incomplete catalog is returned with ErrCatalogTimeout.
+func (d *GatewayDevice) QueryCatalog(ctx context.Context) (*CatalogResult, error) {
+	s, err := d.queryCatalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.wait(ctx)
+}
+
+func (d *GatewayDevice) queryCatalog(ctx context.Context) (*catalogSync, error) {
+	query := &manscdp.CatalogQuery{}
+	request, err := d.newMessage(query)
+	if err != nil {
+		return nil, err
+	}
+	// parts may come before the final response
+	s := d.syncCatalog(query.SN)
+	res, err := d.request(ctx, request)
+	if err == nil && res.StatusCode() != 200 {
+		err = fmt.Errorf("catalog query rejected with '%d %s'", res.StatusCode(), res.Reason())
+	}
+	if err != nil {
+		s.abort(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func onCatalog(ctx context.Context, msg manscdp.Message) error {
+	d := deviceFromContext(ctx)
+	switch m := msg.(type) {
+	case *manscdp.CatalogResponse:
+		// response to the query of another node or sent before restart is gathered as well
+		d.syncCatalog(m.SN).add(m)
+	case *manscdp.CatalogNotify:
+		d.applyCatalogEvents(m.DeviceList.Items)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package gb28181
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+)
+
+// PTZCmd is the 8 byte PTZ instruction of the DeviceControl:
+// A5, version and checksum of the first bytes, address, instruction code,
+// data 1, data 2, data 3 with the high address bits and the checksum of all bytes.
+type PTZCmd [8]byte
+
+// ptzAddress is the low byte of the PTZ address, the high bits are always 0.
+const ptzAddress = 0x01
+
+func newPTZCmd(code, data1, data2, data3 byte) PTZCmd {
+	cmd := PTZCmd{0xA5, 0, ptzAddress, code, data1, data2, data3 << 4}
+	// version 0 in the high bits, checksum of the first nibbles in the low bits
+	cmd[1] = (0xA + 0x5 + 0x0) % 16
+	var sum int
+	for _, b := range cmd[:7] {
+		sum += int(b)
+	}
+	cmd[7] = byte(sum % 256)
+	return cmd
+}
+
+func (c PTZCmd) String() string {
+	return fmt.Sprintf("%X", c[:])
+}
+
+// PTZ directions of PTZMove, combined by OR.
+const (
+	PTZRight byte = 1 << iota
+	PTZLeft
+	PTZDown
+	PTZUp
+	PTZZoomIn
+	PTZZoomOut
+)
+
+// PTZMove starts moving the camera in the directions, speeds of pan and tilt are 0-255, zoom speed is 0-15.
+func PTZMove(dir, panSpeed, tiltSpeed, zoomSpeed byte) PTZCmd {
+	return newPTZCmd(dir&0x3F, panSpeed, tiltSpeed, zoomSpeed&0x0F)
+}
+
+// PTZStop stops any PTZ or FI motion.
+func PTZStop() PTZCmd {
+	return newPTZCmd(0, 0, 0, 0)
+}
+
+// FI operations of PTZFocusIris, focus and iris operations are combined by OR.
+const (
+	FocusFar byte = 1 << iota
+	FocusNear
+	IrisOpen
+	IrisClose
+)
+
+// PTZFocusIris starts focus and iris adjustment, speeds are 0-255.
+func PTZFocusIris(op, focusSpeed, irisSpeed byte) PTZCmd {
+	return newPTZCmd(0x40|op&0x0F, focusSpeed, irisSpeed, 0)
+}
+
+// PresetSet stores the current position as the preset 1-255.
+func PresetSet(index byte) PTZCmd {
+	return newPTZCmd(0x81, 0, index, 0)
+}
+
+// PresetCall moves the camera to the preset.
+func PresetCall(index byte) PTZCmd {
+	return newPTZCmd(0x82, 0, index, 0)
+}
+
+// PresetDelete removes the preset.
+func PresetDelete(index byte) PTZCmd {
+	return newPTZCmd(0x83, 0, index, 0)
+}
+
+// CruiseAdd adds the preset to the cruise group.
+func CruiseAdd(group, preset byte) PTZCmd {
+	return newPTZCmd(0x84, group, preset, 0)
+}
+
+// CruiseDelete removes the preset from the cruise group, preset 0 removes the whole group.
+func CruiseDelete(group, preset byte) PTZCmd {
+	return newPTZCmd(0x85, group, preset, 0)
+}
+
+// CruiseSpeed sets the speed 0-4095 of the cruise group.
+func CruiseSpeed(group byte, speed uint16) PTZCmd {
+	return newPTZCmd(0x86, group, byte(speed), byte(speed>>8)&0x0F)
+}
+
+// CruiseDwell sets the time 0-4095 seconds the camera stays at each preset of the cruise group.
+func CruiseDwell(group byte, seconds uint16) PTZCmd {
+	return newPTZCmd(0x87, group, byte(seconds), byte(seconds>>8)&0x0F)
+}
+
+// CruiseStart starts the cruise group, it is stopped by PTZStop.
+func CruiseStart(group byte) PTZCmd {
+	return newPTZCmd(0x88, group, 0, 0)
+}
+
+// ScanStart starts the auto scan group, it is stopped by PTZStop.
+func ScanStart(group byte) PTZCmd {
+	return newPTZCmd(0x89, group, 0, 0)
+}
+
+// ScanLeft sets the current position as the left boundary of the scan group.
+func ScanLeft(group byte) PTZCmd {
+	return newPTZCmd(0x89, group, 1, 0)
+}
+
+// ScanRight sets the current position as the right boundary of the scan group.
+func ScanRight(group byte) PTZCmd {
+	return newPTZCmd(0x89, group, 2, 0)
+}
+
+// ScanSpeed sets the speed 0-4095 of the scan group.
+func ScanSpeed(group byte, speed uint16) PTZCmd {
+	return newPTZCmd(0x8A, group, byte(speed), byte(speed>>8)&0x0F)
+}
+
+// Control sends DeviceControl to the channel, the channel ID is set as the document DeviceID.
+// Devices accept the command with 200 on MESSAGE, the result of some commands comes in the Response later.
+func (c *Channel) Control(ctx context.Context, cmd *manscdp.DeviceControl) error {
+	if c.ChannelEx == nil || c.device == nil {
+		return fmt.Errorf("channel %s has no device", c.ChannelID)
+	}
+	d := c.device
+
+	if cmd.DeviceID == "" {
+		cmd.DeviceID = c.ChannelID
+	}
+	request, err := d.newMessage(cmd)
+	if err != nil {
+		return err
+	}
+	res, err := d.request(ctx, request)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("device control rejected with '%d %s'", res.StatusCode(), res.Reason())
+	}
+	return nil
+}
+
+// PTZ sends the PTZ instruction.
+func (c *Channel) PTZ(ctx context.Context, cmd PTZCmd) error {
+	return c.Control(ctx, &manscdp.DeviceControl{PTZCmd: cmd.String()})
+}
+
+// TeleBoot reboots the device.
+func (c *Channel) TeleBoot(ctx context.Context) error {
+	return c.Control(ctx, &manscdp.DeviceControl{TeleBoot: manscdp.TeleBoot})
+}
+
+// Guard arms or disarms the alarm channel.
+func (c *Channel) Guard(ctx context.Context, arm bool) error {
+	cmd := manscdp.GuardReset
+	if arm {
+		cmd = manscdp.GuardSet
+	}
+	return c.Control(ctx, &manscdp.DeviceControl{GuardCmd: cmd})
+}
+
+// ResetAlarm resets the alarm of the channel, empty method and type reset all alarms.
+func (c *Channel) ResetAlarm(ctx context.Context, method, typ string) error {
+	cmd := &manscdp.DeviceControl{AlarmCmd: manscdp.AlarmReset}
+	if method != "" || typ != "" {
+		cmd.Info = &manscdp.DeviceControlInfo{AlarmMethod: method, AlarmType: typ}
+	}
+	return c.Control(ctx, cmd)
+}
+
+// RequestIFrame requests the key frame of the live stream.
+func (c *Channel) RequestIFrame(ctx context.Context) error {
+	return c.Control(ctx, &manscdp.DeviceControl{IFrameCmd: manscdp.IFrameRequest})
+}
+
+func onControlResponse(ctx context.Context, msg manscdp.Message) error {
+	res := msg.(*manscdp.DeviceControlResponse)
+	if res.Result != manscdp.ResultOK {
+		logger.Warnf("device control %d of %s failed: %s", res.SN, res.DeviceID, res.Result)
+	}
+	return nil
+}
@@ -5,16 +5,20 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cqu20141693/go-service-common/config"
 	ccredis "github.com/cqu20141693/go-service-common/redis"
 	"github.com/cqu20141693/go-service-common/utils"
+	"github.com/discoviking/fsm"
 
 	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/sip/sdp"
 	"github.com/ghettovoice/gosip/util"
 )
 
@@ -28,6 +32,19 @@ type GatewayDevice struct {
 	// 管理通道
 	ChannelMap map[string]*Channel
 	CSeq       uint32
+
+	// 最后一次收到注册或心跳的时间
+	LastSeen time.Time
+
+	mu       sync.RWMutex
+	catalogs map[int]*catalogSync
+	records  map[recordKey]*recordSync
+	// sn is the last SN of the queries sent to the device, see nextSN
+	sn       uint32
+	state    DeviceState
+	fsm      *fsm.FSM
+	fsmOnce  sync.Once
+	watchdog *time.Timer
 }
 
 func (d *GatewayDevice) cSeqIncr() {
@@ -39,12 +56,24 @@ func (d *GatewayDevice) cSeqIncr() {
 	d.CSeq = uint32(result)
 }
 
+// nextSN returns SN of the new query, it is unique among queries of the device.
+func (d *GatewayDevice) nextSN() int {
+	return int(atomic.AddUint32(&d.sn, 1))
+}
+
 func (d *GatewayDevice) toHashValues() []string {
 	rt := strconv.FormatInt(d.RegisterTime.UnixMilli(), 10)
 	exp := strconv.FormatInt(int64(d.Expires), 10)
+	ls := strconv.FormatInt(d.lastSeen().UnixMilli(), 10)
+	return []string{"from", d.From, "send", d.Addr, "rt", rt, "exp", exp, "addr", nodeAddr(), "ls", ls,
+		"state", d.State().String()}
+}
+
+// nodeAddr returns address of this gateway node stored with the device routes.
+func nodeAddr() string {
 	ip, _ := utils.GetOutBoundIP()
 	port := config.GetString("server.port")
-	return []string{"from", d.From, "send", d.Addr, "rt", rt, "exp", exp, "addr", strings.Join([]string{ip, port}, Delimiter)}
+	return strings.Join([]string{ip, port}, Delimiter)
 }
 
 func getDeviceFields() []string {
@@ -84,43 +113,78 @@ func (r *ChannelInfo) toHashValues() []string {
 	return []string{"callId", r.CallId, "fTag", r.FTag, "tTag", r.TTag}
 }
 
+// Query sends catalog query, the device channels are updated when the catalog is received.
+// Use QueryCatalog to wait for the catalog.
 func (d *GatewayDevice) Query() bool {
 	//d.cSeqIncr()
+	if _, err := d.queryCatalog(context.Background()); err != nil {
+		logger.Info("query failed ", err)
+		return false
+	}
+	return true
+}
+
+// newMessage builds MESSAGE request to the device with the MANSCDP document,
+// the fresh SN and DeviceID are filled when they are not set.
+func (d *GatewayDevice) newMessage(doc manscdp.Message) (sip.Request, error) {
 	recipient := GetRecipient(d.From)
-	contentType := sip.ContentType("Application/MANSCDP+xml")
+	contentType := sip.ContentType(manscdp.ContentType)
 
 	headers := GetSipHeaders(d, sip.MESSAGE, "")
 	headers = append(headers, &contentType)
-	body := fmt.Sprintf(`<?xml version="1.0"?>
-<Query>
-<CmdType>Catalog</CmdType>
-<SN>%d</SN>
-<DeviceID>%s</DeviceID>
-</Query>`, d.CSeq, d.DeviceID)
+	if head := doc.Head(); head.SN == 0 {
+		head.SN = d.nextSN()
+	}
+	if head := doc.Head(); head.DeviceID == "" {
+		head.DeviceID = d.DeviceID
+	}
+	body, err := manscdp.Encode(doc, manscdp.GB2312)
+	if err != nil {
+		return nil, err
+	}
 	request := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.MESSAGE, &recipient, "SIP/2.0",
-		headers, body, nil)
+		headers, string(body), nil)
 	request.SetDestination(d.Addr)
-	res, err := srv.RequestWithContext(context.Background(), request)
+	return request, nil
+}
+
+// request sends request to the device, failed transaction moves the device offline.
+func (d *GatewayDevice) request(ctx context.Context, request sip.Request) (sip.Response, error) {
+	res, err := srv.RequestWithContext(ctx, request)
 	if err != nil {
-		logger.Info("query failed ", err)
-		return false
+		d.reportTxError(err)
 	}
-	return res.StatusCode() == 200
+	return res, err
 }
 
+// UpdateChannels adds or replaces channels of the device.
 func (d *GatewayDevice) UpdateChannels(list []*Channel) {
 	logger.Info("updateChannels ", list)
 	for i := range list {
 		channel := list[i]
 		info := GetChannelInfo(channel.ChannelID)
 		if info != nil {
-			Session.channelCache[channel.ChannelID] = info
+			Session.cacheChannelInfo(channel.ChannelID, info)
 		}
-		d.ChannelMap[channel.ChannelID] = channel
 		channel.ChannelEx = &ChannelEx{
 			device: d,
 		}
 	}
+
+	d.mu.Lock()
+	for _, channel := range list {
+		d.ChannelMap[channel.ChannelID] = channel
+	}
+	d.mu.Unlock()
+}
+
+// Channel returns channel of the device by ID.
+func (d *GatewayDevice) Channel(id string) (*Channel, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.ChannelMap[id]
+	return c, ok
 }
 
 type Channel struct {
@@ -145,8 +209,75 @@ type Channel struct {
 	Children   []*Channel
 	*ChannelEx //自定义属性
 }
+
+// newChannel returns channel of the catalog item.
+func newChannel(item *manscdp.CatalogItem) *Channel {
+	c := &Channel{ChannelID: item.DeviceID}
+	c.update(item)
+	return c
+}
+
+// update sets channel attributes from the catalog item.
+func (c *Channel) update(item *manscdp.CatalogItem) {
+	c.ParentID = item.ParentID
+	c.Name = item.Name
+	c.Manufacturer = item.Manufacturer
+	c.Model = item.Model
+	c.Owner = item.Owner
+	c.CivilCode = item.CivilCode
+	c.Address = item.Address
+	c.Parental = item.Parental
+	c.SafetyWay = item.SafetyWay
+	c.RegisterWay = item.RegisterWay
+	c.Secrecy = item.Secrecy
+	c.Status = item.Status
+}
+
 type ChannelEx struct {
 	device *GatewayDevice
+	dialog gosip.Dialog
+	media  *MediaInfo
+
+	// mu guards dialog and media, they are replaced by Invite and the dialog is cleared when it is done.
+	mu sync.Mutex
+}
+
+// MediaInfo is the stream chosen by the device in SDP answer on INVITE.
+type MediaInfo struct {
+	IP       string
+	Port     int
+	Payload  int
+	Encoding string
+	SSRC     string
+}
+
+func parseMediaInfo(body string) (*MediaInfo, error) {
+	answer, err := sdp.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	video, ok := answer.FirstMedia("video")
+	if !ok {
+		return nil, fmt.Errorf("video media not found in answer")
+	}
+
+	media := &MediaInfo{Port: video.Port, SSRC: answer.SSRC}
+	if conn := answer.MediaConnection(video); conn != nil {
+		media.IP = conn.Address
+	}
+	if maps := video.RTPMaps(); len(maps) > 0 {
+		media.Payload = maps[0].Payload
+		media.Encoding = maps[0].Encoding
+	}
+
+	return media, nil
+}
+
+// Media returns stream negotiated by the last INVITE.
+func (c *Channel) Media() *MediaInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.media
 }
 
 func (c *Channel) Invite(start, end int, ssrc []byte) (streamPath, fCallID, tCallID, tag string, ok bool) {
@@ -158,88 +289,117 @@ func (c *Channel) Invite(start, end int, ssrc []byte) (streamPath, fCallID, tCal
 		streamPath = fmt.Sprintf("%s/%d-%d", c.ChannelID, start, end)
 	}
 
-	inviteSdpInfo := []string{
-		"v=0",
-		fmt.Sprintf("o=%s 0 0 IN IP4 %s", SC.Serial, SC.MediaIp),
-		"s=" + s,
-		"u=" + c.ChannelID + ":0",
-		"c=IN IP4 " + SC.MediaIp,
-		fmt.Sprintf("t=%d %d", start, end),
-		fmt.Sprintf("m=video %d RTP/AVP 96 97 98", SC.MediaPort),
-		"a=recvonly",
-		"a=rtpmap:96 PS/90000",
-		"a=rtpmap:97 MPEG4/90000",
-		"a=rtpmap:98 H264/90000",
-		"y=" + string(ssrc),
+	offer := &sdp.Session{
+		Origin: sdp.Origin{Username: SC.Serial, SessionID: "0", SessionVersion: "0",
+			NetType: "IN", AddrType: "IP4", Address: SC.MediaIp},
+		Name:       s,
+		URI:        c.ChannelID + ":0",
+		Connection: sdp.NewConnection(SC.MediaIp),
+		Timing:     []sdp.Timing{{Start: int64(start), Stop: int64(end)}},
+		SSRC:       string(ssrc),
 	}
-	fmt.Println(inviteSdpInfo)
+	video := &sdp.Media{Type: "video", Port: int(SC.MediaPort), Proto: "RTP/AVP",
+		Attributes: sdp.Attributes{{Key: sdp.RecvOnly}}}
+	video.AddRTPMap(sdp.RTPMap{Payload: 96, Encoding: "PS", ClockRate: 90000}).
+		AddRTPMap(sdp.RTPMap{Payload: 97, Encoding: "MPEG4", ClockRate: 90000}).
+		AddRTPMap(sdp.RTPMap{Payload: 98, Encoding: "H264", ClockRate: 90000})
+	offer.Media = append(offer.Media, video)
 	// 接收者
 	device := c.device
 	recipient := GetRecipient(device.From)
 	headers := GetSipHeaders(device, sip.INVITE, "")
-	contentType := sip.ContentType("application/sdp")
+	contentType := sip.ContentType(sdp.ContentType)
 	headers = append(headers, &contentType)
 	request := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.INVITE, &recipient, "SIP/2.0",
-		headers, strings.Join(inviteSdpInfo, "\r\n")+"\r\n", nil)
+		headers, offer.String(), nil)
 	request.SetDestination(device.Addr)
-	res, err := srv.RequestWithContext(context.Background(), request, gosip.WithResponseHandler(func(res sip.Response, request sip.Request) {
-
+	dlg, err := srv.Invite(context.Background(), request, gosip.WithResponseHandler(func(res sip.Response, request sip.Request) {
 		if res.StatusCode() == 100 {
 			logger.Info("invite receive 100 calling")
-		} else if res.StatusCode() == 200 {
-			//ack := sip.NewAckRequest("", request, res, "", nil)
-			//res1, err := srv.RequestWithContext(context.Background(), ack)
-			//if err != nil || res1.StatusCode() != 200 {
-			//	logger.Info("invite ack failed",err)
-			//}
-			logger.Info("invite ack 200")
 		}
-		//id, _ := res.CallID()
-		//c.CallId = sip.CallID(id.Value())
 	}))
-
-	if err != nil || res.StatusCode() != 200 {
+	if err != nil {
 		logger.Info("send query cmd failed,d=", device.DeviceID, err)
+		device.reportTxError(err)
 		return "", "", "", "", false
 	}
+	if err := dlg.Ack(); err != nil {
+		logger.Info("invite ack failed ", err)
+	}
+	c.setDialog(dlg)
+
+	res := dlg.SipDialog().Response()
+	if media, err := parseMediaInfo(res.Body()); err != nil {
+		logger.Info("parse invite answer sdp failed ", err)
+	} else {
+		logger.Info("invite answer media ", media)
+		c.mu.Lock()
+		c.media = media
+		c.mu.Unlock()
+	}
 	callID, _ := res.CallID()
 	c.CallId = callID.Value()
 	from, _ := res.From()
-	fTag, _ := from.Params.Get("tag")
 	c.From = from
 	to, _ := res.To()
-	tTag, _ := to.Params.Get("tag")
 	c.To = to
-	return streamPath, callID.Value(), fTag.String(), tTag.String(), true
+	return streamPath, callID.Value(), dlg.SipDialog().LocalTag(), dlg.SipDialog().RemoteTag(), true
 }
 
-func (c *Channel) Bye() bool {
-	if c.CallId != "" {
-		d := c.device
-		recipient := GetRecipient(d.From)
-		d.cSeqIncr()
-		maxForwards := sip.MaxForwards(70)
-		branchParams := sip.NewParams().Add("branch", sip.String{Str: sip.RFC3261BranchMagicCookie + util.RandString(8)})
-		via := sip.ViaHeader{&sip.ViaHop{ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: "UDP", Host: SC.SipIp, Port: &SC.SipPort, Params: branchParams}}
-		callID := sip.CallID(c.CallId)
-		headers := []sip.Header{&sip.CSeq{SeqNo: d.CSeq, MethodName: sip.BYE}, &maxForwards,
-			&callID, c.From, c.To, via}
-		request := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.BYE, &recipient, "SIP/2.0",
-			headers, "", nil)
-		request.SetDestination(d.Addr)
-		res, err := srv.RequestWithContext(context.Background(), request)
-		if err != nil {
-			logger.Info("bye failed", err)
-			return false
+func (c *Channel) setDialog(dlg gosip.Dialog) {
+	c.mu.Lock()
+	c.dialog = dlg
+	c.mu.Unlock()
+	dlg.OnSessionExpired(func() {
+		logger.Info("invite session expired, channel=", c.ChannelID)
+	})
+	go func() {
+		<-dlg.Done()
+		// dialog has been terminated by BYE from the device or session expiration
+		c.mu.Lock()
+		current := c.dialog == dlg
+		if current {
+			c.dialog = nil
+		}
+		c.mu.Unlock()
+		if current {
+			atomic.StoreInt32(&c.invited, 0)
+			Session.GetAndDelChannelInfo(c.ChannelID)
 		}
-		return res.StatusCode() == 200
+	}()
+}
+
+func (c *Channel) getDialog() gosip.Dialog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dialog
+}
+
+func (c *Channel) Bye() bool {
+	dlg := c.getDialog()
+	if dlg == nil {
+		return false
 	}
-	return false
+	if err := dlg.Bye(context.Background()); err != nil {
+		logger.Info("bye failed", err)
+		return false
+	}
+	return true
 }
 
 func (c *Channel) Bye2() bool {
 	atomic.StoreInt32(&c.invited, 0)
 	info := Session.GetAndDelChannelInfo(c.ChannelID)
+	if dlg := c.getDialog(); dlg != nil && (info == nil || string(dlg.SipDialog().CallID()) == info.CallId) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		if err := dlg.Bye(ctx); err != nil {
+			logger.Info("bye failed", err)
+			return false
+		}
+		return true
+	}
+	// dialog was established before restart, only stored Call-ID and tags are left
 	if info != nil {
 		d := c.device
 		recipient := GetRecipient(d.From)
@@ -267,7 +427,7 @@ func (c *Channel) Bye2() bool {
 		defer cancel()
 		result := make(chan sip.Response, 1)
 		go func() {
-			res, err := srv.RequestWithContext(ctx, request)
+			res, err := d.request(ctx, request)
 			if err != nil {
 				logger.Info("bye failed", err)
 				result <- nil
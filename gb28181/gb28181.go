@@ -2,13 +2,12 @@ package gb28181
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -16,6 +15,7 @@ import (
 	"github.com/cqu20141693/go-service-common/event"
 	"github.com/cqu20141693/go-service-common/file"
 	"github.com/cqu20141693/go-service-common/logger/cclog"
+	ccredis "github.com/cqu20141693/go-service-common/redis"
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 	"golang.org/x/net/html/charset"
@@ -23,6 +23,7 @@ import (
 	"golang.org/x/text/transform"
 
 	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
@@ -30,14 +31,10 @@ import (
 	"github.com/ghettovoice/gosip/util"
 )
 
-var (
-	logger log.Logger
-	wg     *sync.WaitGroup
-)
+var logger log.Logger
 
 func init() {
 	logger = log.NewDefaultLogrusLogger().WithPrefix("Server")
-	wg = new(sync.WaitGroup)
 	event.RegisterHook(event.ConfigComplete, event.NewHookContext(initSip, "initSip"))
 }
 
@@ -73,9 +70,8 @@ func (r *ResultUtil) Fail(code, message string) *ResultCommon {
 }
 
 func FindChannel(id string, channel string) (*Channel, bool) {
-	if d, ok := Session.Get(id); ok {
-		c, ok := d.ChannelMap[channel]
-		return c, ok
+	if d, ok := Session.Get(id); ok && d.Online() {
+		return d.Channel(channel)
 	}
 	return nil, false
 }
@@ -84,15 +80,19 @@ var SC = NewDefaultSipConfig()
 
 func NewDefaultSipConfig() *SipConfig {
 	return &SipConfig{
-		Serial:        "34020000002000000001",
-		Realm:         "3402000000",
-		Network:       "udp",
-		ListenAddress: "0.0.0.0:5060",
-		SipIp:         "127.0.0.1",
-		SipPort:       5060,
-		MediaIp:       "127.0.0.1",
-		MediaPort:     9000,
-		AudioEnable:   false,
+		Serial:                "34020000002000000001",
+		Realm:                 "3402000000",
+		Network:               "udp",
+		ListenAddress:         "0.0.0.0:5060",
+		SipIp:                 "127.0.0.1",
+		SipPort:               5060,
+		MediaIp:               "127.0.0.1",
+		MediaPort:             9000,
+		AudioEnable:           false,
+		CatalogTimeout:        30 * time.Second,
+		RecordTimeout:         30 * time.Second,
+		KeepaliveInterval:     60 * time.Second,
+		KeepaliveTimeoutCount: 3,
 	}
 }
 
@@ -106,6 +106,15 @@ type SipConfig struct {
 	MediaIp       string   //媒体服务器地址
 	MediaPort     uint16   //媒体服务器端口
 	AudioEnable   bool     //是否开启音频
+	// 目录分包接收超时, 自最后一个分包起计算
+	CatalogTimeout time.Duration `json:"catalogTimeout"`
+	// 录像查询分包接收超时, 自最后一个分包起计算
+	RecordTimeout time.Duration `json:"recordTimeout"`
+	// 心跳周期及超时次数, 连续超时次数未收到心跳设备离线
+	KeepaliveInterval     time.Duration `json:"keepaliveInterval"`
+	KeepaliveTimeoutCount int           `json:"keepaliveTimeoutCount"`
+	// 是否启用会话定时器(RFC 4028), 检测长时间点播中消失的设备
+	SessionTimer bool `json:"sessionTimer"`
 }
 
 func GetRecipient(from string) sip.SipUri {
@@ -148,114 +157,91 @@ type Record struct {
 	Type      string
 }
 
-type SipMessage struct {
-	XMLName    xml.Name
-	CmdType    string
-	DeviceID   string
-	DeviceList []*Channel `xml:"DeviceList>Item"`
-	RecordList []*Record  `xml:"RecordList>Item"`
-}
-
 var srv gosip.Server
 
+// lookupDeviceToken returns device password, the device ID is used as digest username.
+func lookupDeviceToken(username, realm string) (string, bool) {
+	cameraDO, err := spi.DeviceFacadeClient.GetDeviceInfo(username)
+	if err != nil {
+		logger.Warnf("get device %s info failed: %s", username, err)
+		return "", false
+	}
+
+	return cameraDO.DeviceToken, true
+}
+
 func SetSrv(s gosip.Server) {
 	srv = s
 }
 
-var OnRegister gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
+type deviceKey struct{}
 
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.REGISTER && tx.Origin().Method() == sip.REGISTER {
-
-		logger.Info("receive REGISTER cmd", req.Recipient(), req.Headers(), req.Fields())
-		var res sip.Response
-
-		headers := req.GetHeaders("Authorization")
-		if headers == nil || len(headers) == 0 {
-			value := `realm="3402000000"`
-			value = value + `nonce="` + util.RandString(10) + `"`
-			authorization := sip.AuthFromValue(value)
-			res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-			header := sip.Authenticate(authorization.String())
-			res.AppendHeader(&header)
-		} else if len(headers) == 1 {
-			authHeader := headers[0].Value()
-			logger.Info("authorization=", authHeader)
-			from, _ := req.From()
-			ID := from.Address.User().String()
-			logger.Info("contact=", from)
-			cameraDO, err := spi.DeviceFacadeClient.GetDeviceInfo(ID)
-			if err != nil {
-				value := `realm="3402000000"`
-				value = value + `nonce="` + util.RandString(10) + `"`
-				authorization := sip.AuthFromValue(value)
-				res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-				header := sip.Authenticate(authorization.String())
-				res.AppendHeader(&header)
-
-			} else {
-				auth := sip.AuthFromValue(authHeader).
-					SetMethod(string(req.Method())).
-					SetPassword(cameraDO.DeviceToken)
-
-				response := auth.CalcResponse()
-				if response != auth.Response() {
-					value := `realm="3402000000"`
-					value = value + `nonce="` + util.RandString(10) + `"`
-					authorization := sip.AuthFromValue(value)
-					res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-					header := sip.Authenticate(authorization.String())
-					res.AppendHeader(&header)
-				} else {
-					// register 成功
-					addr := getSendAddr(req)
-					res = sip.NewResponseFromRequest("", req, 200, "OK", "")
-					from, _ := req.From()
-					var expires time.Duration = 3600
-					for i := range req.Headers() {
-						header := req.Headers()[i]
-						if header.Name() == "Expires" {
-							expire, err := strconv.ParseInt(header.Value(), 10, 64)
-							if err == nil {
-								expires = time.Duration(expire)
-							}
-							break
-						}
-					}
-					if expires == 0 {
-						Session.Remove(ID)
-					} else {
-
-						device := GatewayDevice{DeviceID: ID, RegisterTime: time.Now(),
-							Expires: expires, From: from.Address.String(), Addr: addr, CSeq: 1, ChannelMap: make(map[string]*Channel, 0)}
-						device.ChannelMap[ID] = &Channel{
-							ChannelID: ID,
-							ChannelEx: &ChannelEx{
-								device: &device,
-							},
-						}
-						// channel Map not set
-						Session.Store(&device, device.Expires*time.Second)
-						go device.Query()
-					}
-				}
-			}
-		}
+// deviceFromContext returns registered device stored by deviceSession middleware.
+func deviceFromContext(ctx context.Context) *GatewayDevice {
+	device, _ := ctx.Value(deviceKey{}).(*GatewayDevice)
+	return device
+}
 
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond '405 Method Not Allowed' failed: %s", err)
+// deviceSession rejects requests from unregistered devices with 401,
+// the registered device is passed on in the context.
+func deviceSession(next gosip.RequestHandlerWithContext) gosip.RequestHandlerWithContext {
+	return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+		from, _ := req.From()
+		device, ok := Session.Get(from.Address.User().String())
+		if !ok {
+			respond(sip.NewResponseFromRequest("", req, 401, "Unauthorized", ""))
+			return
 		}
-	} else {
-		logger.Printf("error REGISTER cmd", req, tx)
+
+		next(context.WithValue(ctx, deviceKey{}, device), req, tx)
+	}
+}
+
+func respond(res sip.Response) {
+	if _, err := srv.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
 	}
 }
 
+// OnRegister keeps device session in sync with the registrar bindings of the device.
+var OnRegister gosip.RegisterHandler = func(req sip.Request, aor string, bindings []*gosip.Binding) {
+	logger.Info("receive REGISTER cmd", req.Recipient(), req.Headers(), req.Fields())
+
+	from, _ := req.From()
+	ID := from.Address.User().String()
+	if len(bindings) == 0 {
+		Session.Remove(ID)
+		return
+	}
+
+	// register 成功
+	binding := bindings[0]
+	expires := time.Duration(binding.ExpiresIn(time.Now()))
+	if device, ok := Session.Load(ID); ok {
+		// registration refresh keeps channels and state of the device
+		device.RegisterTime = binding.Registered
+		device.Expires = expires
+		device.From = from.Address.String()
+		device.Addr = getSendAddr(req)
+		Session.Store(device, device.Expires*time.Second)
+		device.registered()
+		return
+	}
+
+	device := GatewayDevice{DeviceID: ID, RegisterTime: binding.Registered,
+		Expires: expires, From: from.Address.String(), Addr: getSendAddr(req), CSeq: 1, ChannelMap: make(map[string]*Channel, 0)}
+	device.ChannelMap[ID] = &Channel{
+		ChannelID: ID,
+		ChannelEx: &ChannelEx{
+			device: &device,
+		},
+	}
+	// channel Map not set
+	Session.Store(&device, device.Expires*time.Second)
+	device.registered()
+	go device.Query()
+}
+
 func getSendAddr(req sip.Request) string {
 	via, _ := req.Via()
 	var received, rport, host, port string
@@ -290,181 +276,70 @@ func getSendAddr(req sip.Request) string {
 	return host + ":" + port
 }
 
-var OnOptions gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
-
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.OPTIONS && tx.Origin().Method() == sip.OPTIONS {
-		from, _ := req.From()
-		ID := from.Address.User().String()
-		var res sip.Response
-		_, ok := Session.Get(ID)
-		logger.Printf("receive options cmd", ok, req, tx)
-		if ok {
-			res = sip.NewResponseFromRequest("", req, 200, "", "")
-		} else {
-			res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-		}
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond options failed: %s", err)
-		}
-	} else {
-		logger.Printf("error OPTIONS cmd", req, tx)
-	}
+var OnOptions gosip.RequestHandlerWithContext = func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	logger.Printf("receive options cmd", req, tx)
+	respond(sip.NewResponseFromRequest("", req, 200, "", ""))
 }
-var OnInvite gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
 
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.INVITE && tx.Origin().Method() == sip.INVITE {
-		res := sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", "")
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond '405 Method Not Allowed' failed: %s", err)
-		}
-	} else {
-		logger.Printf("error INVITE cmd", req, tx)
-	}
+var OnInvite gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
+	respond(sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", ""))
 }
-var OnBye gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
-
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.BYE && tx.Origin().Method() == sip.BYE {
 
-		// 利用callId
-		from, _ := req.From()
-		ID := from.Address.User().String()
-		var res sip.Response
-		_, ok := Session.Get(ID)
-		if ok {
-			//Session.Remove(ID)
-			res = sip.NewResponseFromRequest("", req, 200, "", "ok")
-		} else {
-			res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-		}
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond bye failed: %s", err)
-		}
-	} else {
-		logger.Printf("error BYE cmd", req, tx)
-	}
+var OnBye gosip.RequestHandlerWithContext = func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	// 利用callId
+	respond(sip.NewResponseFromRequest("", req, 200, "", "ok"))
 }
+
+// OnAck only logs ACK, it has no transaction to respond in.
 var OnAck gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
+	logger.Debug("receive ACK cmd", req.Recipient(), req.Fields())
+}
 
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.ACK && tx.Origin().Method() == sip.ACK {
-		from, _ := req.From()
-		ID := from.Address.User().String()
-		var res sip.Response
-		_, ok := Session.Get(ID)
-		if ok {
-			res = sip.NewResponseFromRequest("", req, 200, "", "ok")
-		} else {
-			res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-		}
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond ack failed: %s", err)
-		}
-	} else {
-		logger.Printf("error ACK cmd", req, tx)
+var OnMessage gosip.RequestHandlerWithContext = func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	logger.Debug("receive Message cmd", req.Recipient(), req.Headers(), req.Fields())
+	contentType, ok := req.ContentType()
+	if !ok || !strings.EqualFold(contentType.Value(), manscdp.ContentType) {
+		respond(sip.NewResponseFromRequest("", req, 415, "Unsupported Media Type", ""))
+		return
 	}
-}
 
-var OnMessage gosip.RequestHandler = func(req sip.Request, tx sip.ServerTransaction) {
+	msg, err := manscdp.Decode([]byte(req.Body()))
+	if err != nil {
+		logger.Warnf("decode message err: %s", err)
+		respond(sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+		return
+	}
+	respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
 
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		if err := recover(); err != nil {
-			logger.Info("occur panic ", err)
-		}
-	}()
-	if req.Method() == sip.MESSAGE && tx.Origin().Method() == sip.MESSAGE {
-		logger.Debug("receive Message cmd", req.Recipient(), req.Headers(), req.Fields())
-		from, _ := req.From()
-		ID := from.Address.User().String()
-		device, ok := Session.Get(ID)
-		var res sip.Response
-		if ok {
-			if contentType, b := req.ContentType(); b {
-				if contentType.Value() == "Application/MANSCDP+xml" {
-					msg := &SipMessage{}
-					decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
-					decoder.CharsetReader = charset.NewReaderLabel
-					err := decoder.Decode(msg)
-					if err != nil {
-						err = DecodeGbk(msg, []byte(req.Body()))
-						if err != nil {
-							logger.Printf("decode message err: %s", err)
-						}
-					}
-					if handleMessage(msg, device) {
-						res = sip.NewResponseFromRequest("", req, 200, "OK", "")
-						if _, err := srv.Respond(res); err != nil {
-							logger.Errorf("respond message 200 failed: %s", err)
-						}
-					} else {
-						res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-					}
-				} else {
-					res = sip.NewResponseFromRequest("", req, 401, "not support content type", "")
-				}
-			} else {
-				res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-			}
-		} else {
-			res = sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
-		}
-		if _, err := srv.Respond(res); err != nil {
-			logger.Errorf("respond message 405 failed: %s", err)
-		}
-	} else {
-		logger.Printf("error MESSAGE cmd", req, tx)
+	if err := dispatcher.Dispatch(ctx, msg); err != nil {
+		logger.Warnf("handle %s %s message err: %s", msg.Root(), msg.Cmd(), err)
 	}
 }
 
-const (
-	Notify   = "Notify"
-	Response = "Response"
-)
+// dispatcher routes MANSCDP documents from the devices, the device is in the context.
+var dispatcher = manscdp.NewDispatcher()
 
-func handleMessage(msg *SipMessage, d *GatewayDevice) bool {
+func init() {
+	dispatcher.Handle(manscdp.RootNotify, manscdp.CmdKeepalive, onKeepalive)
+	dispatcher.Handle(manscdp.RootResponse, manscdp.CmdCatalog, onCatalog)
+	dispatcher.Handle(manscdp.RootNotify, manscdp.CmdCatalog, onCatalog)
+	dispatcher.Handle(manscdp.RootResponse, manscdp.CmdDeviceControl, onControlResponse)
+	dispatcher.Handle(manscdp.RootResponse, manscdp.CmdRecordInfo, onRecordInfo)
+	dispatcher.HandleDefault(func(ctx context.Context, msg manscdp.Message) error {
+		logger.Debugf("skip %s %s message of %s", msg.Root(), msg.Cmd(), msg.Head().DeviceID)
+		return nil
+	})
+}
 
-	switch msg.XMLName.Local {
-	case Notify:
-		if d.ChannelMap == nil {
-			go d.Query()
-		}
-	case Response:
-		switch msg.CmdType {
-		case "Catalog":
-			d.UpdateChannels(msg.DeviceList)
-		case "RecordInfo":
-			logger.Printf("todo handle RecordInfo message", msg)
-		}
+func onKeepalive(ctx context.Context, msg manscdp.Message) error {
+	d := deviceFromContext(ctx)
+	// channels may have changed while the device was offline
+	offline := d.State() == DeviceOffline
+	d.keepalive()
+	if offline {
+		go d.Query()
 	}
-	return true
+	return nil
 }
 
 func DecodeGbk(v interface{}, body []byte) error {
@@ -546,20 +421,49 @@ func newLogger(prefix string) log.Logger {
 func start(srvConf gosip.ServerConfig) {
 	logger = newLogger("User")
 	logger.Info("sc= ", SC)
+	// authenticates REGISTER requests of the devices in the SC.Realm
+	challenger := sip.NewChallenger(SC.Realm)
+	// detect vanished devices during long plays
+	if SC.SessionTimer && !hasExtension(srvConf.Extensions, gosip.ExtensionTimer) {
+		srvConf.Extensions = append(srvConf.Extensions, gosip.ExtensionTimer)
+	}
 	srv := gosip.NewServer(srvConf, nil, nil, newLogger("server"))
+	srv.Use(
+		gosip.Recover(logger),
+		gosip.ForMethods(gosip.Authenticate(challenger, lookupDeviceToken, logger), sip.REGISTER),
+		gosip.ForMethods(deviceSession, sip.OPTIONS, sip.BYE, sip.MESSAGE),
+	)
 	_ = srv.OnRequest(sip.INVITE, OnInvite)
-	_ = srv.OnRequest(sip.MESSAGE, OnMessage)
-	_ = srv.OnRequest(sip.BYE, OnBye)
-	_ = srv.OnRequest(sip.REGISTER, OnRegister)
-	_ = srv.OnRequest(sip.OPTIONS, OnOptions)
+	_ = srv.OnRequestWithContext(sip.MESSAGE, OnMessage)
+	_ = srv.OnRequestWithContext(sip.BYE, OnBye)
+	_ = srv.OnRequestWithContext(sip.OPTIONS, OnOptions)
 	_ = srv.OnRequest(sip.ACK, OnAck)
-	err := srv.Listen(SC.Network, SC.ListenAddress)
+	reg, err := gosip.NewRegistrar(srv, NewRedisBindingStore(ccredis.RedisDB), gosip.RegistrarConfig{}, newLogger("registrar"))
+	if err != nil {
+		panic(err)
+	}
+	reg.OnRegister(OnRegister)
+	sub, err := gosip.NewSubscriber(srv, newLogger("subscriber"))
+	if err != nil {
+		panic(err)
+	}
+	subscriber = sub
+	err = srv.Listen(SC.Network, SC.ListenAddress)
 	if err != nil {
 		panic(err)
 	}
 	SetSrv(srv)
 }
 
+func hasExtension(extensions []string, tag string) bool {
+	for _, ext := range extensions {
+		if strings.EqualFold(ext, tag) {
+			return true
+		}
+	}
+	return false
+}
+
 func ScheduleTask() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
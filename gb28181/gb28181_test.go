@@ -1,9 +1,418 @@
 package gb28181
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	ccredis "github.com/cqu20141693/go-service-common/redis"
+	"github.com/discoviking/fsm"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+	"github.com/ghettovoice/gosip/sip/parser"
 )
 
 func TestUseUri(t *testing.T) {
 
 }
+
+func TestPTZCmd(t *testing.T) {
+	for _, c := range []struct {
+		cmd  PTZCmd
+		want string
+	}{
+		{PTZStop(), "A50F0100000000B5"},
+		{PTZMove(PTZLeft, 0x80, 0x80, 0), "A50F0102808000B7"},
+		{PTZMove(PTZUp|PTZZoomIn, 0, 0x40, 0x0A), "A50F01180040A0AD"},
+		{PTZFocusIris(FocusNear, 0x10, 0), "A50F014210000007"},
+		{PresetCall(1), "A50F018200010038"},
+		{CruiseSpeed(2, 0x123), "A50F018602231070"},
+	} {
+		if got := c.cmd.String(); got != c.want {
+			t.Errorf("unexpected PTZCmd %s, want %s", got, c.want)
+		}
+	}
+}
+
+func TestRecordResult(t *testing.T) {
+	s := &recordSync{sumNum: 4, items: []*manscdp.RecordItem{
+		{Name: "c", StartTime: "2021-06-01T12:00:00", EndTime: "2021-06-01T12:30:00"},
+		{Name: "a", StartTime: "2021-06-01T10:00:00", EndTime: "2021-06-01T10:30:00"},
+		{Name: "b", StartTime: "2021-06-01 10:30:01", EndTime: "2021-06-01 11:00:00"},
+		{Name: "bad", StartTime: "2021-06-01T10:00:00", EndTime: "2021-06-01T09:00:00"},
+	}}
+
+	res := s.result()
+	if !res.Complete || res.SumNum != 4 || len(res.Records) != 3 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res.Records[0].Name != "a" || res.Records[1].Name != "b" || res.Records[2].Name != "c" {
+		t.Errorf("records are not sorted: %s %s %s", res.Records[0].Name, res.Records[1].Name, res.Records[2].Name)
+	}
+	if len(res.Ranges) != 2 {
+		t.Fatalf("unexpected ranges %v", res.Ranges)
+	}
+	if got := res.Ranges[0].End.Format("15:04:05"); got != "11:00:00" {
+		t.Errorf("unexpected end %s of the merged range", got)
+	}
+}
+
+func TestBindingHashLayout(t *testing.T) {
+	contact, err := parser.ParseUri("sip:34020000001320000001@192.168.1.10:5060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := time.UnixMilli(1622540000000)
+	binding := &gosip.Binding{
+		AOR:        "sip:34020000001320000001@3402000000",
+		Contact:    contact,
+		Q:          0.5,
+		CallID:     "call-1",
+		CSeq:       7,
+		Source:     "192.168.1.10:5060",
+		Registered: registered,
+		Expires:    registered.Add(3600 * time.Second),
+	}
+
+	if key := bindingStoreKey(binding.AOR); key != SipSessionPrefix+Delimiter+"34020000001320000001" {
+		t.Errorf("unexpected hash key %s", key)
+	}
+
+	field, value, err := encodeBinding(binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field != "contact:sip:34020000001320000001@192.168.1.10:5060" {
+		t.Errorf("unexpected hash field %s", field)
+	}
+	for _, routeField := range append(getDeviceFields(), "send", "ls", "state") {
+		if field == routeField {
+			t.Errorf("binding overwrites route field %s", routeField)
+		}
+	}
+	want := `{"contact":"sip:34020000001320000001@192.168.1.10:5060","q":0.5,"callId":"call-1","cseq":7,` +
+		`"source":"192.168.1.10:5060","rt":1622540000000,"exp":1622543600000}`
+	if value != want {
+		t.Errorf("unexpected hash value %s, want %s", value, want)
+	}
+
+	got, err := decodeBinding(binding.AOR, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key() != binding.Key() || got.Q != binding.Q || got.CallID != binding.CallID || got.CSeq != binding.CSeq ||
+		got.Source != binding.Source || !got.Registered.Equal(binding.Registered) || !got.Expires.Equal(binding.Expires) {
+		t.Errorf("unexpected decoded binding %+v", got)
+	}
+	if _, err := decodeBinding(binding.AOR, "1"); err == nil {
+		t.Error("malformed hash value is decoded")
+	}
+}
+
+func TestCatalogSync(t *testing.T) {
+	// stored dialogs of the new channels are not found
+	stubRedis()
+	timeout := SC.CatalogTimeout
+	SC.CatalogTimeout = time.Minute
+	defer func() { SC.CatalogTimeout = timeout }()
+
+	const deviceID = "34020000001320000001"
+	part := func(sumNum int, ids ...string) *manscdp.CatalogResponse {
+		res := &manscdp.CatalogResponse{SumNum: sumNum}
+		for _, id := range ids {
+			res.DeviceList.Items = append(res.DeviceList.Items, &manscdp.CatalogItem{DeviceID: id, Name: "new " + id})
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		name     string
+		channels []string
+		parts    []*manscdp.CatalogResponse
+		timeout  bool
+		want     []string
+		added    []string
+		removed  []string
+		complete bool
+	}{
+		{
+			name:     "complete by SumNum",
+			parts:    []*manscdp.CatalogResponse{part(3, "a", "b"), part(3, "c")},
+			want:     []string{"a", "b", "c"},
+			added:    []string{"a", "b", "c"},
+			complete: true,
+		},
+		{
+			name:     "duplicate items",
+			parts:    []*manscdp.CatalogResponse{part(2, "a"), part(2, "a"), part(2, "b")},
+			want:     []string{"a", "b"},
+			added:    []string{"a", "b"},
+			complete: true,
+		},
+		{
+			name:     "complete catalog replaces channels",
+			channels: []string{deviceID, "a", "b"},
+			parts:    []*manscdp.CatalogResponse{part(2, "a", "c")},
+			want:     []string{deviceID, "a", "c"},
+			added:    []string{"c"},
+			removed:  []string{"b"},
+			complete: true,
+		},
+		{
+			name:     "incomplete catalog is merged",
+			channels: []string{"a", "b"},
+			parts:    []*manscdp.CatalogResponse{part(3, "a", "c")},
+			timeout:  true,
+			want:     []string{"a", "b", "c"},
+			added:    []string{"c"},
+		},
+	} {
+		d := &GatewayDevice{DeviceID: deviceID, ChannelMap: make(map[string]*Channel)}
+		for _, id := range c.channels {
+			d.ChannelMap[id] = &Channel{ChannelID: id, ChannelEx: &ChannelEx{device: d}}
+		}
+		known := d.ChannelMap["a"]
+
+		s := d.syncCatalog(1)
+		type outcome struct {
+			res *CatalogResult
+			err error
+		}
+		woken := make(chan outcome, 1)
+		go func() {
+			res, err := s.wait(context.Background())
+			woken <- outcome{res, err}
+		}()
+
+		for _, p := range c.parts {
+			s.add(p)
+		}
+		if c.timeout {
+			s.finish(ErrCatalogTimeout)
+		}
+
+		var got outcome
+		select {
+		case got = <-woken:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: waiter is not woken up", c.name)
+		}
+		if c.timeout && got.err != ErrCatalogTimeout || !c.timeout && got.err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, got.err)
+		}
+		if got.res == nil {
+			t.Fatalf("%s: no result", c.name)
+		}
+		if got.res.Complete != c.complete || got.res.SN != 1 {
+			t.Errorf("%s: unexpected result %+v", c.name, got.res)
+		}
+		if !sameIDs(got.res.Added, c.added) || !sameIDs(got.res.Removed, c.removed) {
+			t.Errorf("%s: unexpected added %v and removed %v", c.name, got.res.Added, got.res.Removed)
+		}
+		ids := make([]string, 0, len(d.ChannelMap))
+		for id := range d.ChannelMap {
+			ids = append(ids, id)
+		}
+		if !sameIDs(ids, c.want) {
+			t.Errorf("%s: unexpected channels %v, want %v", c.name, ids, c.want)
+		}
+		if known != nil && d.ChannelMap["a"] != known {
+			t.Errorf("%s: known channel is replaced", c.name)
+		}
+		if d.ChannelMap["a"].Name != "new a" {
+			t.Errorf("%s: channel is not updated", c.name)
+		}
+		if _, ok := d.catalogs[1]; ok {
+			t.Errorf("%s: finished sync is kept", c.name)
+		}
+		// parts after the finish are ignored
+		s.add(part(4, "d"))
+		if _, ok := d.ChannelMap["d"]; ok {
+			t.Errorf("%s: part is applied after the finish", c.name)
+		}
+	}
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	got = append([]string(nil), got...)
+	want = append([]string(nil), want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var stubRedisOnce sync.Once
+
+// stubRedis replaces the redis client with one failing all commands,
+// it is kept for all tests as state updates use it in background.
+func stubRedis() {
+	stubRedisOnce.Do(func() {
+		ccredis.RedisDB = redis.NewClient(&redis.Options{
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, errors.New("no redis")
+			},
+			MaxRetries: -1,
+		})
+	})
+}
+
+func TestDeviceState(t *testing.T) {
+	stubRedis()
+
+	d := &GatewayDevice{DeviceID: "34020000001320000002"}
+	var events []DeviceEvent
+	HandleDeviceState(func(event DeviceEvent) {
+		if event.Device == d {
+			events = append(events, event)
+		}
+	})
+
+	for _, c := range []struct {
+		input fsm.Input
+		want  DeviceState
+		event bool
+	}{
+		{deviceInputRegister, DeviceRegistered, false},
+		{deviceInputKeepalive, DeviceOnline, true},
+		{deviceInputKeepalive, DeviceOnline, false},
+		{deviceInputTimeout, DeviceOffline, true},
+		{deviceInputTimeout, DeviceOffline, false},
+		{deviceInputKeepalive, DeviceOnline, true},
+		{deviceInputTxFailure, DeviceOffline, true},
+		{deviceInputRegister, DeviceRegistered, true},
+		{deviceInputTxFailure, DeviceOffline, true},
+		{deviceInputExpire, DeviceExpired, true},
+		{deviceInputKeepalive, DeviceExpired, false},
+		{deviceInputTxFailure, DeviceExpired, false},
+		{deviceInputRegister, DeviceRegistered, true},
+	} {
+		from := d.State()
+		count := len(events)
+		d.spin(c.input)
+
+		if got := d.State(); got != c.want {
+			t.Fatalf("input %d moves device from %s to %s, want %s", c.input, from, got, c.want)
+		}
+		if got := len(events) > count; got != c.event {
+			t.Fatalf("input %d from %s: unexpected event %v", c.input, from, got)
+		}
+		if c.event {
+			if event := events[len(events)-1]; event.From != from || event.To != c.want {
+				t.Errorf("unexpected event from %s to %s, want from %s to %s", event.From, event.To, from, c.want)
+			}
+		}
+	}
+	if !d.Online() {
+		t.Errorf("re-registered device is not online")
+	}
+}
+
+func TestDeviceWatchdog(t *testing.T) {
+	stubRedis()
+	interval, count := SC.KeepaliveInterval, SC.KeepaliveTimeoutCount
+	SC.KeepaliveInterval, SC.KeepaliveTimeoutCount = 20*time.Millisecond, 2
+	defer func() { SC.KeepaliveInterval, SC.KeepaliveTimeoutCount = interval, count }()
+
+	waitState := func(d *GatewayDevice, want DeviceState) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for d.State() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("device is %s, want %s", d.State(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	d := &GatewayDevice{DeviceID: "34020000001320000003"}
+	d.registered()
+	if d.lastSeen().IsZero() {
+		t.Fatal("last seen time is not updated on registration")
+	}
+	d.keepalive()
+	if d.State() != DeviceOnline {
+		t.Fatalf("device is %s after keepalive", d.State())
+	}
+
+	// keepalives in time keep the device online
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		d.keepalive()
+		if d.State() != DeviceOnline {
+			t.Fatalf("device is %s with keepalives in time", d.State())
+		}
+	}
+
+	waitState(d, DeviceOffline)
+	d.keepalive()
+	waitState(d, DeviceOnline)
+
+	// expired device is not moved offline by the stopped watchdog
+	d.expired()
+	time.Sleep(60 * time.Millisecond)
+	if d.State() != DeviceExpired {
+		t.Errorf("expired device is %s", d.State())
+	}
+}
+
+func TestRecordSyncKey(t *testing.T) {
+	d := &GatewayDevice{DeviceID: "34020000001320000004"}
+
+	const queries = 100
+	sns := make(chan int, queries)
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sns <- d.nextSN()
+		}()
+	}
+	wg.Wait()
+	close(sns)
+	seen := make(map[int]bool)
+	for sn := range sns {
+		if seen[sn] {
+			t.Fatalf("SN %d is reused", sn)
+		}
+		seen[sn] = true
+	}
+
+	s, err := d.syncRecords(1, "34020000001310000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.finish(context.Canceled)
+	if _, err := d.syncRecords(1, "34020000001310000001"); err == nil {
+		t.Error("record query in progress is replaced")
+	}
+	other, err := d.syncRecords(1, "34020000001310000002")
+	if err != nil {
+		t.Fatalf("record query of another channel is refused: %s", err)
+	}
+	if got, ok := d.findRecordSync(1, "34020000001310000002"); !ok || got != other {
+		t.Error("record sync is not found by the channel")
+	}
+
+	other.finish(context.Canceled)
+	if _, ok := d.findRecordSync(1, "34020000001310000002"); ok {
+		t.Error("finished record sync is kept")
+	}
+	if got, ok := d.findRecordSync(1, "34020000001310000001"); !ok || got != s {
+		t.Error("record sync of the first channel is lost")
+	}
+}
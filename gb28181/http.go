@@ -1,6 +1,7 @@
 package gb28181
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -24,7 +25,17 @@ func ApiListen(address string, stop chan os.Signal) {
 	engine.POST("/inviteWithoutBye", InviteWithoutBye)
 	engine.POST("/bye", Bye)
 	engine.POST("/bye2", Bye2)
+	engine.GET("/records", Records)
 	engine.POST("/query", Query)
+	engine.POST("/ptz", PTZ)
+	engine.POST("/preset", Preset)
+	engine.POST("/cruise", Cruise)
+	engine.POST("/scan", Scan)
+	engine.POST("/guard", Guard)
+	engine.POST("/resetAlarm", ResetAlarm)
+	engine.POST("/teleboot", TeleBoot)
+	engine.POST("/iframe", IFrame)
+	engine.GET("/deviceState", GetDeviceState)
 	service := &CameraService{}
 	service.InitRouterMapper(engine)
 	go func() {
@@ -172,10 +183,45 @@ func Bye2(ginCxt *gin.Context) {
 		ginCxt.JSON(200, ResultUtils.Fail("11002", "device not online"))
 	}
 }
+
+// Records returns records of the channel between startTime and endTime unix seconds,
+// type is one of all, time, alarm or manual.
+func Records(ginCxt *gin.Context) {
+	id := ginCxt.Query("id")
+	channel := ginCxt.Query("channel")
+	start, err1 := strconv.ParseInt(ginCxt.Query("startTime"), 10, 64)
+	end, err2 := strconv.ParseInt(ginCxt.Query("endTime"), 10, 64)
+	if id == "" || channel == "" || err1 != nil || err2 != nil || end < start {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(id,channel,startTime,endTime required)"))
+		return
+	}
+	c, ok := FindChannel(id, channel)
+	if !ok {
+		ginCxt.JSON(200, ResultUtils.Fail("11002", "device not online"))
+		return
+	}
+	result, err := c.QueryRecords(ginCxt.Request.Context(), time.Unix(start, 0), time.Unix(end, 0), ginCxt.Query("type"))
+	if err != nil && result == nil {
+		logger.Info("query records failed ", err)
+		ginCxt.JSON(200, ResultUtils.Fail("11006", "query records failed"))
+		return
+	}
+	ginCxt.JSON(200, ResultUtils.Success(result))
+}
+
 func Query(ginCxt *gin.Context) {
 	id := ginCxt.Query("id")
 	if id != "" {
 		if device, b := Session.Get(id); b {
+			if ginCxt.Query("wait") == "true" {
+				result, err := device.QueryCatalog(ginCxt.Request.Context())
+				if err != nil && result == nil {
+					ginCxt.JSON(200, ResultUtils.Fail("11004", err.Error()))
+					return
+				}
+				ginCxt.JSON(200, ResultUtils.Success(result))
+				return
+			}
 			device.Query()
 			ginCxt.JSON(200, ResultUtils.Success("success"))
 			return
@@ -185,3 +231,229 @@ func Query(ginCxt *gin.Context) {
 	}
 	ginCxt.JSON(200, ResultUtils.Success("id is null"))
 }
+
+// DeviceStateVO is the state of the device returned by the API.
+type DeviceStateVO struct {
+	State    DeviceState `json:"state"`
+	LastSeen time.Time   `json:"lastSeen"`
+}
+
+func GetDeviceState(ginCxt *gin.Context) {
+	id := ginCxt.Query("id")
+	if id == "" {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(id required)"))
+		return
+	}
+	device, ok := Session.Get(id)
+	if !ok {
+		ginCxt.JSON(200, ResultUtils.Success(DeviceStateVO{State: DeviceExpired}))
+		return
+	}
+	ginCxt.JSON(200, ResultUtils.Success(DeviceStateVO{State: device.State(), LastSeen: device.lastSeen()}))
+}
+
+// control runs the command on the channel of id and channel parameters,
+// the device itself is controlled when channel is empty.
+func control(ginCxt *gin.Context, cmd func(ctx context.Context, c *Channel) error) {
+	id := ginCxt.Query("id")
+	channel := ginCxt.Query("channel")
+	if id == "" {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(id required)"))
+		return
+	}
+	if channel == "" {
+		channel = id
+	}
+	c, ok := FindChannel(id, channel)
+	if !ok {
+		ginCxt.JSON(200, ResultUtils.Fail("11002", "device not online"))
+		return
+	}
+	if err := cmd(ginCxt.Request.Context(), c); err != nil {
+		logger.Info("device control failed ", err)
+		ginCxt.JSON(200, ResultUtils.Fail("11005", "device control failed"))
+		return
+	}
+	ginCxt.JSON(200, ResultUtils.Success("success"))
+}
+
+// queryInt returns integer parameter in [0, max], def is returned for the empty parameter.
+func queryInt(ginCxt *gin.Context, name string, def, max int) (int, bool) {
+	v := ginCxt.Query(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+var ptzDirections = map[string]byte{
+	"up":        PTZUp,
+	"down":      PTZDown,
+	"left":      PTZLeft,
+	"right":     PTZRight,
+	"upleft":    PTZUp | PTZLeft,
+	"upright":   PTZUp | PTZRight,
+	"downleft":  PTZDown | PTZLeft,
+	"downright": PTZDown | PTZRight,
+	"zoomin":    PTZZoomIn,
+	"zoomout":   PTZZoomOut,
+}
+
+var fiOperations = map[string]byte{
+	"focusnear": FocusNear,
+	"focusfar":  FocusFar,
+	"irisopen":  IrisOpen,
+	"irisclose": IrisClose,
+}
+
+// PTZ moves the camera by cmd: stop, up, down, left, right, upleft, upright, downleft, downright,
+// zoomin, zoomout, focusnear, focusfar, irisopen or irisclose with speed 0-255 and zoomSpeed 0-15.
+func PTZ(ginCxt *gin.Context) {
+	name := ginCxt.Query("cmd")
+	speed, ok1 := queryInt(ginCxt, "speed", 128, 255)
+	zoomSpeed, ok2 := queryInt(ginCxt, "zoomSpeed", 8, 15)
+	if !ok1 || !ok2 {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(speed 0-255,zoomSpeed 0-15)"))
+		return
+	}
+
+	var cmd PTZCmd
+	if dir, ok := ptzDirections[name]; ok {
+		cmd = PTZMove(dir, byte(speed), byte(speed), byte(zoomSpeed))
+	} else if op, ok := fiOperations[name]; ok {
+		cmd = PTZFocusIris(op, byte(speed), byte(speed))
+	} else if name == "stop" {
+		cmd = PTZStop()
+	} else {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(unknown cmd)"))
+		return
+	}
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.PTZ(ctx, cmd)
+	})
+}
+
+// Preset sets, calls or deletes by op the preset of index 1-255.
+func Preset(ginCxt *gin.Context) {
+	index, ok := queryInt(ginCxt, "index", 0, 255)
+	if !ok || index == 0 {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(index 1-255 required)"))
+		return
+	}
+
+	var cmd PTZCmd
+	switch ginCxt.Query("op") {
+	case "set":
+		cmd = PresetSet(byte(index))
+	case "call":
+		cmd = PresetCall(byte(index))
+	case "delete":
+		cmd = PresetDelete(byte(index))
+	default:
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(op set,call,delete)"))
+		return
+	}
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.PTZ(ctx, cmd)
+	})
+}
+
+// Cruise manages the cruise group by op: add, delete, speed, dwell, start or stop.
+// The preset is added or deleted, value is the speed or the dwell time in seconds 0-4095.
+func Cruise(ginCxt *gin.Context) {
+	group, ok1 := queryInt(ginCxt, "group", 0, 255)
+	preset, ok2 := queryInt(ginCxt, "preset", 0, 255)
+	value, ok3 := queryInt(ginCxt, "value", 0, 4095)
+	if !ok1 || !ok2 || !ok3 {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(group 0-255,preset 0-255,value 0-4095)"))
+		return
+	}
+
+	var cmd PTZCmd
+	switch ginCxt.Query("op") {
+	case "add":
+		cmd = CruiseAdd(byte(group), byte(preset))
+	case "delete":
+		cmd = CruiseDelete(byte(group), byte(preset))
+	case "speed":
+		cmd = CruiseSpeed(byte(group), uint16(value))
+	case "dwell":
+		cmd = CruiseDwell(byte(group), uint16(value))
+	case "start":
+		cmd = CruiseStart(byte(group))
+	case "stop":
+		cmd = PTZStop()
+	default:
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(op add,delete,speed,dwell,start,stop)"))
+		return
+	}
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.PTZ(ctx, cmd)
+	})
+}
+
+// Scan manages the auto scan group by op: start, left, right, speed or stop, value is the speed 0-4095.
+func Scan(ginCxt *gin.Context) {
+	group, ok1 := queryInt(ginCxt, "group", 0, 255)
+	value, ok2 := queryInt(ginCxt, "value", 0, 4095)
+	if !ok1 || !ok2 {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(group 0-255,value 0-4095)"))
+		return
+	}
+
+	var cmd PTZCmd
+	switch ginCxt.Query("op") {
+	case "start":
+		cmd = ScanStart(byte(group))
+	case "left":
+		cmd = ScanLeft(byte(group))
+	case "right":
+		cmd = ScanRight(byte(group))
+	case "speed":
+		cmd = ScanSpeed(byte(group), uint16(value))
+	case "stop":
+		cmd = PTZStop()
+	default:
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(op start,left,right,speed,stop)"))
+		return
+	}
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.PTZ(ctx, cmd)
+	})
+}
+
+// Guard arms the channel with op set and disarms with op reset.
+func Guard(ginCxt *gin.Context) {
+	op := ginCxt.Query("op")
+	if op != "set" && op != "reset" {
+		ginCxt.JSON(http.StatusOK, ResultUtils.Fail("10001", "parameter error,(op set,reset)"))
+		return
+	}
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.Guard(ctx, op == "set")
+	})
+}
+
+func ResetAlarm(ginCxt *gin.Context) {
+	method := ginCxt.Query("alarmMethod")
+	typ := ginCxt.Query("alarmType")
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.ResetAlarm(ctx, method, typ)
+	})
+}
+
+func TeleBoot(ginCxt *gin.Context) {
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.TeleBoot(ctx)
+	})
+}
+
+func IFrame(ginCxt *gin.Context) {
+	control(ginCxt, func(ctx context.Context, c *Channel) error {
+		return c.RequestIFrame(ctx)
+	})
+}
@@ -0,0 +1,69 @@
+package manscdp
+
+func init() {
+	register(func() Message { return &DeviceControl{} })
+	register(func() Message { return &DeviceConfig{} })
+}
+
+// Values of the DeviceControl commands.
+const (
+	TeleBoot      = "Boot"
+	RecordStart   = "Record"
+	RecordStop    = "StopRecord"
+	GuardSet      = "SetGuard"
+	GuardReset    = "ResetGuard"
+	AlarmReset    = "ResetAlarm"
+	IFrameRequest = "Send"
+)
+
+// DeviceControlInfo is the Info element of the DeviceControl.
+type DeviceControlInfo struct {
+	ControlPriority int    `xml:",omitempty"`
+	AlarmMethod     string `xml:",omitempty"`
+	AlarmType       string `xml:",omitempty"`
+}
+
+// DragZoom is the zoom to the rectangle of the picture.
+type DragZoom struct {
+	Length    int
+	Width     int
+	MidPointX int
+	MidPointY int
+	LengthX   int
+	LengthY   int
+}
+
+// HomePosition is the watch position the camera returns to after ResetTime seconds of idle.
+type HomePosition struct {
+	Enabled     int
+	ResetTime   int `xml:",omitempty"`
+	PresetIndex int `xml:",omitempty"`
+}
+
+// DeviceControl is the control command, only one command element is set in a document.
+// PTZCmd is the hex string of the 8 byte PTZ instruction.
+type DeviceControl struct {
+	Header
+	PTZCmd       string             `xml:",omitempty"`
+	TeleBoot     string             `xml:",omitempty"`
+	RecordCmd    string             `xml:",omitempty"`
+	GuardCmd     string             `xml:",omitempty"`
+	AlarmCmd     string             `xml:",omitempty"`
+	IFrameCmd    string             `xml:"IFameCmd,omitempty"`
+	DragZoomIn   *DragZoom          `xml:",omitempty"`
+	DragZoomOut  *DragZoom          `xml:",omitempty"`
+	HomePosition *HomePosition      `xml:",omitempty"`
+	Info         *DeviceControlInfo `xml:",omitempty"`
+}
+
+func (*DeviceControl) Root() Root   { return RootControl }
+func (*DeviceControl) Cmd() CmdType { return CmdDeviceControl }
+
+// DeviceConfig changes the device configuration.
+type DeviceConfig struct {
+	Header
+	BasicParam *BasicParam `xml:",omitempty"`
+}
+
+func (*DeviceConfig) Root() Root   { return RootControl }
+func (*DeviceConfig) Cmd() CmdType { return CmdDeviceConfig }
@@ -0,0 +1,67 @@
+package manscdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoHandler is returned by Dispatch when no handler is registered for the document.
+var ErrNoHandler = errors.New("no MANSCDP handler")
+
+// Handler handles the decoded document, use type switch or assertion to get the concrete type.
+type Handler func(ctx context.Context, msg Message) error
+
+// Dispatcher routes documents to the handlers registered by the root and command.
+type Dispatcher struct {
+	mu       sync.RWMutex
+	handlers map[route]Handler
+	fallback Handler
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[route]Handler),
+	}
+}
+
+// Handle registers handler of the documents with the root and command, it replaces the previous one.
+func (d *Dispatcher) Handle(root Root, cmd CmdType, handler Handler) {
+	d.mu.Lock()
+	d.handlers[route{root, cmd}] = handler
+	d.mu.Unlock()
+}
+
+// HandleDefault registers handler of the documents without own handler.
+func (d *Dispatcher) HandleDefault(handler Handler) {
+	d.mu.Lock()
+	d.fallback = handler
+	d.mu.Unlock()
+}
+
+// Dispatch passes the document to its handler and returns the handler error.
+func (d *Dispatcher) Dispatch(ctx context.Context, msg Message) error {
+	r := route{msg.Root(), msg.Cmd()}
+
+	d.mu.RLock()
+	handler, ok := d.handlers[r]
+	if !ok {
+		handler = d.fallback
+	}
+	d.mu.RUnlock()
+
+	if handler == nil {
+		return fmt.Errorf("%w for %s", ErrNoHandler, r)
+	}
+	return handler(ctx, msg)
+}
+
+// DispatchBody decodes the document and dispatches it.
+func (d *Dispatcher) DispatchBody(ctx context.Context, body []byte) (Message, error) {
+	msg, err := Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return msg, d.Dispatch(ctx, msg)
+}
@@ -0,0 +1,221 @@
+// Package manscdp implements encoding and decoding of GB/T 28181 MANSCDP xml documents
+// carried in MESSAGE and NOTIFY bodies - GB/T 28181-2016 Annex A.
+package manscdp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+const ContentType = "Application/MANSCDP+xml"
+
+// Root is the root element of the document.
+type Root string
+
+const (
+	RootQuery    Root = "Query"
+	RootControl  Root = "Control"
+	RootResponse Root = "Response"
+	RootNotify   Root = "Notify"
+)
+
+// CmdType is the command of the document.
+type CmdType string
+
+const (
+	CmdKeepalive      CmdType = "Keepalive"
+	CmdCatalog        CmdType = "Catalog"
+	CmdDeviceInfo     CmdType = "DeviceInfo"
+	CmdDeviceStatus   CmdType = "DeviceStatus"
+	CmdRecordInfo     CmdType = "RecordInfo"
+	CmdAlarm          CmdType = "Alarm"
+	CmdMobilePosition CmdType = "MobilePosition"
+	CmdConfigDownload CmdType = "ConfigDownload"
+	CmdPresetQuery    CmdType = "PresetQuery"
+	CmdDeviceControl  CmdType = "DeviceControl"
+	CmdDeviceConfig   CmdType = "DeviceConfig"
+)
+
+// Result values of the responses.
+const (
+	ResultOK    = "OK"
+	ResultError = "ERROR"
+)
+
+// Charset is the encoding of the encoded document.
+type Charset string
+
+const (
+	// GB2312 is the charset required by the standard, documents are encoded with GBK
+	// which is a superset of GB2312 accepted by the devices.
+	GB2312 Charset = "GB2312"
+	UTF8   Charset = "UTF-8"
+)
+
+// Header is the set of elements common for all documents.
+type Header struct {
+	CmdType  CmdType
+	SN       int
+	DeviceID string
+}
+
+// Head returns the header, it makes any document embedding Header to implement Message.
+func (h *Header) Head() *Header {
+	return h
+}
+
+// Message is a decoded MANSCDP document.
+type Message interface {
+	Root() Root
+	Cmd() CmdType
+	Head() *Header
+}
+
+type route struct {
+	root Root
+	cmd  CmdType
+}
+
+func (r route) String() string {
+	return fmt.Sprintf("%s %s", r.root, r.cmd)
+}
+
+var messages = map[route]func() Message{}
+
+func register(factory func() Message) {
+	msg := factory()
+	messages[route{msg.Root(), msg.Cmd()}] = factory
+}
+
+// New returns empty document of the root and command, it is nil for unknown commands.
+func New(root Root, cmd CmdType) Message {
+	if factory, ok := messages[route{root, cmd}]; ok {
+		return factory()
+	}
+	return nil
+}
+
+// Unknown is a document with the command this package doesn't know,
+// its elements except the header are kept as is.
+type Unknown struct {
+	XMLName xml.Name
+	Header
+	Inner []byte `xml:",innerxml"`
+}
+
+func (m *Unknown) Root() Root   { return Root(m.XMLName.Local) }
+func (m *Unknown) Cmd() CmdType { return m.CmdType }
+
+var encodingRe = regexp.MustCompile(`^\s*<\?xml[^>]*?encoding\s*=\s*["']([^"']+)["']`)
+
+// declaredCharset returns encoding declared in the xml prolog.
+func declaredCharset(body []byte) string {
+	if m := encodingRe.FindSubmatch(body); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// toUTF8 converts the document to UTF-8 by the declared encoding.
+// Devices often declare GB2312 sending UTF-8 and vice versa,
+// so the declaration is trusted only when the body is not a valid UTF-8 text.
+func toUTF8(body []byte) ([]byte, error) {
+	if utf8.Valid(body) {
+		return body, nil
+	}
+
+	var enc encoding.Encoding = simplifiedchinese.GBK
+	if label := declaredCharset(body); label != "" && !strings.EqualFold(label, string(UTF8)) {
+		if e, _ := charset.Lookup(label); e != nil {
+			enc = e
+		}
+	}
+	res, err := ioutil.ReadAll(transform.NewReader(bytes.NewReader(body), enc.NewDecoder()))
+	if err != nil {
+		return nil, fmt.Errorf("convert document to UTF-8: %w", err)
+	}
+	return res, nil
+}
+
+func newDecoder(body []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	// the body is already converted, the declared encoding is ignored
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder
+}
+
+// Decode decodes the document encoded with GB2312, GBK or UTF-8.
+// Documents with unknown commands are decoded as *Unknown.
+func Decode(body []byte) (Message, error) {
+	body, err := toUTF8(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var head struct {
+		XMLName xml.Name
+		Header
+	}
+	if err := newDecoder(body).Decode(&head); err != nil {
+		return nil, fmt.Errorf("decode MANSCDP document: %w", err)
+	}
+	if head.CmdType == "" {
+		return nil, fmt.Errorf("decode MANSCDP document: missing CmdType in %s", head.XMLName.Local)
+	}
+
+	msg := New(Root(head.XMLName.Local), head.CmdType)
+	if msg == nil {
+		msg = &Unknown{}
+	}
+	if err := newDecoder(body).Decode(msg); err != nil {
+		return nil, fmt.Errorf("decode MANSCDP %s %s document: %w", head.XMLName.Local, head.CmdType, err)
+	}
+
+	return msg, nil
+}
+
+// Encode encodes the document with the charset, the empty charset means GB2312.
+// CmdType of the header is filled by the document command.
+func Encode(msg Message, cs Charset) ([]byte, error) {
+	if cs == "" {
+		cs = GB2312
+	}
+	msg.Head().CmdType = msg.Cmd()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<?xml version=\"1.0\" encoding=\"%s\"?>\n", cs)
+	start := xml.StartElement{Name: xml.Name{Local: string(msg.Root())}}
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.EncodeElement(msg, start); err != nil {
+		return nil, fmt.Errorf("encode MANSCDP %s %s document: %w", msg.Root(), msg.Cmd(), err)
+	}
+	buf.WriteByte('\n')
+
+	switch cs {
+	case UTF8:
+		return buf.Bytes(), nil
+	case GB2312:
+		// characters out of GBK are replaced instead of failing the whole document
+		res, _, err := transform.Bytes(encoding.ReplaceUnsupported(simplifiedchinese.GBK.NewEncoder()), buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("encode MANSCDP document to %s: %w", cs, err)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unsupported charset %s", cs)
+	}
+}
@@ -0,0 +1,193 @@
+package manscdp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+)
+
+const catalogResponse = `<?xml version="1.0" encoding="GB2312"?>
+<Response>
+<CmdType>Catalog</CmdType>
+<SN>17</SN>
+<DeviceID>34020000001320000001</DeviceID>
+<SumNum>2</SumNum>
+<DeviceList Num="1">
+<Item>
+<DeviceID>34020000001310000001</DeviceID>
+<Name>东门摄像机</Name>
+<Manufacturer>Hikvision</Manufacturer>
+<Parental>0</Parental>
+<Status>ON</Status>
+<Info>
+<PTZType>1</PTZType>
+</Info>
+</Item>
+</DeviceList>
+</Response>
+`
+
+func gbk(t *testing.T, s string) []byte {
+	b, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return b
+}
+
+func checkCatalog(t *testing.T, msg manscdp.Message) {
+	res, ok := msg.(*manscdp.CatalogResponse)
+	if !ok {
+		t.Fatalf("unexpected message %T", msg)
+	}
+	if res.SN != 17 || res.DeviceID != "34020000001320000001" || res.SumNum != 2 || res.DeviceList.Num != 1 {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if len(res.DeviceList.Items) != 1 {
+		t.Fatalf("unexpected items %v", res.DeviceList.Items)
+	}
+	item := res.DeviceList.Items[0]
+	if item.DeviceID != "34020000001310000001" || item.Name != "东门摄像机" || item.Status != "ON" {
+		t.Errorf("unexpected item %+v", item)
+	}
+	if item.Info == nil || item.Info.PTZType != 1 {
+		t.Errorf("unexpected item info %+v", item.Info)
+	}
+}
+
+func TestDecodeCharsets(t *testing.T) {
+	t.Run("GB2312", func(t *testing.T) {
+		msg, err := manscdp.Decode(gbk(t, catalogResponse))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		checkCatalog(t, msg)
+	})
+	t.Run("UTF-8 declared as GB2312", func(t *testing.T) {
+		msg, err := manscdp.Decode([]byte(catalogResponse))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		checkCatalog(t, msg)
+	})
+	t.Run("GBK without declaration", func(t *testing.T) {
+		body := strings.Replace(catalogResponse, ` encoding="GB2312"`, "", 1)
+		msg, err := manscdp.Decode(gbk(t, body))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		checkCatalog(t, msg)
+	})
+}
+
+func TestEncode(t *testing.T) {
+	notify := &manscdp.KeepaliveNotify{
+		Header:       manscdp.Header{SN: 5, DeviceID: "34020000001320000001"},
+		Status:       manscdp.ResultOK,
+		FaultDevices: []string{"34020000001310000002"},
+	}
+
+	body, err := manscdp.Encode(notify, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.HasPrefix(body, []byte(`<?xml version="1.0" encoding="GB2312"?>`)) {
+		t.Errorf("unexpected prolog %q", body)
+	}
+	for _, s := range []string{"<Notify>", "<CmdType>Keepalive</CmdType>", "<Info>", "<DeviceID>34020000001310000002</DeviceID>"} {
+		if !bytes.Contains(body, []byte(s)) {
+			t.Errorf("%s not found in %s", s, body)
+		}
+	}
+
+	msg, err := manscdp.Decode(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, ok := msg.(*manscdp.KeepaliveNotify); !ok || got.SN != 5 || len(got.FaultDevices) != 1 {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestEncodeGB2312(t *testing.T) {
+	ctrl := &manscdp.DeviceControl{
+		Header:    manscdp.Header{SN: 3, DeviceID: "34020000001310000001"},
+		IFrameCmd: manscdp.IFrameRequest,
+		Info:      &manscdp.DeviceControlInfo{AlarmMethod: "报警"},
+	}
+
+	body, err := manscdp.Encode(ctrl, manscdp.GB2312)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if utf8.Valid(body) || !bytes.Contains(body, gbk(t, "报警")) {
+		t.Errorf("body is not GB2312 encoded: %q", body)
+	}
+	if !bytes.Contains(body, []byte("<IFameCmd>Send</IFameCmd>")) || !bytes.Contains(body, []byte("<Control>")) {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	body, err = manscdp.Encode(ctrl, manscdp.UTF8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Contains(body, []byte("报警")) {
+		t.Errorf("body is not UTF-8 encoded: %q", body)
+	}
+}
+
+func TestDecodeUnknown(t *testing.T) {
+	msg, err := manscdp.Decode([]byte(`<?xml version="1.0"?>
+<Notify><CmdType>MediaStatus</CmdType><SN>1</SN><DeviceID>1</DeviceID><NotifyType>121</NotifyType></Notify>`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	unknown, ok := msg.(*manscdp.Unknown)
+	if !ok {
+		t.Fatalf("unexpected message %T", msg)
+	}
+	if unknown.Root() != manscdp.RootNotify || unknown.Cmd() != "MediaStatus" || !bytes.Contains(unknown.Inner, []byte("<NotifyType>121</NotifyType>")) {
+		t.Errorf("unexpected message %+v", unknown)
+	}
+
+	if _, err := manscdp.Decode([]byte(`<Notify><SN>1</SN></Notify>`)); err == nil {
+		t.Error("expected error on missing CmdType")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	d := manscdp.NewDispatcher()
+	var got manscdp.Message
+	d.Handle(manscdp.RootResponse, manscdp.CmdCatalog, func(ctx context.Context, msg manscdp.Message) error {
+		got = msg
+		return nil
+	})
+
+	if _, err := d.DispatchBody(context.Background(), []byte(catalogResponse)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkCatalog(t, got)
+
+	err := d.Dispatch(context.Background(), &manscdp.KeepaliveNotify{})
+	if !errors.Is(err, manscdp.ErrNoHandler) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	d.HandleDefault(func(ctx context.Context, msg manscdp.Message) error {
+		got = msg
+		return nil
+	})
+	if err := d.Dispatch(context.Background(), &manscdp.KeepaliveNotify{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := got.(*manscdp.KeepaliveNotify); !ok {
+		t.Errorf("unexpected message %T", got)
+	}
+}
@@ -0,0 +1,79 @@
+package manscdp
+
+func init() {
+	register(func() Message { return &KeepaliveNotify{} })
+	register(func() Message { return &CatalogNotify{} })
+	register(func() Message { return &AlarmNotify{} })
+	register(func() Message { return &MobilePositionNotify{} })
+}
+
+// KeepaliveNotify is the heartbeat of the device, FaultDevices are its channels out of work.
+type KeepaliveNotify struct {
+	Header
+	Status       string
+	FaultDevices []string `xml:"Info>DeviceID,omitempty"`
+}
+
+func (*KeepaliveNotify) Root() Root   { return RootNotify }
+func (*KeepaliveNotify) Cmd() CmdType { return CmdKeepalive }
+
+// Catalog events of the CatalogItem in the CatalogNotify.
+const (
+	EventOn     = "ON"
+	EventOff    = "OFF"
+	EventVLost  = "VLOST"
+	EventDefect = "DEFECT"
+	EventAdd    = "ADD"
+	EventDel    = "DEL"
+	EventUpdate = "UPDATE"
+)
+
+// CatalogNotify is the catalog change of the subscribed device, items carry the Event.
+type CatalogNotify struct {
+	Header
+	SumNum     int
+	DeviceList CatalogList
+}
+
+func (*CatalogNotify) Root() Root   { return RootNotify }
+func (*CatalogNotify) Cmd() CmdType { return CmdCatalog }
+
+// AlarmTypeParam is the parameter of the alarm type.
+type AlarmTypeParam struct {
+	EventType int `xml:",omitempty"`
+}
+
+// AlarmInfo is the type of the alarm of the AlarmMethod.
+type AlarmInfo struct {
+	AlarmType      int             `xml:",omitempty"`
+	AlarmTypeParam *AlarmTypeParam `xml:",omitempty"`
+}
+
+// AlarmNotify is the alarm of the device.
+type AlarmNotify struct {
+	Header
+	AlarmPriority    string
+	AlarmMethod      string
+	AlarmTime        string
+	AlarmDescription string     `xml:",omitempty"`
+	Longitude        float64    `xml:",omitempty"`
+	Latitude         float64    `xml:",omitempty"`
+	Info             *AlarmInfo `xml:",omitempty"`
+}
+
+func (*AlarmNotify) Root() Root   { return RootNotify }
+func (*AlarmNotify) Cmd() CmdType { return CmdAlarm }
+
+// MobilePositionNotify is the position of the mobile device.
+type MobilePositionNotify struct {
+	Header
+	Time      string
+	Longitude float64
+	Latitude  float64
+	Speed     float64 `xml:",omitempty"`
+	Direction float64 `xml:",omitempty"`
+	Altitude  float64 `xml:",omitempty"`
+}
+
+func (*MobilePositionNotify) Root() Root   { return RootNotify }
+func (*MobilePositionNotify) Cmd() CmdType { return CmdMobilePosition }
@@ -0,0 +1,110 @@
+package manscdp
+
+func init() {
+	register(func() Message { return &CatalogQuery{} })
+	register(func() Message { return &DeviceInfoQuery{} })
+	register(func() Message { return &DeviceStatusQuery{} })
+	register(func() Message { return &RecordInfoQuery{} })
+	register(func() Message { return &AlarmQuery{} })
+	register(func() Message { return &MobilePositionQuery{} })
+	register(func() Message { return &ConfigDownloadQuery{} })
+	register(func() Message { return &PresetQuery{} })
+}
+
+// CatalogQuery requests the device channel list.
+type CatalogQuery struct {
+	Header
+	StartTime string `xml:",omitempty"`
+	EndTime   string `xml:",omitempty"`
+}
+
+func (*CatalogQuery) Root() Root   { return RootQuery }
+func (*CatalogQuery) Cmd() CmdType { return CmdCatalog }
+
+// DeviceInfoQuery requests the device information.
+type DeviceInfoQuery struct {
+	Header
+}
+
+func (*DeviceInfoQuery) Root() Root   { return RootQuery }
+func (*DeviceInfoQuery) Cmd() CmdType { return CmdDeviceInfo }
+
+// DeviceStatusQuery requests the device status.
+type DeviceStatusQuery struct {
+	Header
+}
+
+func (*DeviceStatusQuery) Root() Root   { return RootQuery }
+func (*DeviceStatusQuery) Cmd() CmdType { return CmdDeviceStatus }
+
+// Record types of the RecordInfoQuery.
+const (
+	RecordAll    = "all"
+	RecordTime   = "time"
+	RecordAlarm  = "alarm"
+	RecordManual = "manual"
+)
+
+// RecordInfoQuery requests the recordings of the channel in the time range.
+// Times are in the local time format 2006-01-02T15:04:05.
+type RecordInfoQuery struct {
+	Header
+	StartTime       string
+	EndTime         string
+	FilePath        string `xml:",omitempty"`
+	Address         string `xml:",omitempty"`
+	Secrecy         int
+	Type            string `xml:",omitempty"`
+	RecorderID      string `xml:",omitempty"`
+	IndistinctQuery string `xml:",omitempty"`
+}
+
+func (*RecordInfoQuery) Root() Root   { return RootQuery }
+func (*RecordInfoQuery) Cmd() CmdType { return CmdRecordInfo }
+
+// AlarmQuery requests the alarms of the device.
+type AlarmQuery struct {
+	Header
+	StartAlarmPriority string `xml:",omitempty"`
+	EndAlarmPriority   string `xml:",omitempty"`
+	AlarmMethod        string `xml:",omitempty"`
+	AlarmType          string `xml:",omitempty"`
+	StartAlarmTime     string `xml:",omitempty"`
+	EndAlarmTime       string `xml:",omitempty"`
+}
+
+func (*AlarmQuery) Root() Root   { return RootQuery }
+func (*AlarmQuery) Cmd() CmdType { return CmdAlarm }
+
+// MobilePositionQuery requests the position of the mobile device,
+// Interval is the notification period in seconds.
+type MobilePositionQuery struct {
+	Header
+	Interval int `xml:",omitempty"`
+}
+
+func (*MobilePositionQuery) Root() Root   { return RootQuery }
+func (*MobilePositionQuery) Cmd() CmdType { return CmdMobilePosition }
+
+// Config types of the ConfigDownloadQuery, several types are joined by "/".
+const (
+	ConfigBasicParam    = "BasicParam"
+	ConfigVideoParamOpt = "VideoParamOpt"
+)
+
+// ConfigDownloadQuery requests the device configuration.
+type ConfigDownloadQuery struct {
+	Header
+	ConfigType string
+}
+
+func (*ConfigDownloadQuery) Root() Root   { return RootQuery }
+func (*ConfigDownloadQuery) Cmd() CmdType { return CmdConfigDownload }
+
+// PresetQuery requests the PTZ presets of the channel.
+type PresetQuery struct {
+	Header
+}
+
+func (*PresetQuery) Root() Root   { return RootQuery }
+func (*PresetQuery) Cmd() CmdType { return CmdPresetQuery }
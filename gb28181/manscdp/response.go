@@ -0,0 +1,229 @@
+package manscdp
+
+func init() {
+	register(func() Message { return &CatalogResponse{} })
+	register(func() Message { return &DeviceInfoResponse{} })
+	register(func() Message { return &DeviceStatusResponse{} })
+	register(func() Message { return &RecordInfoResponse{} })
+	register(func() Message { return &AlarmResponse{} })
+	register(func() Message { return &ConfigDownloadResponse{} })
+	register(func() Message { return &PresetQueryResponse{} })
+	register(func() Message { return &DeviceControlResponse{} })
+	register(func() Message { return &DeviceConfigResponse{} })
+}
+
+// CatalogItem is a device or a channel of the catalog.
+type CatalogItem struct {
+	DeviceID     string
+	Event        string `xml:",omitempty"`
+	Name         string
+	Manufacturer string `xml:",omitempty"`
+	Model        string `xml:",omitempty"`
+	Owner        string `xml:",omitempty"`
+	CivilCode    string `xml:",omitempty"`
+	Block        string `xml:",omitempty"`
+	Address      string `xml:",omitempty"`
+	Parental     int
+	ParentID     string `xml:",omitempty"`
+	SafetyWay    int
+	RegisterWay  int
+	CertNum      string `xml:",omitempty"`
+	Certifiable  int
+	ErrCode      int
+	EndTime      string `xml:",omitempty"`
+	Secrecy      int
+	IPAddress    string           `xml:",omitempty"`
+	Port         int              `xml:",omitempty"`
+	Password     string           `xml:",omitempty"`
+	Status       string           `xml:",omitempty"`
+	Longitude    float64          `xml:",omitempty"`
+	Latitude     float64          `xml:",omitempty"`
+	Info         *CatalogItemInfo `xml:",omitempty"`
+}
+
+// CatalogItemInfo is the extended information of the camera channel.
+type CatalogItemInfo struct {
+	PTZType             int    `xml:",omitempty"`
+	PositionType        int    `xml:",omitempty"`
+	RoomType            int    `xml:",omitempty"`
+	UseType             int    `xml:",omitempty"`
+	SupplyLightType     int    `xml:",omitempty"`
+	DirectionType       int    `xml:",omitempty"`
+	Resolution          string `xml:",omitempty"`
+	BusinessGroupID     string `xml:",omitempty"`
+	DownloadSpeed       string `xml:",omitempty"`
+	SVCSpaceSupportMode int    `xml:",omitempty"`
+	SVCTimeSupportMode  int    `xml:",omitempty"`
+}
+
+// CatalogList is the DeviceList element, Num is the count of items in this document.
+type CatalogList struct {
+	Num   int            `xml:"Num,attr"`
+	Items []*CatalogItem `xml:"Item"`
+}
+
+// CatalogResponse is one part of the catalog, SumNum is the total count of items in all parts.
+type CatalogResponse struct {
+	Header
+	SumNum     int
+	DeviceList CatalogList
+}
+
+func (*CatalogResponse) Root() Root   { return RootResponse }
+func (*CatalogResponse) Cmd() CmdType { return CmdCatalog }
+
+// DeviceInfoResponse is the device information.
+type DeviceInfoResponse struct {
+	Header
+	DeviceName   string `xml:",omitempty"`
+	Result       string
+	Manufacturer string `xml:",omitempty"`
+	Model        string `xml:",omitempty"`
+	Firmware     string `xml:",omitempty"`
+	Channel      int    `xml:",omitempty"`
+}
+
+func (*DeviceInfoResponse) Root() Root   { return RootResponse }
+func (*DeviceInfoResponse) Cmd() CmdType { return CmdDeviceInfo }
+
+// AlarmStatusItem is the guard status of the alarm channel.
+type AlarmStatusItem struct {
+	DeviceID   string
+	DutyStatus string
+}
+
+// AlarmStatusList is the Alarmstatus element.
+type AlarmStatusList struct {
+	Num   int                `xml:"Num,attr"`
+	Items []*AlarmStatusItem `xml:"Item"`
+}
+
+// DeviceStatusResponse is the device status.
+type DeviceStatusResponse struct {
+	Header
+	Result      string
+	Online      string
+	Status      string
+	Reason      string           `xml:",omitempty"`
+	Encode      string           `xml:",omitempty"`
+	Record      string           `xml:",omitempty"`
+	DeviceTime  string           `xml:",omitempty"`
+	AlarmStatus *AlarmStatusList `xml:"Alarmstatus,omitempty"`
+}
+
+func (*DeviceStatusResponse) Root() Root   { return RootResponse }
+func (*DeviceStatusResponse) Cmd() CmdType { return CmdDeviceStatus }
+
+// RecordItem is a recording file of the channel.
+type RecordItem struct {
+	DeviceID   string
+	Name       string
+	FilePath   string `xml:",omitempty"`
+	Address    string `xml:",omitempty"`
+	StartTime  string
+	EndTime    string
+	Secrecy    int
+	Type       string `xml:",omitempty"`
+	RecorderID string `xml:",omitempty"`
+	FileSize   int64  `xml:",omitempty"`
+}
+
+// RecordList is the RecordList element, Num is the count of items in this document.
+type RecordList struct {
+	Num   int           `xml:"Num,attr"`
+	Items []*RecordItem `xml:"Item"`
+}
+
+// RecordInfoResponse is one part of the recordings, SumNum is the total count of items in all parts.
+type RecordInfoResponse struct {
+	Header
+	Name       string `xml:",omitempty"`
+	SumNum     int
+	RecordList RecordList
+}
+
+func (*RecordInfoResponse) Root() Root   { return RootResponse }
+func (*RecordInfoResponse) Cmd() CmdType { return CmdRecordInfo }
+
+// AlarmResponse acknowledges the alarm notification.
+type AlarmResponse struct {
+	Header
+	Result string
+}
+
+func (*AlarmResponse) Root() Root   { return RootResponse }
+func (*AlarmResponse) Cmd() CmdType { return CmdAlarm }
+
+// BasicParam is the basic configuration of the device.
+type BasicParam struct {
+	Name               string  `xml:",omitempty"`
+	DeviceID           string  `xml:",omitempty"`
+	SIPServerID        string  `xml:",omitempty"`
+	SIPServerIP        string  `xml:",omitempty"`
+	SIPServerPort      int     `xml:",omitempty"`
+	DomainName         string  `xml:",omitempty"`
+	Expiration         int     `xml:",omitempty"`
+	Password           string  `xml:",omitempty"`
+	HeartBeatInterval  int     `xml:",omitempty"`
+	HeartBeatCount     int     `xml:",omitempty"`
+	PositionCapability int     `xml:",omitempty"`
+	Longitude          float64 `xml:",omitempty"`
+	Latitude           float64 `xml:",omitempty"`
+}
+
+// VideoParamOpt is the video options supported by the device.
+type VideoParamOpt struct {
+	DownloadSpeed string `xml:",omitempty"`
+	Resolution    string `xml:",omitempty"`
+}
+
+// ConfigDownloadResponse is the device configuration of the requested types.
+type ConfigDownloadResponse struct {
+	Header
+	Result        string
+	BasicParam    *BasicParam    `xml:",omitempty"`
+	VideoParamOpt *VideoParamOpt `xml:",omitempty"`
+}
+
+func (*ConfigDownloadResponse) Root() Root   { return RootResponse }
+func (*ConfigDownloadResponse) Cmd() CmdType { return CmdConfigDownload }
+
+// PresetItem is a PTZ preset of the channel.
+type PresetItem struct {
+	PresetID   int
+	PresetName string
+}
+
+// PresetList is the PresetList element.
+type PresetList struct {
+	Num   int           `xml:"Num,attr"`
+	Items []*PresetItem `xml:"Item"`
+}
+
+// PresetQueryResponse is the PTZ presets of the channel.
+type PresetQueryResponse struct {
+	Header
+	SumNum     int `xml:",omitempty"`
+	PresetList PresetList
+}
+
+func (*PresetQueryResponse) Root() Root   { return RootResponse }
+func (*PresetQueryResponse) Cmd() CmdType { return CmdPresetQuery }
+
+// DeviceControlResponse is the result of the DeviceControl command.
+type DeviceControlResponse struct {
+	Header
+	Result string
+}
+
+func (*DeviceControlResponse) Root() Root   { return RootResponse }
+func (*DeviceControlResponse) Cmd() CmdType { return CmdDeviceControl }
+
+// DeviceConfigResponse is the result of the DeviceConfig command.
+type DeviceConfigResponse struct {
+	Header
+	Result string
+}
+
+func (*DeviceConfigResponse) Root() Root   { return RootResponse }
+func (*DeviceConfigResponse) Cmd() CmdType { return CmdDeviceConfig }
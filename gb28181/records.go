@@ -0,0 +1,258 @@
+package gb28181
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+)
+
+// ErrRecordTimeout is returned when not all parts of the records are received in SipConfig.RecordTimeout.
+var ErrRecordTimeout = errors.New("records are not complete")
+
+// recordTimeLayouts are formats of the record times, the standard one and the one of some devices.
+var recordTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+func parseRecordTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range recordTimeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// RecordRange is the continuous time range covered by the records.
+type RecordRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RecordResult is the outcome of the records query.
+type RecordResult struct {
+	SumNum   int            `json:"sumNum"`
+	Complete bool           `json:"complete"`
+	Records  []*Record      `json:"records"`
+	Ranges   []*RecordRange `json:"ranges"`
+}
+
+// recordKey identifies the record info query, the channel ID is the DeviceID of the query.
+type recordKey struct {
+	sn        int
+	channelID string
+}
+
+// recordSync gathers parts of the record info response with the SN.
+type recordSync struct {
+	device *GatewayDevice
+	key    recordKey
+
+	mu       sync.Mutex
+	sumNum   int
+	items    []*manscdp.RecordItem
+	timer    *time.Timer
+	finished bool
+
+	done chan struct{}
+	err  error
+}
+
+// syncRecords starts the sync of the record info response with the SN of the channel,
+// the query with the same SN and channel in progress is not replaced.
+func (d *GatewayDevice) syncRecords(sn int, channelID string) (*recordSync, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := recordKey{sn: sn, channelID: channelID}
+	if _, ok := d.records[key]; ok {
+		return nil, fmt.Errorf("record query %d of %s is in progress", sn, channelID)
+	}
+	if d.records == nil {
+		d.records = make(map[recordKey]*recordSync)
+	}
+	s := &recordSync{
+		device: d,
+		key:    key,
+		done:   make(chan struct{}),
+	}
+	s.timer = time.AfterFunc(SC.RecordTimeout, func() {
+		s.finish(ErrRecordTimeout)
+	})
+	d.records[key] = s
+
+	return s, nil
+}
+
+func (d *GatewayDevice) findRecordSync(sn int, channelID string) (*recordSync, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	s, ok := d.records[recordKey{sn: sn, channelID: channelID}]
+	return s, ok
+}
+
+// add appends part of the records, the sync is finished when all SumNum items are received.
+func (s *recordSync) add(res *manscdp.RecordInfoResponse) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	if res.SumNum > s.sumNum {
+		s.sumNum = res.SumNum
+	}
+	s.items = append(s.items, res.RecordList.Items...)
+	complete := len(s.items) >= s.sumNum
+	if !complete {
+		// the timeout is counted from the last part as for the catalog
+		s.timer.Reset(SC.RecordTimeout)
+	}
+	s.mu.Unlock()
+
+	if complete {
+		s.finish(nil)
+	}
+}
+
+func (s *recordSync) finish(err error) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.timer.Stop()
+	s.err = err
+	s.mu.Unlock()
+
+	d := s.device
+	d.mu.Lock()
+	if d.records[s.key] == s {
+		delete(d.records, s.key)
+	}
+	d.mu.Unlock()
+
+	close(s.done)
+}
+
+// result returns received records sorted by the start time and their merged time ranges.
+func (s *recordSync) result() *RecordResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type record struct {
+		*Record
+		start, end time.Time
+	}
+	records := make([]record, 0, len(s.items))
+	for _, item := range s.items {
+		start, err1 := parseRecordTime(item.StartTime)
+		end, err2 := parseRecordTime(item.EndTime)
+		if err1 != nil || err2 != nil || end.Before(start) {
+			logger.Warnf("skip record %s of %s with invalid time range %s - %s",
+				item.Name, item.DeviceID, item.StartTime, item.EndTime)
+			continue
+		}
+		records = append(records, record{
+			Record: &Record{
+				DeviceID:  item.DeviceID,
+				Name:      item.Name,
+				FilePath:  item.FilePath,
+				Address:   item.Address,
+				StartTime: item.StartTime,
+				EndTime:   item.EndTime,
+				Secrecy:   item.Secrecy,
+				Type:      item.Type,
+			},
+			start: start,
+			end:   end,
+		})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].start.Before(records[j].start)
+	})
+
+	result := &RecordResult{
+		SumNum:   s.sumNum,
+		Complete: s.err == nil,
+		Records:  make([]*Record, 0, len(records)),
+		Ranges:   make([]*RecordRange, 0),
+	}
+	var last *RecordRange
+	for _, r := range records {
+		result.Records = append(result.Records, r.Record)
+		// files of the continuous recording are split with a gap up to a second
+		if last != nil && !r.start.After(last.End.Add(time.Second)) {
+			if r.end.After(last.End) {
+				last.End = r.end
+			}
+			continue
+		}
+		last = &RecordRange{Start: r.start, End: r.end}
+		result.Ranges = append(result.Ranges, last)
+	}
+
+	return result
+}
+
+// QueryRecords queries records of the channel in the time range and waits for all parts of the response.
+// Record type is one of manscdp.RecordAll, RecordTime, RecordAlarm or RecordManual, empty means all.
+// Incomplete records are returned with ErrRecordTimeout.
+func (c *Channel) QueryRecords(ctx context.Context, start, end time.Time, typ string) (*RecordResult, error) {
+	if c.ChannelEx == nil || c.device == nil {
+		return nil, fmt.Errorf("channel %s has no device", c.ChannelID)
+	}
+	d := c.device
+
+	if typ == "" {
+		typ = manscdp.RecordAll
+	}
+	query := &manscdp.RecordInfoQuery{
+		Header:    manscdp.Header{DeviceID: c.ChannelID},
+		StartTime: start.In(time.Local).Format(recordTimeLayouts[0]),
+		EndTime:   end.In(time.Local).Format(recordTimeLayouts[0]),
+		Type:      typ,
+	}
+	request, err := d.newMessage(query)
+	if err != nil {
+		return nil, err
+	}
+	// parts may come before the final response
+	s, err := d.syncRecords(query.SN, c.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.finish(context.Canceled)
+
+	res, err := d.request(ctx, request)
+	if err == nil && res.StatusCode() != 200 {
+		err = fmt.Errorf("record query rejected with '%d %s'", res.StatusCode(), res.Reason())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.result(), s.err
+}
+
+func onRecordInfo(ctx context.Context, msg manscdp.Message) error {
+	res := msg.(*manscdp.RecordInfoResponse)
+	s, ok := deviceFromContext(ctx).findRecordSync(res.SN, res.DeviceID)
+	if !ok {
+		logger.Debugf("skip record info %d of %s without query", res.SN, res.DeviceID)
+		return nil
+	}
+	s.add(res)
+	return nil
+}
@@ -24,6 +24,7 @@ type SessionManager interface {
 type MemorySession struct {
 	session      sync.Map
 	channelCache map[string]*ChannelInfo
+	cacheMu      sync.Mutex
 }
 
 func (m *MemorySession) Recover() {
@@ -115,7 +116,13 @@ func checkAndAddSession(deviceId string, value map[string]string) bool {
 							device: &device,
 						},
 					}
+					if ls, ok := value["ls"]; ok {
+						if lastSeen, err := strconv.ParseInt(ls, 10, 64); err == nil {
+							device.LastSeen = time.UnixMilli(lastSeen)
+						}
+					}
 					Session.Store(&device, device.Expires)
+					device.registered()
 					device.Query()
 					return true
 				} else {
@@ -133,10 +140,20 @@ func checkAndAddSession(deviceId string, value map[string]string) bool {
 }
 
 func (m *MemorySession) Remove(id string) {
-	m.session.Delete(id)
+	if load, ok := m.session.LoadAndDelete(id); ok {
+		load.(*GatewayDevice).expired()
+	}
 	RedisRouter.RemoveRoute(id)
 }
 
+// Load returns device of the session without expiration check.
+func (m *MemorySession) Load(id string) (*GatewayDevice, bool) {
+	if load, ok := m.session.Load(id); ok {
+		return load.(*GatewayDevice), true
+	}
+	return nil, false
+}
+
 var Session = MemorySession{session: sync.Map{}, channelCache: map[string]*ChannelInfo{}}
 
 func (m *MemorySession) Store(device *GatewayDevice, expiration time.Duration) bool {
@@ -177,8 +194,15 @@ func (m *MemorySession) Exist(id string) bool {
 	return false
 }
 
-func (m *MemorySession) AddChannelInfo(channelId string, c *ChannelInfo) bool {
+// cacheChannelInfo keeps dialog info of the channel, it is deleted by GetAndDelChannelInfo.
+func (m *MemorySession) cacheChannelInfo(channelId string, c *ChannelInfo) {
+	m.cacheMu.Lock()
 	m.channelCache[channelId] = c
+	m.cacheMu.Unlock()
+}
+
+func (m *MemorySession) AddChannelInfo(channelId string, c *ChannelInfo) bool {
+	m.cacheChannelInfo(channelId, c)
 	key := strings.Join([]string{SipChannelPrefix, channelId}, Delimiter)
 	err := ccredis.RedisDB.HSet(context.Background(), key, c.toHashValues()).Err()
 	if err != nil {
@@ -199,8 +223,11 @@ func GetChannelInfo(channelId string) *ChannelInfo {
 	return CreatChannelInfo(result)
 }
 func (m *MemorySession) GetAndDelChannelInfo(channelId string) *ChannelInfo {
-	if info, ok := m.channelCache[channelId]; ok {
-		delete(m.channelCache, channelId)
+	m.cacheMu.Lock()
+	info, ok := m.channelCache[channelId]
+	delete(m.channelCache, channelId)
+	m.cacheMu.Unlock()
+	if ok {
 		key := strings.Join([]string{SipChannelPrefix, channelId}, Delimiter)
 		ccredis.RedisDB.Del(context.Background(), key)
 		return info
@@ -241,6 +268,30 @@ func (r *redisRouter) Register(device *GatewayDevice, expire time.Duration) bool
 	return true
 }
 
+// Touch stores the last seen time of the device.
+func (r *redisRouter) Touch(device *GatewayDevice) bool {
+	return r.updateSession(device.DeviceID, "ls", strconv.FormatInt(device.lastSeen().UnixMilli(), 10))
+}
+
+// UpdateState stores the state of the device, other nodes route requests only to online devices.
+func (r *redisRouter) UpdateState(device *GatewayDevice) bool {
+	return r.updateSession(device.DeviceID, "state", device.State().String())
+}
+
+// updateSession sets the field of the stored session, expired session is not restored.
+func (r *redisRouter) updateSession(cameraID, field, value string) bool {
+	key := strings.Join([]string{SipSessionPrefix, cameraID}, Delimiter)
+	ctx := context.Background()
+	n, err := ccredis.RedisDB.Exists(ctx, key).Result()
+	if err != nil {
+		return false
+	}
+	if n == 0 {
+		return true
+	}
+	return ccredis.RedisDB.HSet(ctx, key, field, value).Err() == nil
+}
+
 func (r *redisRouter) GetRoute(cameraID string) string {
 	key := strings.Join([]string{SipSessionPrefix, cameraID}, Delimiter)
 	result, err := ccredis.RedisDB.HGet(context.Background(), key, "Addr").Result()
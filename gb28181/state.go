@@ -0,0 +1,257 @@
+package gb28181
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/discoviking/fsm"
+
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// DeviceState is the state of the registered device.
+type DeviceState int
+
+const (
+	// DeviceRegistered device has registered but not sent keepalive yet.
+	DeviceRegistered DeviceState = iota
+	// DeviceOnline device sends keepalive in time.
+	DeviceOnline
+	// DeviceOffline device missed SipConfig.KeepaliveTimeoutCount keepalives or failed a transaction.
+	DeviceOffline
+	// DeviceExpired device registration has expired or removed.
+	DeviceExpired
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceRegistered:
+		return "registered"
+	case DeviceOnline:
+		return "online"
+	case DeviceOffline:
+		return "offline"
+	case DeviceExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+func (s DeviceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Inputs of the device state machine.
+const (
+	deviceInputRegister fsm.Input = iota
+	deviceInputKeepalive
+	deviceInputTimeout
+	deviceInputTxFailure
+	deviceInputExpire
+)
+
+// DeviceEvent is the change of the device state.
+type DeviceEvent struct {
+	Device *GatewayDevice
+	From   DeviceState
+	To     DeviceState
+	Time   time.Time
+}
+
+type DeviceStateHandler func(event DeviceEvent)
+
+var (
+	stateHandlersMu sync.RWMutex
+	stateHandlers   []DeviceStateHandler
+)
+
+// HandleDeviceState adds handler of the device state changes.
+// Handlers are called in order of adding and must not block.
+func HandleDeviceState(handler DeviceStateHandler) {
+	stateHandlersMu.Lock()
+	stateHandlers = append(stateHandlers, handler)
+	stateHandlersMu.Unlock()
+}
+
+// stateUpdates queues devices with state changes to store in the router out of the FSM action.
+var stateUpdates = make(chan *GatewayDevice, 1024)
+
+func init() {
+	go func() {
+		// the current state is stored, so updates are kept in order by the single worker
+		for device := range stateUpdates {
+			if !RedisRouter.UpdateState(device) {
+				logger.Warnf("redis router update state of %s failed", device.DeviceID)
+			}
+		}
+	}()
+
+	HandleDeviceState(func(event DeviceEvent) {
+		logger.Infof("device %s is %s, was %s", event.Device.DeviceID, event.To, event.From)
+		select {
+		case stateUpdates <- event.Device:
+		default:
+			logger.Warnf("redis router state updates are full, state of %s is not stored", event.Device.DeviceID)
+		}
+	})
+}
+
+func (d *GatewayDevice) initFSM() {
+	registered := fsm.State{
+		Index: int(DeviceRegistered),
+		Outcomes: map[fsm.Input]fsm.Outcome{
+			deviceInputRegister:  {State: int(DeviceRegistered), Action: fsm.NO_ACTION},
+			deviceInputKeepalive: {State: int(DeviceOnline), Action: d.act(DeviceOnline)},
+			deviceInputTimeout:   {State: int(DeviceOffline), Action: d.act(DeviceOffline)},
+			deviceInputTxFailure: {State: int(DeviceOffline), Action: d.act(DeviceOffline)},
+			deviceInputExpire:    {State: int(DeviceExpired), Action: d.act(DeviceExpired)},
+		},
+	}
+	online := fsm.State{
+		Index: int(DeviceOnline),
+		Outcomes: map[fsm.Input]fsm.Outcome{
+			deviceInputRegister:  {State: int(DeviceOnline), Action: fsm.NO_ACTION},
+			deviceInputKeepalive: {State: int(DeviceOnline), Action: fsm.NO_ACTION},
+			deviceInputTimeout:   {State: int(DeviceOffline), Action: d.act(DeviceOffline)},
+			deviceInputTxFailure: {State: int(DeviceOffline), Action: d.act(DeviceOffline)},
+			deviceInputExpire:    {State: int(DeviceExpired), Action: d.act(DeviceExpired)},
+		},
+	}
+	offline := fsm.State{
+		Index: int(DeviceOffline),
+		Outcomes: map[fsm.Input]fsm.Outcome{
+			deviceInputRegister:  {State: int(DeviceRegistered), Action: d.act(DeviceRegistered)},
+			deviceInputKeepalive: {State: int(DeviceOnline), Action: d.act(DeviceOnline)},
+			deviceInputTimeout:   {State: int(DeviceOffline), Action: fsm.NO_ACTION},
+			deviceInputTxFailure: {State: int(DeviceOffline), Action: fsm.NO_ACTION},
+			deviceInputExpire:    {State: int(DeviceExpired), Action: d.act(DeviceExpired)},
+		},
+	}
+	expired := fsm.State{
+		Index: int(DeviceExpired),
+		Outcomes: map[fsm.Input]fsm.Outcome{
+			deviceInputRegister:  {State: int(DeviceRegistered), Action: d.act(DeviceRegistered)},
+			deviceInputKeepalive: {State: int(DeviceExpired), Action: fsm.NO_ACTION},
+			deviceInputTimeout:   {State: int(DeviceExpired), Action: fsm.NO_ACTION},
+			deviceInputTxFailure: {State: int(DeviceExpired), Action: fsm.NO_ACTION},
+			deviceInputExpire:    {State: int(DeviceExpired), Action: fsm.NO_ACTION},
+		},
+	}
+
+	f, err := fsm.Define(registered, online, offline, expired)
+	if err != nil {
+		logger.Errorf("define device %s FSM failed: %s", d.DeviceID, err)
+		return
+	}
+	d.fsm = f
+}
+
+// act returns FSM action moving the device to the state.
+func (d *GatewayDevice) act(to DeviceState) fsm.Action {
+	return func() fsm.Input {
+		d.mu.Lock()
+		from := d.state
+		d.state = to
+		d.mu.Unlock()
+
+		event := DeviceEvent{Device: d, From: from, To: to, Time: time.Now()}
+		stateHandlersMu.RLock()
+		handlers := stateHandlers
+		stateHandlersMu.RUnlock()
+		for _, handler := range handlers {
+			handler(event)
+		}
+
+		return fsm.NO_INPUT
+	}
+}
+
+func (d *GatewayDevice) spin(input fsm.Input) {
+	d.fsmOnce.Do(d.initFSM)
+	if d.fsm == nil {
+		return
+	}
+	if err := d.fsm.Spin(input); err != nil {
+		logger.Warnf("device %s FSM spin failed: %s", d.DeviceID, err)
+	}
+}
+
+// State returns the current state of the device.
+func (d *GatewayDevice) State() DeviceState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.state
+}
+
+// Online reports whether the device is reachable: it is registered or sends keepalive.
+func (d *GatewayDevice) Online() bool {
+	switch d.State() {
+	case DeviceRegistered, DeviceOnline:
+		return true
+	default:
+		return false
+	}
+}
+
+// registered is called on REGISTER and session recovery of the device.
+func (d *GatewayDevice) registered() {
+	d.seen()
+	d.spin(deviceInputRegister)
+}
+
+// keepalive is called on Keepalive notification of the device.
+func (d *GatewayDevice) keepalive() {
+	d.seen()
+	if !RedisRouter.Touch(d) {
+		logger.Warnf("redis router touch %s failed", d.DeviceID)
+	}
+	d.spin(deviceInputKeepalive)
+}
+
+// expired is called when the device session is removed.
+func (d *GatewayDevice) expired() {
+	d.mu.Lock()
+	if d.watchdog != nil {
+		d.watchdog.Stop()
+	}
+	d.mu.Unlock()
+	d.spin(deviceInputExpire)
+}
+
+// lastSeen returns the last seen time of the device.
+func (d *GatewayDevice) lastSeen() time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.LastSeen
+}
+
+// seen updates the last seen time and restarts the keepalive watchdog.
+func (d *GatewayDevice) seen() {
+	timeout := SC.KeepaliveInterval * time.Duration(SC.KeepaliveTimeoutCount)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.LastSeen = time.Now()
+	if d.watchdog == nil {
+		d.watchdog = time.AfterFunc(timeout, func() {
+			d.spin(deviceInputTimeout)
+		})
+		return
+	}
+	d.watchdog.Reset(timeout)
+}
+
+// reportTxError moves the device offline when the request to it timed out or failed on the transport.
+func (d *GatewayDevice) reportTxError(err error) {
+	var txErr transaction.TxError
+	var tpErr transport.Error
+	if errors.As(err, &txErr) && (txErr.Timeout() || txErr.Transport()) || errors.As(err, &tpErr) {
+		d.spin(deviceInputTxFailure)
+	}
+}
@@ -0,0 +1,68 @@
+package gb28181
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/gb28181/manscdp"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// GB28181 event packages, NOTIFY bodies are MANSCDP xml documents
+var (
+	CatalogPackage = gosip.EventPackage{
+		Name:           "Catalog",
+		ContentType:    "Application/MANSCDP+xml",
+		DefaultExpires: 3600,
+	}
+	AlarmPackage = gosip.EventPackage{
+		Name:           "Alarm",
+		ContentType:    "Application/MANSCDP+xml",
+		DefaultExpires: 3600,
+	}
+	MobilePositionPackage = gosip.EventPackage{
+		Name:           "MobilePosition",
+		ContentType:    "Application/MANSCDP+xml",
+		DefaultExpires: 3600,
+	}
+)
+
+var subscriber *gosip.Subscriber
+
+// Subscribe 订阅设备事件, 通知消息按 MESSAGE 同样处理
+func (d *GatewayDevice) Subscribe(pkg gosip.EventPackage, expires uint32) (*gosip.ClientSubscription, error) {
+	if subscriber == nil {
+		return nil, fmt.Errorf("subscriber is not started")
+	}
+	recipient := GetRecipient(d.From)
+	contentType := sip.ContentType(pkg.ContentType)
+	exp := sip.Expires(expires)
+
+	headers := GetSipHeaders(d, sip.SUBSCRIBE, "")
+	headers = append(headers, &contentType, &exp)
+	query := manscdp.New(manscdp.RootQuery, manscdp.CmdType(pkg.Name))
+	if query == nil {
+		return nil, fmt.Errorf("unsupported event package %s", pkg.Name)
+	}
+	query.Head().SN = d.nextSN()
+	query.Head().DeviceID = d.DeviceID
+	body, err := manscdp.Encode(query, manscdp.GB2312)
+	if err != nil {
+		return nil, err
+	}
+	request := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.SUBSCRIBE, &recipient, "SIP/2.0",
+		headers, string(body), nil)
+	request.SetDestination(d.Addr)
+
+	ctx := context.WithValue(context.Background(), deviceKey{}, d)
+	return subscriber.Subscribe(context.Background(), request, pkg, func(sub *gosip.ClientSubscription, req sip.Request) {
+		if req.Body() == "" {
+			return
+		}
+		if _, err := dispatcher.DispatchBody(ctx, []byte(req.Body())); err != nil {
+			logger.Warnf("handle notify err: %s", err)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Middleware wraps request handler. It can pass the request on to the next handler,
+// stop the chain with a response or add values to the context.
+// Middlewares are applied to all methods, use ForMethods to scope them.
+type Middleware func(next RequestHandlerWithContext) RequestHandlerWithContext
+
+// ForMethods applies the middleware only to requests of the methods,
+// other requests are passed on to the next handler as is.
+func ForMethods(middleware Middleware, methods ...sip.RequestMethod) Middleware {
+	return func(next RequestHandlerWithContext) RequestHandlerWithContext {
+		wrapped := middleware(next)
+		return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			for _, method := range methods {
+				if req.Method() == method {
+					wrapped(ctx, req, tx)
+					return
+				}
+			}
+			next(ctx, req, tx)
+		}
+	}
+}
+
+type serverKey struct{}
+
+// respondInMiddleware sends final response on the request through the server handling it,
+// so the response gets the server headers, the transaction is used outside of the server.
+// ACK requests have no transaction and are left without response.
+func respondInMiddleware(
+	ctx context.Context,
+	req sip.Request,
+	tx sip.ServerTransaction,
+	res sip.Response,
+	logger log.Logger,
+) {
+	if tx == nil || req.IsAck() {
+		return
+	}
+
+	ensureToTag(res)
+	if srv, ok := ctx.Value(serverKey{}).(*server); ok {
+		if _, err := srv.Respond(res); err != nil {
+			logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+		}
+		return
+	}
+	if err := tx.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+// Recover recovers panics of the next handlers and responds 500 on the request.
+func Recover(logger log.Logger) Middleware {
+	return func(next RequestHandlerWithContext) RequestHandlerWithContext {
+		return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			defer func() {
+				if r := recover(); r != nil {
+					reqLogger := logger.WithFields(req.Fields())
+					reqLogger.Errorf("request handler panic: %v", r)
+
+					res := sip.NewResponseFromRequest("", req, 500, "Server Internal Error", "")
+					respondInMiddleware(ctx, req, tx, res, reqLogger)
+				}
+			}()
+
+			next(ctx, req, tx)
+		}
+	}
+}
+
+// LogRequests logs incoming requests with the time spent in the next handlers.
+func LogRequests(logger log.Logger) Middleware {
+	return func(next RequestHandlerWithContext) RequestHandlerWithContext {
+		return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			reqLogger := logger.WithFields(req.Fields())
+			reqLogger.Infof("handling %s request from %s", req.Method(), req.Source())
+
+			start := time.Now()
+			next(ctx, req, tx)
+
+			reqLogger.Infof("%s request handled in %s", req.Method(), time.Since(start))
+		}
+	}
+}
+
+type authorizationKey struct{}
+
+// AuthorizationFromContext returns credentials verified by Authenticate middleware.
+func AuthorizationFromContext(ctx context.Context) (*sip.Authorization, bool) {
+	auth, ok := ctx.Value(authorizationKey{}).(*sip.Authorization)
+	return auth, ok
+}
+
+// Authenticate rejects requests without valid digest credentials with 401/407 challenge,
+// verified credentials are passed on in the context, see AuthorizationFromContext.
+// ACK requests can't be challenged and are passed on as is.
+func Authenticate(challenger *sip.Challenger, lookup sip.PasswordLookup, logger log.Logger) Middleware {
+	return func(next RequestHandlerWithContext) RequestHandlerWithContext {
+		return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			if req.IsAck() {
+				next(ctx, req, tx)
+				return
+			}
+
+			auth, err := challenger.Verify(req, lookup)
+			if err != nil {
+				reqLogger := logger.WithFields(req.Fields())
+				reqLogger.Debugf("request not authenticated: %s", err)
+
+				respondInMiddleware(ctx, req, tx, challenger.Challenge(req, errors.Is(err, sip.ErrNonceStale)), reqLogger)
+				return
+			}
+
+			next(context.WithValue(ctx, authorizationKey{}, auth), req, tx)
+		}
+	}
+}
+
+// RateLimit limits requests rate of every source host with token bucket of the burst size
+// refilled with rate tokens per second, requests over the limit are answered with 503.
+func RateLimit(rate float64, burst int, logger log.Logger) Middleware {
+	limiter := newRateLimiter(rate, burst)
+
+	return func(next RequestHandlerWithContext) RequestHandlerWithContext {
+		return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			host, _, err := net.SplitHostPort(req.Source())
+			if err != nil {
+				host = req.Source()
+			}
+
+			if !limiter.allow(host, time.Now()) {
+				reqLogger := logger.WithFields(req.Fields())
+				reqLogger.Debugf("request rate limit of %s exceeded", host)
+
+				res := sip.NewResponseFromRequest("", req, 503, "Service Unavailable", "")
+				res.AppendHeader(&sip.GenericHeader{
+					HeaderName: "Retry-After",
+					Contents:   fmt.Sprint(limiter.retryAfter()),
+				})
+				respondInMiddleware(ctx, req, tx, res, reqLogger)
+				return
+			}
+
+			next(ctx, req, tx)
+		}
+	}
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+	sweep   time.Time
+
+	mu sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.collect(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// collect drops buckets refilled to the full burst, they are equal to new ones.
+func (l *rateLimiter) collect(now time.Time) {
+	if now.Before(l.sweep) {
+		return
+	}
+	l.sweep = now.Add(time.Minute)
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfter returns seconds to get the next token.
+func (l *rateLimiter) retryAfter() uint32 {
+	if l.rate <= 0 {
+		return 1
+	}
+	if secs := uint32(1 / l.rate); secs > 1 {
+		return secs
+	}
+	return 1
+}
@@ -1,6 +1,12 @@
 package gosip
 
-import "github.com/ghettovoice/gosip/sip"
+import (
+	"sync"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
 
 type RequestWithContextOption interface {
 	ApplyRequestWithContext(options *RequestWithContextOptions)
@@ -9,6 +15,12 @@ type RequestWithContextOption interface {
 type RequestWithContextOptions struct {
 	ResponseHandler func(res sip.Response, request sip.Request)
 	Authorizer      sip.Authorizer
+	// Timers overrides timer values of the client transaction
+	Timers *transaction.Timers
+	// early dialogs created on reliable provisional responses
+	earlyDialogs *sync.Map
+	// remaining resolved locations of the request next hop
+	locations []*transport.Location
 }
 
 type withResponseHandler struct {
@@ -34,3 +46,24 @@ func (o withAuthorizer) ApplyRequestWithContext(options *RequestWithContextOptio
 func WithAuthorizer(authorizer sip.Authorizer) RequestWithContextOption {
 	return withAuthorizer{authorizer}
 }
+
+type withTimers struct {
+	timers transaction.Timers
+}
+
+func (o withTimers) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.Timers = &o.timers
+}
+
+// WithTimers overrides transaction timers for the request, zero fields keep server values.
+func WithTimers(timers transaction.Timers) RequestWithContextOption {
+	return withTimers{timers}
+}
+
+type withLocations struct {
+	locations []*transport.Location
+}
+
+func (o withLocations) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.locations = o.locations
+}
@@ -0,0 +1,397 @@
+package gosip
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// Extension100rel is the option tag of reliable provisional responses - RFC 3262.
+// Add it to ServerConfig.Extensions to enable PRACK support.
+const Extension100rel = "100rel"
+
+func hasOptionTag(msg sip.Message, name, tag string) bool {
+	for _, hdr := range msg.GetHeaders(name) {
+		for _, opt := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(opt), tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isReliableProvisional checks that the response must be acknowledged with PRACK.
+func isReliableProvisional(res sip.Response) (uint32, bool) {
+	if !res.IsProvisional() || res.StatusCode() == 100 || !hasOptionTag(res, "Require", Extension100rel) {
+		return 0, false
+	}
+
+	hdrs := res.GetHeaders("RSeq")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	rseq, ok := hdrs[0].(*sip.RSeq)
+	if !ok {
+		return 0, false
+	}
+
+	return uint32(*rseq), true
+}
+
+// uasReliable holds reliable provisional responses state of the INVITE server transaction.
+type uasReliable struct {
+	callID string
+	cseq   uint32
+	toTag  string
+	rseq   uint32
+
+	res     sip.Response
+	timer   timing.Timer
+	timeout time.Duration
+	elapsed time.Duration
+}
+
+// prackManager sends provisional responses reliably on the UAS side - RFC 3262 3.
+type prackManager struct {
+	srv *server
+
+	mu  sync.Mutex
+	txs map[transaction.TxKey]*uasReliable
+}
+
+func newPrackManager(srv *server) *prackManager {
+	return &prackManager{
+		srv: srv,
+		txs: make(map[transaction.TxKey]*uasReliable),
+	}
+}
+
+// track starts tracking of the INVITE transaction that supports reliable provisional responses.
+func (pm *prackManager) track(req sip.Request, tx sip.ServerTransaction) {
+	if !req.IsInvite() || tx == nil {
+		return
+	}
+	if !hasOptionTag(req, "Supported", Extension100rel) && !hasOptionTag(req, "Require", Extension100rel) {
+		return
+	}
+	key, err := transaction.MakeServerTxKey(req)
+	if err != nil {
+		return
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		return
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return
+	}
+
+	pm.mu.Lock()
+	pm.txs[key] = &uasReliable{
+		callID: string(*callID),
+		cseq:   cseq.SeqNo,
+		rseq:   uint32(rand.Int31n(1 << 30)),
+	}
+	pm.mu.Unlock()
+
+	go func() {
+		<-tx.Done()
+		pm.untrack(key)
+	}()
+}
+
+func (pm *prackManager) untrack(key transaction.TxKey) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if state, ok := pm.txs[key]; ok {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(pm.txs, key)
+	}
+}
+
+// prepare makes the response reliable if the transaction supports it.
+// Final response gets the same To tag as sent reliable provisional responses, the transaction state is dropped.
+// It returns true when the response should be retransmitted until PRACK.
+func (pm *prackManager) prepare(res sip.Response) (transaction.TxKey, bool) {
+	key, err := transaction.MakeServerTxKey(res)
+	if err != nil {
+		return "", false
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	state, ok := pm.txs[key]
+	if !ok {
+		return "", false
+	}
+
+	if !res.IsProvisional() {
+		if to, ok := res.To(); ok && state.toTag != "" {
+			if to.Params == nil {
+				to.Params = sip.NewParams()
+			}
+			if !to.Params.Has("tag") {
+				to.Params.Add("tag", sip.String{Str: state.toTag})
+			}
+		}
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(pm.txs, key)
+
+		return "", false
+	}
+	if res.StatusCode() == 100 {
+		return "", false
+	}
+
+	ensureToTag(res)
+	if to, ok := res.To(); ok {
+		if tag, ok := to.Params.Get("tag"); ok && tag != nil {
+			state.toTag = tag.String()
+		}
+	}
+	if !hasOptionTag(res, "Require", Extension100rel) {
+		res.AppendHeader(&sip.RequireHeader{Options: []string{Extension100rel}})
+	}
+	state.rseq++
+	rseq := sip.RSeq(state.rseq)
+	res.RemoveHeader("RSeq")
+	res.AppendHeader(&rseq)
+
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	state.res = res
+
+	return key, true
+}
+
+// retransmit resends reliable provisional response with T1 doubling interval until PRACK arrives.
+// The INVITE is rejected with 5xx if PRACK doesn't arrive in 64*T1 - RFC 3262 3.
+// T1 is taken from the timer profile of the server transactions.
+func (pm *prackManager) retransmit(key transaction.TxKey, res sip.Response) {
+	if pm.srv.tp.IsReliable(res.Transport()) {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	state, ok := pm.txs[key]
+	if !ok || state.res != res {
+		return
+	}
+	state.timeout = pm.srv.txTimers(nil).T1
+	state.elapsed = 0
+	state.timer = timing.AfterFunc(state.timeout, func() {
+		pm.onTimer(key, res)
+	})
+}
+
+func (pm *prackManager) onTimer(key transaction.TxKey, res sip.Response) {
+	pm.mu.Lock()
+	state, ok := pm.txs[key]
+	if !ok || state.res != res {
+		pm.mu.Unlock()
+		return
+	}
+
+	state.elapsed += state.timeout
+	if state.elapsed >= 64*pm.srv.txTimers(nil).T1 {
+		state.res = nil
+		pm.mu.Unlock()
+
+		logger := pm.srv.Log().WithFields(res.Fields())
+		logger.Warn("PRACK on reliable provisional response was not received")
+
+		final := sip.CopyResponse(res)
+		final.SetStatusCode(500)
+		final.SetReason("Server Internal Error")
+		final.RemoveHeader("RSeq")
+		final.RemoveHeader("Require")
+		final.SetBody("", true)
+		if _, err := pm.srv.Respond(final); err != nil {
+			logger.Errorf("respond '500 Server Internal Error' failed: %s", err)
+		}
+
+		return
+	}
+
+	state.timeout *= 2
+	state.timer.Reset(state.timeout)
+	pm.mu.Unlock()
+
+	if err := pm.srv.Send(res); err != nil {
+		pm.srv.Log().Warnf("resend reliable provisional response failed: %s", err)
+	}
+}
+
+// acknowledge matches PRACK with sent reliable provisional response and stops its retransmission.
+func (pm *prackManager) acknowledge(req sip.Request) bool {
+	hdrs := req.GetHeaders("RAck")
+	if len(hdrs) == 0 {
+		return false
+	}
+	rack, ok := hdrs[0].(*sip.RAck)
+	if !ok {
+		return false
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		return false
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, state := range pm.txs {
+		if state.callID != string(*callID) || state.cseq != rack.CSeq || rack.MethodName != sip.INVITE {
+			continue
+		}
+		if state.res == nil || state.rseq != rack.RSeq {
+			return false
+		}
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+		}
+		state.res = nil
+
+		return true
+	}
+
+	return false
+}
+
+// handlePrack answers PRACK request, the server handler is called if registered.
+func (srv *server) handlePrack(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	req sip.Request,
+	tx sip.ServerTransaction,
+) {
+	logger := srv.Log().WithFields(req.Fields())
+
+	if !srv.prack.acknowledge(req) {
+		res := sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", "")
+		if _, err := srv.Respond(res); err != nil {
+			logger.Errorf("respond '481 Call/Transaction Does Not Exist' failed: %s", err)
+		}
+
+		return
+	}
+
+	srv.hmu.RLock()
+	_, ok := srv.requestHandlers[sip.PRACK]
+	srv.hmu.RUnlock()
+	if ok {
+		srv.routeRequest(ctx, cancel, req, tx)
+
+		return
+	}
+
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	if _, err := srv.Respond(res); err != nil {
+		logger.Errorf("respond '200 OK' on PRACK failed: %s", err)
+	}
+}
+
+// uacPrack sends PRACK on reliable provisional responses received by the client INVITE transaction - RFC 3262 4.
+type uacPrack struct {
+	srv    *server
+	invite sip.Request
+	// early dialogs by remote tag
+	dialogs map[string]*uacEarlyDialog
+	store   *sync.Map
+}
+
+type uacEarlyDialog struct {
+	sd   *sip.Dialog
+	rseq uint32
+}
+
+func newUacPrack(srv *server, invite sip.Request, store *sync.Map) *uacPrack {
+	return &uacPrack{
+		srv:     srv,
+		invite:  invite,
+		dialogs: make(map[string]*uacEarlyDialog),
+		store:   store,
+	}
+}
+
+func (up *uacPrack) handleResponse(ctx context.Context, res sip.Response) {
+	rseq, ok := isReliableProvisional(res)
+	if !ok {
+		return
+	}
+	to, ok := res.To()
+	if !ok || to.Params == nil {
+		return
+	}
+	tag, ok := to.Params.Get("tag")
+	if !ok || tag == nil {
+		return
+	}
+
+	logger := up.srv.Log().WithFields(res.Fields())
+
+	early, ok := up.dialogs[tag.String()]
+	if !ok {
+		sd, err := sip.NewDialogUAC(up.invite, res)
+		if err != nil {
+			logger.Warnf("create early dialog failed: %s", err)
+			return
+		}
+		early = &uacEarlyDialog{sd: sd}
+		up.dialogs[tag.String()] = early
+		if up.store != nil {
+			up.store.Store(sd.ID(), sd)
+		}
+	}
+	// retransmission or out of order response
+	if early.rseq != 0 && rseq != early.rseq+1 {
+		return
+	}
+	early.rseq = rseq
+
+	prack, err := early.sd.NewRequest(sip.PRACK, "")
+	if err != nil {
+		logger.Warnf("create PRACK failed: %s", err)
+		return
+	}
+	cseq, _ := res.CSeq()
+	prack.AppendHeader(&sip.RAck{
+		RSeq:       rseq,
+		CSeq:       cseq.SeqNo,
+		MethodName: cseq.MethodName,
+	})
+
+	go func() {
+		if _, err := up.srv.RequestWithContext(ctx, prack); err != nil {
+			logger.Warnf("send PRACK failed: %s", err)
+		}
+	}()
+}
+
+type withEarlyDialogs struct {
+	store *sync.Map
+}
+
+func (o withEarlyDialogs) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.earlyDialogs = o.store
+}
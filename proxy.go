@@ -0,0 +1,594 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// DefaultBranchTimeout is the proxy INVITE branch timeout, Timer C - RFC 3261 16.8.
+const DefaultBranchTimeout = 3 * time.Minute
+
+// Locator finds targets of the proxied request - RFC 3261 16.5.
+// Targets are tried in the returned order when forking sequentially.
+type Locator interface {
+	Locate(ctx context.Context, req sip.Request) ([]sip.Uri, error)
+}
+
+// LocatorFunc adapts function to the Locator interface.
+type LocatorFunc func(ctx context.Context, req sip.Request) ([]sip.Uri, error)
+
+func (f LocatorFunc) Locate(ctx context.Context, req sip.Request) ([]sip.Uri, error) {
+	return f(ctx, req)
+}
+
+type ForkMode int
+
+const (
+	// ForkParallel sends the request to all targets at once.
+	ForkParallel ForkMode = iota
+	// ForkSequential tries the next target after final non-2xx response of the previous one.
+	ForkSequential
+)
+
+// ProxyConfig describes the proxy, zero values are replaced with defaults.
+type ProxyConfig struct {
+	// Host and Port the proxy is reached at, they are sent in Via and Record-Route.
+	Host string
+	Port sip.Port
+	// Transport of the Via header, UDP by default.
+	Transport string
+	// RecordRoute keeps the proxy on the path of the dialog requests.
+	RecordRoute bool
+	Forking     ForkMode
+	// BranchTimeout cancels INVITE branch without final response.
+	BranchTimeout time.Duration
+	// Methods are proxied request methods, all common methods except REGISTER by default.
+	Methods []sip.RequestMethod
+}
+
+// Proxy is stateful proxy - RFC 3261 16.
+// CANCEL of the proxied INVITE is answered by the server and cancels all pending branches.
+type Proxy struct {
+	srv     Server
+	locator Locator
+	config  ProxyConfig
+
+	log log.Logger
+}
+
+// NewProxy creates proxy and registers it as request handler of the proxied methods.
+func NewProxy(srv Server, locator Locator, config ProxyConfig, logger log.Logger) (*Proxy, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("proxy: host is required")
+	}
+	if config.Transport == "" {
+		config.Transport = "UDP"
+	}
+	if config.Port == 0 {
+		config.Port = sip.DefaultPort(config.Transport)
+	}
+	if config.BranchTimeout <= 0 {
+		config.BranchTimeout = DefaultBranchTimeout
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []sip.RequestMethod{
+			sip.INVITE, sip.ACK, sip.BYE, sip.OPTIONS, sip.INFO, sip.MESSAGE, sip.UPDATE,
+			sip.PRACK, sip.REFER, sip.SUBSCRIBE, sip.NOTIFY, sip.PUBLISH,
+		}
+	}
+
+	p := &Proxy{
+		srv:     srv,
+		locator: locator,
+		config:  config,
+	}
+	p.log = logger.WithPrefix("gosip.Proxy")
+
+	for _, method := range config.Methods {
+		if err := srv.OnRequestWithContext(method, p.Handle); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Proxy) Log() log.Logger {
+	return p.log
+}
+
+// Handle proxies the request, it can be used as request handler of the server.
+func (p *Proxy) Handle(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	logger := p.Log().WithFields(req.Fields())
+
+	if req.IsAck() {
+		p.forwardAck(ctx, req)
+		return
+	}
+	if tx == nil {
+		logger.Warn("request without transaction can not be proxied")
+		return
+	}
+
+	// RFC 3261 16.3 step 3
+	if maxForwards, ok := getMaxForwards(req); ok && maxForwards == 0 {
+		p.respond(req, tx, 483, "Too Many Hops")
+		return
+	}
+
+	req = sip.CopyRequest(req)
+	targets, err := p.targets(ctx, req)
+	if err != nil {
+		logger.Warnf("locate request targets failed: %s", err)
+		p.respond(req, tx, 500, "Server Internal Error")
+		return
+	}
+	if len(targets) == 0 {
+		p.respond(req, tx, 480, "Temporarily Unavailable")
+		return
+	}
+
+	rc := &responseContext{
+		proxy:   p,
+		req:     req,
+		tx:      tx,
+		pending: targets,
+		events:  make(chan branchEvent),
+		log:     logger,
+	}
+	rc.run(ctx)
+}
+
+// targets strips the proxy Route and returns request targets - RFC 3261 16.4, 16.5.
+// Request with Route is forwarded to its Request-URI along the route.
+func (p *Proxy) targets(ctx context.Context, req sip.Request) ([]sip.Uri, error) {
+	p.stripRoute(req)
+	if len(req.GetHeaders("Route")) > 0 {
+		return []sip.Uri{req.Recipient()}, nil
+	}
+
+	return p.locator.Locate(ctx, req)
+}
+
+func (p *Proxy) isLocal(uri sip.Uri) bool {
+	if uri == nil || uri.Host() != p.config.Host {
+		return false
+	}
+	port := sip.DefaultPort(p.config.Transport)
+	if uri.Port() != nil {
+		port = *uri.Port()
+	}
+
+	return port == p.config.Port
+}
+
+func (p *Proxy) stripRoute(req sip.Request) {
+	hdrs := req.GetHeaders("Route")
+	if len(hdrs) == 0 {
+		return
+	}
+	route, ok := hdrs[0].(*sip.RouteHeader)
+	if !ok || len(route.Addresses) == 0 || !p.isLocal(route.Addresses[0]) {
+		return
+	}
+
+	rest := make([]sip.Header, 0, len(hdrs))
+	if len(route.Addresses) > 1 {
+		rest = append(rest, &sip.RouteHeader{Addresses: route.Addresses[1:]})
+	}
+	rest = append(rest, hdrs[1:]...)
+	req.ReplaceHeaders("Route", rest)
+}
+
+// newBranchRequest copies the request to the target - RFC 3261 16.6.
+func (p *Proxy) newBranchRequest(req sip.Request, target sip.Uri) sip.Request {
+	branch := sip.CopyRequest(req)
+	branch.SetRecipient(target.Clone())
+	branch.SetSource("")
+	branch.SetDestination("")
+	if transport, ok := target.UriParams().Get("transport"); ok && transport != nil && transport.String() != "" {
+		branch.SetTransport(transport.String())
+	} else {
+		branch.SetTransport(p.config.Transport)
+	}
+
+	maxForwards := sip.MaxForwards(70)
+	if value, ok := getMaxForwards(req); ok {
+		maxForwards = value - 1
+	}
+	branch.ReplaceHeaders(maxForwards.Name(), []sip.Header{&maxForwards})
+
+	if p.config.RecordRoute && !req.IsAck() && req.Method() != sip.CANCEL {
+		branch.PrependHeader(&sip.RecordRouteHeader{Addresses: []sip.Uri{p.uri()}})
+	}
+
+	port := p.config.Port
+	branch.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       p.config.Transport,
+		Host:            p.config.Host,
+		Port:            &port,
+		Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}})
+
+	return branch
+}
+
+func (p *Proxy) uri() sip.Uri {
+	port := p.config.Port
+
+	return &sip.SipUri{
+		FHost:      p.config.Host,
+		FPort:      &port,
+		FUriParams: sip.NewParams().Add("lr", nil),
+	}
+}
+
+// forwardAck forwards ACK on 2xx statelessly, ACK on non-2xx is absorbed by the server transaction.
+func (p *Proxy) forwardAck(ctx context.Context, req sip.Request) {
+	logger := p.Log().WithFields(req.Fields())
+
+	if maxForwards, ok := getMaxForwards(req); ok && maxForwards == 0 {
+		return
+	}
+
+	req = sip.CopyRequest(req)
+	targets, err := p.targets(ctx, req)
+	if err != nil || len(targets) == 0 {
+		logger.Debugf("ACK target not found: %v", err)
+		return
+	}
+
+	if err := p.srv.Send(p.newBranchRequest(req, targets[0])); err != nil {
+		logger.Warnf("forward ACK failed: %s", err)
+	}
+}
+
+func (p *Proxy) respond(req sip.Request, tx sip.ServerTransaction, status sip.StatusCode, reason string) {
+	res := sip.NewResponseFromRequest("", req, status, reason, "")
+	ensureToTag(res)
+	if err := tx.Respond(res); err != nil {
+		p.Log().WithFields(req.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+// forwardResponse sends the branch response upstream without the proxy Via - RFC 3261 16.7 step 9.
+func (p *Proxy) forwardResponse(req sip.Request, tx sip.ServerTransaction, res sip.Response) {
+	res = sip.CopyResponse(res)
+	popVia(res)
+	res.SetTransport(req.Transport())
+	res.SetSource(req.Destination())
+	res.SetDestination(req.Source())
+
+	if err := tx.Respond(res); err != nil {
+		p.Log().WithFields(res.Fields()).Errorf("forward response '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
+
+func getMaxForwards(msg sip.Message) (sip.MaxForwards, bool) {
+	hdrs := msg.GetHeaders("Max-Forwards")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	maxForwards, ok := hdrs[0].(*sip.MaxForwards)
+	if !ok {
+		return 0, false
+	}
+
+	return *maxForwards, true
+}
+
+// popVia removes the topmost Via hop.
+func popVia(msg sip.Message) {
+	hdrs := msg.GetHeaders("Via")
+	if len(hdrs) == 0 {
+		return
+	}
+
+	rest := make([]sip.Header, 0, len(hdrs))
+	if via, ok := hdrs[0].(sip.ViaHeader); ok && len(via) > 1 {
+		rest = append(rest, via[1:])
+	}
+	rest = append(rest, hdrs[1:]...)
+	msg.ReplaceHeaders("Via", rest)
+}
+
+type branchEvent struct {
+	branch *proxyBranch
+	res    sip.Response
+	err    error
+	done   bool
+}
+
+type proxyBranch struct {
+	tx    sip.ClientTransaction
+	final sip.Response
+	err   error
+	timer timing.Timer
+}
+
+// responseContext keeps branches of the proxied request - RFC 3261 16.7.
+type responseContext struct {
+	proxy   *Proxy
+	req     sip.Request
+	tx      sip.ServerTransaction
+	pending []sip.Uri
+	events  chan branchEvent
+
+	active    int
+	branches  []*proxyBranch
+	succeeded bool
+	// 6xx and 2xx stop starting new branches
+	stopped  bool
+	answered bool
+
+	log log.Logger
+}
+
+// run forwards the request and waits for termination of all branch transactions,
+// so 2xx retransmissions are forwarded too.
+func (rc *responseContext) run(ctx context.Context) {
+	rc.startBranches()
+	rc.complete()
+
+	canceled := ctx.Done()
+	for rc.active > 0 {
+		select {
+		case <-canceled:
+			// remaining events of the canceled branches are still drained
+			canceled = nil
+			rc.stopped = true
+			rc.cancelBranches()
+		case event := <-rc.events:
+			rc.handle(event)
+		}
+
+		rc.complete()
+	}
+}
+
+// complete starts the next target when all started branches are finished without 2xx,
+// the best response is sent when there are no targets left.
+func (rc *responseContext) complete() {
+	if rc.succeeded || rc.answered || rc.unfinished() > 0 {
+		return
+	}
+	if !rc.stopped && len(rc.pending) > 0 {
+		rc.startBranches()
+		if rc.unfinished() > 0 {
+			return
+		}
+	}
+
+	rc.sendBest()
+}
+
+// unfinished returns number of branches without final response.
+func (rc *responseContext) unfinished() int {
+	count := 0
+	for _, branch := range rc.branches {
+		if branch.tx != nil && branch.final == nil && branch.err == nil {
+			count++
+		}
+	}
+
+	return count
+}
+
+// startBranches starts all pending targets when forking in parallel or the next one when sequentially.
+func (rc *responseContext) startBranches() {
+	for len(rc.pending) > 0 {
+		target := rc.pending[0]
+		rc.pending = rc.pending[1:]
+
+		if rc.startBranch(target) && rc.proxy.config.Forking == ForkSequential {
+			return
+		}
+	}
+}
+
+func (rc *responseContext) startBranch(target sip.Uri) bool {
+	req := rc.proxy.newBranchRequest(rc.req, target)
+	branch := &proxyBranch{}
+	rc.branches = append(rc.branches, branch)
+
+	tx, err := rc.proxy.srv.Request(req)
+	if err != nil {
+		rc.log.Warnf("forward request to %s failed: %s", target, err)
+		branch.err = err
+		return false
+	}
+	branch.tx = tx
+	if req.IsInvite() {
+		branch.timer = timing.AfterFunc(rc.proxy.config.BranchTimeout, func() {
+			_ = tx.Cancel()
+		})
+	}
+
+	rc.active++
+	go rc.watchBranch(branch)
+
+	return true
+}
+
+func (rc *responseContext) watchBranch(branch *proxyBranch) {
+	responses := branch.tx.Responses()
+	errs := branch.tx.Errors()
+	for responses != nil || errs != nil {
+		select {
+		case res, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+			rc.events <- branchEvent{branch: branch, res: res}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			rc.events <- branchEvent{branch: branch, err: err}
+		}
+	}
+	rc.events <- branchEvent{branch: branch, done: true}
+}
+
+func (rc *responseContext) handle(event branchEvent) {
+	branch := event.branch
+	switch {
+	case event.done:
+		rc.active--
+		if branch.timer != nil {
+			branch.timer.Stop()
+		}
+		if branch.final == nil && branch.err == nil {
+			branch.err = fmt.Errorf("branch %s terminated without final response", branch.tx)
+		}
+	case event.err != nil:
+		if branch.final == nil && branch.err == nil {
+			branch.err = event.err
+		}
+	case event.res.IsProvisional():
+		// RFC 3261 16.7 step 5, 100 Trying is not forwarded
+		if event.res.StatusCode() > 100 && !rc.succeeded {
+			if branch.timer != nil {
+				branch.timer.Reset(rc.proxy.config.BranchTimeout)
+			}
+			rc.proxy.forwardResponse(rc.req, rc.tx, event.res)
+		}
+	case event.res.IsSuccess():
+		// every 2xx is forwarded, including the ones of the other forks
+		branch.final = event.res
+		rc.succeeded = true
+		rc.proxy.forwardResponse(rc.req, rc.tx, event.res)
+		if !rc.stopped {
+			rc.stopped = true
+			rc.cancelBranches()
+		}
+	default:
+		if branch.final == nil {
+			branch.final = event.res
+		}
+		if event.res.StatusCode() >= 600 && !rc.stopped {
+			rc.stopped = true
+			rc.cancelBranches()
+		}
+	}
+}
+
+// cancelBranches cancels branches without final response - RFC 3261 16.7 step 10.
+func (rc *responseContext) cancelBranches() {
+	rc.pending = nil
+	for _, branch := range rc.branches {
+		if branch.tx != nil && branch.final == nil {
+			if err := branch.tx.Cancel(); err != nil {
+				rc.log.Debugf("cancel branch %s failed: %s", branch.tx, err)
+			}
+		}
+	}
+}
+
+// sendBest sends the best final response of the branches - RFC 3261 16.7 step 6.
+func (rc *responseContext) sendBest() {
+	rc.answered = true
+
+	var best sip.Response
+	for _, branch := range rc.branches {
+		res := branch.final
+		if res == nil {
+			res = rc.errorResponse(branch.err)
+		}
+		if res != nil && betterResponse(best, res) {
+			best = res
+		}
+	}
+	if best == nil {
+		rc.proxy.respond(rc.req, rc.tx, 408, "Request Timeout")
+		return
+	}
+
+	best = sip.CopyResponse(best)
+	if best.StatusCode() == 503 {
+		// RFC 3261 16.7 step 6, 503 of the downstream is not passed upstream
+		best.SetStatusCode(500)
+		best.SetReason("Server Internal Error")
+	}
+	if best.StatusCode() == 401 || best.StatusCode() == 407 {
+		rc.collectChallenges(best)
+	}
+
+	rc.proxy.forwardResponse(rc.req, rc.tx, best)
+}
+
+// errorResponse converts branch error to the response - RFC 3261 16.7 step 2, 16.9.
+func (rc *responseContext) errorResponse(err error) sip.Response {
+	if err == nil {
+		return nil
+	}
+
+	res := sip.NewResponseFromRequest("", rc.req, 503, "Service Unavailable", "")
+	var txErr transaction.TxError
+	if errors.As(err, &txErr) && txErr.Timeout() {
+		res = sip.NewResponseFromRequest("", rc.req, 408, "Request Timeout", "")
+	}
+	ensureToTag(res)
+	// generated responses have no proxy Via to remove
+	port := rc.proxy.config.Port
+	res.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       rc.proxy.config.Transport,
+		Host:            rc.proxy.config.Host,
+		Port:            &port,
+		Params:          sip.NewParams(),
+	}})
+
+	return res
+}
+
+// collectChallenges adds challenges of all 401 and 407 responses to the best one - RFC 3261 16.7 step 7.
+func (rc *responseContext) collectChallenges(best sip.Response) {
+	names := []string{"WWW-Authenticate", "Proxy-Authenticate"}
+	for _, name := range names {
+		best.RemoveHeader(name)
+	}
+
+	for _, branch := range rc.branches {
+		res := branch.final
+		if res == nil || (res.StatusCode() != 401 && res.StatusCode() != 407) {
+			continue
+		}
+		for _, name := range names {
+			for _, header := range res.GetHeaders(name) {
+				best.AppendHeader(header.Clone())
+			}
+		}
+	}
+}
+
+// betterResponse checks that res is better than best - RFC 3261 16.7 step 6,
+// 6xx is preferred, otherwise the lowest response class.
+func betterResponse(best, res sip.Response) bool {
+	if best == nil {
+		return true
+	}
+
+	bestClass := best.StatusCode() / 100
+	resClass := res.StatusCode() / 100
+	switch {
+	case bestClass == 6:
+		return false
+	case resClass == 6:
+		return true
+	default:
+		return resClass < bestClass
+	}
+}
@@ -0,0 +1,429 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultRegisterRefreshRatio = 0.5
+	// retry delays of the failed registrations - RFC 5626 4.5
+	DefaultRegisterRetryBase = 30 * time.Second
+	DefaultRegisterRetryMax  = 1800 * time.Second
+	// MinRegisterRefreshDelay keeps short registrations from being refreshed in a busy loop
+	MinRegisterRefreshDelay = time.Second
+)
+
+type RegisterState string
+
+const (
+	RegisterStateRegistering  RegisterState = "registering"
+	RegisterStateRegistered   RegisterState = "registered"
+	RegisterStateFailed       RegisterState = "failed"
+	RegisterStateUnregistered RegisterState = "unregistered"
+)
+
+// RegisterEvent reports the registration state change.
+type RegisterEvent struct {
+	State RegisterState
+	// Proxy is the outbound proxy the last REGISTER was sent to, empty when sent to the registrar.
+	Proxy string
+	// Expires is the registration duration in seconds granted by the registrar.
+	Expires uint32
+	// Err is the reason of the failed state.
+	Err error
+}
+
+// RegisterClientConfig describes the registration, zero values are replaced with defaults.
+type RegisterClientConfig struct {
+	// Registrar is the Request-URI of REGISTER, i.e. sip:example.com.
+	Registrar sip.Uri
+	// AOR is the address-of-record put in From and To headers.
+	AOR sip.Uri
+	// Contact is the address bound to the AOR, Via is sent from its host and port.
+	Contact sip.ContactUri
+	// Transport of the REGISTER requests, UDP by default.
+	Transport string
+	// Proxies are outbound proxy addresses (host:port) tried in order on failure,
+	// REGISTER is sent to the registrar when empty.
+	Proxies []string
+	// User and Password are digest credentials, User defaults to the AOR user.
+	User     string
+	Password string
+	// Expires is the requested registration duration in seconds, 3600 by default.
+	Expires uint32
+	// RefreshRatio is the fraction of the granted expires after which the registration is refreshed.
+	RefreshRatio float64
+	// RetryBase and RetryMax limit exponential backoff of the failed registrations.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+}
+
+// RegisterClient keeps the contact registered on the registrar - RFC 3261 10.2.
+type RegisterClient struct {
+	srv        Server
+	config     RegisterClientConfig
+	authorizer sip.Authorizer
+
+	callID  sip.CallID
+	fromTag string
+	cseq    uint32
+	proxy   int
+	expires uint32
+
+	mu      sync.Mutex
+	started bool
+	states  chan RegisterEvent
+	// ctx is canceled on Stop to abort pending REGISTER
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	stopErr  error
+	done     chan struct{}
+	// last is the last reported event, it is used by run and then by Stop
+	last RegisterEvent
+
+	log log.Logger
+}
+
+// NewRegisterClient creates register client, call Start to register.
+func NewRegisterClient(srv Server, config RegisterClientConfig, logger log.Logger) (*RegisterClient, error) {
+	if config.Registrar == nil || config.AOR == nil || config.Contact == nil {
+		return nil, fmt.Errorf("register client: registrar, AOR and contact are required")
+	}
+	if config.Transport == "" {
+		config.Transport = "UDP"
+	}
+	if config.Expires == 0 {
+		config.Expires = DefaultRegisterExpires
+	}
+	if config.RefreshRatio <= 0 || config.RefreshRatio >= 1 {
+		config.RefreshRatio = DefaultRegisterRefreshRatio
+	}
+	if config.RetryBase <= 0 {
+		config.RetryBase = DefaultRegisterRetryBase
+	}
+	if config.RetryMax < config.RetryBase {
+		config.RetryMax = DefaultRegisterRetryMax
+		if config.RetryMax < config.RetryBase {
+			config.RetryMax = config.RetryBase
+		}
+	}
+
+	c := &RegisterClient{
+		srv:     srv,
+		config:  config,
+		callID:  sip.CallID(util.RandString(32)),
+		fromTag: util.RandString(10),
+		expires: config.Expires,
+		states:  make(chan RegisterEvent, 16),
+		done:    make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if config.User != "" || config.Password != "" {
+		user := config.User
+		if user == "" && config.AOR.User() != nil {
+			user = config.AOR.User().String()
+		}
+		c.authorizer = &sip.DefaultAuthorizer{
+			User:     sip.String{Str: user},
+			Password: sip.String{Str: config.Password},
+		}
+	}
+	c.log = logger.WithPrefix("gosip.RegisterClient").WithFields(log.Fields{
+		"aor": config.AOR.String(),
+	})
+
+	return c, nil
+}
+
+func (c *RegisterClient) Log() log.Logger {
+	return c.log
+}
+
+// States returns channel of the registration state changes, it is closed after Stop.
+// Events are dropped when the channel buffer is full.
+// Refreshes are reported only when the granted expires or the proxy changes.
+func (c *RegisterClient) States() <-chan RegisterEvent {
+	return c.states
+}
+
+// Done is closed when the client is stopped.
+func (c *RegisterClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Start sends the first REGISTER and keeps the registration refreshed until Stop.
+func (c *RegisterClient) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started {
+		return
+	}
+	c.started = true
+	go c.run()
+}
+
+// Stop stops refreshing and removes the registration with zero expires REGISTER.
+func (c *RegisterClient) Stop(ctx context.Context) error {
+	c.stopOnce.Do(func() {
+		c.cancel()
+
+		c.mu.Lock()
+		started := c.started
+		c.started = true
+		c.mu.Unlock()
+		if !started {
+			close(c.done)
+		}
+		<-c.done
+
+		_, err := c.send(ctx, 0)
+		c.report(RegisterEvent{State: RegisterStateUnregistered, Proxy: c.currentProxy(), Err: err})
+		close(c.states)
+
+		if err != nil {
+			c.stopErr = fmt.Errorf("unregister: %w", err)
+		}
+	})
+
+	return c.stopErr
+}
+
+func (c *RegisterClient) report(event RegisterEvent) {
+	if event.State == c.last.State && event.Proxy == c.last.Proxy && event.Expires == c.last.Expires {
+		return
+	}
+	c.last = event
+
+	select {
+	case c.states <- event:
+	default:
+		c.Log().Warnf("registration state '%s' dropped, states channel is full", event.State)
+	}
+}
+
+func (c *RegisterClient) currentProxy() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.config.Proxies) == 0 {
+		return ""
+	}
+
+	return c.config.Proxies[c.proxy]
+}
+
+func (c *RegisterClient) run() {
+	defer close(c.done)
+
+	failures := 0
+	for {
+		// refresh of the registration is not a state change
+		if c.last.State != RegisterStateRegistered {
+			c.report(RegisterEvent{State: RegisterStateRegistering, Proxy: c.currentProxy()})
+		}
+
+		expires, err := c.register()
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		var delay time.Duration
+		if err == nil {
+			failures = 0
+			delay = time.Duration(float64(expires) * c.config.RefreshRatio * float64(time.Second))
+			if delay < MinRegisterRefreshDelay {
+				delay = MinRegisterRefreshDelay
+			}
+			c.Log().Debugf("registered for %d seconds", expires)
+			c.report(RegisterEvent{State: RegisterStateRegistered, Proxy: c.currentProxy(), Expires: expires})
+		} else {
+			delay = retryDelay(c.config.RetryBase, c.config.RetryMax, failures)
+			failures++
+			c.Log().Warnf("registration failed, retrying in %s: %s", delay, err)
+			c.report(RegisterEvent{State: RegisterStateFailed, Proxy: c.currentProxy(), Err: err})
+		}
+
+		timer := timing.NewTimer(delay)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// retryDelay returns exponential backoff delay with jitter between 50% and 100% of it - RFC 5626 4.5.
+func retryDelay(base, max time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// register sends REGISTER to the current proxy and fails over to the next ones,
+// every attempt is limited by Timer F. REGISTER rejected with 423 is resent with the registrar Min-Expires.
+func (c *RegisterClient) register() (uint32, error) {
+	attempts := len(c.config.Proxies)
+	if attempts == 0 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		c.mu.Lock()
+		expires := c.expires
+		c.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(c.ctx, serverTimers(c.srv).TimerF)
+		var res sip.Response
+		res, err = c.send(ctx, expires)
+		cancel()
+		if c.ctx.Err() != nil {
+			return 0, err
+		}
+		if err == nil {
+			if granted := c.grantedExpires(res, expires); granted > 0 {
+				return granted, nil
+			}
+			return 0, fmt.Errorf("registrar granted zero expires")
+		}
+
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && reqErr.Code == 423 && reqErr.Response != nil {
+			if hdrs := reqErr.Response.GetHeaders("Min-Expires"); len(hdrs) > 0 {
+				if value, perr := strconv.ParseUint(hdrs[0].Value(), 10, 32); perr == nil && uint32(value) > expires {
+					c.mu.Lock()
+					c.expires = uint32(value)
+					c.mu.Unlock()
+					i--
+					continue
+				}
+			}
+		}
+
+		if !isRegisterFailoverError(err) || len(c.config.Proxies) == 0 {
+			return 0, err
+		}
+
+		c.mu.Lock()
+		c.proxy = (c.proxy + 1) % len(c.config.Proxies)
+		c.mu.Unlock()
+		c.Log().Debugf("REGISTER failed, trying next proxy %s: %s", c.currentProxy(), err)
+	}
+
+	return 0, err
+}
+
+// isRegisterFailoverError checks that REGISTER should be sent to the next outbound proxy.
+func isRegisterFailoverError(err error) bool {
+	if isFailoverError(err) {
+		return true
+	}
+
+	var reqErr *sip.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Code == 408 || reqErr.Code >= 500
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// grantedExpires returns expires of our contact in the 2xx response - RFC 3261 10.2.4.
+func (c *RegisterClient) grantedExpires(res sip.Response, requested uint32) uint32 {
+	for _, header := range res.GetHeaders("Contact") {
+		contact, ok := header.(*sip.ContactHeader)
+		if !ok || contact.Address == nil || !contact.Address.Equals(c.config.Contact) || contact.Params == nil {
+			continue
+		}
+		if value, ok := contact.Params.Get("expires"); ok && value != nil {
+			if expires, err := strconv.ParseUint(value.String(), 10, 32); err == nil {
+				return uint32(expires)
+			}
+		}
+	}
+	if expires, ok := getExpires(res); ok {
+		return expires
+	}
+
+	return requested
+}
+
+func (c *RegisterClient) send(ctx context.Context, expires uint32) (sip.Response, error) {
+	req := c.newRequest(expires)
+
+	var options []RequestWithContextOption
+	if c.authorizer != nil {
+		options = append(options, WithAuthorizer(c.authorizer))
+	}
+	res, err := c.srv.RequestWithContext(ctx, req, options...)
+
+	// the authorizer increases CSeq of the re-sent request
+	if cseq, ok := req.CSeq(); ok {
+		c.mu.Lock()
+		if cseq.SeqNo > c.cseq {
+			c.cseq = cseq.SeqNo
+		}
+		c.mu.Unlock()
+	}
+
+	return res, err
+}
+
+func (c *RegisterClient) newRequest(expires uint32) sip.Request {
+	c.mu.Lock()
+	c.cseq++
+	cseq := c.cseq
+	c.mu.Unlock()
+
+	callID := c.callID
+	maxForwards := sip.MaxForwards(70)
+	expiresHdr := sip.Expires(expires)
+	via := sip.ViaHeader{&sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       c.config.Transport,
+		Host:            c.config.Contact.Host(),
+		Port:            c.config.Contact.Port(),
+		Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}}
+	headers := []sip.Header{
+		via,
+		&maxForwards,
+		&sip.FromHeader{
+			Address: c.config.AOR.Clone(),
+			Params:  sip.NewParams().Add("tag", sip.String{Str: c.fromTag}),
+		},
+		&sip.ToHeader{Address: c.config.AOR.Clone()},
+		&callID,
+		&sip.CSeq{SeqNo: cseq, MethodName: sip.REGISTER},
+		&sip.ContactHeader{Address: c.config.Contact.Clone()},
+		&expiresHdr,
+	}
+
+	req := sip.NewRequest(sip.MessageID(util.RandString(10)), sip.REGISTER, c.config.Registrar.Clone(), "SIP/2.0", headers, "", nil)
+	req.SetTransport(c.config.Transport)
+	if proxy := c.currentProxy(); proxy != "" {
+		req.SetDestination(proxy)
+	}
+
+	return req
+}
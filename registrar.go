@@ -0,0 +1,445 @@
+package gosip
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	DefaultRegisterExpires uint32 = 3600
+	DefaultMinExpires      uint32 = 60
+)
+
+// Binding is the contact address bound to the address-of-record - RFC 3261 10.
+type Binding struct {
+	// AOR is the canonical address-of-record, i.e. sip:alice@example.com.
+	AOR     string
+	Contact sip.ContactUri
+	// Q is the contact preference from 0 to 1, 1 when REGISTER has no q parameter.
+	Q float32
+	// CallID and CSeq of the last REGISTER that updated the binding.
+	CallID string
+	CSeq   uint32
+	// Source is the address REGISTER was received from.
+	Source     string
+	Registered time.Time
+	Expires    time.Time
+}
+
+// Key identifies the binding within the address-of-record.
+func (b *Binding) Key() string {
+	return b.Contact.String()
+}
+
+// ExpiresIn returns seconds until the binding expiration.
+func (b *Binding) ExpiresIn(now time.Time) uint32 {
+	if !now.Before(b.Expires) {
+		return 0
+	}
+
+	return uint32((b.Expires.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// BindingStore stores bindings of the Registrar.
+// Expired bindings must not be returned.
+type BindingStore interface {
+	Bindings(aor string) ([]*Binding, error)
+	Put(binding *Binding) error
+	Remove(aor, key string) error
+}
+
+// MemoryBindingStore keeps bindings in the process memory.
+type MemoryBindingStore struct {
+	mu       sync.Mutex
+	bindings map[string]map[string]*Binding
+}
+
+func NewMemoryBindingStore() *MemoryBindingStore {
+	return &MemoryBindingStore{
+		bindings: make(map[string]map[string]*Binding),
+	}
+}
+
+func (store *MemoryBindingStore) Bindings(aor string) ([]*Binding, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	bindings := make([]*Binding, 0, len(store.bindings[aor]))
+	for key, binding := range store.bindings[aor] {
+		if !now.Before(binding.Expires) {
+			delete(store.bindings[aor], key)
+			continue
+		}
+		b := *binding
+		bindings = append(bindings, &b)
+	}
+	if len(store.bindings[aor]) == 0 {
+		delete(store.bindings, aor)
+	}
+
+	return bindings, nil
+}
+
+func (store *MemoryBindingStore) Put(binding *Binding) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.bindings[binding.AOR]; !ok {
+		store.bindings[binding.AOR] = make(map[string]*Binding)
+	}
+	b := *binding
+	store.bindings[binding.AOR][binding.Key()] = &b
+
+	return nil
+}
+
+func (store *MemoryBindingStore) Remove(aor, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.bindings[aor], key)
+	if len(store.bindings[aor]) == 0 {
+		delete(store.bindings, aor)
+	}
+
+	return nil
+}
+
+// RegistrarConfig holds expiration limits of the registrations, zero values are replaced with defaults.
+type RegistrarConfig struct {
+	// DefaultExpires is used when REGISTER has neither expires parameter nor Expires header.
+	DefaultExpires uint32
+	// MinExpires is the shortest accepted registration, shorter ones are rejected with 423.
+	MinExpires uint32
+	// MaxExpires caps longer registrations, 0 means no limit.
+	MaxExpires uint32
+}
+
+// RegisterHandler is called after successful REGISTER with all current bindings of the address-of-record.
+type RegisterHandler func(req sip.Request, aor string, bindings []*Binding)
+
+// Registrar handles REGISTER requests and serves as location service - RFC 3261 10.3.
+// Requests are not authenticated by the Registrar, use Authenticate middleware for this.
+type Registrar struct {
+	srv     Server
+	store   BindingStore
+	config  RegistrarConfig
+	handler RegisterHandler
+
+	// serializes read-modify-write of the bindings
+	mu sync.Mutex
+
+	log log.Logger
+}
+
+// NewRegistrar creates registrar and registers it as REGISTER request handler of the server.
+func NewRegistrar(srv Server, store BindingStore, config RegistrarConfig, logger log.Logger) (*Registrar, error) {
+	if config.DefaultExpires == 0 {
+		config.DefaultExpires = DefaultRegisterExpires
+	}
+	if config.MinExpires == 0 {
+		config.MinExpires = DefaultMinExpires
+	}
+
+	r := &Registrar{
+		srv:    srv,
+		store:  store,
+		config: config,
+	}
+	r.log = logger.WithPrefix("gosip.Registrar")
+
+	if err := srv.OnRequest(sip.REGISTER, r.handleRegister); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Registrar) Log() log.Logger {
+	return r.log
+}
+
+// OnRegister sets handler called after every successful REGISTER.
+func (r *Registrar) OnRegister(handler RegisterHandler) {
+	r.mu.Lock()
+	r.handler = handler
+	r.mu.Unlock()
+}
+
+// Lookup returns current bindings of the address-of-record ordered by q-value.
+func (r *Registrar) Lookup(aor sip.Uri) ([]*Binding, error) {
+	bindings, err := r.store.Bindings(CanonicalAOR(aor))
+	if err != nil {
+		return nil, err
+	}
+	sortBindings(bindings)
+
+	return bindings, nil
+}
+
+// Locate returns contacts bound to the request URI, it makes the Registrar Locator of the Proxy.
+func (r *Registrar) Locate(ctx context.Context, req sip.Request) ([]sip.Uri, error) {
+	bindings, err := r.Lookup(req.Recipient())
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]sip.Uri, 0, len(bindings))
+	for _, binding := range bindings {
+		targets = append(targets, binding.Contact.Clone())
+	}
+
+	return targets, nil
+}
+
+// CanonicalAOR converts URI to the address-of-record form - RFC 3261 10.3 step 5,
+// URI parameters and port are dropped.
+func CanonicalAOR(uri sip.Uri) string {
+	var buffer strings.Builder
+	if uri.IsEncrypted() {
+		buffer.WriteString("sips:")
+	} else {
+		buffer.WriteString("sip:")
+	}
+	if user := uri.User(); user != nil && user.String() != "" {
+		buffer.WriteString(user.String())
+		buffer.WriteString("@")
+	}
+	buffer.WriteString(strings.ToLower(uri.Host()))
+
+	return buffer.String()
+}
+
+func sortBindings(bindings []*Binding) {
+	sort.SliceStable(bindings, func(i, j int) bool {
+		if bindings[i].Q != bindings[j].Q {
+			return bindings[i].Q > bindings[j].Q
+		}
+		return bindings[i].Registered.After(bindings[j].Registered)
+	})
+}
+
+func (r *Registrar) respond(req sip.Request, status sip.StatusCode, reason string, headers ...sip.Header) {
+	res := sip.NewResponseFromRequest("", req, status, reason, "")
+	for _, header := range headers {
+		res.AppendHeader(header)
+	}
+	ensureToTag(res)
+	if _, err := r.srv.Respond(res); err != nil {
+		r.Log().WithFields(req.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+// registerError is the REGISTER rejection with the response status.
+type registerError struct {
+	status  sip.StatusCode
+	reason  string
+	headers []sip.Header
+}
+
+func (err *registerError) Error() string {
+	return fmt.Sprintf("%d %s", err.status, err.reason)
+}
+
+type contactUpdate struct {
+	contact sip.ContactUri
+	q       float32
+	expires uint32
+}
+
+func (r *Registrar) handleRegister(req sip.Request, tx sip.ServerTransaction) {
+	to, ok := req.To()
+	if !ok || to.Address == nil {
+		r.respond(req, 400, "Missing To Header")
+		return
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		r.respond(req, 400, "Missing Call-ID Header")
+		return
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		r.respond(req, 400, "Missing CSeq Header")
+		return
+	}
+	aor := CanonicalAOR(to.Address)
+
+	r.mu.Lock()
+	bindings, err := r.register(req, aor, string(*callID), cseq.SeqNo)
+	handler := r.handler
+	r.mu.Unlock()
+
+	if err != nil {
+		if rerr, ok := err.(*registerError); ok {
+			r.Log().WithFields(req.Fields()).Debugf("REGISTER of %s rejected: %s", aor, rerr)
+			r.respond(req, rerr.status, rerr.reason, rerr.headers...)
+			return
+		}
+
+		r.Log().WithFields(req.Fields()).Errorf("update bindings of %s failed: %s", aor, err)
+		r.respond(req, 500, "Server Internal Error")
+		return
+	}
+
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	now := time.Now()
+	for _, binding := range bindings {
+		params := sip.NewParams().
+			Add("expires", sip.String{Str: strconv.FormatUint(uint64(binding.ExpiresIn(now)), 10)}).
+			Add("q", sip.String{Str: strconv.FormatFloat(float64(binding.Q), 'f', -1, 32)})
+		res.AppendHeader(&sip.ContactHeader{
+			Address: binding.Contact.Clone(),
+			Params:  params,
+		})
+	}
+	ensureToTag(res)
+	if _, err := r.srv.Respond(res); err != nil {
+		r.Log().WithFields(req.Fields()).Errorf("respond '200 OK' on REGISTER failed: %s", err)
+		return
+	}
+
+	if handler != nil {
+		handler(req, aor, bindings)
+	}
+}
+
+// register applies REGISTER to the bindings of the address-of-record - RFC 3261 10.3 steps 6-8,
+// the request is either applied entirely or rejected with registerError.
+func (r *Registrar) register(req sip.Request, aor, callID string, cseq uint32) ([]*Binding, error) {
+	current, err := r.store.Bindings(aor)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*Binding, len(current))
+	for _, binding := range current {
+		existing[binding.Key()] = binding
+	}
+
+	headerExpires, hasExpires := getExpires(req)
+	contacts := req.GetHeaders("Contact")
+
+	// checks Call-ID and CSeq of the binding update - RFC 3261 10.3 step 7
+	checkOrder := func(binding *Binding) error {
+		if binding.CallID == callID && cseq <= binding.CSeq {
+			return &registerError{status: 500, reason: "Server Internal Error"}
+		}
+		return nil
+	}
+
+	updates := make([]contactUpdate, 0, len(contacts))
+	for _, header := range contacts {
+		contact, ok := header.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			return nil, &registerError{status: 400, reason: "Invalid Contact Header"}
+		}
+
+		if contact.Address.IsWildcard() {
+			if len(contacts) != 1 || !hasExpires || headerExpires != 0 {
+				return nil, &registerError{status: 400, reason: "Invalid Wildcard Contact"}
+			}
+			for _, binding := range current {
+				if err := checkOrder(binding); err != nil {
+					return nil, err
+				}
+			}
+			for _, binding := range current {
+				if err := r.store.Remove(aor, binding.Key()); err != nil {
+					return nil, err
+				}
+			}
+
+			return []*Binding{}, nil
+		}
+
+		update := contactUpdate{
+			contact: contact.Address,
+			q:       1,
+			expires: r.config.DefaultExpires,
+		}
+		if hasExpires {
+			update.expires = headerExpires
+		}
+		if contact.Params != nil {
+			if value, ok := contact.Params.Get("expires"); ok && value != nil {
+				expires, err := strconv.ParseUint(value.String(), 10, 32)
+				if err != nil {
+					return nil, &registerError{status: 400, reason: "Invalid Contact Expires"}
+				}
+				update.expires = uint32(expires)
+			}
+			if value, ok := contact.Params.Get("q"); ok && value != nil {
+				q, err := strconv.ParseFloat(value.String(), 32)
+				if err != nil || q < 0 || q > 1 {
+					return nil, &registerError{status: 400, reason: "Invalid Contact Q-Value"}
+				}
+				update.q = float32(q)
+			}
+		}
+
+		if update.expires > 0 && update.expires < r.config.MinExpires {
+			minExpires := &sip.GenericHeader{
+				HeaderName: "Min-Expires",
+				Contents:   strconv.FormatUint(uint64(r.config.MinExpires), 10),
+			}
+			return nil, &registerError{status: 423, reason: "Interval Too Brief", headers: []sip.Header{minExpires}}
+		}
+		if r.config.MaxExpires > 0 && update.expires > r.config.MaxExpires {
+			update.expires = r.config.MaxExpires
+		}
+
+		if binding, ok := existing[update.contact.String()]; ok {
+			if err := checkOrder(binding); err != nil {
+				return nil, err
+			}
+		}
+
+		updates = append(updates, update)
+	}
+
+	now := time.Now()
+	for _, update := range updates {
+		key := update.contact.String()
+		if update.expires == 0 {
+			if _, ok := existing[key]; ok {
+				if err := r.store.Remove(aor, key); err != nil {
+					return nil, err
+				}
+				delete(existing, key)
+			}
+			continue
+		}
+
+		binding := &Binding{
+			AOR:        aor,
+			Contact:    update.contact.Clone(),
+			Q:          update.q,
+			CallID:     callID,
+			CSeq:       cseq,
+			Source:     req.Source(),
+			Registered: now,
+			Expires:    now.Add(time.Duration(update.expires) * time.Second),
+		}
+		if err := r.store.Put(binding); err != nil {
+			return nil, err
+		}
+		existing[key] = binding
+	}
+
+	bindings := make([]*Binding, 0, len(existing))
+	for _, binding := range existing {
+		bindings = append(bindings, binding)
+	}
+	sortBindings(bindings)
+
+	return bindings, nil
+}
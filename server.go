@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 
 	"github.com/ghettovoice/gosip/log"
@@ -22,6 +23,19 @@ import (
 // tx argument can be nil for 2xx ACK request
 type RequestHandler func(req sip.Request, tx sip.ServerTransaction)
 
+// RequestHandlerWithContext is a callback that will be called on the incoming request
+// of the certain method with the context of the request processing.
+// The context is canceled on CANCEL, transaction termination or server shutdown,
+// INVITE canceled without final response is answered with 487 automatically.
+// Server reads tx.Cancels() itself, so the handler should watch the context instead.
+type RequestHandlerWithContext func(ctx context.Context, req sip.Request, tx sip.ServerTransaction)
+
+type requestHandler struct {
+	handler RequestHandlerWithContext
+	// watch cancels the handler context when the caller gives up
+	watch bool
+}
+
 type Server interface {
 	Shutdown()
 
@@ -35,6 +49,19 @@ type Server interface {
 		options ...RequestWithContextOption,
 	) (sip.Response, error)
 	OnRequest(method sip.RequestMethod, handler RequestHandler) error
+	OnRequestWithContext(method sip.RequestMethod, handler RequestHandlerWithContext) error
+	// Use appends middlewares to the chain wrapping dispatching of every incoming request,
+	// including in-dialog requests and PRACK, the first one is the outermost.
+	Use(middleware ...Middleware)
+
+	// Invite sends INVITE request and creates UAC dialog on 2xx response.
+	Invite(
+		ctx context.Context,
+		request sip.Request,
+		options ...RequestWithContextOption,
+	) (Dialog, error)
+	// GetDialog returns active dialog by ID, see sip.Dialog.ID.
+	GetDialog(id string) (Dialog, bool)
 
 	Respond(res sip.Response) (sip.ServerTransaction, error)
 	RespondOnRequest(
@@ -58,11 +85,24 @@ type TransactionLayerFactory func(tpl sip.Transport, logger log.Logger) transact
 type ServerConfig struct {
 	// Public IP address or domain name, if empty auto resolved IP will be used.
 	Host string
-	// Dns is an address of the public DNS server to use in SRV lookup.
+	// Dns is an address of the public DNS server to use in RFC 3263 server location.
 	Dns        string
 	Extensions []string
 	MsgMapper  sip.MessageMapper
 	UserAgent  string
+	// DNSResolver replaces DNS lookups of RFC 3263 server location, i.e. with in-memory records.
+	DNSResolver transport.DNSResolver
+	// SessionExpires is the session interval in seconds requested in INVITE when ExtensionTimer is enabled,
+	// DefaultSessionExpires is used if empty.
+	SessionExpires uint32
+	// MinSE is the minimal session interval in seconds accepted from the remote side,
+	// it can't be less than MinSessionExpires.
+	MinSE uint32
+	// Timers is the timer profile of transactions created by the default transaction layer,
+	// zero fields keep RFC 3261 values.
+	Timers transaction.Timers
+	// DisableLoopDetection turns off 482 answers of the default transaction layer on merged and looped requests.
+	DisableLoopDetection bool
 }
 
 // Server is a SIP server
@@ -70,11 +110,16 @@ type server struct {
 	running         abool.AtomicBool
 	tp              transport.Layer
 	tx              transaction.Layer
+	resolver        transport.Resolver
 	host            string
 	ip              net.IP
 	hwg             *sync.WaitGroup
 	hmu             *sync.RWMutex
-	requestHandlers map[sip.RequestMethod]RequestHandler
+	requestHandlers map[sip.RequestMethod]requestHandler
+	middlewares     []Middleware
+	dialogs         *dialogStore
+	prack           *prackManager
+	timers          *sessionTimers
 	extensions      []string
 	userAgent       string
 
@@ -88,11 +133,15 @@ func NewServer(
 	txFactory TransactionLayerFactory,
 	logger log.Logger,
 ) Server {
-	if tpFactory == nil {
-		tpFactory = transport.NewLayer
-	}
 	if txFactory == nil {
-		txFactory = transaction.NewLayer
+		txFactory = func(tpl sip.Transport, logger log.Logger) transaction.Layer {
+			return transaction.NewLayer(
+				tpl,
+				logger,
+				transaction.WithTimers(config.Timers),
+				transaction.WithLoopDetection(!config.DisableLoopDetection),
+			)
+		}
 	}
 	var host string
 	var ip net.IP
@@ -125,6 +174,18 @@ func NewServer(
 		dnsResolver = net.DefaultResolver
 	}
 
+	dns := config.DNSResolver
+	if dns == nil {
+		dns = transport.NewDNSResolver(dnsResolver, config.Dns)
+	}
+	resolver := transport.NewResolver(dns)
+
+	if tpFactory == nil {
+		tpFactory = func(ip net.IP, dnsResolver *net.Resolver, msgMapper sip.MessageMapper, logger log.Logger) transport.Layer {
+			return transport.NewLayer(ip, dnsResolver, msgMapper, logger, transport.WithResolver(resolver))
+		}
+	}
+
 	var extensions []string
 	if config.Extensions != nil {
 		extensions = config.Extensions
@@ -140,13 +201,21 @@ func NewServer(
 		ip:              ip,
 		hwg:             new(sync.WaitGroup),
 		hmu:             new(sync.RWMutex),
-		requestHandlers: make(map[sip.RequestMethod]RequestHandler),
+		requestHandlers: make(map[sip.RequestMethod]requestHandler),
+		dialogs:         newDialogStore(),
+		resolver:        resolver,
 		extensions:      extensions,
 		userAgent:       userAgent,
 	}
 	srv.log = logger.WithFields(log.Fields{
 		"sip_server_ptr": fmt.Sprintf("%p", srv),
 	})
+	if srv.isExtensionEnabled(Extension100rel) {
+		srv.prack = newPrackManager(srv)
+	}
+	if srv.isExtensionEnabled(ExtensionTimer) {
+		srv.timers = newSessionTimers(srv, config.SessionExpires, config.MinSE)
+	}
 	srv.tp = tpFactory(ip, dnsResolver, config.MsgMapper, srv.Log())
 	sipTp := &sipTransport{
 		tpl: srv.tp,
@@ -191,6 +260,13 @@ func (srv *server) serve() {
 				return
 			}
 
+			// 2xx retransmissions after INVITE client transaction termination
+			if dlg, ok := srv.dialogs.matchResponse(response); ok && isInviteSuccess(response) {
+				dlg.resendAck()
+
+				continue
+			}
+
 			logger := srv.Log().WithFields(response.Fields())
 			logger.Warn("received not matched response")
 
@@ -222,59 +298,154 @@ func (srv *server) serve() {
 	}
 }
 
+// handleRequest passes the request through the middlewares before any dispatching,
+// so PRACK and in-dialog requests are seen by them as well as requests of the server handlers.
 func (srv *server) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 	defer srv.hwg.Done()
 
+	srv.hmu.RLock()
+	middlewares := srv.middlewares
+	srv.hmu.RUnlock()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), serverKey{}, srv))
+	defer cancel()
+
+	handler := func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+		srv.dispatchRequest(ctx, cancel, req, tx)
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	handler(ctx, req, tx)
+}
+
+func (srv *server) dispatchRequest(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	req sip.Request,
+	tx sip.ServerTransaction,
+) {
+	if srv.prack != nil {
+		if req.Method() == sip.PRACK {
+			srv.handlePrack(ctx, cancel, req, tx)
+
+			return
+		}
+
+		srv.prack.track(req, tx)
+	}
+
+	if srv.timers != nil && !srv.timers.check(req, tx) {
+		return
+	}
+
+	if dlg, ok := srv.dialogs.matchRequest(req); ok {
+		dlg.handleRequest(ctx, cancel, req, tx)
+
+		return
+	}
+
+	srv.routeRequest(ctx, cancel, req, tx)
+}
+
+func (srv *server) routeRequest(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	req sip.Request,
+	tx sip.ServerTransaction,
+) {
 	logger := srv.Log().WithFields(req.Fields())
 	logger.Debug("routing incoming SIP request...")
 
 	srv.hmu.RLock()
-	handler, ok := srv.requestHandlers[req.Method()]
-
+	entry, ok := srv.requestHandlers[req.Method()]
 	srv.hmu.RUnlock()
 
-	if !ok {
-		logger.Warn("SIP request handler not found")
-
-		// ACK request doesn't have any transaction, so just skip this step
-		if tx != nil {
-			go func(tx sip.ServerTransaction, logger log.Logger) {
-				for {
-					select {
-					case <-srv.tx.Done():
-						return
-					case err, ok := <-tx.Errors():
-						if !ok {
-							return
-						}
+	handler := srv.handleNotFound
+	if ok {
+		handler = entry.handler
+		if entry.watch {
+			go srv.watchRequest(ctx, cancel, req, tx)
+		}
+	}
+
+	handler(ctx, req, tx)
+}
 
-						logger.Warnf("error from SIP server transaction %s: %s", tx, err)
+func (srv *server) handleNotFound(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+	logger := srv.Log().WithFields(req.Fields())
+	logger.Warn("SIP request handler not found")
+
+	// ACK request doesn't have any transaction, so just skip this step
+	if tx != nil {
+		go func(tx sip.ServerTransaction, logger log.Logger) {
+			for {
+				select {
+				case <-srv.tx.Done():
+					return
+				case err, ok := <-tx.Errors():
+					if !ok {
+						return
 					}
-				}
-			}(tx, logger)
-		}
 
-		// ACK request doesn't require any response, so just skip this step
-		if !req.IsAck() {
-			res := sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", "")
-			if _, err := srv.Respond(res); err != nil {
-				logger.Errorf("respond '405 Method Not Allowed' failed: %s", err)
+					logger.Warnf("error from SIP server transaction %s: %s", tx, err)
+				}
 			}
-		}
-
-		return
+		}(tx, logger)
 	}
 
-	handler(req, tx)
+	// ACK request doesn't require any response, so just skip this step
+	if !req.IsAck() {
+		res := sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", "")
+		if _, err := srv.Respond(res); err != nil {
+			logger.Errorf("respond '405 Method Not Allowed' failed: %s", err)
+		}
+	}
 }
 
 // Send SIP message
 func (srv *server) Request(req sip.Request) (sip.ClientTransaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), transport.DefaultResolveTimeout)
+	defer cancel()
+
+	return srv.request(ctx, req)
+}
+
+func (srv *server) request(
+	ctx context.Context,
+	req sip.Request,
+	options ...transaction.TxOption,
+) (sip.ClientTransaction, error) {
 	if !srv.running.IsSet() {
 		return nil, fmt.Errorf("can not send through stopped server")
 	}
+	if _, err := srv.bindRequest(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return srv.tx.Request(srv.prepareRequest(req), options...)
+}
+
+// bindRequest locates the next hop of the request and binds the request to the first location,
+// so the transaction and its retransmissions are sent without further lookups.
+// Remaining locations are returned to be tried on failure - RFC 3263 4.3.
+func (srv *server) bindRequest(ctx context.Context, req sip.Request) ([]*transport.Location, error) {
+	if _, ok := transport.BoundLocation(req); ok {
+		return nil, nil
+	}
+
+	locations, err := transport.ResolveRequest(ctx, srv.resolver, req)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", req.Destination(), err)
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("resolve %s: no locations", req.Destination())
+	}
+	req.SetTransport(locations[0].Transport)
+	req.SetDestination(locations[0].Target.Addr())
 
-	return srv.tx.Request(srv.prepareRequest(req))
+	return locations[1:], nil
 }
 
 func (srv *server) RequestWithContext(
@@ -291,14 +462,53 @@ func (srv *server) requestWithContext(
 	attempt int,
 	options ...RequestWithContextOption,
 ) (sip.Response, error) {
-	tx, err := srv.Request(request)
+	optionsHash := &RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(optionsHash)
+	}
+
+	// RFC 3263 - 4.3, the request is bound to the first location, others are tried on failure
+	locations := optionsHash.locations
+	if len(locations) > 0 {
+		request.SetTransport(locations[0].Transport)
+		request.SetDestination(locations[0].Target.Addr())
+		locations = locations[1:]
+	} else if locations == nil {
+		found, err := srv.bindRequest(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		locations = found
+	}
+	failover := func() (sip.Response, error) {
+		srv.Log().WithFields(request.Fields()).Debugf("trying next location %s", locations[0])
+
+		if viaHop, ok := request.ViaHop(); ok {
+			viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+		}
+		opts := make([]RequestWithContextOption, 0, len(options)+1)
+		opts = append(opts, options...)
+		opts = append(opts, withLocations{locations})
+
+		return srv.requestWithContext(ctx, request, attempt, opts...)
+	}
+
+	var txOpts []transaction.TxOption
+	if optionsHash.Timers != nil {
+		txOpts = append(txOpts, transaction.WithTimers(*optionsHash.Timers))
+	}
+	tx, err := srv.request(ctx, request, txOpts...)
 	if err != nil {
+		if len(locations) > 0 && isFailoverError(err) {
+			return failover()
+		}
+
 		return nil, err
 	}
 
-	optionsHash := &RequestWithContextOptions{}
-	for _, opt := range options {
-		opt.ApplyRequestWithContext(optionsHash)
+	var prack *uacPrack
+	if srv.prack != nil && request.IsInvite() {
+		prack = newUacPrack(srv, request, optionsHash.earlyDialogs)
 	}
 
 	txResponses := tx.Responses()
@@ -344,6 +554,15 @@ func (srv *server) requestWithContext(
 					// we continue to pull responses until close
 					continue
 				}
+				if len(locations) > 0 && isFailoverError(err) {
+					if response, err := failover(); err == nil {
+						responses <- response
+					} else {
+						errs <- err
+					}
+
+					return
+				}
 				errs <- err
 				return
 			case response, ok := <-txResponses:
@@ -363,6 +582,10 @@ func (srv *server) requestWithContext(
 				}
 
 				if response.IsProvisional() {
+					if prack != nil {
+						prack.handleResponse(ctx, response)
+					}
+
 					if _, ok := previousResponsesStatuses[getKey(response)]; !ok {
 						previousMessages = append(previousMessages, response)
 						previousResponsesStatuses[getKey(response)] = true
@@ -405,6 +628,29 @@ func (srv *server) requestWithContext(
 					return
 				}
 
+				// session interval too small
+				needInterval := response.StatusCode() == 422 && attempt < 3 && srv.timers != nil
+				if needInterval && srv.timers.raiseInterval(request, response) {
+					if response, err := srv.requestWithContext(ctx, request, attempt+1, options...); err == nil {
+						responses <- response
+					} else {
+						errs <- err
+					}
+
+					return
+				}
+
+				// service unavailable on this location
+				if response.StatusCode() == 503 && len(locations) > 0 {
+					if response, err := failover(); err == nil {
+						responses <- response
+					} else {
+						errs <- err
+					}
+
+					return
+				}
+
 				// failed request
 				response.SetPrevious(previousMessages)
 				errs <- sip.NewRequestError(uint(response.StatusCode()), response.Reason(), request, response)
@@ -425,6 +671,16 @@ func (srv *server) requestWithContext(
 	return res, err
 }
 
+// isFailoverError checks that the next location should be tried - RFC 3263 4.3.
+func isFailoverError(err error) bool {
+	var txErr transaction.TxError
+	if errors.As(err, &txErr) {
+		return txErr.Timeout() || txErr.Transport()
+	}
+	var tpErr transport.Error
+	return errors.As(err, &tpErr)
+}
+
 func (srv *server) prepareRequest(req sip.Request) sip.Request {
 	srv.appendAutoHeaders(req)
 
@@ -436,7 +692,202 @@ func (srv *server) Respond(res sip.Response) (sip.ServerTransaction, error) {
 		return nil, fmt.Errorf("can not send through stopped server")
 	}
 
-	return srv.tx.Respond(srv.prepareResponse(res))
+	res = srv.prepareResponse(res)
+
+	var (
+		prackKey transaction.TxKey
+		reliable bool
+		session  *sip.SessionExpires
+	)
+	if srv.prack != nil {
+		prackKey, reliable = srv.prack.prepare(res)
+	}
+	if srv.timers != nil {
+		session = srv.timers.prepare(res)
+	}
+
+	isInvite2xx := isInviteSuccess(res)
+	if isInvite2xx {
+		ensureToTag(res)
+	}
+
+	tx, err := srv.tx.Respond(res)
+	if err != nil {
+		return nil, err
+	}
+
+	if reliable {
+		srv.prack.retransmit(prackKey, res)
+	}
+	if isInvite2xx {
+		srv.createServerDialog(tx.Origin(), res)
+	}
+	if session != nil {
+		srv.timers.start(res, session)
+	}
+
+	return tx, nil
+}
+
+// Invite sends INVITE request and creates UAC dialog on 2xx response.
+// ACK is not sent automatically, use Dialog.Ack.
+// Session timer is started on the dialog if ExtensionTimer is enabled.
+func (srv *server) Invite(
+	ctx context.Context,
+	request sip.Request,
+	options ...RequestWithContextOption,
+) (Dialog, error) {
+	if !request.IsInvite() {
+		return nil, fmt.Errorf("invite: unexpected %s request", request.Method())
+	}
+
+	optionsHash := &RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(optionsHash)
+	}
+	if srv.timers != nil && len(request.GetHeaders("Session-Expires")) == 0 {
+		for _, hdr := range srv.timers.headers() {
+			request.AppendHeader(hdr)
+		}
+	}
+
+	responseHandler := optionsHash.ResponseHandler
+	earlyDialogs := new(sync.Map)
+	options = append(options, withEarlyDialogs{earlyDialogs}, WithResponseHandler(func(res sip.Response, req sip.Request) {
+		if responseHandler != nil {
+			responseHandler(res, req)
+		}
+		if isInviteSuccess(res) {
+			if dlg, ok := srv.dialogs.matchResponse(res); ok {
+				dlg.resendAck()
+			}
+		}
+	}))
+
+	res, err := srv.RequestWithContext(ctx, request, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := sip.NewDialogUAC(request, res)
+	if err != nil {
+		return nil, fmt.Errorf("invite: create dialog failed: %w", err)
+	}
+	// PRACK requests were sent in the early dialog
+	if early, ok := earlyDialogs.Load(sd.ID()); ok {
+		sd.SetLocalSeq(early.(*sip.Dialog).LocalSeq())
+	}
+
+	dlg := newDialog(srv, sd, srv.txTimers(optionsHash.Timers))
+	srv.dialogs.put(dlg)
+	dlg.Log().Debug("UAC dialog created")
+
+	if srv.timers != nil {
+		if se, ok := getSessionExpires(res); ok {
+			dlg.startSessionTimer(se.Delta, se.Refresher != sip.RefresherUAS)
+		} else if se, ok := getSessionExpires(request); ok {
+			// UAS doesn't support session timer, UAC refreshes alone - RFC 4028 7.2
+			dlg.startSessionTimer(se.Delta, true)
+		}
+	}
+
+	return dlg, nil
+}
+
+func (srv *server) GetDialog(id string) (Dialog, bool) {
+	dlg, ok := srv.dialogs.get(id)
+	if !ok {
+		return nil, false
+	}
+
+	return dlg, true
+}
+
+func (srv *server) createServerDialog(invite sip.Request, res sip.Response) {
+	sd, err := sip.NewDialogUAS(invite, res)
+	if err != nil {
+		srv.Log().Warnf("create UAS dialog failed: %s", err)
+
+		return
+	}
+	if _, ok := srv.dialogs.get(sd.ID()); ok {
+		return
+	}
+
+	dlg := newDialog(srv, sd, srv.txTimers(nil))
+	srv.dialogs.put(dlg)
+	dlg.retransmit2xx()
+	dlg.Log().Debug("UAS dialog created")
+}
+
+func isInviteSuccess(res sip.Response) bool {
+	if !res.IsSuccess() {
+		return false
+	}
+	cseq, ok := res.CSeq()
+
+	return ok && cseq.MethodName == sip.INVITE
+}
+
+// ensureToTag adds local tag to the response To header - RFC 3261 8.2.6.2.
+func ensureToTag(res sip.Response) {
+	to, ok := res.To()
+	if !ok {
+		return
+	}
+	if to.Params == nil {
+		to.Params = sip.NewParams()
+	}
+	if !to.Params.Has("tag") {
+		to.Params.Add("tag", sip.String{Str: util.RandString(10)})
+	}
+}
+
+// txTimers returns timer profile of the server transactions overridden by the request timers.
+func (srv *server) txTimers(override *transaction.Timers) transaction.Timers {
+	if override != nil {
+		return srv.tx.Timers(transaction.WithTimers(*override))
+	}
+
+	return srv.tx.Timers()
+}
+
+// serverTimers returns timer profile of the server transactions,
+// RFC 3261 values are used for servers other than the one created by NewServer.
+func serverTimers(srv Server) transaction.Timers {
+	if s, ok := srv.(*server); ok {
+		return s.txTimers(nil)
+	}
+
+	return transaction.DefaultTimers()
+}
+
+// localContact returns Contact URI the server is reached at for the request received by it:
+// the server host, the local port and the transport the request arrived on,
+// the user part is taken from the Request-URI.
+func localContact(srv Server, req sip.Request) *sip.SipUri {
+	uri := &sip.SipUri{
+		FUriParams: sip.NewParams(),
+		FHeaders:   sip.NewParams(),
+	}
+	if target, err := transport.NewTargetFromAddr(req.Destination()); err == nil {
+		uri.FHost = target.Host
+		if strings.Contains(uri.FHost, ":") {
+			uri.FHost = "[" + uri.FHost + "]"
+		}
+		uri.FPort = target.Port
+	}
+	if s, ok := srv.(*server); ok {
+		uri.FHost = s.host
+	}
+	if user := req.Recipient().User(); user != nil {
+		uri.FUser = user
+	}
+	if tp := req.Transport(); tp != "" && tp != "UDP" {
+		uri.FUriParams.Add("transport", sip.String{Str: strings.ToLower(tp)})
+	}
+
+	return uri
 }
 
 func (srv *server) RespondOnRequest(
@@ -465,6 +916,12 @@ func (srv *server) Send(msg sip.Message) error {
 
 	switch m := msg.(type) {
 	case sip.Request:
+		ctx, cancel := context.WithTimeout(context.Background(), transport.DefaultResolveTimeout)
+		_, err := srv.bindRequest(ctx, m)
+		cancel()
+		if err != nil {
+			return err
+		}
 		msg = srv.prepareRequest(m)
 	case sip.Response:
 		msg = srv.prepareResponse(m)
@@ -498,12 +955,82 @@ func (srv *server) Shutdown() {
 // OnRequest registers new request callback
 func (srv *server) OnRequest(method sip.RequestMethod, handler RequestHandler) error {
 	srv.hmu.Lock()
-	srv.requestHandlers[method] = handler
+	srv.requestHandlers[method] = requestHandler{
+		handler: func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+			handler(req, tx)
+		},
+	}
+	srv.hmu.Unlock()
+
+	return nil
+}
+
+// OnRequestWithContext registers new request callback that receives context of the request processing
+func (srv *server) OnRequestWithContext(method sip.RequestMethod, handler RequestHandlerWithContext) error {
+	srv.hmu.Lock()
+	srv.requestHandlers[method] = requestHandler{handler, true}
 	srv.hmu.Unlock()
 
 	return nil
 }
 
+// Use appends middlewares to the chain wrapping dispatching of every incoming request
+func (srv *server) Use(middleware ...Middleware) {
+	srv.hmu.Lock()
+	srv.middlewares = append(srv.middlewares[:len(srv.middlewares):len(srv.middlewares)], middleware...)
+	srv.hmu.Unlock()
+}
+
+// watchRequest cancels context of the request processing when the caller gives up.
+func (srv *server) watchRequest(ctx context.Context, cancel context.CancelFunc, req sip.Request, tx sip.ServerTransaction) {
+	logger := srv.Log().WithFields(req.Fields())
+
+	// ACK request doesn't have any transaction, so only server shutdown is watched
+	var (
+		cancels <-chan sip.Request
+		txDone  <-chan bool
+	)
+	if tx != nil {
+		cancels = tx.Cancels()
+		txDone = tx.Done()
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-srv.tx.Done():
+		logger.Debug("server shutdown, cancel request processing")
+
+		cancel()
+	case <-txDone:
+		logger.Debug("transaction terminated, cancel request processing")
+
+		cancel()
+	case cancelReq, ok := <-cancels:
+		if !ok {
+			cancel()
+
+			return
+		}
+
+		logger.Debug("request canceled, cancel request processing")
+
+		cancel()
+
+		// RFC 3261 - 9.2
+		if _, err := srv.RespondOnRequest(cancelReq, 200, "OK", "", nil); err != nil {
+			logger.Errorf("respond '200 OK' on CANCEL failed: %s", err)
+		}
+		if req.IsInvite() {
+			// ignored by the transaction if final response already sent
+			res := sip.NewResponseFromRequest("", req, 487, "Request Terminated", "")
+			ensureToTag(res)
+			if _, err := srv.Respond(res); err != nil {
+				logger.Errorf("respond '487 Request Terminated' failed: %s", err)
+			}
+		}
+	}
+}
+
 func (srv *server) appendAutoHeaders(msg sip.Message) {
 	autoAppendMethods := map[sip.RequestMethod]bool{
 		sip.INVITE:   true,
@@ -560,6 +1087,16 @@ func (srv *server) appendAutoHeaders(msg sip.Message) {
 	}
 }
 
+func (srv *server) isExtensionEnabled(tag string) bool {
+	for _, ext := range srv.extensions {
+		if strings.EqualFold(ext, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (srv *server) getAllowedMethods() []sip.RequestMethod {
 	methods := []sip.RequestMethod{
 		sip.INVITE,
@@ -572,6 +1109,15 @@ func (srv *server) getAllowedMethods() []sip.RequestMethod {
 		sip.CANCEL: true,
 	}
 
+	if srv.prack != nil {
+		methods = append(methods, sip.PRACK)
+		added[sip.PRACK] = true
+	}
+	if srv.timers != nil {
+		methods = append(methods, sip.UPDATE)
+		added[sip.UPDATE] = true
+	}
+
 	srv.hmu.RLock()
 	for method := range srv.requestHandlers {
 		if _, ok := added[method]; !ok {
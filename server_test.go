@@ -2,6 +2,7 @@ package gosip_test
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -16,6 +17,8 @@ import (
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
 	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
 	"github.com/ghettovoice/gosip/transport"
 )
 
@@ -346,4 +349,1924 @@ var _ = Describe("GoSIP Server", func() {
 
 		wg.Wait()
 	}, 3)
+
+	It("should create dialog on INVITE and send ACK and BYE through it", func(done Done) {
+		defer close(done)
+
+		inviteReq = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Route: <sip:" + clientAddr + ";lr>",
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+			"To: \"Bob\" <sip:bob@far-far-away.com>",
+			"Call-ID: dialog-call-id",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+
+			buf := make([]byte, transport.MTU)
+			read := func() sip.Request {
+				num, raddr, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				viaHop, ok := msg.ViaHop()
+				Expect(ok).Should(BeTrue())
+				viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+				req, ok := msg.(sip.Request)
+				Expect(ok).Should(BeTrue())
+				return req
+			}
+			write := func(res sip.Response) {
+				raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = conn.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			req := read()
+			Expect(req.Method()).Should(Equal(sip.INVITE))
+			res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			to, _ := res.To()
+			to.Params.Add("tag", sip.String{Str: "bob-tag"})
+			res.AppendHeader(&sip.ContactHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "127.0.0.1", FPort: localTarget.Port},
+			})
+			write(res)
+
+			req = read()
+			Expect(req.Method()).Should(Equal(sip.ACK))
+			cseq, _ := req.CSeq()
+			Expect(cseq.SeqNo).Should(Equal(uint32(1)))
+
+			req = read()
+			Expect(req.Method()).Should(Equal(sip.BYE))
+			Expect(req.Recipient().String()).Should(Equal("sip:bob@127.0.0.1:5060"))
+			cseq, _ = req.CSeq()
+			Expect(cseq.SeqNo).Should(Equal(uint32(2)))
+			to, _ = req.To()
+			toTag, _ := to.Params.Get("tag")
+			Expect(toTag.String()).Should(Equal("bob-tag"))
+			write(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+		}()
+
+		dlg, err := srv.Invite(context.Background(), inviteReq)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(dlg.SipDialog().RemoteTag()).Should(Equal("bob-tag"))
+		_, ok := srv.GetDialog(dlg.ID())
+		Expect(ok).Should(BeTrue())
+
+		Expect(dlg.Ack()).Should(Succeed())
+		Expect(dlg.Bye(context.Background())).Should(Succeed())
+		Eventually(dlg.Done()).Should(BeClosed())
+		_, ok = srv.GetDialog(dlg.ID())
+		Expect(ok).Should(BeFalse())
+
+		wg.Wait()
+	}, 3)
+
+	Context("with 100rel extension", func() {
+		BeforeEach(func() {
+			srvConf.Extensions = []string{gosip.Extension100rel}
+		})
+
+		AfterEach(func() {
+			srvConf.Extensions = nil
+		})
+
+		It("should send PRACK on reliable provisional response", func(done Done) {
+			defer close(done)
+
+			inviteReq = testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Route: <sip:" + clientAddr + ";lr>",
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: prack-call-id",
+				"CSeq: 1 INVITE",
+				"",
+				"",
+			})
+
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, err := net.ListenPacket("udp", clientAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer conn.Close()
+
+				buf := make([]byte, transport.MTU)
+				read := func() sip.Request {
+					num, raddr, err := conn.ReadFrom(buf)
+					Expect(err).ShouldNot(HaveOccurred())
+					msg, err := parser.ParseMessage(buf[:num], logger)
+					Expect(err).ShouldNot(HaveOccurred())
+					viaHop, ok := msg.ViaHop()
+					Expect(ok).Should(BeTrue())
+					viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+					req, ok := msg.(sip.Request)
+					Expect(ok).Should(BeTrue())
+					return req
+				}
+				write := func(res sip.Response) {
+					raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = conn.WriteTo([]byte(res.String()), raddr)
+					Expect(err).ShouldNot(HaveOccurred())
+				}
+				contact := &sip.ContactHeader{
+					Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "127.0.0.1", FPort: localTarget.Port},
+				}
+
+				invite := read()
+				Expect(invite.Method()).Should(Equal(sip.INVITE))
+				Expect(invite.GetHeaders("Supported")).ShouldNot(BeEmpty())
+				Expect(invite.GetHeaders("Supported")[0].Value()).Should(ContainSubstring(gosip.Extension100rel))
+
+				res := sip.NewResponseFromRequest("", invite, 183, "Session Progress", "")
+				to, _ := res.To()
+				to.Params.Add("tag", sip.String{Str: "bob-tag"})
+				res.AppendHeader(contact)
+				res.AppendHeader(&sip.RequireHeader{Options: []string{gosip.Extension100rel}})
+				rseq := sip.RSeq(10)
+				res.AppendHeader(&rseq)
+				write(res)
+
+				req := read()
+				Expect(req.Method()).Should(Equal(sip.PRACK))
+				cseq, _ := req.CSeq()
+				Expect(cseq.SeqNo).Should(Equal(uint32(2)))
+				rack := req.GetHeaders("RAck")
+				Expect(rack).Should(HaveLen(1))
+				Expect(rack[0].Value()).Should(Equal("10 1 INVITE"))
+				write(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+
+				res = sip.NewResponseFromRequest("", invite, 200, "OK", "")
+				to, _ = res.To()
+				to.Params.Add("tag", sip.String{Str: "bob-tag"})
+				res.AppendHeader(contact)
+				write(res)
+
+				req = read()
+				Expect(req.Method()).Should(Equal(sip.ACK))
+				// 2xx after provisional response may be ACKed by the transaction too
+				for req.Method() == sip.ACK {
+					req = read()
+				}
+				Expect(req.Method()).Should(Equal(sip.BYE))
+				cseq, _ = req.CSeq()
+				Expect(cseq.SeqNo).Should(Equal(uint32(3)))
+				write(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+			}()
+
+			dlg, err := srv.Invite(context.Background(), inviteReq)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dlg.Ack()).Should(Succeed())
+			Expect(dlg.Bye(context.Background())).Should(Succeed())
+
+			wg.Wait()
+		}, 3)
+
+		It("should retransmit reliable provisional response until PRACK", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			inviteBranch = sip.GenerateBranch()
+			inviteReq = testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + inviteBranch,
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: prack-uas-call-id",
+				"CSeq: 1 INVITE",
+				"Supported: 100rel",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+
+			prackReceived := make(chan struct{})
+			prackOnce := new(sync.Once)
+			defer prackOnce.Do(func() { close(prackReceived) })
+			Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+				_, err := srv.Respond(sip.NewResponseFromRequest("", req, 183, "Session Progress", ""))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				<-prackReceived
+				_, err = srv.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+				Expect(err).ShouldNot(HaveOccurred())
+			})).To(Succeed())
+
+			write := func(req sip.Request) {
+				_, err := conn.WriteTo([]byte(req.String()), srvAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			write(inviteReq)
+
+			buf := make([]byte, transport.MTU)
+			readResponse := func() sip.Response {
+				num, _, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				res, ok := msg.(sip.Response)
+				Expect(ok).Should(BeTrue())
+				return res
+			}
+
+			var first sip.Response
+			for first == nil {
+				if res := readResponse(); res.StatusCode() == 183 {
+					first = res
+				}
+			}
+			Expect(first.GetHeaders("Require")[0].Value()).Should(Equal(gosip.Extension100rel))
+			Expect(first.GetHeaders("RSeq")).Should(HaveLen(1))
+			to, _ := first.To()
+			tag, ok := to.Params.Get("tag")
+			Expect(ok).Should(BeTrue())
+
+			// retransmission after T1
+			second := readResponse()
+			Expect(second.StatusCode()).Should(Equal(sip.StatusCode(183)))
+			Expect(second.GetHeaders("RSeq")[0].Value()).Should(Equal(first.GetHeaders("RSeq")[0].Value()))
+
+			prack := testutils.Request([]string{
+				"PRACK sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>;tag=" + tag.String(),
+				"Call-ID: prack-uas-call-id",
+				"CSeq: 2 PRACK",
+				"RAck: " + first.GetHeaders("RSeq")[0].Value() + " 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+			write(prack)
+
+			res := readResponse()
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			cseq, _ := res.CSeq()
+			Expect(cseq.MethodName).Should(Equal(sip.PRACK))
+			prackOnce.Do(func() { close(prackReceived) })
+
+			res = readResponse()
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			cseq, _ = res.CSeq()
+			Expect(cseq.MethodName).Should(Equal(sip.INVITE))
+			to, _ = res.To()
+			finalTag, _ := to.Params.Get("tag")
+			Expect(finalTag.String()).Should(Equal(tag.String()))
+		}, 5)
+	})
+
+	Context("with session timer extension", func() {
+		BeforeEach(func() {
+			srvConf.Extensions = []string{gosip.ExtensionTimer}
+		})
+
+		AfterEach(func() {
+			srvConf.Extensions = nil
+		})
+
+		It("should reject too small session interval and negotiate refresher", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+				_, err := srv.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+				Expect(err).ShouldNot(HaveOccurred())
+			})).To(Succeed())
+
+			invite := func(cseq, sessionExpires string) sip.Request {
+				return testutils.Request([]string{
+					"INVITE sip:bob@example.com SIP/2.0",
+					"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+					"To: \"Bob\" <sip:bob@far-far-away.com>",
+					"Contact: <sip:alice@" + clientAddr + ">",
+					"Call-ID: timer-uas-call-id",
+					"CSeq: " + cseq + " INVITE",
+					"Supported: timer",
+					"Session-Expires: " + sessionExpires,
+					"Content-Length: 0",
+					"",
+					"",
+				})
+			}
+			buf := make([]byte, transport.MTU)
+			request := func(req sip.Request) sip.Response {
+				_, err := conn.WriteTo([]byte(req.String()), srvAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+				for {
+					num, _, err := conn.ReadFrom(buf)
+					Expect(err).ShouldNot(HaveOccurred())
+					msg, err := parser.ParseMessage(buf[:num], logger)
+					Expect(err).ShouldNot(HaveOccurred())
+					if res, ok := msg.(sip.Response); ok && !res.IsProvisional() {
+						return res
+					}
+				}
+			}
+
+			res := request(invite("1", "60"))
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(422)))
+			Expect(res.GetHeaders("Min-SE")).Should(HaveLen(1))
+			Expect(res.GetHeaders("Min-SE")[0].Value()).Should(Equal("90"))
+
+			req := invite("2", "1800")
+			res = request(req)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(res.GetHeaders("Session-Expires")).Should(HaveLen(1))
+			Expect(res.GetHeaders("Session-Expires")[0].Value()).Should(Equal("1800;refresher=uac"))
+			Expect(res.GetHeaders("Require")).ShouldNot(BeEmpty())
+			Expect(res.GetHeaders("Require")[0].Value()).Should(ContainSubstring(gosip.ExtensionTimer))
+
+			ack := sip.NewAckRequest("", req, res, "", nil)
+			_, err = conn.WriteTo([]byte(ack.String()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+		}, 3)
+
+		It("should raise session interval on 422 response", func(done Done) {
+			defer close(done)
+
+			inviteReq = testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Route: <sip:" + clientAddr + ";lr>",
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: timer-uac-call-id",
+				"CSeq: 1 INVITE",
+				"",
+				"",
+			})
+
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, err := net.ListenPacket("udp", clientAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer conn.Close()
+
+				buf := make([]byte, transport.MTU)
+				read := func() sip.Request {
+					num, raddr, err := conn.ReadFrom(buf)
+					Expect(err).ShouldNot(HaveOccurred())
+					msg, err := parser.ParseMessage(buf[:num], logger)
+					Expect(err).ShouldNot(HaveOccurred())
+					viaHop, ok := msg.ViaHop()
+					Expect(ok).Should(BeTrue())
+					viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+					req, ok := msg.(sip.Request)
+					Expect(ok).Should(BeTrue())
+					return req
+				}
+				write := func(res sip.Response) {
+					raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = conn.WriteTo([]byte(res.String()), raddr)
+					Expect(err).ShouldNot(HaveOccurred())
+				}
+
+				req := read()
+				Expect(req.Method()).Should(Equal(sip.INVITE))
+				Expect(req.GetHeaders("Session-Expires")).Should(HaveLen(1))
+				Expect(req.GetHeaders("Session-Expires")[0].Value()).Should(Equal("1800"))
+				res := sip.NewResponseFromRequest("", req, 422, "Session Interval Too Small", "")
+				minSE := sip.MinSE(3600)
+				res.AppendHeader(&minSE)
+				write(res)
+
+				// skip ACK on 422 and retransmissions of the first INVITE
+				for {
+					req = read()
+					if cseq, _ := req.CSeq(); cseq.SeqNo != 1 {
+						break
+					}
+				}
+				Expect(req.Method()).Should(Equal(sip.INVITE))
+				cseq, _ := req.CSeq()
+				Expect(cseq.SeqNo).Should(Equal(uint32(2)))
+				Expect(req.GetHeaders("Session-Expires")[0].Value()).Should(Equal("3600"))
+				Expect(req.GetHeaders("Min-SE")[0].Value()).Should(Equal("3600"))
+
+				res = sip.NewResponseFromRequest("", req, 200, "OK", "")
+				to, _ := res.To()
+				to.Params.Add("tag", sip.String{Str: "bob-tag"})
+				res.AppendHeader(&sip.ContactHeader{
+					Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "127.0.0.1", FPort: localTarget.Port},
+				})
+				res.AppendHeader(&sip.SessionExpires{Delta: 3600, Refresher: sip.RefresherUAC})
+				write(res)
+
+				req = read()
+				Expect(req.Method()).Should(Equal(sip.ACK))
+
+				req = read()
+				Expect(req.Method()).Should(Equal(sip.BYE))
+				cseq, _ = req.CSeq()
+				Expect(cseq.SeqNo).Should(Equal(uint32(3)))
+				write(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			dlg, err := srv.Invite(context.Background(), inviteReq)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dlg.Ack()).Should(Succeed())
+			Expect(dlg.Bye(context.Background())).Should(Succeed())
+
+			wg.Wait()
+		}, 3)
+	})
+
+	Context("with subscriptions", func() {
+		It("should accept subscription, notify and terminate it on unsubscribe", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			notifier, err := gosip.NewNotifier(srv, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			subs := make(chan *gosip.ServerSubscription, 1)
+			notifier.Handle(gosip.PresencePackage, func(sub *gosip.ServerSubscription, req sip.Request) (string, string, error) {
+				select {
+				case subs <- sub:
+				default:
+				}
+				return sip.SubStateActive, "<presence/>", nil
+			})
+
+			buf := make([]byte, transport.MTU)
+			read := func() sip.Message {
+				num, raddr, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				if _, ok := msg.(sip.Request); ok {
+					viaHop, ok := msg.ViaHop()
+					Expect(ok).Should(BeTrue())
+					viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+				}
+				return msg
+			}
+			write := func(msg sip.Message, addr net.Addr) {
+				_, err := conn.WriteTo([]byte(msg.String()), addr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			respond := func(req sip.Request) {
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				write(res, raddr)
+			}
+			subscribe := func(cseq, event, toTag, expires string) sip.Request {
+				to := "To: <sip:bob@far-far-away.com>"
+				if toTag != "" {
+					to += ";tag=" + toTag
+				}
+				return testutils.Request([]string{
+					"SUBSCRIBE sip:bob@127.0.0.1:5060 SIP/2.0",
+					"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+					"From: <sip:alice@wonderland.com>;tag=1928301774",
+					to,
+					"Contact: <sip:alice@" + clientAddr + ">",
+					"Call-ID: subscribe-call-id",
+					"CSeq: " + cseq + " SUBSCRIBE",
+					"Event: " + event,
+					"Expires: " + expires,
+					"Content-Length: 0",
+					"",
+					"",
+				})
+			}
+			// waits final response and NOTIFY in any order
+			exchange := func(req sip.Request) (sip.Response, sip.Request) {
+				write(req, srvAddr)
+				var (
+					res    sip.Response
+					notify sip.Request
+				)
+				for res == nil || notify == nil {
+					switch msg := read().(type) {
+					case sip.Response:
+						if !msg.IsProvisional() {
+							res = msg
+						}
+					case sip.Request:
+						Expect(msg.Method()).Should(Equal(sip.NOTIFY))
+						respond(msg)
+						notify = msg
+					}
+				}
+				return res, notify
+			}
+
+			write(subscribe("1", "foo", "", "600"), srvAddr)
+			res, ok := read().(sip.Response)
+			Expect(ok).Should(BeTrue())
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(489)))
+			Expect(res.GetHeaders("Allow-Events")).Should(HaveLen(1))
+			Expect(res.GetHeaders("Allow-Events")[0].Value()).Should(Equal("presence"))
+
+			res, notify := exchange(subscribe("2", "presence", "", "600"))
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(res.GetHeaders("Expires")[0].Value()).Should(Equal("600"))
+			contact, ok := res.Contact()
+			Expect(ok).Should(BeTrue())
+			Expect(contact.Address.User().String()).Should(Equal("bob"))
+			Expect(contact.Address.Port()).ShouldNot(BeNil())
+			Expect(*contact.Address.Port()).Should(Equal(sip.Port(5060)))
+			Expect(contact.Address.Host()).ShouldNot(Equal("127.0.0.1:5060"))
+			notifyContact, ok := notify.Contact()
+			Expect(ok).Should(BeTrue())
+			Expect(notifyContact.Address.Equals(contact.Address)).Should(BeTrue())
+			Expect(notify.GetHeaders("Event")[0].Value()).Should(Equal("presence"))
+			Expect(notify.GetHeaders("Subscription-State")[0].Value()).Should(Equal("active;expires=600"))
+			Expect(notify.Body()).Should(Equal("<presence/>"))
+
+			sub := <-subs
+			Expect(sub.State()).Should(Equal(sip.SubStateActive))
+			Expect(notifier.Subscriptions("presence")).Should(HaveLen(1))
+
+			to, _ := res.To()
+			toTag, _ := to.Params.Get("tag")
+			res, notify = exchange(subscribe("3", "presence", toTag.String(), "0"))
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(notify.GetHeaders("Subscription-State")[0].Value()).Should(Equal("terminated;reason=timeout"))
+
+			Eventually(sub.Done()).Should(BeClosed())
+			Expect(notifier.Subscriptions("presence")).Should(BeEmpty())
+		}, 3)
+
+		It("should subscribe and handle NOTIFY requests until termination", func(done Done) {
+			defer close(done)
+
+			subscriber, err := gosip.NewSubscriber(srv, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, err := net.ListenPacket("udp", clientAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer conn.Close()
+				srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+				Expect(err).ShouldNot(HaveOccurred())
+
+				buf := make([]byte, transport.MTU)
+				read := func() sip.Message {
+					num, raddr, err := conn.ReadFrom(buf)
+					Expect(err).ShouldNot(HaveOccurred())
+					msg, err := parser.ParseMessage(buf[:num], logger)
+					Expect(err).ShouldNot(HaveOccurred())
+					if _, ok := msg.(sip.Request); ok {
+						viaHop, ok := msg.ViaHop()
+						Expect(ok).Should(BeTrue())
+						viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+					}
+					return msg
+				}
+
+				req, ok := read().(sip.Request)
+				Expect(ok).Should(BeTrue())
+				Expect(req.Method()).Should(Equal(sip.SUBSCRIBE))
+				Expect(req.GetHeaders("Event")[0].Value()).Should(Equal("presence"))
+				Expect(req.GetHeaders("Accept")[0].Value()).Should(Equal("application/pidf+xml"))
+				Expect(req.GetHeaders("Expires")[0].Value()).Should(Equal("3600"))
+				from, _ := req.From()
+				fromTag, ok := from.Params.Get("tag")
+				Expect(ok).Should(BeTrue())
+
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				to, _ := res.To()
+				to.Params.Add("tag", sip.String{Str: "bob-tag"})
+				res.AppendHeader(&sip.ContactHeader{
+					Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "127.0.0.1", FPort: localTarget.Port},
+				})
+				expires := sip.Expires(600)
+				res.AppendHeader(&expires)
+				raddr, err := net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = conn.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				notify := func(cseq, state, body string) {
+					req := testutils.Request([]string{
+						"NOTIFY sip:alice@127.0.0.1:5060 SIP/2.0",
+						"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+						"From: <sip:bob@far-far-away.com>;tag=bob-tag",
+						"To: <sip:alice@wonderland.com>;tag=" + fromTag.String(),
+						"Contact: <sip:bob@" + clientAddr + ">",
+						"Call-ID: subscribe-call-id",
+						"CSeq: " + cseq + " NOTIFY",
+						"Event: presence",
+						"Subscription-State: " + state,
+						"Content-Type: application/pidf+xml",
+						"",
+						body,
+					})
+					_, err := conn.WriteTo([]byte(req.String()), srvAddr)
+					Expect(err).ShouldNot(HaveOccurred())
+					for {
+						if res, ok := read().(sip.Response); ok {
+							Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+							return
+						}
+					}
+				}
+
+				notify("1", "active;expires=600", "<presence/>")
+				notify("2", "terminated;reason=rejected", "")
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			req := testutils.Request([]string{
+				"SUBSCRIBE sip:bob@far-far-away.com SIP/2.0",
+				"Route: <sip:" + clientAddr + ";lr>",
+				"From: <sip:alice@wonderland.com>",
+				"To: <sip:bob@far-far-away.com>",
+				"Contact: <sip:alice@127.0.0.1:5060>",
+				"Call-ID: subscribe-call-id",
+				"CSeq: 1 SUBSCRIBE",
+				"",
+				"",
+			})
+			bodies := make(chan string, 2)
+			sub, err := subscriber.Subscribe(context.Background(), req, gosip.PresencePackage,
+				func(sub *gosip.ClientSubscription, req sip.Request) {
+					bodies <- req.Body()
+				})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Eventually(bodies).Should(Receive(Equal("<presence/>")))
+			Eventually(sub.Done()).Should(BeClosed())
+			Expect(sub.State()).Should(Equal(sip.SubStateTerminated))
+			Expect(sub.Reason()).Should(Equal(sip.SubReasonRejected))
+
+			wg.Wait()
+		}, 3)
+	})
+
+	Context("with RFC 3263 server location", func() {
+		BeforeEach(func() {
+			srvConf.DNSResolver = &memoryDNS{
+				naptr: map[string][]*transport.NAPTR{
+					"example.test": {
+						{Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.test."},
+						{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.test."},
+					},
+				},
+				srv: map[string][]*net.SRV{
+					"_sip._tcp.example.test": {{Target: "sip.example.test.", Port: 9003, Priority: 10}},
+					"_sip._udp.example.test": {{Target: "sip.example.test.", Port: 9001, Priority: 10}},
+				},
+				hosts: map[string][]string{
+					"sip.example.test": {"127.0.0.1"},
+				},
+			}
+		})
+
+		AfterEach(func() {
+			srvConf.DNSResolver = nil
+		})
+
+		It("should fail over to the next location on transport error", func(done Done) {
+			defer close(done)
+
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, err := net.ListenPacket("udp", clientAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer conn.Close()
+
+				buf := make([]byte, transport.MTU)
+				num, raddr, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				req, ok := msg.(sip.Request)
+				Expect(ok).Should(BeTrue())
+				Expect(req.Method()).Should(Equal(sip.OPTIONS))
+				viaHop, ok := req.ViaHop()
+				Expect(ok).Should(BeTrue())
+				Expect(viaHop.Transport).Should(Equal("UDP"))
+				viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				raddr, err = net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = conn.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			req := testutils.Request([]string{
+				"OPTIONS sip:bob@example.test SIP/2.0",
+				"From: <sip:alice@wonderland.com>;tag=1928301774",
+				"To: <sip:bob@example.test>",
+				"Call-ID: failover-call-id",
+				"CSeq: 1 OPTIONS",
+				"",
+				"",
+			})
+			res, err := srv.RequestWithContext(context.Background(), req)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+
+			wg.Wait()
+		}, 3)
+	})
+
+	Context("with transaction timers", func() {
+		BeforeEach(func() {
+			srvConf.Timers = transaction.Timers{T1: 10 * time.Millisecond}
+		})
+
+		AfterEach(func() {
+			srvConf.Timers = transaction.Timers{}
+		})
+
+		// listen collects retransmissions of the request that is never answered.
+		listen := func(received *int32) (net.PacketConn, *sync.WaitGroup) {
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				buf := make([]byte, transport.MTU)
+				for {
+					if _, _, err := conn.ReadFrom(buf); err != nil {
+						return
+					}
+					atomic.AddInt32(received, 1)
+				}
+			}()
+
+			return conn, wg
+		}
+		request := func() sip.Request {
+			return testutils.Request([]string{
+				"OPTIONS sip:bob@" + clientAddr + " SIP/2.0",
+				"From: <sip:alice@wonderland.com>;tag=1928301774",
+				"To: <sip:bob@example.com>",
+				"Call-ID: timers-call-id",
+				"CSeq: 1 OPTIONS",
+				"",
+				"",
+			})
+		}
+
+		It("should retransmit and time out by the server timer profile", func(done Done) {
+			defer close(done)
+
+			var received int32
+			conn, wg := listen(&received)
+
+			start := time.Now()
+			_, err := srv.RequestWithContext(context.Background(), request())
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("timed out"))
+			Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+			Expect(atomic.LoadInt32(&received)).Should(BeNumerically(">", 3))
+
+			conn.Close()
+			wg.Wait()
+		}, 3)
+
+		It("should apply timers of the request", func(done Done) {
+			defer close(done)
+
+			var received int32
+			conn, wg := listen(&received)
+
+			start := time.Now()
+			_, err := srv.RequestWithContext(context.Background(), request(),
+				gosip.WithTimers(transaction.Timers{TimerF: 100 * time.Millisecond}))
+			Expect(err).Should(HaveOccurred())
+			Expect(time.Since(start)).Should(BeNumerically("<", 300*time.Millisecond))
+
+			conn.Close()
+			wg.Wait()
+		}, 3)
+
+		It("should retransmit 2xx on INVITE by the server timer profile", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				res.AppendHeader(&sip.ContactHeader{Address: req.Recipient().Clone()})
+				_, err := srv.Respond(res)
+				Expect(err).ShouldNot(HaveOccurred())
+			})).To(BeNil())
+
+			_, err = conn.WriteTo([]byte(testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@wonderland.com>;tag=1928301774",
+				"To: <sip:bob@far-far-away.com>",
+				"Contact: <sip:alice@" + clientAddr + ">",
+				"Call-ID: retransmit-2xx-call-id",
+				"CSeq: 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			}).String()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// 2xx is resent in T1, 2*T1, 4*T1... without ACK
+			received := 0
+			buf := make([]byte, transport.MTU)
+			Expect(conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))).To(Succeed())
+			for {
+				num, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				if res, ok := msg.(sip.Response); ok && res.StatusCode() == 200 {
+					received++
+				}
+			}
+			Expect(received).Should(BeNumerically(">", 3))
+		}, 3)
+	})
+
+	Context("with loop detection", func() {
+		It("should respond 482 on merged request", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			request := func(branch string) []byte {
+				return []byte(testutils.Request([]string{
+					"OPTIONS sip:bob@example.com SIP/2.0",
+					"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+					"To: \"Bob\" <sip:bob@far-far-away.com>",
+					"Call-ID: merged-call-id",
+					"CSeq: 1 OPTIONS",
+					"Content-Length: 0",
+					"",
+					"",
+				}).String())
+			}
+
+			var handled int32
+			Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+				atomic.AddInt32(&handled, 1)
+			})).To(BeNil())
+
+			_, err = conn.WriteTo(request(sip.GenerateBranch()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			time.Sleep(50 * time.Millisecond)
+			merged := request(sip.GenerateBranch())
+			// the merged request and its retransmission are answered by the same server transaction
+			for i := 0; i < 2; i++ {
+				_, err = conn.WriteTo(merged, srvAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				buf := make([]byte, transport.MTU)
+				num, _, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				res, ok := msg.(sip.Response)
+				Expect(ok).Should(BeTrue())
+				Expect(res.StatusCode()).Should(Equal(sip.StatusCode(482)))
+			}
+			Expect(atomic.LoadInt32(&handled)).Should(Equal(int32(1)))
+		}, 3)
+	})
+
+	Context("with context handlers", func() {
+		It("should cancel context and respond 487 on CANCEL", func(done Done) {
+			defer close(done)
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			canceled := make(chan struct{})
+			Expect(srv.OnRequestWithContext(sip.INVITE, func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+				<-ctx.Done()
+				close(canceled)
+			})).To(BeNil())
+
+			branch := sip.GenerateBranch()
+			request := func(method string) []byte {
+				return []byte(testutils.Request([]string{
+					method + " sip:bob@example.com SIP/2.0",
+					"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+					"To: \"Bob\" <sip:bob@far-far-away.com>",
+					"Call-ID: cancel-call-id",
+					"CSeq: 1 " + method,
+					"Content-Length: 0",
+					"",
+					"",
+				}).String())
+			}
+
+			_, err = conn.WriteTo(request("INVITE"), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			time.Sleep(50 * time.Millisecond)
+			_, err = conn.WriteTo(request("CANCEL"), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Eventually(canceled).Should(BeClosed())
+
+			received := make(map[string]sip.StatusCode)
+			buf := make([]byte, transport.MTU)
+			for len(received) < 2 {
+				num, _, err := conn.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				res, ok := msg.(sip.Response)
+				Expect(ok).Should(BeTrue())
+				if res.StatusCode() == 100 {
+					continue
+				}
+				cseq, ok := res.CSeq()
+				Expect(ok).Should(BeTrue())
+				received[string(cseq.MethodName)] = res.StatusCode()
+			}
+			Expect(received).Should(Equal(map[string]sip.StatusCode{
+				"CANCEL": 200,
+				"INVITE": 487,
+			}))
+		}, 3)
+	})
+
+	Context("with middlewares", func() {
+		var (
+			conn    net.PacketConn
+			srvAddr net.Addr
+		)
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			srvAddr, err = net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		request := func(method, branch string) []byte {
+			return []byte(testutils.Request([]string{
+				method + " sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: " + branch,
+				"CSeq: 1 " + method,
+				"Content-Length: 0",
+				"",
+				"",
+			}).String())
+		}
+
+		readResponse := func() sip.Response {
+			msg, _ := testutils.ReadMessage(conn, logger)
+			res, ok := msg.(sip.Response)
+			Expect(ok).Should(BeTrue())
+			return res
+		}
+
+		It("should respond 500 on handler panic", func(done Done) {
+			defer close(done)
+
+			srv.Use(gosip.Recover(logger))
+			Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+				panic("handler failed")
+			})).To(BeNil())
+
+			_, err := conn.WriteTo(request("OPTIONS", sip.GenerateBranch()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			res := readResponse()
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(500)))
+			Expect(res.GetHeaders("Server")).Should(HaveLen(1))
+		}, 3)
+
+		It("should pass in-dialog requests through middlewares", func(done Done) {
+			defer close(done)
+
+			srv.Use(gosip.Recover(logger), gosip.ForMethods(func(next gosip.RequestHandlerWithContext) gosip.RequestHandlerWithContext {
+				return func(ctx context.Context, req sip.Request, tx sip.ServerTransaction) {
+					panic("middleware failed")
+				}
+			}, sip.BYE))
+			Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				res.AppendHeader(&sip.ContactHeader{Address: req.Recipient().Clone()})
+				_, err := srv.Respond(res)
+				Expect(err).ShouldNot(HaveOccurred())
+			})).To(BeNil())
+
+			inDialog := func(method, toTag string, cseq int) []byte {
+				to := "To: \"Bob\" <sip:bob@far-far-away.com>"
+				if toTag != "" {
+					to += ";tag=" + toTag
+				}
+				return []byte(testutils.Request([]string{
+					method + " sip:bob@example.com SIP/2.0",
+					"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+					to,
+					"Contact: <sip:alice@" + clientAddr + ">",
+					"Call-ID: middleware-dialog-call-id",
+					fmt.Sprintf("CSeq: %d %s", cseq, method),
+					"Content-Length: 0",
+					"",
+					"",
+				}).String())
+			}
+
+			_, err := conn.WriteTo(inDialog("INVITE", "", 1), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			res := readResponse()
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			to, _ := res.To()
+			toTag, _ := to.Params.Get("tag")
+
+			_, err = conn.WriteTo(inDialog("ACK", toTag.String(), 1), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = conn.WriteTo(inDialog("BYE", toTag.String(), 2), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			for {
+				res = readResponse()
+				if cseq, _ := res.CSeq(); cseq.MethodName == sip.BYE {
+					break
+				}
+			}
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(500)))
+		}, 3)
+
+		It("should respond 503 over the rate limit of the scoped methods", func(done Done) {
+			defer close(done)
+
+			srv.Use(gosip.ForMethods(gosip.RateLimit(0.1, 1, logger), sip.OPTIONS))
+			handler := func(req sip.Request, tx sip.ServerTransaction) {
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				Expect(tx.Respond(res)).To(Succeed())
+			}
+			Expect(srv.OnRequest(sip.OPTIONS, handler)).To(BeNil())
+			Expect(srv.OnRequest(sip.INFO, handler)).To(BeNil())
+
+			for i, expected := range []struct {
+				method string
+				code   sip.StatusCode
+			}{
+				{"OPTIONS", 200},
+				{"OPTIONS", 503},
+				{"INFO", 200},
+			} {
+				_, err := conn.WriteTo(request(expected.method, sip.GenerateBranch()), srvAddr)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				res := readResponse()
+				Expect(res.StatusCode()).Should(Equal(expected.code), "request %d", i)
+				if expected.code == 503 {
+					Expect(res.GetHeaders("Retry-After")).Should(HaveLen(1))
+				}
+			}
+		}, 3)
+	})
+
+	Context("with registrar", func() {
+		var (
+			conn      net.PacketConn
+			srvAddr   net.Addr
+			registrar *gosip.Registrar
+		)
+
+		JustBeforeEach(func() {
+			var err error
+			registrar, err = gosip.NewRegistrar(srv, gosip.NewMemoryBindingStore(), gosip.RegistrarConfig{
+				MinExpires: 60,
+				MaxExpires: 7200,
+			}, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			conn, err = net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			srvAddr, err = net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		register := func(callID string, cseq int, headers ...string) sip.Response {
+			lines := []string{
+				"REGISTER sip:far-far-away.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: \"Bob\" <sip:bob@far-far-away.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: " + callID,
+				fmt.Sprintf("CSeq: %d REGISTER", cseq),
+			}
+			lines = append(lines, headers...)
+			lines = append(lines, "Content-Length: 0", "", "")
+			testutils.WriteMessage(conn, testutils.Request(lines), srvAddr)
+
+			return testutils.ReadResponse(conn, sip.REGISTER, logger)
+		}
+
+		contacts := func(res sip.Response) []string {
+			values := make([]string, 0)
+			for _, header := range res.GetHeaders("Contact") {
+				values = append(values, header.Value())
+			}
+			return values
+		}
+
+		It("should bind contacts ordered by q-value", func(done Done) {
+			defer close(done)
+
+			res := register("reg-call-id", 1,
+				"Contact: <sip:bob@192.0.2.1:5060>;q=0.5",
+				"Contact: <sip:bob@192.0.2.2:5060>;q=0.9;expires=9000",
+				"Expires: 600",
+			)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(contacts(res)).Should(Equal([]string{
+				"<sip:bob@192.0.2.2:5060>;expires=7200;q=0.9",
+				"<sip:bob@192.0.2.1:5060>;expires=600;q=0.5",
+			}))
+
+			aor, err := parser.ParseUri("sip:bob@far-far-away.com:5060;transport=udp")
+			Expect(err).ShouldNot(HaveOccurred())
+			bindings, err := registrar.Lookup(aor)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(bindings).Should(HaveLen(2))
+			Expect(bindings[0].Contact.String()).Should(Equal("sip:bob@192.0.2.2:5060"))
+
+			res = register("reg-call-id", 2, "Contact: <sip:bob@192.0.2.1:5060>;expires=0")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(contacts(res)).Should(Equal([]string{"<sip:bob@192.0.2.2:5060>;expires=7200;q=0.9"}))
+		}, 3)
+
+		It("should respond 423 on too brief expiration", func(done Done) {
+			defer close(done)
+
+			res := register("reg-call-id", 1, "Contact: <sip:bob@192.0.2.1:5060>", "Expires: 30")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(423)))
+			hdrs := res.GetHeaders("Min-Expires")
+			Expect(hdrs).Should(HaveLen(1))
+			Expect(hdrs[0].Value()).Should(Equal("60"))
+		}, 3)
+
+		It("should reject out of order CSeq of the same Call-ID", func(done Done) {
+			defer close(done)
+
+			res := register("reg-call-id", 5, "Contact: <sip:bob@192.0.2.1:5060>")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+
+			res = register("reg-call-id", 3, "Contact: <sip:bob@192.0.2.1:5060>")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(500)))
+
+			res = register("other-call-id", 3, "Contact: <sip:bob@192.0.2.1:5060>")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+		}, 3)
+
+		It("should remove all bindings on wildcard contact", func(done Done) {
+			defer close(done)
+
+			res := register("reg-call-id", 1,
+				"Contact: <sip:bob@192.0.2.1:5060>",
+				"Contact: <sip:bob@192.0.2.2:5060>",
+			)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(contacts(res)).Should(HaveLen(2))
+
+			res = register("reg-call-id", 2, "Contact: *")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(400)))
+
+			res = register("reg-call-id", 3, "Contact: *", "Expires: 0")
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(contacts(res)).Should(BeEmpty())
+
+			res = register("reg-call-id", 4)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(contacts(res)).Should(BeEmpty())
+		}, 3)
+	})
+
+	Context("with register client", func() {
+		var (
+			registrar, failed net.PacketConn
+			client            *gosip.RegisterClient
+		)
+
+		JustBeforeEach(func() {
+			var err error
+			registrar, err = net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			failed, err = net.ListenPacket("udp", "127.0.0.1:9002")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			registrarUri, err := parser.ParseUri("sip:127.0.0.1:9001")
+			Expect(err).ShouldNot(HaveOccurred())
+			aor, err := parser.ParseUri("sip:alice@127.0.0.1:9001")
+			Expect(err).ShouldNot(HaveOccurred())
+			contact, err := parser.ParseUri("sip:alice@" + localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			client, err = gosip.NewRegisterClient(srv, gosip.RegisterClientConfig{
+				Registrar: registrarUri,
+				AOR:       aor,
+				Contact:   contact,
+				Proxies:   []string{"127.0.0.1:9002", clientAddr},
+				Password:  "secret",
+				Expires:   60,
+			}, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			registrar.Close()
+			failed.Close()
+		})
+
+		readRequest := func(conn net.PacketConn) (sip.Request, net.Addr) {
+			return testutils.ReadRequest(conn, sip.REGISTER, logger)
+		}
+
+		It("should fail over, authenticate, refresh and unregister", func(done Done) {
+			defer close(done)
+
+			challenger := sip.NewChallenger("example.com")
+			lookup := func(username, realm string) (string, bool) {
+				return "secret", username == "alice"
+			}
+			accept := func(req sip.Request, addr net.Addr, expires string) {
+				_, err := challenger.Verify(req, lookup)
+				Expect(err).ShouldNot(HaveOccurred())
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				contact, ok := req.Contact()
+				Expect(ok).Should(BeTrue())
+				res.AppendHeader(&sip.ContactHeader{
+					Address: contact.Address,
+					Params:  sip.NewParams().Add("expires", sip.String{Str: expires}),
+				})
+				testutils.WriteMessage(registrar, res, addr)
+			}
+
+			client.Start()
+
+			req, addr := readRequest(failed)
+			testutils.WriteMessage(failed, sip.NewResponseFromRequest("", req, 503, "Service Unavailable", ""), addr)
+
+			req, addr = readRequest(registrar)
+			testutils.WriteMessage(registrar, challenger.Challenge(req, false), addr)
+			req, addr = readRequest(registrar)
+			accept(req, addr, "2")
+			callID, _ := req.CallID()
+			cseq, _ := req.CSeq()
+
+			Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateRegistering, Proxy: "127.0.0.1:9002"}))
+			Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateRegistered, Proxy: clientAddr, Expires: 2}))
+
+			// refreshed at the half of the granted expires with the same Call-ID
+			req, addr = readRequest(registrar)
+			testutils.WriteMessage(registrar, challenger.Challenge(req, false), addr)
+			req, addr = readRequest(registrar)
+			refreshCallID, _ := req.CallID()
+			refreshCSeq, _ := req.CSeq()
+			Expect(*refreshCallID).Should(Equal(*callID))
+			Expect(refreshCSeq.SeqNo).Should(BeNumerically(">", cseq.SeqNo))
+			accept(req, addr, "2")
+
+			// refresh with the same expires is not reported, only the changed expires is
+			req, addr = readRequest(registrar)
+			testutils.WriteMessage(registrar, challenger.Challenge(req, false), addr)
+			req, addr = readRequest(registrar)
+			accept(req, addr, "60")
+
+			Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateRegistered, Proxy: clientAddr, Expires: 60}))
+
+			go func() {
+				defer GinkgoRecover()
+
+				req, addr := readRequest(registrar)
+				expires := req.GetHeaders("Expires")
+				Expect(expires).Should(HaveLen(1))
+				Expect(expires[0].Value()).Should(Equal("0"))
+				testutils.WriteMessage(registrar, sip.NewResponseFromRequest("", req, 200, "OK", ""), addr)
+			}()
+
+			Expect(client.Stop(context.Background())).To(Succeed())
+			Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateUnregistered, Proxy: clientAddr}))
+			Eventually(client.States()).Should(BeClosed())
+		}, 5)
+
+		Context("with proxy never answering", func() {
+			BeforeEach(func() {
+				srvConf.Timers = transaction.Timers{T1: 10 * time.Millisecond}
+			})
+
+			AfterEach(func() {
+				srvConf.Timers = transaction.Timers{}
+			})
+
+			It("should fail over to the next proxy after the transaction timeout", func(done Done) {
+				defer close(done)
+
+				client.Start()
+
+				// the first proxy gets REGISTER and its retransmissions without answer
+				readRequest(failed)
+
+				// the next proxy answers in a while, in the own timeout of the attempt
+				req, addr := readRequest(registrar)
+				time.Sleep(100 * time.Millisecond)
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				expires := sip.Expires(60)
+				res.AppendHeader(&expires)
+				testutils.WriteMessage(registrar, res, addr)
+
+				Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateRegistering, Proxy: "127.0.0.1:9002"}))
+				Expect(<-client.States()).Should(Equal(gosip.RegisterEvent{State: gosip.RegisterStateRegistered, Proxy: clientAddr, Expires: 60}))
+
+				go func() {
+					defer GinkgoRecover()
+
+					// retransmissions of the answered REGISTER are skipped
+					for {
+						req, addr := readRequest(registrar)
+						if expires := req.GetHeaders("Expires"); len(expires) == 1 && expires[0].Value() == "0" {
+							testutils.WriteMessage(registrar, sip.NewResponseFromRequest("", req, 200, "OK", ""), addr)
+							return
+						}
+					}
+				}()
+				Expect(client.Stop(context.Background())).To(Succeed())
+			}, 5)
+		})
+
+		It("should not refresh short registration sooner than the minimum delay", func(done Done) {
+			defer close(done)
+
+			client.Start()
+
+			req, addr := readRequest(failed)
+			testutils.WriteMessage(failed, sip.NewResponseFromRequest("", req, 503, "Service Unavailable", ""), addr)
+
+			accept := func(req sip.Request, addr net.Addr, expires string) {
+				res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+				contact, ok := req.Contact()
+				Expect(ok).Should(BeTrue())
+				res.AppendHeader(&sip.ContactHeader{
+					Address: contact.Address,
+					Params:  sip.NewParams().Add("expires", sip.String{Str: expires}),
+				})
+				testutils.WriteMessage(registrar, res, addr)
+			}
+
+			req, addr = readRequest(registrar)
+			granted := time.Now()
+			accept(req, addr, "1")
+
+			req, addr = readRequest(registrar)
+			Expect(time.Since(granted)).Should(BeNumerically(">=", gosip.MinRegisterRefreshDelay))
+			accept(req, addr, "60")
+
+			go func() {
+				defer GinkgoRecover()
+
+				req, addr := readRequest(registrar)
+				testutils.WriteMessage(registrar, sip.NewResponseFromRequest("", req, 200, "OK", ""), addr)
+			}()
+
+			Expect(client.Stop(context.Background())).To(Succeed())
+		}, 5)
+	})
+
+	Context("with proxy", func() {
+		var (
+			uac, uasA, uasB net.PacketConn
+			srvAddr         net.Addr
+			proxyConf       gosip.ProxyConfig
+		)
+
+		uasAddrA := "127.0.0.1:9002"
+		uasAddrB := "127.0.0.1:9003"
+
+		BeforeEach(func() {
+			proxyConf = gosip.ProxyConfig{
+				Host:        localTarget.Host,
+				Port:        *localTarget.Port,
+				RecordRoute: true,
+			}
+		})
+
+		JustBeforeEach(func() {
+			locator := gosip.LocatorFunc(func(ctx context.Context, req sip.Request) ([]sip.Uri, error) {
+				targets := make([]sip.Uri, 0, 2)
+				for _, addr := range []string{uasAddrA, uasAddrB} {
+					uri, err := parser.ParseUri("sip:bob@" + addr)
+					if err != nil {
+						return nil, err
+					}
+					targets = append(targets, uri)
+				}
+				return targets, nil
+			})
+			_, err := gosip.NewProxy(srv, locator, proxyConf, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			uac, err = net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			uasA, err = net.ListenPacket("udp", uasAddrA)
+			Expect(err).ShouldNot(HaveOccurred())
+			uasB, err = net.ListenPacket("udp", uasAddrB)
+			Expect(err).ShouldNot(HaveOccurred())
+			srvAddr, err = net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			uac.Close()
+			uasA.Close()
+			uasB.Close()
+		})
+
+		invite := func(maxForwards string) {
+			_, err := uac.WriteTo([]byte(testutils.Request([]string{
+				"INVITE sip:bob@far-far-away.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 INVITE",
+				"Max-Forwards: " + maxForwards,
+				"Contact: <sip:alice@" + clientAddr + ">",
+				"Content-Length: 0",
+				"",
+				"",
+			}).String()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+
+		readRequest := func(conn net.PacketConn, method sip.RequestMethod) sip.Request {
+			req, _ := testutils.ReadRequest(conn, method, logger)
+			return req
+		}
+
+		readFinal := func(conn net.PacketConn) sip.Response {
+			for {
+				if res := testutils.ReadResponse(conn, sip.INVITE, logger); !res.IsProvisional() {
+					return res
+				}
+			}
+		}
+
+		respond := func(conn net.PacketConn, req sip.Request, status sip.StatusCode, reason string) {
+			res := sip.NewResponseFromRequest("", req, status, reason, "")
+			to, _ := res.To()
+			to.Params.Add("tag", sip.String{Str: conn.LocalAddr().String()})
+			testutils.WriteMessage(conn, res, srvAddr)
+		}
+
+		It("should fork in parallel and cancel other branches on 2xx", func(done Done) {
+			defer close(done)
+
+			invite("70")
+
+			reqA := readRequest(uasA, sip.INVITE)
+			reqB := readRequest(uasB, sip.INVITE)
+			for _, req := range []sip.Request{reqA, reqB} {
+				maxForwards := req.GetHeaders("Max-Forwards")
+				Expect(maxForwards).Should(HaveLen(1))
+				Expect(maxForwards[0].Value()).Should(Equal("69"))
+				via := req.GetHeaders("Via")
+				Expect(via).Should(HaveLen(2))
+				Expect(via[1].Value()).Should(ContainSubstring(clientAddr))
+				recordRoute := req.GetHeaders("Record-Route")
+				Expect(recordRoute).Should(HaveLen(1))
+				Expect(recordRoute[0].Value()).Should(Equal("<sip:127.0.0.1:5060;lr>"))
+			}
+			Expect(reqA.Recipient().String()).Should(Equal("sip:bob@" + uasAddrA))
+
+			respond(uasB, reqB, 180, "Ringing")
+			res := testutils.ReadResponse(uac, sip.INVITE, logger)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(180)))
+
+			respond(uasA, reqA, 200, "OK")
+			res = readFinal(uac)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			viaHop, ok := res.ViaHop()
+			Expect(ok).Should(BeTrue())
+			Expect(viaHop.Host + ":" + viaHop.Port.String()).Should(Equal(clientAddr))
+
+			cancel := readRequest(uasB, sip.CANCEL)
+			respond(uasB, cancel, 200, "OK")
+			respond(uasB, reqB, 487, "Request Terminated")
+			readRequest(uasB, sip.ACK)
+		}, 3)
+
+		It("should respond 483 on exhausted Max-Forwards", func(done Done) {
+			defer close(done)
+
+			invite("0")
+			Expect(readFinal(uac).StatusCode()).Should(Equal(sip.StatusCode(483)))
+		}, 3)
+
+		Context("forking sequentially", func() {
+			BeforeEach(func() {
+				proxyConf.Forking = gosip.ForkSequential
+			})
+
+			It("should try the next target on failure and forward the best response", func(done Done) {
+				defer close(done)
+
+				invite("70")
+
+				reqA := readRequest(uasA, sip.INVITE)
+				respond(uasA, reqA, 486, "Busy Here")
+				readRequest(uasA, sip.ACK)
+
+				reqB := readRequest(uasB, sip.INVITE)
+				respond(uasB, reqB, 503, "Service Unavailable")
+
+				Expect(readFinal(uac).StatusCode()).Should(Equal(sip.StatusCode(486)))
+			}, 3)
+		})
+	})
+
+	Context("with b2bua", func() {
+		var (
+			uac, uas net.PacketConn
+			srvAddr  net.Addr
+			b2bua    *gosip.B2BUA
+		)
+
+		uasAddr := "127.0.0.1:9002"
+		sdp := "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\n"
+
+		JustBeforeEach(func() {
+			locator := gosip.LocatorFunc(func(ctx context.Context, req sip.Request) ([]sip.Uri, error) {
+				uri, err := parser.ParseUri("sip:bob@" + uasAddr)
+				if err != nil {
+					return nil, err
+				}
+				return []sip.Uri{uri}, nil
+			})
+			var err error
+			b2bua, err = gosip.NewB2BUA(srv, locator, gosip.B2BUAConfig{
+				Host: localTarget.Host,
+				Port: *localTarget.Port,
+				RewriteRequest: func(call *gosip.Call, leg gosip.Leg, req, origin sip.Request) {
+					req.SetBody(origin.Body()+"a=leg:"+leg.String()+"\r\n", true)
+				},
+				RewriteResponse: func(call *gosip.Call, leg gosip.Leg, res, origin sip.Response) {
+					res.AppendHeader(&sip.GenericHeader{HeaderName: "X-Leg", Contents: leg.String()})
+				},
+			}, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			uac, err = net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			uas, err = net.ListenPacket("udp", uasAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			srvAddr, err = net.ResolveUDPAddr("udp", localTarget.Addr())
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			uac.Close()
+			uas.Close()
+		})
+
+		send := func(conn net.PacketConn, lines ...string) {
+			testutils.WriteMessage(conn, testutils.Request(lines), srvAddr)
+		}
+
+		request := func(method sip.RequestMethod, ruri, branch, callID, toTag string, cseq int, body string) []string {
+			to := "To: \"Bob\" <sip:bob@far-far-away.com>"
+			if toTag != "" {
+				to += ";tag=" + toTag
+			}
+			lines := []string{
+				fmt.Sprintf("%s %s SIP/2.0", method, ruri),
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				to,
+				"Call-ID: " + callID,
+				fmt.Sprintf("CSeq: %d %s", cseq, method),
+				"Max-Forwards: 70",
+				"Contact: <sip:alice@" + clientAddr + ">",
+			}
+			if body != "" {
+				lines = append(lines, "Content-Type: application/sdp")
+			}
+			return append(lines, fmt.Sprintf("Content-Length: %d", len(body)), "", body)
+		}
+
+		readRequest := func(conn net.PacketConn, method sip.RequestMethod) sip.Request {
+			req, _ := testutils.ReadRequest(conn, method, logger)
+			return req
+		}
+
+		readResponse := func(conn net.PacketConn, method sip.RequestMethod) sip.Response {
+			return testutils.ReadResponse(conn, method, logger)
+		}
+
+		respond := func(req sip.Request, status sip.StatusCode, reason, body string) {
+			res := sip.NewResponseFromRequest("", req, status, reason, body)
+			to, _ := res.To()
+			to.Params.Add("tag", sip.String{Str: "uas"})
+			if status < 300 {
+				res.AppendHeader(&sip.ContactHeader{Address: &sip.SipUri{
+					FUser: sip.String{Str: "bob"},
+					FHost: "127.0.0.1",
+					FPort: func() *sip.Port { port := sip.Port(9002); return &port }(),
+				}})
+			}
+			if body != "" {
+				res.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "application/sdp"})
+			}
+			testutils.WriteMessage(uas, res, srvAddr)
+		}
+
+		toTag := func(res sip.Response) string {
+			to, ok := res.To()
+			Expect(ok).Should(BeTrue())
+			tag, ok := to.Params.Get("tag")
+			Expect(ok).Should(BeTrue())
+			return tag.String()
+		}
+
+		It("should bridge the call and release both legs on BYE", func(done Done) {
+			defer close(done)
+
+			callID := sip.GenerateBranch()
+			send(uac, request(sip.INVITE, "sip:bob@far-far-away.com", sip.GenerateBranch(), callID, "", 1, sdp)...)
+
+			invite := readRequest(uas, sip.INVITE)
+			outCallID, ok := invite.CallID()
+			Expect(ok).Should(BeTrue())
+			Expect(string(*outCallID)).ShouldNot(Equal(callID))
+			Expect(invite.Body()).Should(Equal(sdp + "a=leg:B\r\n"))
+			Expect(invite.Recipient().String()).Should(Equal("sip:bob@" + uasAddr))
+
+			respond(invite, 180, "Ringing", "")
+			res := readResponse(uac, sip.INVITE)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(180)))
+			Expect(res.GetHeaders("X-Leg")).Should(HaveLen(1))
+			tag := toTag(res)
+
+			respond(invite, 200, "OK", "v=0\r\n")
+			res = readResponse(uac, sip.INVITE)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(res.Body()).Should(Equal("v=0\r\n"))
+			Expect(toTag(res)).Should(Equal(tag))
+			contact, ok := res.Contact()
+			Expect(ok).Should(BeTrue())
+			readRequest(uas, sip.ACK)
+
+			call, ok := b2bua.Call(callID)
+			Expect(ok).Should(BeTrue())
+			Expect(call.State()).Should(Equal(gosip.CallEstablished))
+			Expect(call.CallID(gosip.LegB)).Should(Equal(string(*outCallID)))
+			byOut, ok := b2bua.Call(string(*outCallID))
+			Expect(ok).Should(BeTrue())
+			Expect(byOut).Should(BeIdenticalTo(call))
+
+			send(uac, request(sip.ACK, contact.Address.String(), sip.GenerateBranch(), callID, tag, 1, "")...)
+			send(uac, request(sip.BYE, contact.Address.String(), sip.GenerateBranch(), callID, tag, 2, "")...)
+			Expect(readResponse(uac, sip.BYE).StatusCode()).Should(Equal(sip.StatusCode(200)))
+
+			bye := readRequest(uas, sip.BYE)
+			byeCallID, _ := bye.CallID()
+			Expect(byeCallID).Should(Equal(outCallID))
+			respond(bye, 200, "OK", "")
+
+			Eventually(call.Done()).Should(BeClosed())
+			_, ok = b2bua.Call(callID)
+			Expect(ok).Should(BeFalse())
+		}, 3)
+
+		It("should hold ACK of the outgoing leg until ACK on delayed offer re-INVITE", func(done Done) {
+			defer close(done)
+
+			callID := sip.GenerateBranch()
+			send(uac, request(sip.INVITE, "sip:bob@far-far-away.com", sip.GenerateBranch(), callID, "", 1, sdp)...)
+			invite := readRequest(uas, sip.INVITE)
+			respond(invite, 200, "OK", "v=0\r\n")
+			res := readResponse(uac, sip.INVITE)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			tag := toTag(res)
+			contact, ok := res.Contact()
+			Expect(ok).Should(BeTrue())
+			readRequest(uas, sip.ACK)
+			send(uac, request(sip.ACK, contact.Address.String(), sip.GenerateBranch(), callID, tag, 1, "")...)
+
+			// re-INVITE without offer
+			send(uac, request(sip.INVITE, contact.Address.String(), sip.GenerateBranch(), callID, tag, 2, "")...)
+			reinvite := readRequest(uas, sip.INVITE)
+			offer := "v=0\r\no=offer\r\n"
+			respond(reinvite, 200, "OK", offer)
+			res = readResponse(uac, sip.INVITE)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(res.Body()).Should(Equal(offer))
+
+			Expect(uas.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			_, _, err := uas.ReadFrom(make([]byte, testutils.MaxPacketSize))
+			Expect(err).Should(HaveOccurred())
+			Expect(uas.SetReadDeadline(time.Time{})).To(Succeed())
+
+			answer := "v=0\r\no=answer\r\n"
+			send(uac, request(sip.ACK, contact.Address.String(), sip.GenerateBranch(), callID, tag, 2, answer)...)
+			ack := readRequest(uas, sip.ACK)
+			Expect(ack.Body()).Should(Equal(answer + "a=leg:B\r\n"))
+			Expect(ack.GetHeaders("Content-Type")).Should(HaveLen(1))
+			reinviteCSeq, ok := reinvite.CSeq()
+			Expect(ok).Should(BeTrue())
+			ackCSeq, ok := ack.CSeq()
+			Expect(ok).Should(BeTrue())
+			Expect(ackCSeq.SeqNo).Should(Equal(reinviteCSeq.SeqNo))
+		}, 3)
+
+		It("should cancel the outgoing leg on CANCEL", func(done Done) {
+			defer close(done)
+
+			callID := sip.GenerateBranch()
+			branch := sip.GenerateBranch()
+			send(uac, request(sip.INVITE, "sip:bob@far-far-away.com", branch, callID, "", 1, sdp)...)
+
+			invite := readRequest(uas, sip.INVITE)
+			respond(invite, 180, "Ringing", "")
+			Expect(readResponse(uac, sip.INVITE).StatusCode()).Should(Equal(sip.StatusCode(180)))
+
+			call, ok := b2bua.Call(callID)
+			Expect(ok).Should(BeTrue())
+			Expect(call.State()).Should(Equal(gosip.CallTrying))
+
+			send(uac, request(sip.CANCEL, "sip:bob@far-far-away.com", branch, callID, "", 1, "")...)
+			Expect(readResponse(uac, sip.CANCEL).StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(readResponse(uac, sip.INVITE).StatusCode()).Should(Equal(sip.StatusCode(487)))
+
+			cancel := readRequest(uas, sip.CANCEL)
+			respond(cancel, 200, "OK", "")
+			respond(invite, 487, "Request Terminated", "")
+			readRequest(uas, sip.ACK)
+
+			Eventually(call.Done()).Should(BeClosed())
+		}, 3)
+
+		It("should relay final failure of the outgoing leg", func(done Done) {
+			defer close(done)
+
+			callID := sip.GenerateBranch()
+			send(uac, request(sip.INVITE, "sip:bob@far-far-away.com", sip.GenerateBranch(), callID, "", 1, sdp)...)
+
+			invite := readRequest(uas, sip.INVITE)
+			respond(invite, 486, "Busy Here", "")
+			readRequest(uas, sip.ACK)
+
+			res := readResponse(uac, sip.INVITE)
+			Expect(res.StatusCode()).Should(Equal(sip.StatusCode(486)))
+			Expect(res.GetHeaders("X-Leg")).Should(HaveLen(1))
+			Eventually(func() bool {
+				_, ok := b2bua.Call(callID)
+				return ok
+			}).Should(BeFalse())
+		}, 3)
+	})
+
+	Context("over mem transport", func() {
+		var peer gosip.Server
+
+		peerTarget := transport.NewTarget("127.0.0.1", 5070)
+
+		JustBeforeEach(func() {
+			Expect(srv.Listen("mem", localTarget.Addr())).To(Succeed())
+			peer = gosip.NewServer(gosip.ServerConfig{}, nil, nil, logger)
+			Expect(peer.Listen("mem", peerTarget.Addr())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			transport.DefaultSwitchboard.SetConditions(transport.MemConditions{})
+			peer.Shutdown()
+		})
+
+		It("should retransmit request lost by the network", func(done Done) {
+			defer close(done)
+
+			var sent int32
+			transport.DefaultSwitchboard.SetConditions(transport.MemConditions{
+				Filter: func(src, dst string, msg sip.Message) bool {
+					if req, ok := msg.(sip.Request); ok && req.Method() == sip.OPTIONS {
+						return atomic.AddInt32(&sent, 1) > 1
+					}
+					return true
+				},
+			})
+
+			received := make(chan sip.Request, 1)
+			Expect(peer.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+				received <- req
+				_, err := peer.RespondOnRequest(req, 200, "OK", "", nil)
+				Expect(err).ShouldNot(HaveOccurred())
+			})).To(Succeed())
+
+			req := testutils.Request([]string{
+				"OPTIONS sip:bob@" + peerTarget.Addr() + ";transport=mem SIP/2.0",
+				"Via: SIP/2.0/MEM " + localTarget.Addr() + ";branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@" + localTarget.Addr() + ">;tag=1928301774",
+				"To: <sip:bob@" + peerTarget.Addr() + ">",
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Max-Forwards: 70",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+
+			// retransmission timer is driven by the mock clock
+			timing.MockMode = true
+			defer func() { timing.MockMode = false }()
+
+			type outcome struct {
+				res sip.Response
+				err error
+			}
+			result := make(chan outcome, 1)
+			go func() {
+				res, err := srv.RequestWithContext(context.Background(), req)
+				result <- outcome{res, err}
+			}()
+
+			Eventually(func() int32 { return atomic.LoadInt32(&sent) }).Should(Equal(int32(1)))
+			Consistently(result, 50*time.Millisecond).ShouldNot(Receive())
+			timing.Elapse(transaction.T1)
+
+			var out outcome
+			Eventually(result).Should(Receive(&out))
+			Expect(out.err).ShouldNot(HaveOccurred())
+			Expect(out.res.StatusCode()).Should(Equal(sip.StatusCode(200)))
+			Expect(atomic.LoadInt32(&sent)).Should(Equal(int32(2)))
+
+			var in sip.Request
+			Expect(received).Should(Receive(&in))
+			Expect(in.Transport()).Should(Equal("MEM"))
+		}, 3)
+	})
 })
@@ -0,0 +1,429 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// ExtensionTimer is the option tag of session timers - RFC 4028.
+// Add it to ServerConfig.Extensions to enable session timers on INVITE dialogs.
+const ExtensionTimer = "timer"
+
+const (
+	// DefaultSessionExpires is the session interval in seconds used when ServerConfig.SessionExpires is not set.
+	DefaultSessionExpires uint32 = 1800
+	// MinSessionExpires is the smallest session interval in seconds allowed by RFC 4028 4.
+	MinSessionExpires uint32 = 90
+)
+
+func getSessionExpires(msg sip.Message) (*sip.SessionExpires, bool) {
+	hdrs := msg.GetHeaders("Session-Expires")
+	if len(hdrs) == 0 {
+		return nil, false
+	}
+	se, ok := hdrs[0].(*sip.SessionExpires)
+
+	return se, ok
+}
+
+func getMinSE(msg sip.Message) (uint32, bool) {
+	hdrs := msg.GetHeaders("Min-SE")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	minSE, ok := hdrs[0].(*sip.MinSE)
+	if !ok {
+		return 0, false
+	}
+
+	return uint32(*minSE), true
+}
+
+func isSessionRefresh(method sip.RequestMethod) bool {
+	return method == sip.INVITE || method == sip.UPDATE
+}
+
+// sessionTimers negotiates session intervals of INVITE and UPDATE transactions - RFC 4028.
+type sessionTimers struct {
+	srv     *server
+	expires uint32
+	minSE   uint32
+
+	mu sync.Mutex
+	// negotiated Session-Expires of the server transactions
+	txs map[transaction.TxKey]*sip.SessionExpires
+}
+
+func newSessionTimers(srv *server, expires, minSE uint32) *sessionTimers {
+	if minSE < MinSessionExpires {
+		minSE = MinSessionExpires
+	}
+	if expires == 0 {
+		expires = DefaultSessionExpires
+	}
+	if expires < minSE {
+		expires = minSE
+	}
+
+	return &sessionTimers{
+		srv:     srv,
+		expires: expires,
+		minSE:   minSE,
+		txs:     make(map[transaction.TxKey]*sip.SessionExpires),
+	}
+}
+
+// headers returns Session-Expires and Min-SE headers for the new INVITE.
+func (st *sessionTimers) headers() []sip.Header {
+	minSE := sip.MinSE(st.minSE)
+
+	return []sip.Header{
+		&sip.SessionExpires{Delta: st.expires},
+		&minSE,
+	}
+}
+
+// check rejects the request with too small session interval by 422 response,
+// otherwise Session-Expires of the 2xx response is negotiated - RFC 4028 9.
+func (st *sessionTimers) check(req sip.Request, tx sip.ServerTransaction) bool {
+	if !isSessionRefresh(req.Method()) || tx == nil {
+		return true
+	}
+
+	uacSupported := hasOptionTag(req, "Supported", ExtensionTimer) || hasOptionTag(req, "Require", ExtensionTimer)
+	se, ok := getSessionExpires(req)
+	if ok {
+		if se.Delta < st.minSE {
+			res := sip.NewResponseFromRequest("", req, 422, "Session Interval Too Small", "")
+			minSE := sip.MinSE(st.minSE)
+			res.AppendHeader(&minSE)
+			if _, err := st.srv.Respond(res); err != nil {
+				st.srv.Log().WithFields(req.Fields()).
+					Errorf("respond '422 Session Interval Too Small' failed: %s", err)
+			}
+
+			return false
+		}
+		se = &sip.SessionExpires{Delta: se.Delta, Refresher: se.Refresher}
+	} else {
+		se = &sip.SessionExpires{Delta: st.expires}
+		if minSE, ok := getMinSE(req); ok && minSE > se.Delta {
+			se.Delta = minSE
+		}
+	}
+	if se.Refresher == "" {
+		if uacSupported {
+			se.Refresher = sip.RefresherUAC
+		} else {
+			se.Refresher = sip.RefresherUAS
+		}
+	}
+
+	key, err := transaction.MakeServerTxKey(req)
+	if err != nil {
+		return true
+	}
+
+	st.mu.Lock()
+	st.txs[key] = se
+	st.mu.Unlock()
+
+	go func() {
+		<-tx.Done()
+
+		st.mu.Lock()
+		delete(st.txs, key)
+		st.mu.Unlock()
+	}()
+
+	return true
+}
+
+// prepare adds negotiated Session-Expires to the 2xx response.
+// It returns Session-Expires that should be applied to the dialog.
+func (st *sessionTimers) prepare(res sip.Response) *sip.SessionExpires {
+	if res.IsProvisional() {
+		return nil
+	}
+	key, err := transaction.MakeServerTxKey(res)
+	if err != nil {
+		return nil
+	}
+
+	st.mu.Lock()
+	se, ok := st.txs[key]
+	delete(st.txs, key)
+	st.mu.Unlock()
+
+	if !ok || !res.IsSuccess() {
+		return nil
+	}
+
+	if hdr, ok := getSessionExpires(res); ok {
+		se = hdr
+	} else {
+		res.AppendHeader(se.Clone())
+	}
+	if se.Refresher == sip.RefresherUAC && !hasOptionTag(res, "Require", ExtensionTimer) {
+		res.AppendHeader(&sip.RequireHeader{Options: []string{ExtensionTimer}})
+	}
+
+	return se
+}
+
+// start runs the session timer of the dialog after 2xx response sent on INVITE or UPDATE.
+func (st *sessionTimers) start(res sip.Response, se *sip.SessionExpires) {
+	id, err := sip.MakeDialogIDFromMessage(res)
+	if err != nil {
+		return
+	}
+	dlg, ok := st.srv.dialogs.get(id)
+	if !ok {
+		return
+	}
+
+	dlg.startSessionTimer(se.Delta, se.Refresher == sip.RefresherUAS)
+}
+
+// raiseInterval updates request rejected with 422 response to be sent again - RFC 4028 7.4.
+func (st *sessionTimers) raiseInterval(req sip.Request, res sip.Response) bool {
+	minSE, ok := getMinSE(res)
+	if !ok {
+		return false
+	}
+	se, ok := getSessionExpires(req)
+	if !ok || se.Delta >= minSE {
+		return false
+	}
+
+	se = &sip.SessionExpires{Delta: minSE, Refresher: se.Refresher}
+	req.ReplaceHeaders(se.Name(), []sip.Header{se})
+	hdr := sip.MinSE(minSE)
+	if _, ok := getMinSE(req); ok {
+		req.ReplaceHeaders(hdr.Name(), []sip.Header{&hdr})
+	} else {
+		req.AppendHeader(&hdr)
+	}
+
+	if viaHop, ok := req.ViaHop(); ok {
+		viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+	if cseq, ok := req.CSeq(); ok {
+		cseq := cseq.Clone().(*sip.CSeq)
+		cseq.SeqNo++
+		req.ReplaceHeaders(cseq.Name(), []sip.Header{cseq})
+	}
+
+	return true
+}
+
+// sessionTimer holds session timer state of the dialog.
+type sessionTimer struct {
+	interval  uint32
+	refresher bool
+	timer     timing.Timer
+}
+
+// startSessionTimer (re)starts session timer with the session interval in seconds.
+// Refresher sends refresh request at the half of the interval,
+// other side terminates the session a bit before the interval ends - RFC 4028 10.
+func (dlg *dialog) startSessionTimer(interval uint32, refresher bool) {
+	if interval == 0 {
+		dlg.stopSessionTimer()
+		return
+	}
+
+	delay := time.Duration(interval) * time.Second / 2
+	fn := dlg.refreshSession
+	if !refresher {
+		margin := interval / 3
+		if margin > 32 {
+			margin = 32
+		}
+		delay = time.Duration(interval-margin) * time.Second
+		fn = dlg.expireSession
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.session != nil && dlg.session.timer != nil {
+		dlg.session.timer.Stop()
+	}
+	dlg.session = &sessionTimer{
+		interval:  interval,
+		refresher: refresher,
+		timer:     timing.AfterFunc(delay, fn),
+	}
+
+	dlg.Log().Debugf("session timer started: interval %ds, refresher %t", interval, refresher)
+}
+
+func (dlg *dialog) stopSessionTimer() {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.session != nil && dlg.session.timer != nil {
+		dlg.session.timer.Stop()
+	}
+	dlg.session = nil
+}
+
+// remoteAllows checks Allow header received from the remote side of the dialog.
+func (dlg *dialog) remoteAllows(method sip.RequestMethod) bool {
+	msg := sip.Message(dlg.sd.Invite())
+	if dlg.sd.IsUAC() {
+		msg = dlg.sd.Response()
+	}
+	if msg == nil {
+		return false
+	}
+
+	for _, hdr := range msg.GetHeaders("Allow") {
+		if allow, ok := hdr.(sip.AllowHeader); ok {
+			for _, m := range allow {
+				if m == method {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// localSession returns the last session description sent by the local side.
+func (dlg *dialog) localSession() (string, []sip.Header) {
+	msg := sip.Message(dlg.sd.Response())
+	if dlg.sd.IsUAC() {
+		msg = dlg.sd.Invite()
+	}
+	if msg == nil || msg.Body() == "" {
+		return "", nil
+	}
+
+	return msg.Body(), msg.GetHeaders("Content-Type")
+}
+
+// refreshSession sends UPDATE if the remote side allows it or re-INVITE otherwise - RFC 4028 7.4.
+func (dlg *dialog) refreshSession() {
+	select {
+	case <-dlg.done:
+		return
+	default:
+	}
+
+	dlg.mu.Lock()
+	session := dlg.session
+	dlg.mu.Unlock()
+	if session == nil {
+		return
+	}
+
+	method := sip.INVITE
+	body, hdrs := dlg.localSession()
+	if dlg.remoteAllows(sip.UPDATE) {
+		method = sip.UPDATE
+		body, hdrs = "", nil
+	}
+
+	req, err := dlg.sd.NewRequest(method, body)
+	if err != nil {
+		dlg.Log().Warnf("create session refresh request failed: %s", err)
+		return
+	}
+	for _, hdr := range hdrs {
+		req.AppendHeader(hdr.Clone())
+	}
+	req.AppendHeader(&sip.SessionExpires{Delta: session.interval, Refresher: sip.RefresherUAC})
+	req.AppendHeader(&sip.RequireHeader{Options: []string{ExtensionTimer}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), dlg.timers.TimerF)
+	defer cancel()
+
+	res, err := dlg.srv.RequestWithContext(ctx, req)
+	if err != nil {
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && reqErr.Response != nil && reqErr.Code != 408 && reqErr.Code != 481 {
+			// remote side has answered, so it is still alive,
+			// i.e. devices without UPDATE support reject re-INVITE during the stream
+			dlg.Log().Warnf("session refresh rejected: %s", err)
+			dlg.startSessionTimer(session.interval, true)
+
+			return
+		}
+
+		dlg.Log().Warnf("session refresh failed, terminating dialog: %s", err)
+		dlg.expireSession()
+
+		return
+	}
+
+	if cseq, ok := res.CSeq(); ok {
+		dlg.sd.SetLocalSeq(cseq.SeqNo)
+	}
+	dlg.sd.ReceiveResponse(res)
+	if method == sip.INVITE {
+		ack := sip.NewAckRequest("", req, res, "", dlg.sd.Fields())
+		if err := dlg.srv.Send(ack); err != nil {
+			dlg.Log().Warnf("send ACK on session refresh failed: %s", err)
+		}
+	}
+
+	// UAS without session timer support leaves refreshing to the UAC - RFC 4028 7.2
+	if se, ok := getSessionExpires(res); ok {
+		dlg.startSessionTimer(se.Delta, se.Refresher != sip.RefresherUAS)
+	} else {
+		dlg.startSessionTimer(session.interval, true)
+	}
+}
+
+// expireSession terminates the dialog with BYE and raises session expired event - RFC 4028 10.
+func (dlg *dialog) expireSession() {
+	select {
+	case <-dlg.done:
+		return
+	default:
+	}
+
+	dlg.Log().Warn("session timer expired, terminating dialog")
+
+	ctx, cancel := context.WithTimeout(context.Background(), dlg.timers.TimerF)
+	defer cancel()
+	if err := dlg.Bye(ctx); err != nil {
+		dlg.Log().Debugf("send BYE on session expiration failed: %s", err)
+	}
+
+	dlg.hmu.RLock()
+	handler := dlg.onExpired
+	dlg.hmu.RUnlock()
+	if handler != nil {
+		handler()
+	}
+}
+
+// answerRefresh answers in-dialog session refresh request without dialog handler.
+// re-INVITE gets the last local session description back.
+func (dlg *dialog) answerRefresh(req sip.Request) {
+	body, hdrs := "", []sip.Header(nil)
+	if req.IsInvite() {
+		body, hdrs = dlg.localSession()
+	}
+
+	res := sip.NewResponseFromRequest("", req, 200, "OK", body)
+	for _, hdr := range hdrs {
+		res.AppendHeader(hdr.Clone())
+	}
+	if dlg.sd.LocalTarget() != nil {
+		res.AppendHeader(&sip.ContactHeader{Address: dlg.sd.LocalTarget().Clone()})
+	}
+	if _, err := dlg.srv.Respond(res); err != nil {
+		dlg.Log().WithFields(req.Fields()).Errorf("respond '200 OK' on session refresh failed: %s", err)
+	}
+}
@@ -2,16 +2,19 @@ package sip
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
-	"regexp"
+	"hash"
 	"strings"
 )
 
-// currently only Digest and MD5
+// Digest credentials with MD5, SHA-256 and SHA-512-256 algorithms and their -sess variants
 type Authorization struct {
 	realm     string
 	nonce     string
+	opaque    string
 	algorithm string
 	username  string
 	password  string
@@ -25,29 +28,38 @@ type Authorization struct {
 }
 
 func AuthFromValue(value string) *Authorization {
+	challenges, _ := ParseAuthChallenges(value)
+	if len(challenges) == 0 {
+		return authFromChallenge(&AuthChallenge{})
+	}
+
+	return authFromChallenge(challenges[0])
+}
+
+func authFromChallenge(challenge *AuthChallenge) *Authorization {
 	auth := &Authorization{
 		algorithm: "MD5",
 		other:     make(map[string]string),
 	}
 
-	re := regexp.MustCompile(`([\w]+)="([^"]+)"`)
-	matches := re.FindAllStringSubmatch(value, -1)
-	for _, match := range matches {
-		switch match[1] {
+	for _, param := range challenge.Params {
+		switch strings.ToLower(param.Name) {
 		case "realm":
-			auth.realm = match[2]
+			auth.realm = param.Value
 		case "algorithm":
-			auth.algorithm = match[2]
+			auth.algorithm = param.Value
 		case "nonce":
-			auth.nonce = match[2]
+			auth.nonce = param.Value
+		case "opaque":
+			auth.opaque = param.Value
 		case "username":
-			auth.username = match[2]
+			auth.username = param.Value
 		case "uri":
-			auth.uri = match[2]
+			auth.uri = param.Value
 		case "response":
-			auth.response = match[2]
+			auth.response = param.Value
 		case "qop":
-			for _, v := range strings.Split(match[2], ",") {
+			for _, v := range strings.Split(param.Value, ",") {
 				v = strings.Trim(v, " ")
 				if v == "auth" || v == "auth-int" {
 					auth.qop = "auth"
@@ -55,17 +67,82 @@ func AuthFromValue(value string) *Authorization {
 				}
 			}
 		case "nc":
-			auth.nc = match[2]
+			auth.nc = param.Value
 		case "cnonce":
-			auth.cnonce = match[2]
+			auth.cnonce = param.Value
 		default:
-			auth.other[match[1]] = match[2]
+			auth.other[param.Name] = param.Value
 		}
 	}
 
 	return auth
 }
 
+// ParseAuthChallenges parses challenges or credentials value into the list of auth-schemes with auth-params,
+// both quoted and token param values are supported - RFC 3261 25.1.
+// Params that precede any auth-scheme are collected into the challenge with empty scheme.
+func ParseAuthChallenges(value string) ([]*AuthChallenge, error) {
+	challenges := make([]*AuthChallenge, 0)
+	var current *AuthChallenge
+
+	for {
+		value = strings.TrimLeft(value, ", \t")
+		if len(value) == 0 {
+			break
+		}
+
+		end := strings.IndexAny(value, "=, \t")
+		if end == -1 {
+			end = len(value)
+		}
+		token := value[:end]
+		value = strings.TrimLeft(value[end:], " \t")
+
+		if !strings.HasPrefix(value, "=") {
+			current = &AuthChallenge{Scheme: token, Params: make([]AuthParam, 0)}
+			challenges = append(challenges, current)
+			continue
+		}
+		if token == "" {
+			return challenges, fmt.Errorf("missing auth-param name in '%s'", value)
+		}
+
+		value = strings.TrimLeft(value[1:], " \t")
+		param := AuthParam{Name: token}
+		if strings.HasPrefix(value, `"`) {
+			var buf strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				buf.WriteByte(value[i])
+			}
+			if i == len(value) {
+				return challenges, fmt.Errorf("unterminated quoted auth-param '%s'", token)
+			}
+			param.Value = buf.String()
+			param.Quoted = true
+			value = value[i+1:]
+		} else {
+			end := strings.IndexAny(value, ", \t")
+			if end == -1 {
+				end = len(value)
+			}
+			param.Value = value[:end]
+			value = value[end:]
+		}
+
+		if current == nil {
+			current = &AuthChallenge{Params: make([]AuthParam, 0)}
+			challenges = append(challenges, current)
+		}
+		current.Params = append(current.Params, param)
+	}
+
+	return challenges, nil
+}
+
 func (auth *Authorization) Realm() string {
 	return auth.realm
 }
@@ -74,6 +151,10 @@ func (auth *Authorization) Nonce() string {
 	return auth.nonce
 }
 
+func (auth *Authorization) Opaque() string {
+	return auth.opaque
+}
+
 func (auth *Authorization) Algorithm() string {
 	return auth.algorithm
 }
@@ -144,6 +225,7 @@ func (auth *Authorization) SetCNonce(cnonce string) {
 
 func (auth *Authorization) CalcResponse() string {
 	return calcResponse(
+		auth.algorithm,
 		auth.username,
 		auth.realm,
 		auth.password,
@@ -156,50 +238,106 @@ func (auth *Authorization) CalcResponse() string {
 	)
 }
 
+// Credentials returns digest credentials to be sent in Authorization/Proxy-Authorization header.
+func (auth *Authorization) Credentials() *AuthChallenge {
+	creds := &AuthChallenge{Scheme: "Digest"}
+	creds.SetParam("realm", auth.realm, true).
+		SetParam("algorithm", auth.algorithm, false).
+		SetParam("nonce", auth.nonce, true).
+		SetParam("username", auth.username, true).
+		SetParam("uri", auth.uri, true).
+		SetParam("response", auth.response, true)
+	if auth.opaque != "" {
+		creds.SetParam("opaque", auth.opaque, true)
+	}
+	if auth.qop == "auth" {
+		creds.SetParam("qop", auth.qop, false).
+			SetParam("nc", auth.nc, false)
+	}
+	// cnonce is a part of A1 of -sess algorithms even without qop - RFC 2617 3.2.2.2
+	if auth.qop == "auth" || strings.HasSuffix(strings.ToLower(auth.algorithm), "-sess") {
+		creds.SetParam("cnonce", auth.cnonce, true)
+	}
+
+	return creds
+}
+
 func (auth *Authorization) String() string {
 	if auth == nil {
 		return "<nil>"
 	}
 
-	str := fmt.Sprintf(
-		`Digest realm="%s",algorithm=%s,nonce="%s",username="%s",uri="%s",response="%s"`,
-		auth.realm,
-		auth.algorithm,
-		auth.nonce,
-		auth.username,
-		auth.uri,
-		auth.response,
-	)
-	if auth.qop == "auth" {
-		str += fmt.Sprintf(`,qop=%s,nc=%s,cnonce="%s"`, auth.qop, auth.nc, auth.cnonce)
+	return auth.Credentials().String()
+}
+
+// digestAlgorithms lists supported digest algorithms ordered by strength - RFC 8760.
+var digestAlgorithms = []string{
+	"SHA-512-256",
+	"SHA-512-256-sess",
+	"SHA-256",
+	"SHA-256-sess",
+	"MD5",
+	"MD5-sess",
+}
+
+// digestHash returns hash function for the digest algorithm.
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	case "SHA-512-256":
+		return sha512.New512_256, true
+	default:
+		return nil, false
+	}
+}
+
+// digestStrength returns position of the algorithm in the supported list, lower is stronger.
+// Unsupported algorithms get -1.
+func digestStrength(algorithm string) int {
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	for i, alg := range digestAlgorithms {
+		if strings.EqualFold(alg, algorithm) {
+			return i
+		}
 	}
 
-	return str
+	return -1
 }
 
-// calculates Authorization response https://www.ietf.org/rfc/rfc2617.txt
-func calcResponse(username, realm, password, method, uri, nonce, qop, cnonce, nc string) string {
-	calcA1 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(username + ":" + realm + ":" + password))
+// IsDigestAlgorithmSupported reports whether the digest algorithm can be used for authorization.
+func IsDigestAlgorithmSupported(algorithm string) bool {
+	return digestStrength(algorithm) != -1
+}
 
-		return hex.EncodeToString(encoder.Sum(nil))
+// calculates Authorization response https://www.ietf.org/rfc/rfc2617.txt, https://www.ietf.org/rfc/rfc8760.txt
+func calcResponse(algorithm, username, realm, password, method, uri, nonce, qop, cnonce, nc string) string {
+	newHash, ok := digestHash(algorithm)
+	if !ok {
+		return ""
 	}
-	calcA2 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(method + ":" + uri))
+	h := func(data string) string {
+		encoder := newHash()
+		encoder.Write([]byte(data))
 
 		return hex.EncodeToString(encoder.Sum(nil))
 	}
 
-	encoder := md5.New()
-	encoder.Write([]byte(calcA1() + ":" + nonce + ":"))
+	a1 := h(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		a1 = h(a1 + ":" + nonce + ":" + cnonce)
+	}
+	a2 := h(method + ":" + uri)
+
 	if qop != "" {
-		encoder.Write([]byte(nc + ":" + cnonce + ":" + qop + ":"))
+		return h(a1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + a2)
 	}
-	encoder.Write([]byte(calcA2()))
 
-	return hex.EncodeToString(encoder.Sum(nil))
+	return h(a1 + ":" + nonce + ":" + a2)
 }
 
 func AuthorizeRequest(request Request, response Response, user, password MaybeString) error {
@@ -219,16 +357,20 @@ func AuthorizeRequest(request Request, response Response, user, password MaybeSt
 	}
 
 	if hdrs := response.GetHeaders(authenticateHeaderName); len(hdrs) > 0 {
-		authenticateHeader := hdrs[0].(*GenericHeader)
-		auth := AuthFromValue(authenticateHeader.Contents).
-			SetMethod(string(request.Method())).
+		auth := selectChallenge(hdrs)
+		if auth == nil {
+			return fmt.Errorf("authorize request: no supported digest algorithm in '%s'", authenticateHeaderName)
+		}
+		auth.SetMethod(string(request.Method())).
 			SetUri(request.Recipient().String()).
 			SetUsername(user.String())
 		if password != nil {
 			auth.SetPassword(password.String())
 		}
-		if auth.Qop() == "auth" {
-			auth.SetNc("00000001")
+		if auth.Qop() == "auth" || strings.HasSuffix(strings.ToLower(auth.Algorithm()), "-sess") {
+			if auth.Qop() == "auth" {
+				auth.SetNc("00000001")
+			}
 			encoder := md5.New()
 			encoder.Write([]byte(user.String() + request.Recipient().String()))
 			if password != nil {
@@ -238,15 +380,14 @@ func AuthorizeRequest(request Request, response Response, user, password MaybeSt
 		}
 		auth.SetResponse(auth.CalcResponse())
 
+		authorizationHeader := &AuthorizationHeader{
+			HeaderName:  authorizeHeaderName,
+			Credentials: auth.Credentials(),
+		}
 		if hdrs = request.GetHeaders(authorizeHeaderName); len(hdrs) > 0 {
-			authorizationHeader := hdrs[0].Clone().(*GenericHeader)
-			authorizationHeader.Contents = auth.String()
-			request.ReplaceHeaders(authorizationHeader.Name(), []Header{authorizationHeader})
+			request.ReplaceHeaders(authorizeHeaderName, []Header{authorizationHeader})
 		} else {
-			request.AppendHeader(&GenericHeader{
-				HeaderName: authorizeHeaderName,
-				Contents:   auth.String(),
-			})
+			request.AppendHeader(authorizationHeader)
 		}
 	} else {
 		return fmt.Errorf("authorize request: header '%s' not found in response", authenticateHeaderName)
@@ -265,6 +406,40 @@ func AuthorizeRequest(request Request, response Response, user, password MaybeSt
 	return nil
 }
 
+// selectChallenge picks the strongest supported digest challenge - RFC 8760 2.4.
+func selectChallenge(hdrs []Header) *Authorization {
+	var (
+		best     *Authorization
+		strength int
+	)
+	for _, hdr := range hdrs {
+		var challenges []*AuthChallenge
+		if h, ok := hdr.(*AuthenticateHeader); ok {
+			challenges = h.Challenges
+		} else {
+			challenges, _ = ParseAuthChallenges(hdr.Value())
+		}
+
+		for _, challenge := range challenges {
+			if challenge.Scheme != "" && !strings.EqualFold(challenge.Scheme, "Digest") {
+				continue
+			}
+
+			auth := authFromChallenge(challenge)
+			s := digestStrength(auth.Algorithm())
+			if s == -1 {
+				continue
+			}
+			if best == nil || s < strength {
+				best = auth
+				strength = s
+			}
+		}
+	}
+
+	return best
+}
+
 type Authorizer interface {
 	AuthorizeRequest(request Request, response Response) error
 }
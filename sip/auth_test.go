@@ -0,0 +1,102 @@
+package sip_test
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// test vectors from RFC 7616 3.9.1
+func TestAuthorizationCalcResponse(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, c := range cases {
+		auth := sip.AuthFromValue(`Digest realm="http-auth@example.org", qop="auth", algorithm=` + c.algorithm +
+			`, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`).
+			SetUsername("Mufasa").
+			SetPassword("Circle of Life").
+			SetMethod("GET").
+			SetUri("/dir/index.html")
+		auth.SetNc("00000001")
+		auth.SetCNonce("f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+
+		if response := auth.CalcResponse(); response != c.response {
+			t.Errorf("%s: expected response %s, got %s", c.algorithm, c.response, response)
+		}
+	}
+}
+
+func TestAuthorizeRequestStrongestChallenge(t *testing.T) {
+	req := newRegisterRequest()
+	res := sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	for _, alg := range []string{"MD5", "SHA-512-256", "UNKNOWN", "SHA-256"} {
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "WWW-Authenticate",
+			Contents:   `Digest realm="wonderland.com", nonce="abc", qop="auth", algorithm=` + alg,
+		})
+	}
+
+	if err := sip.AuthorizeRequest(req, res, sip.String{Str: "alice"}, sip.String{Str: "secret"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	hdrs := req.GetHeaders("Authorization")
+	if len(hdrs) != 1 {
+		t.Fatalf("expected Authorization header, got %v", hdrs)
+	}
+	auth := sip.AuthFromValue(hdrs[0].Value())
+	if auth.Algorithm() != "SHA-512-256" {
+		t.Errorf("expected SHA-512-256 algorithm, got %s", auth.Algorithm())
+	}
+	if len(auth.Response()) != 64 {
+		t.Errorf("expected 256 bit response, got %s", auth.Response())
+	}
+
+	expected := sip.AuthFromValue(hdrs[0].Value()).SetMethod(string(sip.REGISTER)).SetPassword("secret")
+	if expected.CalcResponse() != auth.Response() {
+		t.Errorf("response mismatch in %s", hdrs[0].Value())
+	}
+}
+
+func TestAuthorizeRequestSess(t *testing.T) {
+	challenger := sip.NewChallenger("wonderland.com")
+	challenger.Algorithm = "SHA-256-sess"
+	req := newRegisterRequest()
+
+	res := challenger.Challenge(req, false)
+	authorizer := &sip.DefaultAuthorizer{User: sip.String{Str: "alice"}, Password: sip.String{Str: "secret"}}
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := challenger.Verify(req, lookupPassword); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestAuthorizeRequestSessWithoutQop(t *testing.T) {
+	challenger := sip.NewChallenger("wonderland.com")
+	challenger.Algorithm = "MD5-sess"
+	challenger.Qop = ""
+	req := newRegisterRequest()
+
+	res := challenger.Challenge(req, false)
+	authorizer := &sip.DefaultAuthorizer{User: sip.String{Str: "alice"}, Password: sip.String{Str: "secret"}}
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	auth := sip.AuthFromValue(req.GetHeaders("Authorization")[0].Value())
+	if auth.CNonce() == "" || auth.Qop() != "" {
+		t.Errorf("expected cnonce without qop, got %s", auth)
+	}
+	if _, err := challenger.Verify(req, lookupPassword); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,264 @@
+package sip
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/util"
+)
+
+const DefaultNonceTTL = 5 * time.Minute
+
+var (
+	// ErrAuthMissing is returned when the request has no credentials for the challenger realm.
+	ErrAuthMissing = errors.New("authorization credentials missing")
+	// ErrAuthInvalid is returned when the credentials are malformed or the response digest mismatch.
+	ErrAuthInvalid = errors.New("authorization credentials invalid")
+	// ErrNonceUnknown is returned when the nonce was not issued by the nonce store.
+	ErrNonceUnknown = errors.New("nonce unknown")
+	// ErrNonceStale is returned when the nonce was issued but has already expired.
+	// The client should repeat the request with the new nonce without asking a user for the password.
+	ErrNonceStale = errors.New("nonce stale")
+	// ErrNonceReplay is returned when the nonce count was not increased - RFC 2617 3.2.2.
+	ErrNonceReplay = errors.New("nonce count replayed")
+)
+
+// NonceStore issues nonces and tracks their usage.
+type NonceStore interface {
+	// Generate returns new nonce.
+	Generate() string
+	// Use validates nonce with nonce count.
+	// Zero nc is used for credentials without qop, it skips replay check.
+	Use(nonce string, nc uint64) error
+}
+
+type nonceEntry struct {
+	expires time.Time
+	nc      uint64
+}
+
+type memoryNonceStore struct {
+	ttl    time.Duration
+	nonces map[string]*nonceEntry
+	sweep  time.Time
+
+	mu sync.Mutex
+}
+
+// NewMemoryNonceStore creates in-memory nonce store, nonces are valid for ttl after generation.
+func NewMemoryNonceStore(ttl time.Duration) NonceStore {
+	if ttl <= 0 {
+		ttl = DefaultNonceTTL
+	}
+
+	return &memoryNonceStore{
+		ttl:    ttl,
+		nonces: make(map[string]*nonceEntry),
+		sweep:  time.Now().Add(ttl),
+	}
+}
+
+func (store *memoryNonceStore) Generate() string {
+	nonce := util.RandString(32)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	store.collect(now)
+	store.nonces[nonce] = &nonceEntry{expires: now.Add(store.ttl)}
+
+	return nonce
+}
+
+func (store *memoryNonceStore) Use(nonce string, nc uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	store.collect(now)
+
+	entry, ok := store.nonces[nonce]
+	if !ok {
+		return ErrNonceUnknown
+	}
+	if now.After(entry.expires) {
+		return ErrNonceStale
+	}
+	if nc == 0 {
+		return nil
+	}
+	if nc <= entry.nc {
+		return ErrNonceReplay
+	}
+	entry.nc = nc
+
+	return nil
+}
+
+// collect drops nonces expired long enough to not be reported as stale anymore.
+func (store *memoryNonceStore) collect(now time.Time) {
+	if now.Before(store.sweep) {
+		return
+	}
+
+	for nonce, entry := range store.nonces {
+		if now.Sub(entry.expires) > store.ttl {
+			delete(store.nonces, nonce)
+		}
+	}
+	store.sweep = now.Add(store.ttl)
+}
+
+// PasswordLookup returns password of the user in the realm.
+type PasswordLookup func(username, realm string) (string, bool)
+
+// Challenger implements server side of the digest authentication - RFC 3261 22.
+type Challenger struct {
+	Realm     string
+	Opaque    string
+	Qop       string
+	Algorithm string
+	// Proxy selects 407 Proxy Authentication Required challenges
+	// instead of 401 Unauthorized.
+	Proxy  bool
+	Nonces NonceStore
+}
+
+// NewChallenger creates challenger for the realm with qop=auth, MD5 algorithm and in-memory nonce store.
+func NewChallenger(realm string) *Challenger {
+	return &Challenger{
+		Realm:     realm,
+		Opaque:    util.RandString(16),
+		Qop:       "auth",
+		Algorithm: "MD5",
+		Nonces:    NewMemoryNonceStore(DefaultNonceTTL),
+	}
+}
+
+func (c *Challenger) headerNames() (string, string) {
+	if c.Proxy {
+		return "Proxy-Authenticate", "Proxy-Authorization"
+	}
+
+	return "WWW-Authenticate", "Authorization"
+}
+
+// NewChallenge builds digest challenge with the fresh nonce.
+func (c *Challenger) NewChallenge(stale bool) *AuthChallenge {
+	challenge := &AuthChallenge{Scheme: "Digest"}
+	challenge.SetParam("realm", c.Realm, true).
+		SetParam("nonce", c.Nonces.Generate(), true)
+	if c.Opaque != "" {
+		challenge.SetParam("opaque", c.Opaque, true)
+	}
+	if c.Algorithm != "" {
+		challenge.SetParam("algorithm", c.Algorithm, false)
+	}
+	if c.Qop != "" {
+		challenge.SetParam("qop", c.Qop, true)
+	}
+	if stale {
+		challenge.SetParam("stale", "true", false)
+	}
+
+	return challenge
+}
+
+// Challenge creates 401/407 response on the request.
+func (c *Challenger) Challenge(req Request, stale bool) Response {
+	var res Response
+	if c.Proxy {
+		res = NewResponseFromRequest("", req, 407, "Proxy Authentication Required", "")
+	} else {
+		res = NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	}
+
+	name, _ := c.headerNames()
+	res.AppendHeader(&AuthenticateHeader{
+		HeaderName: name,
+		Challenges: []*AuthChallenge{c.NewChallenge(stale)},
+	})
+
+	return res
+}
+
+// Verify checks request credentials issued for the challenger realm.
+// Successfully verified credentials are returned.
+func (c *Challenger) Verify(req Request, lookup PasswordLookup) (*Authorization, error) {
+	_, name := c.headerNames()
+
+	var auth *Authorization
+	for _, hdr := range req.GetHeaders(name) {
+		if a := AuthFromValue(hdr.Value()); a.Realm() == c.Realm {
+			auth = a
+			break
+		}
+	}
+	if auth == nil {
+		return nil, ErrAuthMissing
+	}
+
+	if auth.Username() == "" || auth.Nonce() == "" || auth.Response() == "" {
+		return auth, ErrAuthInvalid
+	}
+	if c.Opaque != "" && auth.Opaque() != c.Opaque {
+		return auth, ErrAuthInvalid
+	}
+	if c.Algorithm != "" && !strings.EqualFold(auth.Algorithm(), c.Algorithm) {
+		return auth, ErrAuthInvalid
+	}
+
+	var nc uint64
+	if c.Qop != "" {
+		if auth.Qop() != c.Qop || auth.CNonce() == "" {
+			return auth, ErrAuthInvalid
+		}
+		n, err := strconv.ParseUint(auth.Nc(), 16, 64)
+		if err != nil || n == 0 {
+			return auth, ErrAuthInvalid
+		}
+		nc = n
+	}
+
+	password, ok := lookup(auth.Username(), auth.Realm())
+	if !ok {
+		return auth, ErrAuthInvalid
+	}
+
+	expected := *auth
+	expected.SetMethod(string(req.Method())).SetPassword(password)
+	if subtle.ConstantTimeCompare([]byte(expected.CalcResponse()), []byte(auth.Response())) != 1 {
+		return auth, ErrAuthInvalid
+	}
+
+	if err := c.Nonces.Use(auth.Nonce(), nc); err != nil {
+		return auth, err
+	}
+
+	return auth, nil
+}
+
+// Authenticate verifies request credentials and returns challenge response
+// if the request must be rejected.
+// Handlers can protect themselves with one call:
+//
+//	if res, ok := challenger.Authenticate(req, lookup); !ok {
+//		srv.Respond(res)
+//		return
+//	}
+func (c *Challenger) Authenticate(req Request, lookup PasswordLookup) (Response, bool) {
+	_, err := c.Verify(req, lookup)
+	switch {
+	case err == nil:
+		return nil, true
+	case errors.Is(err, ErrNonceStale):
+		return c.Challenge(req, true), false
+	default:
+		return c.Challenge(req, false), false
+	}
+}
@@ -0,0 +1,115 @@
+package sip_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func newRegisterRequest() sip.Request {
+	req := newDialogInvite()
+	req.SetMethod(sip.REGISTER)
+	req.ReplaceHeaders("CSeq", []sip.Header{&sip.CSeq{SeqNo: 1, MethodName: sip.REGISTER}})
+
+	return req
+}
+
+func lookupPassword(username, realm string) (string, bool) {
+	if username == "alice" && realm == "wonderland.com" {
+		return "secret", true
+	}
+
+	return "", false
+}
+
+func authorize(t *testing.T, req sip.Request, res sip.Response, password string) {
+	t.Helper()
+
+	if err := sip.AuthorizeRequest(req, res, sip.String{Str: "alice"}, sip.String{Str: password}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestChallengerVerify(t *testing.T) {
+	challenger := sip.NewChallenger("wonderland.com")
+	req := newRegisterRequest()
+
+	if _, err := challenger.Verify(req, lookupPassword); !errors.Is(err, sip.ErrAuthMissing) {
+		t.Fatalf("expected ErrAuthMissing, got %v", err)
+	}
+
+	res := challenger.Challenge(req, false)
+	if res.StatusCode() != 401 {
+		t.Fatalf("expected 401 challenge, got %d", res.StatusCode())
+	}
+	hdrs := res.GetHeaders("WWW-Authenticate")
+	if len(hdrs) != 1 {
+		t.Fatalf("expected WWW-Authenticate header, got %v", hdrs)
+	}
+	challenge := sip.AuthFromValue(hdrs[0].Value())
+	if challenge.Realm() != "wonderland.com" || challenge.Nonce() == "" || challenge.Qop() != "auth" {
+		t.Errorf("unexpected challenge %s", hdrs[0].Value())
+	}
+
+	bad := sip.CopyRequest(req)
+	authorize(t, bad, res, "wrong")
+	if _, err := challenger.Verify(bad, lookupPassword); !errors.Is(err, sip.ErrAuthInvalid) {
+		t.Errorf("expected ErrAuthInvalid, got %v", err)
+	}
+
+	authorize(t, req, res, "secret")
+	auth, err := challenger.Verify(req, lookupPassword)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if auth.Username() != "alice" {
+		t.Errorf("expected username alice, got %s", auth.Username())
+	}
+
+	if _, err := challenger.Verify(req, lookupPassword); !errors.Is(err, sip.ErrNonceReplay) {
+		t.Errorf("expected ErrNonceReplay, got %v", err)
+	}
+}
+
+func TestChallengerAuthenticateStale(t *testing.T) {
+	challenger := sip.NewChallenger("wonderland.com")
+	challenger.Nonces = sip.NewMemoryNonceStore(50 * time.Millisecond)
+	req := newRegisterRequest()
+
+	res, ok := challenger.Authenticate(req, lookupPassword)
+	if ok {
+		t.Fatalf("expected request without credentials to be rejected")
+	}
+	authorize(t, req, res, "secret")
+
+	time.Sleep(70 * time.Millisecond)
+
+	res, ok = challenger.Authenticate(req, lookupPassword)
+	if ok {
+		t.Fatalf("expected request with expired nonce to be rejected")
+	}
+	if stale := sip.AuthFromValue(res.GetHeaders("WWW-Authenticate")[0].Value()); stale.Nonce() == "" {
+		t.Errorf("expected new nonce in stale challenge")
+	}
+	if value := res.GetHeaders("WWW-Authenticate")[0].Value(); !strings.Contains(value, "stale=true") {
+		t.Errorf("expected stale=true in %s", value)
+	}
+}
+
+func TestAuthFromValue(t *testing.T) {
+	auth := sip.AuthFromValue(`Digest username="alice", realm="wonderland.com", nonce="abc",` +
+		`uri="sip:wonderland.com", response="0123", algorithm=MD5, opaque="xyz", qop=auth, nc=00000001, cnonce="c1"`)
+
+	if auth.Username() != "alice" || auth.Realm() != "wonderland.com" || auth.Nonce() != "abc" {
+		t.Errorf("unexpected credentials %s", auth)
+	}
+	if auth.Algorithm() != "MD5" || auth.Opaque() != "xyz" || auth.Qop() != "auth" {
+		t.Errorf("unexpected credentials %s", auth)
+	}
+	if auth.Nc() != "00000001" || auth.CNonce() != "c1" {
+		t.Errorf("unexpected credentials %s", auth)
+	}
+}
@@ -0,0 +1,550 @@
+package sip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/log"
+)
+
+// DialogState describes the state of INVITE dialog - RFC 3261 12.
+type DialogState int
+
+const (
+	DialogStateEarly DialogState = iota
+	DialogStateConfirmed
+	DialogStateTerminated
+)
+
+func (state DialogState) String() string {
+	switch state {
+	case DialogStateEarly:
+		return "Early"
+	case DialogStateConfirmed:
+		return "Confirmed"
+	case DialogStateTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Dialog holds the state of the peer-to-peer SIP relationship
+// established by INVITE and 2xx response - RFC 3261 12.
+// It is transport agnostic and only builds and validates in-dialog messages.
+type Dialog struct {
+	mu sync.RWMutex
+
+	callID       CallID
+	localTag     string
+	remoteTag    string
+	localSeq     uint32
+	remoteSeq    uint32
+	localUri     *Address
+	remoteUri    *Address
+	localTarget  Uri
+	remoteTarget Uri
+	routeSet     []Uri
+	secure       bool
+	uac          bool
+	state        DialogState
+
+	invite   Request
+	response Response
+	ack      Request
+	// remote address where in-dialog requests should be sent
+	// when there is no route set (i.e. NAT'ed devices)
+	remoteAddr string
+	transport  string
+}
+
+// NewDialogUAC creates dialog on the UAC side from sent INVITE and received 2xx (or 1xx with To tag) response
+// - RFC 3261 12.1.2. SUBSCRIBE dialogs are created the same way - RFC 6665 4.1.2.
+func NewDialogUAC(invite Request, res Response) (*Dialog, error) {
+	callID, from, to, cseq, err := dialogHeaders(invite, res)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteTag, ok := to.Params.Get("tag")
+	if !ok || remoteTag == nil || remoteTag.String() == "" {
+		return nil, fmt.Errorf("missing tag param in To header of response '%s'", res.Short())
+	}
+	localTag, ok := from.Params.Get("tag")
+	if !ok || localTag == nil {
+		return nil, fmt.Errorf("missing tag param in From header of request '%s'", invite.Short())
+	}
+
+	dlg := &Dialog{
+		callID:     *callID,
+		localTag:   localTag.String(),
+		remoteTag:  remoteTag.String(),
+		localSeq:   cseq.SeqNo,
+		localUri:   NewAddressFromFromHeader(from),
+		remoteUri:  NewAddressFromToHeader(to),
+		secure:     invite.Recipient().IsEncrypted(),
+		uac:        true,
+		invite:     invite,
+		response:   res,
+		remoteAddr: invite.Destination(),
+		transport:  invite.Transport(),
+	}
+	if contact, ok := invite.Contact(); ok {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := res.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	} else {
+		dlg.remoteTarget = invite.Recipient().Clone()
+	}
+	// route set is taken from Record-Route of the response in reverse order
+	hdrs := res.GetHeaders("Record-Route")
+	for i := len(hdrs) - 1; i >= 0; i-- {
+		rr := hdrs[i].(*RecordRouteHeader)
+		for j := len(rr.Addresses) - 1; j >= 0; j-- {
+			dlg.routeSet = append(dlg.routeSet, rr.Addresses[j].Clone())
+		}
+	}
+	if res.IsSuccess() {
+		dlg.state = DialogStateConfirmed
+	} else {
+		dlg.state = DialogStateEarly
+	}
+
+	return dlg, nil
+}
+
+// NewDialogUAS creates dialog on the UAS side from received INVITE (or SUBSCRIBE) and sent 2xx response - RFC 3261 12.1.1.
+func NewDialogUAS(invite Request, res Response) (*Dialog, error) {
+	callID, from, to, cseq, err := dialogHeaders(invite, res)
+	if err != nil {
+		return nil, err
+	}
+
+	localTag, ok := to.Params.Get("tag")
+	if !ok || localTag == nil || localTag.String() == "" {
+		return nil, fmt.Errorf("missing tag param in To header of response '%s'", res.Short())
+	}
+	remoteTag, ok := from.Params.Get("tag")
+	if !ok || remoteTag == nil {
+		return nil, fmt.Errorf("missing tag param in From header of request '%s'", invite.Short())
+	}
+
+	dlg := &Dialog{
+		callID:     *callID,
+		localTag:   localTag.String(),
+		remoteTag:  remoteTag.String(),
+		remoteSeq:  cseq.SeqNo,
+		localUri:   NewAddressFromToHeader(to),
+		remoteUri:  NewAddressFromFromHeader(from),
+		secure:     invite.Recipient().IsEncrypted(),
+		invite:     invite,
+		response:   res,
+		remoteAddr: invite.Source(),
+		transport:  invite.Transport(),
+	}
+	if contact, ok := res.Contact(); ok {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := invite.Contact(); ok {
+		dlg.remoteTarget = contact.Address.Clone()
+	} else {
+		// broken UAC, fallback to the From URI
+		dlg.remoteTarget = from.Address.Clone()
+	}
+	for _, hdr := range invite.GetHeaders("Record-Route") {
+		for _, uri := range hdr.(*RecordRouteHeader).Addresses {
+			dlg.routeSet = append(dlg.routeSet, uri.Clone())
+		}
+	}
+	if res.IsSuccess() {
+		dlg.state = DialogStateConfirmed
+	} else {
+		dlg.state = DialogStateEarly
+	}
+
+	return dlg, nil
+}
+
+func dialogHeaders(invite Request, res Response) (*CallID, *FromHeader, *ToHeader, *CSeq, error) {
+	callID, ok := invite.CallID()
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("missing Call-ID header in request '%s'", invite.Short())
+	}
+	from, ok := invite.From()
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("missing From header in request '%s'", invite.Short())
+	}
+	cseq, ok := invite.CSeq()
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("missing CSeq header in request '%s'", invite.Short())
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("missing To header in response '%s'", res.Short())
+	}
+
+	return callID, from, to, cseq, nil
+}
+
+// ID returns dialog ID in form of MakeDialogID(Call-ID, local tag, remote tag).
+// This is the same value as MakeDialogIDFromMessage returns for the incoming in-dialog request.
+func (dlg *Dialog) ID() string {
+	return MakeDialogID(string(dlg.callID), dlg.localTag, dlg.remoteTag)
+}
+
+func (dlg *Dialog) String() string {
+	if dlg == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("sip.Dialog<%s>", dlg.Fields())
+}
+
+func (dlg *Dialog) Fields() log.Fields {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+
+	return log.Fields{
+		"dialog_id":    dlg.ID(),
+		"dialog_uac":   dlg.uac,
+		"dialog_state": dlg.state,
+	}
+}
+
+func (dlg *Dialog) CallID() CallID {
+	return dlg.callID
+}
+
+func (dlg *Dialog) LocalTag() string {
+	return dlg.localTag
+}
+
+func (dlg *Dialog) RemoteTag() string {
+	return dlg.remoteTag
+}
+
+// IsUAC reports whether the dialog was created by the local UA as caller.
+func (dlg *Dialog) IsUAC() bool {
+	return dlg.uac
+}
+
+// IsSecure reports whether the dialog was established over SIPS URI.
+func (dlg *Dialog) IsSecure() bool {
+	return dlg.secure
+}
+
+func (dlg *Dialog) LocalSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.localSeq
+}
+
+func (dlg *Dialog) RemoteSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.remoteSeq
+}
+
+func (dlg *Dialog) LocalUri() *Address {
+	return dlg.localUri
+}
+
+func (dlg *Dialog) RemoteUri() *Address {
+	return dlg.remoteUri
+}
+
+// LocalTarget returns Contact URI of the local side.
+func (dlg *Dialog) LocalTarget() Uri {
+	return dlg.localTarget
+}
+
+func (dlg *Dialog) RemoteTarget() Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.remoteTarget
+}
+
+func (dlg *Dialog) RouteSet() []Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.routeSet
+}
+
+func (dlg *Dialog) State() DialogState {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.state
+}
+
+func (dlg *Dialog) SetState(state DialogState) {
+	dlg.mu.Lock()
+	dlg.state = state
+	dlg.mu.Unlock()
+}
+
+// Invite returns INVITE request that has created the dialog.
+func (dlg *Dialog) Invite() Request {
+	return dlg.invite
+}
+
+// Response returns the latest final response to INVITE request.
+func (dlg *Dialog) Response() Response {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.response
+}
+
+// SetLocalSeq raises local CSeq, i.e. after PRACK requests sent in the early dialog
+// with the same identifier - RFC 3262 4.
+func (dlg *Dialog) SetLocalSeq(seq uint32) {
+	dlg.mu.Lock()
+	if seq > dlg.localSeq {
+		dlg.localSeq = seq
+	}
+	dlg.mu.Unlock()
+}
+
+// SetRemoteAddr overrides network address where in-dialog requests are sent.
+func (dlg *Dialog) SetRemoteAddr(addr string) {
+	dlg.mu.Lock()
+	dlg.remoteAddr = addr
+	dlg.mu.Unlock()
+}
+
+// NewRequest creates in-dialog request - RFC 3261 12.2.1.1.
+// Local CSeq is incremented for every request except ACK and CANCEL.
+func (dlg *Dialog) NewRequest(method RequestMethod, body string) (Request, error) {
+	if method == ACK {
+		return dlg.NewAck("")
+	}
+
+	dlg.mu.Lock()
+	if dlg.state == DialogStateTerminated {
+		dlg.mu.Unlock()
+		return nil, fmt.Errorf("dialog %s is terminated", dlg.ID())
+	}
+	if method != CANCEL {
+		dlg.localSeq++
+	}
+	seqNo := dlg.localSeq
+	remoteTarget := dlg.remoteTarget
+	routeSet := dlg.routeSet
+	remoteAddr := dlg.remoteAddr
+	dlg.mu.Unlock()
+
+	hdrs := make([]Header, 0)
+	recipient := remoteTarget.Clone()
+	if len(routeSet) > 0 {
+		route := &RouteHeader{
+			Addresses: make([]Uri, 0, len(routeSet)+1),
+		}
+		// strict routing - RFC 3261 12.2.1.1
+		if params := routeSet[0].UriParams(); params != nil && !params.Has("lr") {
+			recipient = routeSet[0].Clone()
+			if recipient.UriParams() != nil {
+				recipient.UriParams().Remove("method")
+			}
+			for _, uri := range routeSet[1:] {
+				route.Addresses = append(route.Addresses, uri.Clone())
+			}
+			route.Addresses = append(route.Addresses, remoteTarget.Clone())
+		} else {
+			for _, uri := range routeSet {
+				route.Addresses = append(route.Addresses, uri.Clone())
+			}
+		}
+		hdrs = append(hdrs, route)
+	}
+
+	if via := dlg.viaHop(); via != nil {
+		hdrs = append(hdrs, ViaHeader{via})
+	}
+
+	maxForwards := MaxForwards(70)
+	callID := dlg.callID
+	hdrs = append(
+		hdrs,
+		&CSeq{SeqNo: seqNo, MethodName: method},
+		dlg.fromHeader(),
+		dlg.toHeader(),
+		&callID,
+		&maxForwards,
+	)
+	if dlg.localTarget != nil && method != BYE && method != CANCEL {
+		hdrs = append(hdrs, &ContactHeader{Address: dlg.localTarget.Clone()})
+	}
+
+	req := NewRequest(
+		"",
+		method,
+		recipient,
+		dlg.invite.SipVersion(),
+		hdrs,
+		"",
+		log.Fields{
+			"dialog_id": dlg.ID(),
+		},
+	)
+	req.SetBody(body, true)
+	if dlg.transport != "" {
+		req.SetTransport(dlg.transport)
+	}
+	if len(routeSet) == 0 && remoteAddr != "" {
+		req.SetDestination(remoteAddr)
+	}
+
+	return req, nil
+}
+
+// NewAck creates ACK request on 2xx response to INVITE - RFC 3261 13.2.2.4.
+// Created ACK is kept in the dialog to be resent on retransmitted 2xx responses.
+func (dlg *Dialog) NewAck(body string) (Request, error) {
+	if !dlg.uac {
+		return nil, fmt.Errorf("%s is not UAC dialog", dlg)
+	}
+
+	dlg.mu.RLock()
+	res := dlg.response
+	remoteAddr := dlg.remoteAddr
+	routeSet := dlg.routeSet
+	dlg.mu.RUnlock()
+
+	if res == nil || !res.IsSuccess() {
+		return nil, fmt.Errorf("%s has no 2xx response to acknowledge", dlg)
+	}
+
+	ack := NewAckRequest("", dlg.invite, res, body, log.Fields{
+		"dialog_id": dlg.ID(),
+	})
+	if len(routeSet) == 0 && remoteAddr != "" {
+		ack.SetDestination(remoteAddr)
+	}
+
+	dlg.mu.Lock()
+	dlg.ack = ack
+	dlg.mu.Unlock()
+
+	return ack, nil
+}
+
+// Ack returns the latest ACK request created by NewAck.
+func (dlg *Dialog) Ack() (Request, bool) {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.ack, dlg.ack != nil
+}
+
+// ReceiveRequest validates incoming in-dialog request and updates remote CSeq and target - RFC 3261 12.2.2.
+// It returns error when the request is out of order and must be answered with 500.
+func (dlg *Dialog) ReceiveRequest(req Request) error {
+	cseq, ok := req.CSeq()
+	if !ok {
+		return fmt.Errorf("missing CSeq header in request '%s'", req.Short())
+	}
+	if req.IsAck() || req.IsCancel() {
+		return nil
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.remoteSeq != 0 && cseq.SeqNo < dlg.remoteSeq {
+		return fmt.Errorf("dialog %s received out of order request '%s': CSeq %d < %d",
+			dlg.ID(), req.Short(), cseq.SeqNo, dlg.remoteSeq)
+	}
+	dlg.remoteSeq = cseq.SeqNo
+
+	// target refresh requests
+	if isTargetRefresh(req.Method()) {
+		if contact, ok := req.Contact(); ok {
+			dlg.remoteTarget = contact.Address.Clone()
+		}
+	}
+
+	return nil
+}
+
+// ReceiveResponse updates remote target from 2xx response on target refresh request (re-INVITE, UPDATE, SUBSCRIBE).
+func (dlg *Dialog) ReceiveResponse(res Response) {
+	if !res.IsSuccess() {
+		return
+	}
+	cseq, ok := res.CSeq()
+	if !ok {
+		return
+	}
+
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if isTargetRefresh(cseq.MethodName) {
+		if contact, ok := res.Contact(); ok {
+			dlg.remoteTarget = contact.Address.Clone()
+		}
+	}
+	if cseq.MethodName == INVITE && dlg.uac && cseq.SeqNo == dlg.localSeq {
+		dlg.response = res
+	}
+}
+
+// isTargetRefresh checks that the request updates remote target of the dialog - RFC 3311, RFC 6665 4.1.2.1.
+func isTargetRefresh(method RequestMethod) bool {
+	return method == INVITE || method == UPDATE || method == SUBSCRIBE || method == NOTIFY
+}
+
+func (dlg *Dialog) fromHeader() *FromHeader {
+	from := dlg.localUri.AsFromHeader()
+	if from.Params == nil {
+		from.Params = NewParams()
+	}
+	from.Params.Add("tag", String{Str: dlg.localTag})
+
+	return from
+}
+
+func (dlg *Dialog) toHeader() *ToHeader {
+	to := dlg.remoteUri.AsToHeader()
+	if to.Params == nil {
+		to.Params = NewParams()
+	}
+	to.Params.Add("tag", String{Str: dlg.remoteTag})
+
+	return to
+}
+
+// viaHop builds Via hop for the new in-dialog request.
+// UAC reuses sent-by of the original INVITE, UAS builds it from the local target.
+func (dlg *Dialog) viaHop() *ViaHop {
+	var hop *ViaHop
+	if dlg.uac {
+		if via, ok := dlg.invite.ViaHop(); ok {
+			hop = via.Clone()
+			hop.Params = NewParams()
+		}
+	} else if dlg.localTarget != nil {
+		tp := dlg.transport
+		if params := dlg.localTarget.UriParams(); params != nil {
+			if val, ok := params.Get("transport"); ok && val != nil && val.String() != "" {
+				tp = strings.ToUpper(val.String())
+			}
+		}
+		if tp == "" {
+			tp = DefaultProtocol
+		}
+		hop = &ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       tp,
+			Host:            dlg.localTarget.Host(),
+			Port:            dlg.localTarget.Port().Clone(),
+			Params:          NewParams(),
+		}
+	}
+	if hop != nil {
+		hop.Params.Add("branch", String{Str: GenerateBranch()})
+	}
+
+	return hop
+}
@@ -0,0 +1,132 @@
+package sip_test
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func newDialogInvite() sip.Request {
+	callID := sip.CallID("dialog-call-id")
+	port := sip.Port(5060)
+	return sip.NewRequest(
+		"",
+		sip.INVITE,
+		&sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "far-far-away.com"},
+		"SIP/2.0",
+		[]sip.Header{
+			sip.ViaHeader{&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       "UDP",
+				Host:            "127.0.0.1",
+				Port:            &port,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			}},
+			&sip.FromHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "wonderland.com"},
+				Params:  sip.NewParams().Add("tag", sip.String{Str: "alice-tag"}),
+			},
+			&sip.ToHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "far-far-away.com"},
+				Params:  sip.NewParams(),
+			},
+			&callID,
+			&sip.CSeq{SeqNo: 10, MethodName: sip.INVITE},
+			&sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "127.0.0.1", FPort: &port}},
+		},
+		"",
+		nil,
+	)
+}
+
+func newDialogResponse(invite sip.Request) sip.Response {
+	res := sip.NewResponseFromRequest("", invite, 200, "OK", "")
+	to, _ := res.To()
+	to.Params.Add("tag", sip.String{Str: "bob-tag"})
+	bobPort := sip.Port(5070)
+	res.AppendHeader(&sip.ContactHeader{
+		Address: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "192.168.0.10", FPort: &bobPort},
+	})
+	res.AppendHeader(&sip.RecordRouteHeader{Addresses: []sip.Uri{
+		&sip.SipUri{FHost: "proxy1.com", FUriParams: sip.NewParams().Add("lr", nil)},
+		&sip.SipUri{FHost: "proxy2.com", FUriParams: sip.NewParams().Add("lr", nil)},
+	}})
+
+	return res
+}
+
+func TestNewDialogUAC(t *testing.T) {
+	invite := newDialogInvite()
+	dlg, err := sip.NewDialogUAC(invite, newDialogResponse(invite))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if id := sip.MakeDialogID("dialog-call-id", "alice-tag", "bob-tag"); dlg.ID() != id {
+		t.Errorf("expected dialog ID %s, got %s", id, dlg.ID())
+	}
+	if dlg.State() != sip.DialogStateConfirmed {
+		t.Errorf("expected confirmed dialog, got %s", dlg.State())
+	}
+
+	bye, err := dlg.NewRequest(sip.BYE, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if recipient := bye.Recipient().String(); recipient != "sip:bob@192.168.0.10:5070" {
+		t.Errorf("expected Request-URI from remote target, got %s", recipient)
+	}
+	if cseq, _ := bye.CSeq(); cseq.SeqNo != 11 || cseq.MethodName != sip.BYE {
+		t.Errorf("expected CSeq 11 BYE, got %s", cseq.Value())
+	}
+	if to, _ := bye.To(); !to.Params.Has("tag") {
+		t.Errorf("expected To tag in %s", to)
+	}
+	hdrs := bye.GetHeaders("Route")
+	if len(hdrs) != 1 {
+		t.Fatalf("expected Route header, got %v", hdrs)
+	}
+	route := hdrs[0].(*sip.RouteHeader)
+	if len(route.Addresses) != 2 || route.Addresses[0].Host() != "proxy2.com" {
+		t.Errorf("expected reversed route set, got %s", route.Value())
+	}
+
+	ack, err := dlg.NewAck("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cseq, _ := ack.CSeq(); cseq.SeqNo != 10 || cseq.MethodName != sip.ACK {
+		t.Errorf("expected CSeq 10 ACK, got %s", cseq.Value())
+	}
+}
+
+func TestNewDialogUAS(t *testing.T) {
+	invite := newDialogInvite()
+	dlg, err := sip.NewDialogUAS(invite, newDialogResponse(invite))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if id := sip.MakeDialogID("dialog-call-id", "bob-tag", "alice-tag"); dlg.ID() != id {
+		t.Errorf("expected dialog ID %s, got %s", id, dlg.ID())
+	}
+	if dlg.RemoteTarget().Host() != "127.0.0.1" {
+		t.Errorf("expected remote target from INVITE Contact, got %s", dlg.RemoteTarget())
+	}
+
+	bye := newDialogInvite()
+	bye.SetMethod(sip.BYE)
+	bye.ReplaceHeaders("CSeq", []sip.Header{&sip.CSeq{SeqNo: 9, MethodName: sip.BYE}})
+	if err := dlg.ReceiveRequest(bye); err == nil {
+		t.Errorf("expected error on out of order request")
+	}
+
+	bye.ReplaceHeaders("CSeq", []sip.Header{&sip.CSeq{SeqNo: 11, MethodName: sip.BYE}})
+	if err := dlg.ReceiveRequest(bye); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if dlg.RemoteSeq() != 11 {
+		t.Errorf("expected remote CSeq 11, got %d", dlg.RemoteSeq())
+	}
+}
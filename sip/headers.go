@@ -1012,6 +1012,261 @@ func (expires *Expires) Equals(other interface{}) bool {
 	return false
 }
 
+// RSeq header of reliable provisional response - RFC 3262 7.1.
+type RSeq uint32
+
+func (rseq *RSeq) String() string {
+	return fmt.Sprintf("%s: %s", rseq.Name(), rseq.Value())
+}
+
+func (rseq *RSeq) Name() string { return "RSeq" }
+
+func (rseq RSeq) Value() string { return fmt.Sprintf("%d", rseq) }
+
+func (rseq *RSeq) Clone() Header { return rseq }
+
+func (rseq *RSeq) Equals(other interface{}) bool {
+	if h, ok := other.(RSeq); ok {
+		if rseq == nil {
+			return false
+		}
+
+		return *rseq == h
+	}
+	if h, ok := other.(*RSeq); ok {
+		if rseq == h {
+			return true
+		}
+		if rseq == nil && h != nil || rseq != nil && h == nil {
+			return false
+		}
+
+		return *rseq == *h
+	}
+
+	return false
+}
+
+// RAck header of PRACK request - RFC 3262 7.2.
+type RAck struct {
+	RSeq       uint32
+	CSeq       uint32
+	MethodName RequestMethod
+}
+
+func (rack *RAck) String() string {
+	return fmt.Sprintf("%s: %s", rack.Name(), rack.Value())
+}
+
+func (rack *RAck) Name() string { return "RAck" }
+
+func (rack *RAck) Value() string {
+	return fmt.Sprintf("%d %d %s", rack.RSeq, rack.CSeq, rack.MethodName)
+}
+
+func (rack *RAck) Clone() Header {
+	if rack == nil {
+		var newRAck *RAck
+		return newRAck
+	}
+
+	return &RAck{
+		RSeq:       rack.RSeq,
+		CSeq:       rack.CSeq,
+		MethodName: rack.MethodName,
+	}
+}
+
+func (rack *RAck) Equals(other interface{}) bool {
+	if h, ok := other.(*RAck); ok {
+		if rack == h {
+			return true
+		}
+		if rack == nil && h != nil || rack != nil && h == nil {
+			return false
+		}
+
+		return rack.RSeq == h.RSeq &&
+			rack.CSeq == h.CSeq &&
+			rack.MethodName == h.MethodName
+	}
+
+	return false
+}
+
+// Subscription states - RFC 6665 4.1.3.
+const (
+	SubStateActive     = "active"
+	SubStatePending    = "pending"
+	SubStateTerminated = "terminated"
+)
+
+// Subscription termination reasons - RFC 6665 4.1.3.
+const (
+	SubReasonDeactivated = "deactivated"
+	SubReasonProbation   = "probation"
+	SubReasonRejected    = "rejected"
+	SubReasonTimeout     = "timeout"
+	SubReasonGiveUp      = "giveup"
+	SubReasonNoResource  = "noresource"
+	SubReasonInvariant   = "invariant"
+)
+
+// SubscriptionState header of NOTIFY request - RFC 6665 8.2.3.
+type SubscriptionState struct {
+	State string
+	// Expires in seconds, it is not sent with terminated state.
+	Expires uint32
+	Reason  string
+	// RetryAfter in seconds, zero if not present.
+	RetryAfter uint32
+}
+
+func (ss *SubscriptionState) String() string {
+	return fmt.Sprintf("%s: %s", ss.Name(), ss.Value())
+}
+
+func (ss *SubscriptionState) Name() string { return "Subscription-State" }
+
+func (ss *SubscriptionState) Value() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(ss.State)
+	if ss.Reason != "" {
+		buffer.WriteString(fmt.Sprintf(";reason=%s", ss.Reason))
+	}
+	if ss.State != SubStateTerminated {
+		buffer.WriteString(fmt.Sprintf(";expires=%d", ss.Expires))
+	}
+	if ss.RetryAfter > 0 {
+		buffer.WriteString(fmt.Sprintf(";retry-after=%d", ss.RetryAfter))
+	}
+
+	return buffer.String()
+}
+
+func (ss *SubscriptionState) Clone() Header {
+	if ss == nil {
+		var newSS *SubscriptionState
+		return newSS
+	}
+
+	return &SubscriptionState{
+		State:      ss.State,
+		Expires:    ss.Expires,
+		Reason:     ss.Reason,
+		RetryAfter: ss.RetryAfter,
+	}
+}
+
+func (ss *SubscriptionState) Equals(other interface{}) bool {
+	if h, ok := other.(*SubscriptionState); ok {
+		if ss == h {
+			return true
+		}
+		if ss == nil && h != nil || ss != nil && h == nil {
+			return false
+		}
+
+		return strings.EqualFold(ss.State, h.State) &&
+			ss.Expires == h.Expires &&
+			strings.EqualFold(ss.Reason, h.Reason) &&
+			ss.RetryAfter == h.RetryAfter
+	}
+
+	return false
+}
+
+// Session refresher roles - RFC 4028 4.
+const (
+	RefresherUAC = "uac"
+	RefresherUAS = "uas"
+)
+
+// SessionExpires header conveys the session interval and the refresher role - RFC 4028 4.
+type SessionExpires struct {
+	// Delta is the session interval in seconds.
+	Delta uint32
+	// Refresher is RefresherUAC, RefresherUAS or empty if not chosen yet.
+	Refresher string
+}
+
+func (se *SessionExpires) String() string {
+	return fmt.Sprintf("%s: %s", se.Name(), se.Value())
+}
+
+func (se *SessionExpires) Name() string { return "Session-Expires" }
+
+func (se *SessionExpires) Value() string {
+	if se.Refresher == "" {
+		return fmt.Sprintf("%d", se.Delta)
+	}
+
+	return fmt.Sprintf("%d;refresher=%s", se.Delta, se.Refresher)
+}
+
+func (se *SessionExpires) Clone() Header {
+	if se == nil {
+		var newSE *SessionExpires
+		return newSE
+	}
+
+	return &SessionExpires{
+		Delta:     se.Delta,
+		Refresher: se.Refresher,
+	}
+}
+
+func (se *SessionExpires) Equals(other interface{}) bool {
+	if h, ok := other.(*SessionExpires); ok {
+		if se == h {
+			return true
+		}
+		if se == nil && h != nil || se != nil && h == nil {
+			return false
+		}
+
+		return se.Delta == h.Delta &&
+			strings.EqualFold(se.Refresher, h.Refresher)
+	}
+
+	return false
+}
+
+// MinSE header is the minimum session interval in seconds - RFC 4028 5.
+type MinSE uint32
+
+func (minSE *MinSE) String() string {
+	return fmt.Sprintf("%s: %s", minSE.Name(), minSE.Value())
+}
+
+func (minSE *MinSE) Name() string { return "Min-SE" }
+
+func (minSE MinSE) Value() string { return fmt.Sprintf("%d", minSE) }
+
+func (minSE *MinSE) Clone() Header { return minSE }
+
+func (minSE *MinSE) Equals(other interface{}) bool {
+	if h, ok := other.(MinSE); ok {
+		if minSE == nil {
+			return false
+		}
+
+		return *minSE == h
+	}
+	if h, ok := other.(*MinSE); ok {
+		if minSE == h {
+			return true
+		}
+		if minSE == nil && h != nil || minSE != nil && h == nil {
+			return false
+		}
+
+		return *minSE == *h
+	}
+
+	return false
+}
+
 type ContentLength uint32
 
 func (contentLength ContentLength) String() string {
@@ -1585,6 +1840,204 @@ func (a *Authenticate) Equals(other interface{}) bool {
 	return false
 }
 
+// AuthParam is a single auth-param of the challenge or credentials - RFC 3261 25.1.
+// Quoted keeps the original value form to serialize it back without loss.
+type AuthParam struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+func (param AuthParam) String() string {
+	if param.Quoted {
+		return fmt.Sprintf(`%s="%s"`, param.Name, strings.ReplaceAll(param.Value, `"`, `\"`))
+	}
+
+	return fmt.Sprintf("%s=%s", param.Name, param.Value)
+}
+
+// AuthChallenge is auth-scheme with the list of auth-params, used both for challenges and credentials.
+type AuthChallenge struct {
+	Scheme string
+	Params []AuthParam
+}
+
+// Param returns value of the auth-param, the name is case-insensitive.
+func (c *AuthChallenge) Param(name string) (string, bool) {
+	for _, param := range c.Params {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// SetParam replaces value of the existing auth-param or appends new one.
+func (c *AuthChallenge) SetParam(name, value string, quoted bool) *AuthChallenge {
+	for i := range c.Params {
+		if strings.EqualFold(c.Params[i].Name, name) {
+			c.Params[i].Value = value
+			c.Params[i].Quoted = quoted
+			return c
+		}
+	}
+	c.Params = append(c.Params, AuthParam{Name: name, Value: value, Quoted: quoted})
+
+	return c
+}
+
+func (c *AuthChallenge) String() string {
+	if c == nil {
+		return ""
+	}
+
+	params := make([]string, len(c.Params))
+	for i, param := range c.Params {
+		params[i] = param.String()
+	}
+	if c.Scheme == "" {
+		return strings.Join(params, ", ")
+	}
+	if len(params) == 0 {
+		return c.Scheme
+	}
+
+	return c.Scheme + " " + strings.Join(params, ", ")
+}
+
+func (c *AuthChallenge) Clone() *AuthChallenge {
+	if c == nil {
+		return nil
+	}
+
+	return &AuthChallenge{
+		Scheme: c.Scheme,
+		Params: append([]AuthParam(nil), c.Params...),
+	}
+}
+
+func (c *AuthChallenge) Equals(other *AuthChallenge) bool {
+	if c == other {
+		return true
+	}
+	if c == nil || other == nil {
+		return false
+	}
+	if !strings.EqualFold(c.Scheme, other.Scheme) || len(c.Params) != len(other.Params) {
+		return false
+	}
+	for i, param := range c.Params {
+		if !strings.EqualFold(param.Name, other.Params[i].Name) || param.Value != other.Params[i].Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AuthenticateHeader is WWW-Authenticate or Proxy-Authenticate header with one or more challenges.
+type AuthenticateHeader struct {
+	HeaderName string
+	Challenges []*AuthChallenge
+}
+
+func (header *AuthenticateHeader) Name() string { return header.HeaderName }
+
+func (header *AuthenticateHeader) Value() string {
+	values := make([]string, len(header.Challenges))
+	for i, challenge := range header.Challenges {
+		values[i] = challenge.String()
+	}
+
+	return strings.Join(values, ", ")
+}
+
+func (header *AuthenticateHeader) String() string {
+	return fmt.Sprintf("%s: %s", header.Name(), header.Value())
+}
+
+func (header *AuthenticateHeader) Clone() Header {
+	var newHeader *AuthenticateHeader
+	if header == nil {
+		return newHeader
+	}
+
+	newHeader = &AuthenticateHeader{
+		HeaderName: header.HeaderName,
+		Challenges: make([]*AuthChallenge, len(header.Challenges)),
+	}
+	for i, challenge := range header.Challenges {
+		newHeader.Challenges[i] = challenge.Clone()
+	}
+
+	return newHeader
+}
+
+func (header *AuthenticateHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*AuthenticateHeader); ok {
+		if header == h {
+			return true
+		}
+		if header == nil && h != nil || header != nil && h == nil {
+			return false
+		}
+		if header.HeaderName != h.HeaderName || len(header.Challenges) != len(h.Challenges) {
+			return false
+		}
+		for i, challenge := range header.Challenges {
+			if !challenge.Equals(h.Challenges[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// AuthorizationHeader is Authorization or Proxy-Authorization header with credentials.
+type AuthorizationHeader struct {
+	HeaderName  string
+	Credentials *AuthChallenge
+}
+
+func (header *AuthorizationHeader) Name() string { return header.HeaderName }
+
+func (header *AuthorizationHeader) Value() string { return header.Credentials.String() }
+
+func (header *AuthorizationHeader) String() string {
+	return fmt.Sprintf("%s: %s", header.Name(), header.Value())
+}
+
+func (header *AuthorizationHeader) Clone() Header {
+	var newHeader *AuthorizationHeader
+	if header == nil {
+		return newHeader
+	}
+
+	return &AuthorizationHeader{
+		HeaderName:  header.HeaderName,
+		Credentials: header.Credentials.Clone(),
+	}
+}
+
+func (header *AuthorizationHeader) Equals(other interface{}) bool {
+	if h, ok := other.(*AuthorizationHeader); ok {
+		if header == h {
+			return true
+		}
+		if header == nil && h != nil || header != nil && h == nil {
+			return false
+		}
+
+		return header.HeaderName == h.HeaderName && header.Credentials.Equals(h.Credentials)
+	}
+
+	return false
+}
+
 type Accept string
 
 func (ct *Accept) String() string { return fmt.Sprintf("%s: %s", ct.Name(), ct.Value()) }
@@ -1729,8 +2182,36 @@ func (route *RecordRouteHeader) Equals(other interface{}) bool {
 	return false
 }
 
+// Event header identifies event package of the subscription - RFC 6665 8.2.1.
 type Event string
 
+// Package returns event package name without parameters.
+func (et Event) Package() string {
+	if idx := strings.Index(string(et), ";"); idx != -1 {
+		return strings.TrimSpace(string(et)[:idx])
+	}
+
+	return strings.TrimSpace(string(et))
+}
+
+// ID returns value of the id parameter.
+func (et Event) ID() string {
+	parts := strings.Split(string(et), ";")
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "id") {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+
+	return ""
+}
+
+// Matches compares events by package and id - RFC 6665 8.2.1.
+func (et Event) Matches(other Event) bool {
+	return strings.EqualFold(et.Package(), other.Package()) && et.ID() == other.ID()
+}
+
 func (et *Event) String() string { return fmt.Sprintf("%s: %s", et.Name(), et.Value()) }
 
 func (et *Event) Name() string { return "Event" }
@@ -49,32 +49,44 @@ type HeaderParser func(headerName string, headerData string) ([]sip.Header, erro
 
 func defaultHeaderParsers() map[string]HeaderParser {
 	return map[string]HeaderParser{
-		"to":             parseAddressHeader,
-		"t":              parseAddressHeader,
-		"from":           parseAddressHeader,
-		"f":              parseAddressHeader,
-		"contact":        parseAddressHeader,
-		"m":              parseAddressHeader,
-		"call-id":        parseCallId,
-		"i":              parseCallId,
-		"cseq":           parseCSeq,
-		"via":            parseViaHeader,
-		"v":              parseViaHeader,
-		"max-forwards":   parseMaxForwards,
-		"content-length": parseContentLength,
-		"l":              parseContentLength,
-		"expires":        parseExpires,
-		"user-agent":     parseUserAgent,
-		"server":         parseServer,
-		"allow":          parseAllow,
-		"content-type":   parseContentType,
-		"c":              parseContentType,
-		"accept":         parseAccept,
-		"require":        parseRequire,
-		"supported":      parseSupported,
-		"k":              parseSupported,
-		"route":          parseRouteHeader,
-		"record-route":   parseRecordRouteHeader,
+		"to":                  parseAddressHeader,
+		"t":                   parseAddressHeader,
+		"from":                parseAddressHeader,
+		"f":                   parseAddressHeader,
+		"contact":             parseAddressHeader,
+		"m":                   parseAddressHeader,
+		"call-id":             parseCallId,
+		"i":                   parseCallId,
+		"cseq":                parseCSeq,
+		"via":                 parseViaHeader,
+		"v":                   parseViaHeader,
+		"max-forwards":        parseMaxForwards,
+		"content-length":      parseContentLength,
+		"l":                   parseContentLength,
+		"expires":             parseExpires,
+		"user-agent":          parseUserAgent,
+		"server":              parseServer,
+		"allow":               parseAllow,
+		"content-type":        parseContentType,
+		"c":                   parseContentType,
+		"accept":              parseAccept,
+		"require":             parseRequire,
+		"supported":           parseSupported,
+		"k":                   parseSupported,
+		"route":               parseRouteHeader,
+		"record-route":        parseRecordRouteHeader,
+		"www-authenticate":    parseAuthenticateHeader,
+		"proxy-authenticate":  parseAuthenticateHeader,
+		"authorization":       parseAuthorizationHeader,
+		"proxy-authorization": parseAuthorizationHeader,
+		"rseq":                parseRSeq,
+		"rack":                parseRAck,
+		"session-expires":     parseSessionExpires,
+		"x":                   parseSessionExpires,
+		"min-se":              parseMinSE,
+		"event":               parseEvent,
+		"o":                   parseEvent,
+		"subscription-state":  parseSubscriptionState,
 		//"content-encoding","e"
 		//"subject":          "s",
 	}
@@ -1236,3 +1248,196 @@ func SplitByWhitespace(text string) []string {
 
 	return result
 }
+
+// Parse a string representation of a WWW-Authenticate or Proxy-Authenticate header,
+// returning a slice of at most one AuthenticateHeader with all challenges of the header.
+func parseAuthenticateHeader(headerName string, headerText string) (headers []sip.Header, err error) {
+	challenges, err := sip.ParseAuthChallenges(headerText)
+	if err != nil {
+		return
+	}
+	if len(challenges) == 0 {
+		err = fmt.Errorf("empty %s body", headerName)
+		return
+	}
+
+	var header sip.AuthenticateHeader
+	switch headerName {
+	case "www-authenticate":
+		header.HeaderName = "WWW-Authenticate"
+	case "proxy-authenticate":
+		header.HeaderName = "Proxy-Authenticate"
+	}
+	header.Challenges = challenges
+	headers = []sip.Header{&header}
+
+	return
+}
+
+// Parse a string representation of an Authorization or Proxy-Authorization header,
+// returning a slice of at most one AuthorizationHeader.
+func parseAuthorizationHeader(headerName string, headerText string) (headers []sip.Header, err error) {
+	challenges, err := sip.ParseAuthChallenges(headerText)
+	if err != nil {
+		return
+	}
+	if len(challenges) != 1 {
+		err = fmt.Errorf("%s header must contain exactly one credentials, got %d", headerName, len(challenges))
+		return
+	}
+
+	var header sip.AuthorizationHeader
+	switch headerName {
+	case "authorization":
+		header.HeaderName = "Authorization"
+	case "proxy-authorization":
+		header.HeaderName = "Proxy-Authorization"
+	}
+	header.Credentials = challenges[0]
+	headers = []sip.Header{&header}
+
+	return
+}
+
+// Parse a string representation of a RSeq header, returning a slice of at most one RSeq.
+func parseRSeq(headerName string, headerText string) (headers []sip.Header, err error) {
+	var value uint64
+	value, err = strconv.ParseUint(strings.TrimSpace(headerText), 10, 32)
+	if err != nil {
+		return
+	}
+	if value == 0 {
+		err = fmt.Errorf("invalid RSeq value %d", value)
+		return
+	}
+
+	rseq := sip.RSeq(value)
+	headers = []sip.Header{&rseq}
+
+	return
+}
+
+// Parse a string representation of a RAck header, returning a slice of at most one RAck.
+func parseRAck(headerName string, headerText string) (headers []sip.Header, err error) {
+	parts := strings.Fields(headerText)
+	if len(parts) != 3 {
+		err = fmt.Errorf("RAck field should have response-num, CSeq-num and method; found '%s'", headerText)
+		return
+	}
+
+	var rack sip.RAck
+	var value uint64
+	if value, err = strconv.ParseUint(parts[0], 10, 32); err != nil {
+		return
+	}
+	rack.RSeq = uint32(value)
+	if value, err = strconv.ParseUint(parts[1], 10, 32); err != nil {
+		return
+	}
+	if value > maxCseq {
+		err = fmt.Errorf("invalid CSeq %d: exceeds maximum permitted value 2**31 - 1", value)
+		return
+	}
+	rack.CSeq = uint32(value)
+	rack.MethodName = sip.RequestMethod(strings.TrimSpace(parts[2]))
+	headers = []sip.Header{&rack}
+
+	return
+}
+
+// Parse a string representation of a Session-Expires header, returning a slice of at most one SessionExpires.
+func parseSessionExpires(headerName string, headerText string) (headers []sip.Header, err error) {
+	var se sip.SessionExpires
+	text := strings.TrimSpace(headerText)
+	delta := text
+	var params sip.Params
+	if idx := strings.Index(text, ";"); idx != -1 {
+		delta = strings.TrimSpace(text[:idx])
+		params, _, err = ParseParams(text[idx:], ';', ';', 0, false, true)
+		if err != nil {
+			return
+		}
+	}
+
+	var value uint64
+	if value, err = strconv.ParseUint(delta, 10, 32); err != nil {
+		return
+	}
+	se.Delta = uint32(value)
+	if params != nil {
+		if refresher, ok := params.Get("refresher"); ok && refresher != nil {
+			se.Refresher = strings.ToLower(refresher.String())
+			if se.Refresher != sip.RefresherUAC && se.Refresher != sip.RefresherUAS {
+				err = fmt.Errorf("invalid Session-Expires refresher '%s'", refresher)
+				return
+			}
+		}
+	}
+	headers = []sip.Header{&se}
+
+	return
+}
+
+// Parse a string representation of a Min-SE header, returning a slice of at most one MinSE.
+func parseMinSE(headerName string, headerText string) (headers []sip.Header, err error) {
+	var value uint64
+	value, err = strconv.ParseUint(strings.TrimSpace(headerText), 10, 32)
+	if err != nil {
+		return
+	}
+
+	minSE := sip.MinSE(value)
+	headers = []sip.Header{&minSE}
+
+	return
+}
+
+// Parse a string representation of an Event header, returning a slice of at most one Event.
+func parseEvent(headerName string, headerText string) (headers []sip.Header, err error) {
+	event := sip.Event(strings.TrimSpace(headerText))
+	if event.Package() == "" {
+		err = fmt.Errorf("empty event package in Event header '%s'", headerText)
+		return
+	}
+	headers = []sip.Header{&event}
+
+	return
+}
+
+// Parse a string representation of a Subscription-State header, returning a slice of at most one SubscriptionState.
+func parseSubscriptionState(headerName string, headerText string) (headers []sip.Header, err error) {
+	var ss sip.SubscriptionState
+	text := strings.TrimSpace(headerText)
+	state := text
+	var params sip.Params
+	if idx := strings.Index(text, ";"); idx != -1 {
+		state = strings.TrimSpace(text[:idx])
+		params, _, err = ParseParams(text[idx:], ';', ';', 0, true, true)
+		if err != nil {
+			return
+		}
+	}
+	if state == "" {
+		err = fmt.Errorf("empty state in Subscription-State header '%s'", headerText)
+		return
+	}
+	ss.State = strings.ToLower(state)
+
+	if params != nil {
+		if reason, ok := params.Get("reason"); ok && reason != nil {
+			ss.Reason = strings.ToLower(reason.String())
+		}
+		for name, field := range map[string]*uint32{"expires": &ss.Expires, "retry-after": &ss.RetryAfter} {
+			if val, ok := params.Get(name); ok && val != nil {
+				var value uint64
+				if value, err = strconv.ParseUint(val.String(), 10, 32); err != nil {
+					return
+				}
+				*field = uint32(value)
+			}
+		}
+	}
+	headers = []sip.Header{&ss}
+
+	return
+}
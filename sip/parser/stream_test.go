@@ -1109,6 +1109,131 @@ func TestSupported(t *testing.T) {
 	}, t)
 }
 
+func TestAuthenticate(t *testing.T) {
+	doTests([]test{
+		{authenticateInput(`WWW-Authenticate: Digest realm="atlanta.com", nonce="84a4cc6f3082121f32b42a2187831a9e", algorithm=MD5, qop="auth"`),
+			&authenticateResult{pass, &sip.AuthenticateHeader{
+				HeaderName: "WWW-Authenticate",
+				Challenges: []*sip.AuthChallenge{{Scheme: "Digest", Params: []sip.AuthParam{
+					{Name: "realm", Value: "atlanta.com", Quoted: true},
+					{Name: "nonce", Value: "84a4cc6f3082121f32b42a2187831a9e", Quoted: true},
+					{Name: "algorithm", Value: "MD5"},
+					{Name: "qop", Value: "auth", Quoted: true},
+				}}},
+			}}},
+		{authenticateInput(`Proxy-Authenticate: Digest realm="atlanta.com", nonce="a", algorithm=SHA-256, Digest realm="atlanta.com", nonce="b", algorithm=MD5, stale=true`),
+			&authenticateResult{pass, &sip.AuthenticateHeader{
+				HeaderName: "Proxy-Authenticate",
+				Challenges: []*sip.AuthChallenge{
+					{Scheme: "Digest", Params: []sip.AuthParam{
+						{Name: "realm", Value: "atlanta.com", Quoted: true},
+						{Name: "nonce", Value: "a", Quoted: true},
+						{Name: "algorithm", Value: "SHA-256"},
+					}},
+					{Scheme: "Digest", Params: []sip.AuthParam{
+						{Name: "realm", Value: "atlanta.com", Quoted: true},
+						{Name: "nonce", Value: "b", Quoted: true},
+						{Name: "algorithm", Value: "MD5"},
+						{Name: "stale", Value: "true"},
+					}},
+				},
+			}}},
+		{authenticateInput(`WWW-Authenticate: Digest realm="atlanta.com`), &authenticateResult{fail, &sip.AuthenticateHeader{}}},
+		{authenticateInput(`WWW-Authenticate: `), &authenticateResult{fail, &sip.AuthenticateHeader{}}},
+	}, t)
+}
+
+func TestAuthorization(t *testing.T) {
+	doTests([]test{
+		{authorizationInput(`Authorization: Digest username="bob", realm="atlanta.com", nonce="a", uri="sip:bob@biloxi.com", response="42ce3cef44b22f50c6a6071bc8", algorithm=MD5, qop=auth, nc=00000001, cnonce="0a4f113b"`),
+			&authorizationResult{pass, &sip.AuthorizationHeader{
+				HeaderName: "Authorization",
+				Credentials: &sip.AuthChallenge{Scheme: "Digest", Params: []sip.AuthParam{
+					{Name: "username", Value: "bob", Quoted: true},
+					{Name: "realm", Value: "atlanta.com", Quoted: true},
+					{Name: "nonce", Value: "a", Quoted: true},
+					{Name: "uri", Value: "sip:bob@biloxi.com", Quoted: true},
+					{Name: "response", Value: "42ce3cef44b22f50c6a6071bc8", Quoted: true},
+					{Name: "algorithm", Value: "MD5"},
+					{Name: "qop", Value: "auth"},
+					{Name: "nc", Value: "00000001"},
+					{Name: "cnonce", Value: "0a4f113b", Quoted: true},
+				}},
+			}}},
+		{authorizationInput(`Proxy-Authorization: Digest username="bob", realm="atlanta.com"`),
+			&authorizationResult{pass, &sip.AuthorizationHeader{
+				HeaderName: "Proxy-Authorization",
+				Credentials: &sip.AuthChallenge{Scheme: "Digest", Params: []sip.AuthParam{
+					{Name: "username", Value: "bob", Quoted: true},
+					{Name: "realm", Value: "atlanta.com", Quoted: true},
+				}},
+			}}},
+		{authorizationInput(`Authorization: Digest username="bob", Digest username="alice"`), &authorizationResult{fail, &sip.AuthorizationHeader{}}},
+	}, t)
+}
+
+func TestRSeq(t *testing.T) {
+	doTests([]test{
+		{rseqInput("RSeq: 988789"), &rseqResult{pass, sip.RSeq(988789)}},
+		{rseqInput("RSeq:\t1"), &rseqResult{pass, sip.RSeq(1)}},
+		{rseqInput("RSeq: 0"), &rseqResult{fail, sip.RSeq(0)}},
+		{rseqInput("RSeq: -1"), &rseqResult{fail, sip.RSeq(0)}},
+		{rseqInput("RSeq: "), &rseqResult{fail, sip.RSeq(0)}},
+	}, t)
+}
+
+func TestRAck(t *testing.T) {
+	doTests([]test{
+		{rackInput("RAck: 776656 1 INVITE"), &rackResult{pass, &sip.RAck{RSeq: 776656, CSeq: 1, MethodName: sip.INVITE}}},
+		{rackInput("RAck:  10\t314159   INVITE"), &rackResult{pass, &sip.RAck{RSeq: 10, CSeq: 314159, MethodName: sip.INVITE}}},
+		{rackInput("RAck: 776656 1"), &rackResult{fail, &sip.RAck{}}},
+		{rackInput("RAck: abc 1 INVITE"), &rackResult{fail, &sip.RAck{}}},
+		{rackInput("RAck: 1 4294967296 INVITE"), &rackResult{fail, &sip.RAck{}}},
+	}, t)
+}
+
+func TestSessionExpires(t *testing.T) {
+	doTests([]test{
+		{sessionExpiresInput("Session-Expires: 1800"), &sessionExpiresResult{pass, &sip.SessionExpires{Delta: 1800}}},
+		{sessionExpiresInput("Session-Expires: 4000;refresher=uac"), &sessionExpiresResult{pass, &sip.SessionExpires{Delta: 4000, Refresher: sip.RefresherUAC}}},
+		{sessionExpiresInput("x: 90 ; refresher=UAS"), &sessionExpiresResult{pass, &sip.SessionExpires{Delta: 90, Refresher: sip.RefresherUAS}}},
+		{sessionExpiresInput("Session-Expires: 1800;refresher=proxy"), &sessionExpiresResult{fail, &sip.SessionExpires{}}},
+		{sessionExpiresInput("Session-Expires: ;refresher=uac"), &sessionExpiresResult{fail, &sip.SessionExpires{}}},
+		{sessionExpiresInput("Session-Expires: -1"), &sessionExpiresResult{fail, &sip.SessionExpires{}}},
+	}, t)
+}
+
+func TestMinSE(t *testing.T) {
+	doTests([]test{
+		{minSEInput("Min-SE: 90"), &minSEResult{pass, sip.MinSE(90)}},
+		{minSEInput("Min-SE:\t3600"), &minSEResult{pass, sip.MinSE(3600)}},
+		{minSEInput("Min-SE: abc"), &minSEResult{fail, sip.MinSE(0)}},
+		{minSEInput("Min-SE: "), &minSEResult{fail, sip.MinSE(0)}},
+	}, t)
+}
+
+func TestEvent(t *testing.T) {
+	doTests([]test{
+		{eventInput("Event: presence"), &eventResult{pass, sip.Event("presence")}},
+		{eventInput("o: Catalog;id=1894"), &eventResult{pass, sip.Event("Catalog;id=1894")}},
+		{eventInput("Event:  dialog ; id=7 "), &eventResult{pass, sip.Event("dialog ; id=7")}},
+		{eventInput("Event: ;id=1"), &eventResult{fail, sip.Event("")}},
+	}, t)
+}
+
+func TestSubscriptionState(t *testing.T) {
+	doTests([]test{
+		{subscriptionStateInput("Subscription-State: active;expires=600"),
+			&subscriptionStateResult{pass, &sip.SubscriptionState{State: sip.SubStateActive, Expires: 600}}},
+		{subscriptionStateInput("Subscription-State: Pending; expires=60"),
+			&subscriptionStateResult{pass, &sip.SubscriptionState{State: sip.SubStatePending, Expires: 60}}},
+		{subscriptionStateInput("Subscription-State: terminated;reason=probation;retry-after=30"),
+			&subscriptionStateResult{pass, &sip.SubscriptionState{State: sip.SubStateTerminated, Reason: sip.SubReasonProbation, RetryAfter: 30}}},
+		{subscriptionStateInput("Subscription-State: active;expires=soon"), &subscriptionStateResult{fail, &sip.SubscriptionState{}}},
+		{subscriptionStateInput("Subscription-State: "), &subscriptionStateResult{fail, &sip.SubscriptionState{}}},
+	}, t)
+}
+
 // Basic test of unstreamed parsing, using empty INVITE.
 func TestUnstreamedParse1(t *testing.T) {
 	test := ParserTest{false, []parserTestStep{
@@ -2338,6 +2463,82 @@ func (expected *supportedResult) equals(other result) (equal bool, reason string
 	return true, ""
 }
 
+type authenticateInput string
+
+func (data authenticateInput) String() string {
+	return string(data)
+}
+
+func (data authenticateInput) evaluate() result {
+	headers, err := parseHeader(data.String())
+	if len(headers) == 1 {
+		return &authenticateResult{err, headers[0].(*sip.AuthenticateHeader)}
+	} else if len(headers) == 0 {
+		return &authenticateResult{err, &sip.AuthenticateHeader{}}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Authenticate test: %s", string(data)))
+	}
+}
+
+type authenticateResult struct {
+	err    error
+	header *sip.AuthenticateHeader
+}
+
+func (expected *authenticateResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*authenticateResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && !expected.header.Equals(actual.header) {
+		return false, fmt.Sprintf("unexpected Authenticate value: expected \"%s\", got \"%s\"",
+			expected.header, actual.header)
+	} else if actual.err == nil && expected.header.String() != actual.header.String() {
+		return false, fmt.Sprintf("unexpected Authenticate string: expected \"%s\", got \"%s\"",
+			expected.header, actual.header)
+	}
+	return true, ""
+}
+
+type authorizationInput string
+
+func (data authorizationInput) String() string {
+	return string(data)
+}
+
+func (data authorizationInput) evaluate() result {
+	headers, err := parseHeader(data.String())
+	if len(headers) == 1 {
+		return &authorizationResult{err, headers[0].(*sip.AuthorizationHeader)}
+	} else if len(headers) == 0 {
+		return &authorizationResult{err, &sip.AuthorizationHeader{}}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Authorization test: %s", string(data)))
+	}
+}
+
+type authorizationResult struct {
+	err    error
+	header *sip.AuthorizationHeader
+}
+
+func (expected *authorizationResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*authorizationResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && !expected.header.Equals(actual.header) {
+		return false, fmt.Sprintf("unexpected Authorization value: expected \"%s\", got \"%s\"",
+			expected.header, actual.header)
+	} else if actual.err == nil && expected.header.String() != actual.header.String() {
+		return false, fmt.Sprintf("unexpected Authorization string: expected \"%s\", got \"%s\"",
+			expected.header, actual.header)
+	}
+	return true, ""
+}
+
 type ParserTest struct {
 	streamed bool
 	steps    []parserTestStep
@@ -2489,3 +2690,213 @@ func errToStr(err error) string {
 		return err.Error()
 	}
 }
+
+type rseqInput string
+
+func (data rseqInput) String() string {
+	return string(data)
+}
+
+func (data rseqInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &rseqResult{err, *(headers[0].(*sip.RSeq))}
+	} else if len(headers) == 0 {
+		return &rseqResult{err, sip.RSeq(0)}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by RSeq test: %s", string(data)))
+	}
+}
+
+type rseqResult struct {
+	err    error
+	header sip.RSeq
+}
+
+func (expected *rseqResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*rseqResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && expected.header != actual.header {
+		return false, fmt.Sprintf("unexpected RSeq value: expected \"%d\", got \"%d\"",
+			expected.header, actual.header)
+	}
+	return true, ""
+}
+
+type rackInput string
+
+func (data rackInput) String() string {
+	return string(data)
+}
+
+func (data rackInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &rackResult{err, headers[0].(*sip.RAck)}
+	} else if len(headers) == 0 {
+		return &rackResult{err, &sip.RAck{}}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by RAck test: %s", string(data)))
+	}
+}
+
+type rackResult struct {
+	err    error
+	header *sip.RAck
+}
+
+func (expected *rackResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*rackResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && !expected.header.Equals(actual.header) {
+		return false, fmt.Sprintf("unexpected RAck value: expected \"%s\", got \"%s\"",
+			expected.header.Value(), actual.header.Value())
+	}
+	return true, ""
+}
+
+type sessionExpiresInput string
+
+func (data sessionExpiresInput) String() string {
+	return string(data)
+}
+
+func (data sessionExpiresInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &sessionExpiresResult{err, headers[0].(*sip.SessionExpires)}
+	} else if len(headers) == 0 {
+		return &sessionExpiresResult{err, &sip.SessionExpires{}}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Session-Expires test: %s", string(data)))
+	}
+}
+
+type sessionExpiresResult struct {
+	err    error
+	header *sip.SessionExpires
+}
+
+func (expected *sessionExpiresResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*sessionExpiresResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && !expected.header.Equals(actual.header) {
+		return false, fmt.Sprintf("unexpected Session-Expires value: expected \"%s\", got \"%s\"",
+			expected.header.Value(), actual.header.Value())
+	}
+	return true, ""
+}
+
+type minSEInput string
+
+func (data minSEInput) String() string {
+	return string(data)
+}
+
+func (data minSEInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &minSEResult{err, *(headers[0].(*sip.MinSE))}
+	} else if len(headers) == 0 {
+		return &minSEResult{err, sip.MinSE(0)}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Min-SE test: %s", string(data)))
+	}
+}
+
+type minSEResult struct {
+	err    error
+	header sip.MinSE
+}
+
+func (expected *minSEResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*minSEResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && expected.header != actual.header {
+		return false, fmt.Sprintf("unexpected Min-SE value: expected \"%d\", got \"%d\"",
+			expected.header, actual.header)
+	}
+	return true, ""
+}
+
+type eventInput string
+
+func (data eventInput) String() string {
+	return string(data)
+}
+
+func (data eventInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &eventResult{err, *(headers[0].(*sip.Event))}
+	} else if len(headers) == 0 {
+		return &eventResult{err, sip.Event("")}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Event test: %s", string(data)))
+	}
+}
+
+type eventResult struct {
+	err    error
+	header sip.Event
+}
+
+func (expected *eventResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*eventResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && expected.header != actual.header {
+		return false, fmt.Sprintf("unexpected Event value: expected \"%s\", got \"%s\"",
+			expected.header, actual.header)
+	}
+	return true, ""
+}
+
+type subscriptionStateInput string
+
+func (data subscriptionStateInput) String() string {
+	return string(data)
+}
+
+func (data subscriptionStateInput) evaluate() result {
+	headers, err := parseHeader(string(data))
+	if len(headers) == 1 {
+		return &subscriptionStateResult{err, headers[0].(*sip.SubscriptionState)}
+	} else if len(headers) == 0 {
+		return &subscriptionStateResult{err, &sip.SubscriptionState{}}
+	} else {
+		panic(fmt.Sprintf("Multiple headers returned by Subscription-State test: %s", string(data)))
+	}
+}
+
+type subscriptionStateResult struct {
+	err    error
+	header *sip.SubscriptionState
+}
+
+func (expected *subscriptionStateResult) equals(other result) (equal bool, reason string) {
+	actual := *(other.(*subscriptionStateResult))
+	if expected.err == nil && actual.err != nil {
+		return false, fmt.Sprintf("unexpected error: %s", actual.err.Error())
+	} else if expected.err != nil && actual.err == nil {
+		return false, fmt.Sprintf("unexpected success: got \"%s\"", actual.header.String())
+	} else if actual.err == nil && !expected.header.Equals(actual.header) {
+		return false, fmt.Sprintf("unexpected Subscription-State value: expected \"%s\", got \"%s\"",
+			expected.header.Value(), actual.header.Value())
+	}
+	return true, ""
+}
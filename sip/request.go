@@ -181,10 +181,6 @@ func (req *request) Transport() string {
 		}
 	}
 
-	if tp == "UDP" && len(req.String()) > int(MTU)-200 {
-		tp = "TCP"
-	}
-
 	return tp
 }
 
@@ -0,0 +1,105 @@
+package sdp
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrNoCommonMedia = errors.New("no common media in offer")
+
+// AnswerOptions describes local capabilities used to answer the offer.
+type AnswerOptions struct {
+	Origin     Origin
+	Connection *Connection
+	// Ports maps media type to the local port, offered media without local port is rejected.
+	Ports map[string]int
+	// Encodings lists supported encodings in the order of preference, e.g. PS, H264.
+	Encodings []string
+	// SSRC overrides y= line of the offer.
+	SSRC string
+}
+
+// Answer builds answer on the offer - RFC 3264 6.
+// Each accepted media gets the most preferred supported payload, reversed direction
+// and the opposite TCP setup role, rejected media are answered with zero port.
+func Answer(offer *Session, opts AnswerOptions) (*Session, error) {
+	answer := &Session{
+		Version:    0,
+		Origin:     opts.Origin,
+		Name:       offer.Name,
+		URI:        offer.URI,
+		Connection: opts.Connection,
+		Timing:     append([]Timing(nil), offer.Timing...),
+		SSRC:       offer.SSRC,
+		Format:     offer.Format,
+	}
+	if opts.SSRC != "" {
+		answer.SSRC = opts.SSRC
+	}
+
+	accepted := 0
+	for _, om := range offer.Media {
+		am := &Media{
+			Type:  om.Type,
+			Proto: om.Proto,
+		}
+		answer.Media = append(answer.Media, am)
+
+		port, ok := opts.Ports[om.Type]
+		rm, found := selectRTPMap(om, opts.Encodings)
+		if om.Port == 0 || !ok || !found {
+			am.Formats = om.Formats
+			continue
+		}
+
+		am.Port = port
+		am.AddRTPMap(rm)
+		am.Attributes = append(am.Attributes, Attribute{Key: reverseDirection(om.Attributes.Direction())})
+		if setup := om.Setup(); setup != "" {
+			am.Attributes = append(am.Attributes, Attribute{Key: "setup", Value: reverseSetup(setup)})
+			if mode := om.ConnectionMode(); mode != "" {
+				am.Attributes = append(am.Attributes, Attribute{Key: "connection", Value: mode})
+			}
+		}
+		accepted++
+	}
+
+	if accepted == 0 {
+		return answer, ErrNoCommonMedia
+	}
+
+	return answer, nil
+}
+
+func selectRTPMap(m *Media, encodings []string) (RTPMap, bool) {
+	maps := m.RTPMaps()
+	for _, enc := range encodings {
+		for _, rm := range maps {
+			if strings.EqualFold(rm.Encoding, enc) {
+				return rm, true
+			}
+		}
+	}
+
+	return RTPMap{}, false
+}
+
+func reverseDirection(dir string) string {
+	switch dir {
+	case SendOnly:
+		return RecvOnly
+	case RecvOnly:
+		return SendOnly
+	default:
+		return dir
+	}
+}
+
+func reverseSetup(setup string) string {
+	switch setup {
+	case SetupActive:
+		return SetupPassive
+	default:
+		return SetupActive
+	}
+}
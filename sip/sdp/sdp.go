@@ -0,0 +1,551 @@
+// Package sdp implements parsing and building of session descriptions - RFC 4566,
+// including GB/T 28181 extensions: y= SSRC, f= media format and the
+// setup, connection, downloadspeed and filesize attributes.
+package sdp
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const ContentType = "application/sdp"
+
+// Media directions - RFC 4566 6.
+const (
+	SendRecv = "sendrecv"
+	SendOnly = "sendonly"
+	RecvOnly = "recvonly"
+	Inactive = "inactive"
+)
+
+// Setup roles of the TCP media transport - RFC 4145 4.
+const (
+	SetupActive  = "active"
+	SetupPassive = "passive"
+	SetupActPass = "actpass"
+)
+
+// Session is a session description.
+type Session struct {
+	Version     int
+	Origin      Origin
+	Name        string
+	Information string
+	URI         string
+	Connection  *Connection
+	Bandwidth   []string
+	Timing      []Timing
+	Attributes  Attributes
+	Media       []*Media
+	// SSRC is GB/T 28181 y= line, decimal SSRC of the RTP stream.
+	SSRC string
+	// Format is GB/T 28181 f= line, media format description.
+	Format string
+}
+
+// Origin is o= line.
+type Origin struct {
+	Username       string
+	SessionID      string
+	SessionVersion string
+	NetType        string
+	AddrType       string
+	Address        string
+}
+
+func (o Origin) String() string {
+	return fmt.Sprintf("%s %s %s %s %s %s",
+		o.Username, o.SessionID, o.SessionVersion, o.NetType, o.AddrType, o.Address)
+}
+
+// Connection is c= line.
+type Connection struct {
+	NetType  string
+	AddrType string
+	Address  string
+}
+
+// NewConnection creates IN IP4 connection with the address.
+func NewConnection(address string) *Connection {
+	return &Connection{NetType: "IN", AddrType: "IP4", Address: address}
+}
+
+func (c *Connection) String() string {
+	return fmt.Sprintf("%s %s %s", c.NetType, c.AddrType, c.Address)
+}
+
+// Timing is t= line.
+type Timing struct {
+	Start int64
+	Stop  int64
+}
+
+func (t Timing) String() string {
+	return fmt.Sprintf("%d %d", t.Start, t.Stop)
+}
+
+// Attribute is a= line, property attributes have empty value.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+func (a Attribute) String() string {
+	if a.Value == "" {
+		return a.Key
+	}
+
+	return a.Key + ":" + a.Value
+}
+
+type Attributes []Attribute
+
+// Get returns value of the first attribute with the key.
+func (attrs Attributes) Get(key string) (string, bool) {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Values returns values of all attributes with the key.
+func (attrs Attributes) Values(key string) []string {
+	var values []string
+	for _, a := range attrs {
+		if a.Key == key {
+			values = append(values, a.Value)
+		}
+	}
+
+	return values
+}
+
+func (attrs Attributes) Has(key string) bool {
+	_, ok := attrs.Get(key)
+	return ok
+}
+
+// Set replaces value of the first attribute with the key or appends new attribute.
+func (attrs Attributes) Set(key, value string) Attributes {
+	for i := range attrs {
+		if attrs[i].Key == key {
+			attrs[i].Value = value
+			return attrs
+		}
+	}
+
+	return append(attrs, Attribute{Key: key, Value: value})
+}
+
+// Direction returns media direction attribute, sendrecv by default.
+func (attrs Attributes) Direction() string {
+	for _, a := range attrs {
+		switch a.Key {
+		case SendRecv, SendOnly, RecvOnly, Inactive:
+			return a.Key
+		}
+	}
+
+	return SendRecv
+}
+
+// Media is m= line with its media level lines.
+type Media struct {
+	Type        string
+	Port        int
+	Proto       string
+	Formats     []string
+	Information string
+	Connection  *Connection
+	Bandwidth   []string
+	Attributes  Attributes
+}
+
+// RTPMap is rtpmap attribute value - RFC 4566 6.
+type RTPMap struct {
+	Payload   int
+	Encoding  string
+	ClockRate int
+	Params    string
+}
+
+func (m RTPMap) String() string {
+	s := fmt.Sprintf("%d %s/%d", m.Payload, m.Encoding, m.ClockRate)
+	if m.Params != "" {
+		s += "/" + m.Params
+	}
+
+	return s
+}
+
+// staticPayloads are RTP payload types that may be used without rtpmap - RFC 3551 6.
+var staticPayloads = map[int]RTPMap{
+	0:  {Payload: 0, Encoding: "PCMU", ClockRate: 8000},
+	8:  {Payload: 8, Encoding: "PCMA", ClockRate: 8000},
+	26: {Payload: 26, Encoding: "JPEG", ClockRate: 90000},
+	33: {Payload: 33, Encoding: "MP2T", ClockRate: 90000},
+}
+
+func parseRTPMap(value string) (RTPMap, error) {
+	var m RTPMap
+	fields := strings.SplitN(value, " ", 2)
+	if len(fields) != 2 {
+		return m, fmt.Errorf("invalid rtpmap '%s'", value)
+	}
+	pt, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return m, fmt.Errorf("invalid rtpmap payload '%s': %w", value, err)
+	}
+	m.Payload = pt
+
+	parts := strings.SplitN(fields[1], "/", 3)
+	m.Encoding = parts[0]
+	if len(parts) > 1 {
+		if m.ClockRate, err = strconv.Atoi(parts[1]); err != nil {
+			return m, fmt.Errorf("invalid rtpmap clock rate '%s': %w", value, err)
+		}
+	}
+	if len(parts) > 2 {
+		m.Params = parts[2]
+	}
+
+	return m, nil
+}
+
+// RTPMaps returns rtpmap attributes in the order of media formats.
+func (m *Media) RTPMaps() []RTPMap {
+	maps := make(map[int]RTPMap)
+	for _, value := range m.Attributes.Values("rtpmap") {
+		if rm, err := parseRTPMap(value); err == nil {
+			maps[rm.Payload] = rm
+		}
+	}
+
+	result := make([]RTPMap, 0, len(m.Formats))
+	for _, f := range m.Formats {
+		pt, err := strconv.Atoi(f)
+		if err != nil {
+			continue
+		}
+		if rm, ok := maps[pt]; ok {
+			result = append(result, rm)
+		} else if rm, ok := staticPayloads[pt]; ok {
+			result = append(result, rm)
+		}
+	}
+
+	return result
+}
+
+// AddRTPMap appends the payload to media formats with its rtpmap attribute.
+func (m *Media) AddRTPMap(rm RTPMap) *Media {
+	m.Formats = append(m.Formats, strconv.Itoa(rm.Payload))
+	m.Attributes = append(m.Attributes, Attribute{Key: "rtpmap", Value: rm.String()})
+
+	return m
+}
+
+// Setup returns setup attribute of the TCP media - RFC 4145.
+func (m *Media) Setup() string {
+	v, _ := m.Attributes.Get("setup")
+	return v
+}
+
+// ConnectionMode returns connection attribute of the TCP media, new or existing - RFC 4145.
+func (m *Media) ConnectionMode() string {
+	v, _ := m.Attributes.Get("connection")
+	return v
+}
+
+// DownloadSpeed returns GB/T 28181 downloadspeed attribute, the speed multiplier of the download.
+func (m *Media) DownloadSpeed() (int, bool) {
+	v, ok := m.Attributes.Get("downloadspeed")
+	if !ok {
+		return 0, false
+	}
+	speed, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+
+	return speed, true
+}
+
+// FileSize returns GB/T 28181 filesize attribute in bytes.
+func (m *Media) FileSize() (int64, bool) {
+	v, ok := m.Attributes.Get("filesize")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// IsTCP reports whether the media is transported over TCP, e.g. TCP/RTP/AVP.
+func (m *Media) IsTCP() bool {
+	return strings.HasPrefix(strings.ToUpper(m.Proto), "TCP")
+}
+
+func (m *Media) String() string {
+	return fmt.Sprintf("%s %d %s %s", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+}
+
+// MediaConnection returns connection of the media, falls back to the session connection.
+func (s *Session) MediaConnection(m *Media) *Connection {
+	if m.Connection != nil {
+		return m.Connection
+	}
+
+	return s.Connection
+}
+
+// FirstMedia returns the first media of the type.
+func (s *Session) FirstMedia(typ string) (*Media, bool) {
+	for _, m := range s.Media {
+		if m.Type == typ {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// Parse parses session description.
+func Parse(data string) (*Session, error) {
+	s := &Session{}
+	var media *Media
+	seen := false
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		if len(text) < 2 || text[1] != '=' {
+			return nil, fmt.Errorf("sdp line %d: invalid line '%s'", line, text)
+		}
+		typ, value := text[0], text[2:]
+
+		if !seen {
+			if typ != 'v' {
+				return nil, fmt.Errorf("sdp line %d: expected v= line, got '%s'", line, text)
+			}
+			seen = true
+		}
+
+		var err error
+		switch typ {
+		case 'v':
+			s.Version, err = strconv.Atoi(value)
+		case 'o':
+			err = parseOrigin(value, &s.Origin)
+		case 's':
+			s.Name = value
+		case 'i':
+			if media != nil {
+				media.Information = value
+			} else {
+				s.Information = value
+			}
+		case 'u':
+			s.URI = value
+		case 'c':
+			var c *Connection
+			if c, err = parseConnection(value); err == nil {
+				if media != nil {
+					media.Connection = c
+				} else {
+					s.Connection = c
+				}
+			}
+		case 'b':
+			if media != nil {
+				media.Bandwidth = append(media.Bandwidth, value)
+			} else {
+				s.Bandwidth = append(s.Bandwidth, value)
+			}
+		case 't':
+			var t Timing
+			if t, err = parseTiming(value); err == nil {
+				s.Timing = append(s.Timing, t)
+			}
+		case 'm':
+			if media, err = parseMedia(value); err == nil {
+				s.Media = append(s.Media, media)
+			}
+		case 'a':
+			attr := parseAttribute(value)
+			if media != nil {
+				media.Attributes = append(media.Attributes, attr)
+			} else {
+				s.Attributes = append(s.Attributes, attr)
+			}
+		case 'y':
+			s.SSRC = value
+		case 'f':
+			s.Format = value
+		default:
+			// e=, p=, z=, k=, r= and unknown lines are ignored
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sdp line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !seen {
+		return nil, fmt.Errorf("empty session description")
+	}
+
+	return s, nil
+}
+
+func parseOrigin(value string, o *Origin) error {
+	fields := strings.Fields(value)
+	if len(fields) != 6 {
+		return fmt.Errorf("invalid origin '%s'", value)
+	}
+	*o = Origin{
+		Username:       fields[0],
+		SessionID:      fields[1],
+		SessionVersion: fields[2],
+		NetType:        fields[3],
+		AddrType:       fields[4],
+		Address:        fields[5],
+	}
+
+	return nil
+}
+
+func parseConnection(value string) (*Connection, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid connection '%s'", value)
+	}
+
+	return &Connection{NetType: fields[0], AddrType: fields[1], Address: fields[2]}, nil
+}
+
+func parseTiming(value string) (Timing, error) {
+	var t Timing
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return t, fmt.Errorf("invalid timing '%s'", value)
+	}
+	var err error
+	if t.Start, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return t, fmt.Errorf("invalid timing '%s': %w", value, err)
+	}
+	if t.Stop, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return t, fmt.Errorf("invalid timing '%s': %w", value, err)
+	}
+
+	return t, nil
+}
+
+func parseMedia(value string) (*Media, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid media '%s'", value)
+	}
+	// port may have number of ports suffix
+	port, err := strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid media port '%s': %w", value, err)
+	}
+
+	return &Media{
+		Type:    fields[0],
+		Port:    port,
+		Proto:   fields[2],
+		Formats: fields[3:],
+	}, nil
+}
+
+func parseAttribute(value string) Attribute {
+	if i := strings.IndexByte(value, ':'); i != -1 {
+		return Attribute{Key: value[:i], Value: value[i+1:]}
+	}
+
+	return Attribute{Key: value}
+}
+
+// String marshals session description with CRLF line endings,
+// GB/T 28181 y= and f= lines are written after media descriptions.
+func (s *Session) String() string {
+	var b strings.Builder
+	line := func(typ byte, value string) {
+		b.WriteByte(typ)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteString("\r\n")
+	}
+
+	line('v', strconv.Itoa(s.Version))
+	line('o', s.Origin.String())
+	name := s.Name
+	if name == "" {
+		name = "-"
+	}
+	line('s', name)
+	if s.Information != "" {
+		line('i', s.Information)
+	}
+	if s.URI != "" {
+		line('u', s.URI)
+	}
+	if s.Connection != nil {
+		line('c', s.Connection.String())
+	}
+	for _, bw := range s.Bandwidth {
+		line('b', bw)
+	}
+	if len(s.Timing) == 0 {
+		line('t', Timing{}.String())
+	}
+	for _, t := range s.Timing {
+		line('t', t.String())
+	}
+	for _, a := range s.Attributes {
+		line('a', a.String())
+	}
+	for _, m := range s.Media {
+		line('m', m.String())
+		if m.Information != "" {
+			line('i', m.Information)
+		}
+		if m.Connection != nil {
+			line('c', m.Connection.String())
+		}
+		for _, bw := range m.Bandwidth {
+			line('b', bw)
+		}
+		for _, a := range m.Attributes {
+			line('a', a.String())
+		}
+	}
+	if s.SSRC != "" {
+		line('y', s.SSRC)
+	}
+	if s.Format != "" {
+		line('f', s.Format)
+	}
+
+	return b.String()
+}
+
+// Marshal returns session description bytes.
+func (s *Session) Marshal() []byte {
+	return []byte(s.String())
+}
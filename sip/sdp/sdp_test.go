@@ -0,0 +1,124 @@
+package sdp_test
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip/sdp"
+)
+
+const gbOffer = "v=0\r\n" +
+	"o=34020000002000000001 0 0 IN IP4 192.168.1.10\r\n" +
+	"s=Playback\r\n" +
+	"u=34020000001320000001:0\r\n" +
+	"c=IN IP4 192.168.1.10\r\n" +
+	"t=1600000000 1600003600\r\n" +
+	"m=video 9000 TCP/RTP/AVP 96 97 98\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:96 PS/90000\r\n" +
+	"a=rtpmap:97 MPEG4/90000\r\n" +
+	"a=rtpmap:98 H264/90000\r\n" +
+	"a=setup:passive\r\n" +
+	"a=connection:new\r\n" +
+	"a=downloadspeed:4\r\n" +
+	"a=filesize:1048576\r\n" +
+	"y=1100000001\r\n" +
+	"f=v/2/4///a///\r\n"
+
+func TestParseMarshal(t *testing.T) {
+	s, err := sdp.Parse(gbOffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s.Origin.Username != "34020000002000000001" || s.Name != "Playback" || s.URI != "34020000001320000001:0" {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if s.SSRC != "1100000001" || s.Format != "v/2/4///a///" {
+		t.Errorf("unexpected GB28181 lines y=%s f=%s", s.SSRC, s.Format)
+	}
+	if len(s.Timing) != 1 || s.Timing[0].Start != 1600000000 {
+		t.Errorf("unexpected timing %v", s.Timing)
+	}
+
+	m, ok := s.FirstMedia("video")
+	if !ok {
+		t.Fatalf("video media not found")
+	}
+	if m.Port != 9000 || !m.IsTCP() || m.Attributes.Direction() != sdp.RecvOnly {
+		t.Errorf("unexpected media %s", m)
+	}
+	if m.Setup() != sdp.SetupPassive || m.ConnectionMode() != "new" {
+		t.Errorf("unexpected setup %s connection %s", m.Setup(), m.ConnectionMode())
+	}
+	if speed, ok := m.DownloadSpeed(); !ok || speed != 4 {
+		t.Errorf("unexpected downloadspeed %d", speed)
+	}
+	if size, ok := m.FileSize(); !ok || size != 1048576 {
+		t.Errorf("unexpected filesize %d", size)
+	}
+	if maps := m.RTPMaps(); len(maps) != 3 || maps[2].Encoding != "H264" || maps[2].ClockRate != 90000 {
+		t.Errorf("unexpected rtpmaps %v", maps)
+	}
+
+	if out := s.String(); out != gbOffer {
+		t.Errorf("marshal mismatch:\n%s\nexpected:\n%s", out, gbOffer)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"o=- 0 0 IN IP4 127.0.0.1\r\n",
+		"v=0\r\nm=video abc RTP/AVP 96\r\n",
+		"v=0\r\nc=IN IP4\r\n",
+		"v=0\r\nbroken\r\n",
+	} {
+		if _, err := sdp.Parse(data); err == nil {
+			t.Errorf("expected error on %q", data)
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	offer, err := sdp.Parse(gbOffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	offer.Media = append(offer.Media, &sdp.Media{Type: "audio", Port: 9002, Proto: "RTP/AVP", Formats: []string{"8"}})
+
+	answer, err := sdp.Answer(offer, sdp.AnswerOptions{
+		Origin:     sdp.Origin{Username: "34020000001320000001", SessionID: "0", SessionVersion: "0", NetType: "IN", AddrType: "IP4", Address: "192.168.1.64"},
+		Connection: sdp.NewConnection("192.168.1.64"),
+		Ports:      map[string]int{"video": 15060},
+		Encodings:  []string{"H264", "PS"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	parsed, err := sdp.Parse(answer.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(parsed.Media) != 2 {
+		t.Fatalf("expected 2 media, got %d", len(parsed.Media))
+	}
+
+	video := parsed.Media[0]
+	if video.Port != 15060 || parsed.MediaConnection(video).Address != "192.168.1.64" {
+		t.Errorf("unexpected video media %s", video)
+	}
+	if maps := video.RTPMaps(); len(maps) != 1 || maps[0].Payload != 98 {
+		t.Errorf("expected preferred H264 payload, got %v", maps)
+	}
+	if video.Attributes.Direction() != sdp.SendOnly || video.Setup() != sdp.SetupActive {
+		t.Errorf("unexpected direction %s setup %s", video.Attributes.Direction(), video.Setup())
+	}
+	if parsed.SSRC != "1100000001" {
+		t.Errorf("expected SSRC from offer, got %s", parsed.SSRC)
+	}
+
+	if audio := parsed.Media[1]; audio.Port != 0 {
+		t.Errorf("expected rejected audio media, got %s", audio)
+	}
+}
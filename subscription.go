@@ -0,0 +1,995 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// EventPackage describes event package served by the Notifier or subscribed by the Subscriber - RFC 6665 7.
+type EventPackage struct {
+	// Name is the event package name sent in Event header, i.e. presence or Catalog.
+	Name string
+	// ContentType of NOTIFY bodies, it is sent in Accept header of SUBSCRIBE.
+	ContentType string
+	// DefaultExpires is the subscription duration in seconds used when SUBSCRIBE has no Expires header.
+	DefaultExpires uint32
+}
+
+var (
+	// PresencePackage - RFC 3856.
+	PresencePackage = EventPackage{
+		Name:           "presence",
+		ContentType:    "application/pidf+xml",
+		DefaultExpires: 3600,
+	}
+	// DialogPackage - RFC 4235.
+	DialogPackage = EventPackage{
+		Name:           "dialog",
+		ContentType:    "application/dialog-info+xml",
+		DefaultExpires: 3600,
+	}
+	// MessageSummaryPackage - RFC 3842.
+	MessageSummaryPackage = EventPackage{
+		Name:           "message-summary",
+		ContentType:    "application/simple-message-summary",
+		DefaultExpires: 3600,
+	}
+)
+
+func getEvent(msg sip.Message) (sip.Event, bool) {
+	hdrs := msg.GetHeaders("Event")
+	if len(hdrs) == 0 {
+		return "", false
+	}
+	if event, ok := hdrs[0].(*sip.Event); ok {
+		return *event, true
+	}
+
+	return sip.Event(hdrs[0].Value()), true
+}
+
+func getExpires(msg sip.Message) (uint32, bool) {
+	hdrs := msg.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	expires, ok := hdrs[0].(*sip.Expires)
+	if !ok {
+		return 0, false
+	}
+
+	return uint32(*expires), true
+}
+
+func getSubscriptionState(msg sip.Message) (*sip.SubscriptionState, bool) {
+	hdrs := msg.GetHeaders("Subscription-State")
+	if len(hdrs) == 0 {
+		return nil, false
+	}
+	ss, ok := hdrs[0].(*sip.SubscriptionState)
+
+	return ss, ok
+}
+
+func subscriptionKey(callID, localTag string, event sip.Event) string {
+	key := strings.Join([]string{callID, localTag, strings.ToLower(event.Package())}, "__")
+	if id := event.ID(); id != "" {
+		key += "__" + id
+	}
+
+	return key
+}
+
+// refreshDelay returns delay before the subscription refresh,
+// the refresh is sent in advance enough for the transaction timeout.
+func refreshDelay(expires uint32) time.Duration {
+	margin := expires / 2
+	if margin > 32 {
+		margin = 32
+	}
+
+	return time.Duration(expires-margin) * time.Second
+}
+
+// SubscribeHandler is called on the new subscription and on every refresh.
+// It returns the subscription state (sip.SubStateActive or sip.SubStatePending)
+// and the body of NOTIFY with the current state.
+// Returned error rejects the subscription with 403 Forbidden.
+type SubscribeHandler func(sub *ServerSubscription, req sip.Request) (state string, body string, err error)
+
+type notifierHandler struct {
+	pkg     EventPackage
+	handler SubscribeHandler
+}
+
+// Notifier accepts subscriptions and sends NOTIFY requests - RFC 6665 4.2.
+type Notifier struct {
+	srv Server
+
+	mu       sync.RWMutex
+	handlers map[string]notifierHandler
+	subs     map[string]*ServerSubscription
+
+	log log.Logger
+}
+
+// NewNotifier creates notifier and registers it as SUBSCRIBE request handler of the server.
+func NewNotifier(srv Server, logger log.Logger) (*Notifier, error) {
+	n := &Notifier{
+		srv:      srv,
+		handlers: make(map[string]notifierHandler),
+		subs:     make(map[string]*ServerSubscription),
+	}
+	n.log = logger.WithPrefix("gosip.Notifier")
+
+	if err := srv.OnRequest(sip.SUBSCRIBE, n.handleSubscribe); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *Notifier) Log() log.Logger {
+	return n.log
+}
+
+// Handle registers event package, the handler decides about every subscription to it.
+func (n *Notifier) Handle(pkg EventPackage, handler SubscribeHandler) {
+	n.mu.Lock()
+	n.handlers[strings.ToLower(pkg.Name)] = notifierHandler{pkg, handler}
+	n.mu.Unlock()
+}
+
+// Subscriptions returns active and pending subscriptions of the event package.
+func (n *Notifier) Subscriptions(pkg string) []*ServerSubscription {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	subs := make([]*ServerSubscription, 0)
+	for _, sub := range n.subs {
+		if strings.EqualFold(sub.event.Package(), pkg) {
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs
+}
+
+func (n *Notifier) handler(pkg string) (notifierHandler, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	h, ok := n.handlers[strings.ToLower(pkg)]
+
+	return h, ok
+}
+
+func (n *Notifier) allowEvents() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	names := make([]string, 0, len(n.handlers))
+	for _, h := range n.handlers {
+		names = append(names, h.pkg.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (n *Notifier) respond(req sip.Request, status sip.StatusCode, reason string, headers ...sip.Header) {
+	res := sip.NewResponseFromRequest("", req, status, reason, "")
+	for _, header := range headers {
+		res.AppendHeader(header)
+	}
+	if _, err := n.srv.Respond(res); err != nil {
+		n.Log().WithFields(req.Fields()).Errorf("respond '%d %s' failed: %s", status, reason, err)
+	}
+}
+
+func (n *Notifier) handleSubscribe(req sip.Request, tx sip.ServerTransaction) {
+	event, ok := getEvent(req)
+	if !ok {
+		n.respond(req, 400, "Missing Event Header")
+		return
+	}
+	h, ok := n.handler(event.Package())
+	if !ok {
+		n.respond(req, 489, "Bad Event", &sip.GenericHeader{HeaderName: "Allow-Events", Contents: n.allowEvents()})
+		return
+	}
+
+	expires := h.pkg.DefaultExpires
+	if value, ok := getExpires(req); ok {
+		expires = value
+	}
+
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		id, err := sip.MakeDialogIDFromMessage(req)
+		if err != nil {
+			n.respond(req, 400, "Bad Request")
+			return
+		}
+
+		n.mu.RLock()
+		sub, ok := n.subs[id+"__"+subscriptionKey("", "", event)]
+		n.mu.RUnlock()
+		if !ok {
+			n.respond(req, 481, "Subscription Does Not Exist")
+			return
+		}
+
+		sub.refresh(req, expires)
+
+		return
+	}
+
+	// the Contact is the local target of the subscription dialog - RFC 6665 4.1.4
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	ensureToTag(res)
+	res.AppendHeader(&sip.ContactHeader{Address: localContact(n.srv, req)})
+	sd, err := sip.NewDialogUAS(req, res)
+	if err != nil {
+		n.Log().WithFields(req.Fields()).Warnf("create subscription dialog failed: %s", err)
+		n.respond(req, 400, "Bad Request")
+		return
+	}
+
+	sub := newServerSubscription(n, h, event, sd)
+	state, body, err := h.handler(sub, req)
+	if err != nil {
+		sub.Log().Debugf("subscription rejected: %s", err)
+		n.respond(req, 403, "Forbidden")
+		return
+	}
+
+	expiresHdr := sip.Expires(expires)
+	res.AppendHeader(&expiresHdr)
+	if _, err := n.srv.Respond(res); err != nil {
+		sub.Log().Errorf("respond '200 OK' on SUBSCRIBE failed: %s", err)
+		return
+	}
+
+	n.mu.Lock()
+	n.subs[sub.ID()] = sub
+	n.mu.Unlock()
+	sub.Log().Debug("subscription created")
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimers(n.srv).TimerF)
+	defer cancel()
+
+	// fetch - RFC 6665 4.4.3
+	if expires == 0 {
+		if err := sub.Terminate(ctx, sip.SubReasonTimeout, body); err != nil {
+			sub.Log().Warnf("send final NOTIFY failed: %s", err)
+		}
+
+		return
+	}
+
+	sub.setState(state, expires)
+	if err := sub.Notify(ctx, body); err != nil {
+		sub.Log().Warnf("send NOTIFY failed: %s", err)
+	}
+}
+
+// ServerSubscription is the subscription accepted by the Notifier.
+type ServerSubscription struct {
+	notifier *Notifier
+	pkg      EventPackage
+	handler  SubscribeHandler
+	event    sip.Event
+	sd       *sip.Dialog
+
+	mu      sync.Mutex
+	state   string
+	expires time.Time
+	timer   timing.Timer
+
+	done     chan struct{}
+	doneOnce sync.Once
+
+	log log.Logger
+}
+
+func newServerSubscription(n *Notifier, h notifierHandler, event sip.Event, sd *sip.Dialog) *ServerSubscription {
+	sub := &ServerSubscription{
+		notifier: n,
+		pkg:      h.pkg,
+		handler:  h.handler,
+		event:    event,
+		sd:       sd,
+		state:    sip.SubStatePending,
+		done:     make(chan struct{}),
+	}
+	sub.log = n.Log().WithFields(sd.Fields()).WithFields(log.Fields{
+		"event": string(event),
+	})
+
+	return sub
+}
+
+func (sub *ServerSubscription) Log() log.Logger {
+	return sub.log
+}
+
+// ID returns the subscription ID in form of the dialog ID with event package and id.
+func (sub *ServerSubscription) ID() string {
+	return sub.sd.ID() + "__" + subscriptionKey("", "", sub.event)
+}
+
+func (sub *ServerSubscription) Event() sip.Event {
+	return sub.event
+}
+
+func (sub *ServerSubscription) Package() EventPackage {
+	return sub.pkg
+}
+
+// Dialog returns dialog created by the subscription.
+func (sub *ServerSubscription) Dialog() *sip.Dialog {
+	return sub.sd
+}
+
+func (sub *ServerSubscription) State() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.state
+}
+
+// Done is closed when the subscription is terminated.
+func (sub *ServerSubscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *ServerSubscription) setState(state string, expires uint32) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if state != "" {
+		sub.state = state
+	}
+	sub.expires = timing.Now().Add(time.Duration(expires) * time.Second)
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.timer = timing.AfterFunc(time.Duration(expires)*time.Second, sub.expire)
+}
+
+// Notify sends NOTIFY with the current subscription state.
+func (sub *ServerSubscription) Notify(ctx context.Context, body string) error {
+	sub.mu.Lock()
+	ss := &sip.SubscriptionState{State: sub.state}
+	if remaining := sub.expires.Sub(timing.Now()); remaining > 0 {
+		ss.Expires = uint32(remaining.Round(time.Second) / time.Second)
+	}
+	sub.mu.Unlock()
+
+	return sub.notify(ctx, ss, body)
+}
+
+// Activate moves pending subscription to the active state and notifies subscriber.
+func (sub *ServerSubscription) Activate(ctx context.Context, body string) error {
+	sub.mu.Lock()
+	sub.state = sip.SubStateActive
+	sub.mu.Unlock()
+
+	return sub.Notify(ctx, body)
+}
+
+// Terminate sends final NOTIFY with the termination reason and drops the subscription.
+func (sub *ServerSubscription) Terminate(ctx context.Context, reason, body string) error {
+	defer sub.terminate()
+
+	sub.mu.Lock()
+	sub.state = sip.SubStateTerminated
+	sub.mu.Unlock()
+
+	return sub.notify(ctx, &sip.SubscriptionState{State: sip.SubStateTerminated, Reason: reason}, body)
+}
+
+func (sub *ServerSubscription) notify(ctx context.Context, ss *sip.SubscriptionState, body string) error {
+	req, err := sub.sd.NewRequest(sip.NOTIFY, body)
+	if err != nil {
+		return err
+	}
+	event := sub.event
+	req.AppendHeader(&event)
+	req.AppendHeader(ss)
+	if body != "" && sub.pkg.ContentType != "" {
+		contentType := sip.ContentType(sub.pkg.ContentType)
+		req.AppendHeader(&contentType)
+	}
+
+	res, err := sub.notifier.srv.RequestWithContext(ctx, req)
+	if err != nil {
+		// subscriber has gone - RFC 6665 4.2.2
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && ss.State != sip.SubStateTerminated {
+			sub.Log().Debugf("NOTIFY rejected, terminating subscription: %s", err)
+			sub.terminate()
+		}
+
+		return fmt.Errorf("send NOTIFY failed: %w", err)
+	}
+	sub.sd.ReceiveResponse(res)
+
+	return nil
+}
+
+func (sub *ServerSubscription) refresh(req sip.Request, expires uint32) {
+	logger := sub.Log().WithFields(req.Fields())
+
+	if err := sub.sd.ReceiveRequest(req); err != nil {
+		logger.Warn(err)
+		sub.notifier.respond(req, 500, "Server Internal Error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimers(sub.notifier.srv).TimerF)
+	defer cancel()
+
+	state, body, err := sub.handler(sub, req)
+	if err != nil {
+		logger.Debugf("subscription refresh rejected: %s", err)
+		sub.notifier.respond(req, 403, "Forbidden")
+		if err := sub.Terminate(ctx, sip.SubReasonRejected, ""); err != nil {
+			logger.Warnf("send final NOTIFY failed: %s", err)
+		}
+		return
+	}
+
+	expiresHdr := sip.Expires(expires)
+	sub.notifier.respond(req, 200, "OK", &expiresHdr, &sip.ContactHeader{Address: sub.sd.LocalTarget().Clone()})
+
+	// unsubscribe - RFC 6665 4.2.1.4
+	if expires == 0 {
+		if err := sub.Terminate(ctx, sip.SubReasonTimeout, body); err != nil {
+			logger.Warnf("send final NOTIFY failed: %s", err)
+		}
+		return
+	}
+
+	sub.setState(state, expires)
+	if err := sub.Notify(ctx, body); err != nil {
+		logger.Warnf("send NOTIFY failed: %s", err)
+	}
+}
+
+func (sub *ServerSubscription) expire() {
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+
+	sub.Log().Debug("subscription expired")
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimers(sub.notifier.srv).TimerF)
+	defer cancel()
+	if err := sub.Terminate(ctx, sip.SubReasonTimeout, ""); err != nil {
+		sub.Log().Debugf("send final NOTIFY failed: %s", err)
+	}
+}
+
+func (sub *ServerSubscription) terminate() {
+	sub.doneOnce.Do(func() {
+		sub.mu.Lock()
+		sub.state = sip.SubStateTerminated
+		if sub.timer != nil {
+			sub.timer.Stop()
+			sub.timer = nil
+		}
+		sub.mu.Unlock()
+
+		sub.notifier.mu.Lock()
+		delete(sub.notifier.subs, sub.ID())
+		sub.notifier.mu.Unlock()
+		close(sub.done)
+
+		sub.Log().Debug("subscription terminated")
+	})
+}
+
+// NotifyHandler is called on every NOTIFY of the subscription, including the final one.
+type NotifyHandler func(sub *ClientSubscription, req sip.Request)
+
+// Subscriber sends SUBSCRIBE requests and keeps subscriptions refreshed - RFC 6665 4.1.
+type Subscriber struct {
+	srv Server
+
+	mu   sync.RWMutex
+	subs map[string]*ClientSubscription
+
+	log log.Logger
+}
+
+// NewSubscriber creates subscriber and registers it as NOTIFY request handler of the server.
+func NewSubscriber(srv Server, logger log.Logger) (*Subscriber, error) {
+	s := &Subscriber{
+		srv:  srv,
+		subs: make(map[string]*ClientSubscription),
+	}
+	s.log = logger.WithPrefix("gosip.Subscriber")
+
+	if err := srv.OnRequest(sip.NOTIFY, s.handleNotify); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Subscriber) Log() log.Logger {
+	return s.log
+}
+
+// Subscribe sends SUBSCRIBE request and returns the subscription on 2xx response.
+// Event, Accept and Expires headers are added from the event package if the request doesn't have them.
+// The subscription is refreshed before it expires and re-created when the notifier
+// terminates it with deactivated, timeout, probation or giveup reason.
+func (s *Subscriber) Subscribe(
+	ctx context.Context,
+	req sip.Request,
+	pkg EventPackage,
+	handler NotifyHandler,
+) (*ClientSubscription, error) {
+	if req.Method() != sip.SUBSCRIBE {
+		return nil, fmt.Errorf("subscribe: unexpected %s request", req.Method())
+	}
+
+	if _, ok := getEvent(req); !ok {
+		event := sip.Event(pkg.Name)
+		req.AppendHeader(&event)
+	}
+	if len(req.GetHeaders("Accept")) == 0 && pkg.ContentType != "" {
+		accept := sip.Accept(pkg.ContentType)
+		req.AppendHeader(&accept)
+	}
+	if _, ok := getExpires(req); !ok {
+		expires := sip.Expires(pkg.DefaultExpires)
+		req.AppendHeader(&expires)
+	}
+	if from, ok := req.From(); ok {
+		if from.Params == nil {
+			from.Params = sip.NewParams()
+		}
+		if !from.Params.Has("tag") {
+			from.Params.Add("tag", sip.String{Str: util.RandString(10)})
+		}
+	}
+
+	sub := &ClientSubscription{
+		subscriber: s,
+		pkg:        pkg,
+		handler:    handler,
+		done:       make(chan struct{}),
+	}
+	sub.log = s.Log()
+	if err := sub.subscribe(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (s *Subscriber) handleNotify(req sip.Request, tx sip.ServerTransaction) {
+	logger := s.Log().WithFields(req.Fields())
+
+	respond := func(status sip.StatusCode, reason string) {
+		res := sip.NewResponseFromRequest("", req, status, reason, "")
+		if _, err := s.srv.Respond(res); err != nil {
+			logger.Errorf("respond '%d %s' failed: %s", status, reason, err)
+		}
+	}
+
+	event, ok := getEvent(req)
+	if !ok {
+		respond(489, "Bad Event")
+		return
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		respond(400, "Bad Request")
+		return
+	}
+	to, ok := req.To()
+	if !ok || to.Params == nil {
+		respond(481, "Subscription Does Not Exist")
+		return
+	}
+	tag, ok := to.Params.Get("tag")
+	if !ok || tag == nil {
+		respond(481, "Subscription Does Not Exist")
+		return
+	}
+
+	s.mu.RLock()
+	sub, ok := s.subs[subscriptionKey(string(*callID), tag.String(), event)]
+	s.mu.RUnlock()
+	if !ok {
+		respond(481, "Subscription Does Not Exist")
+		return
+	}
+
+	ss, ok := getSubscriptionState(req)
+	if !ok {
+		respond(400, "Missing Subscription-State Header")
+		return
+	}
+	if sd := sub.Dialog(); sd != nil {
+		if err := sd.ReceiveRequest(req); err != nil {
+			logger.Warn(err)
+			respond(500, "Server Internal Error")
+			return
+		}
+	}
+
+	respond(200, "OK")
+	sub.handleNotify(req, ss)
+}
+
+// ClientSubscription is the subscription created by the Subscriber.
+type ClientSubscription struct {
+	subscriber *Subscriber
+	pkg        EventPackage
+	handler    NotifyHandler
+
+	mu            sync.Mutex
+	req           sip.Request
+	key           string
+	event         sip.Event
+	sd            *sip.Dialog
+	state         string
+	reason        string
+	expires       uint32
+	timer         timing.Timer
+	unsubscribing bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+
+	log log.Logger
+}
+
+func (sub *ClientSubscription) Log() log.Logger {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.log
+}
+
+// ID returns the subscription ID in form of Call-ID, local tag, event package and id.
+// It changes when the subscription is re-created.
+func (sub *ClientSubscription) ID() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.key
+}
+
+func (sub *ClientSubscription) Event() sip.Event {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.event
+}
+
+func (sub *ClientSubscription) Package() EventPackage {
+	return sub.pkg
+}
+
+// Dialog returns dialog of the subscription, it is nil until 2xx response on SUBSCRIBE.
+func (sub *ClientSubscription) Dialog() *sip.Dialog {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.sd
+}
+
+// State returns the last subscription state received in NOTIFY.
+func (sub *ClientSubscription) State() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.state
+}
+
+// Reason returns the termination reason of the terminated subscription.
+func (sub *ClientSubscription) Reason() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.reason
+}
+
+// Done is closed when the subscription is terminated.
+func (sub *ClientSubscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *ClientSubscription) subscribe(ctx context.Context, req sip.Request) error {
+	callID, ok := req.CallID()
+	if !ok {
+		return fmt.Errorf("subscribe: missing Call-ID header")
+	}
+	from, ok := req.From()
+	if !ok {
+		return fmt.Errorf("subscribe: missing From header")
+	}
+	tag, _ := from.Params.Get("tag")
+	event, _ := getEvent(req)
+	key := subscriptionKey(string(*callID), tag.String(), event)
+
+	sub.mu.Lock()
+	sub.req = req
+	sub.key = key
+	sub.event = event
+	sub.sd = nil
+	sub.state = sip.SubStatePending
+	sub.log = sub.subscriber.Log().WithFields(log.Fields{
+		"subscription_id": key,
+	})
+	sub.mu.Unlock()
+
+	// NOTIFY can arrive before 2xx response - RFC 6665 4.1.2.4
+	s := sub.subscriber
+	s.mu.Lock()
+	s.subs[key] = sub
+	s.mu.Unlock()
+
+	res, err := s.srv.RequestWithContext(ctx, req)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.subs, key)
+		s.mu.Unlock()
+
+		return fmt.Errorf("subscribe: %w", err)
+	}
+
+	sd, err := sip.NewDialogUAC(req, res)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.subs, key)
+		s.mu.Unlock()
+
+		return fmt.Errorf("subscribe: create dialog failed: %w", err)
+	}
+
+	expires, ok := getExpires(res)
+	if !ok {
+		expires, _ = getExpires(req)
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.sd = sd
+	// terminated by NOTIFY before 2xx response
+	if sub.state == sip.SubStateTerminated {
+		return nil
+	}
+	sub.schedule(expires)
+	sub.log.Debug("subscription created")
+
+	return nil
+}
+
+// schedule starts refresh timer, must be called under the lock.
+func (sub *ClientSubscription) schedule(expires uint32) {
+	sub.expires = expires
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+	if expires == 0 {
+		return
+	}
+	sub.timer = timing.AfterFunc(refreshDelay(expires), sub.refresh)
+}
+
+func (sub *ClientSubscription) newRequest(expires uint32) (sip.Request, error) {
+	sub.mu.Lock()
+	sd := sub.sd
+	event := sub.event
+	sub.mu.Unlock()
+
+	if sd == nil {
+		return nil, fmt.Errorf("subscription %s has no dialog", sub.ID())
+	}
+
+	req, err := sd.NewRequest(sip.SUBSCRIBE, "")
+	if err != nil {
+		return nil, err
+	}
+	req.AppendHeader(&event)
+	if sub.pkg.ContentType != "" {
+		accept := sip.Accept(sub.pkg.ContentType)
+		req.AppendHeader(&accept)
+	}
+	expiresHdr := sip.Expires(expires)
+	req.AppendHeader(&expiresHdr)
+
+	return req, nil
+}
+
+func (sub *ClientSubscription) refresh() {
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+
+	sub.mu.Lock()
+	expires, _ := getExpires(sub.req)
+	sub.mu.Unlock()
+
+	req, err := sub.newRequest(expires)
+	if err != nil {
+		sub.Log().Warnf("create SUBSCRIBE refresh failed: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimers(sub.subscriber.srv).TimerF)
+	defer cancel()
+
+	res, err := sub.subscriber.srv.RequestWithContext(ctx, req)
+	if err != nil {
+		sub.Log().Warnf("subscription refresh failed, re-creating subscription: %s", err)
+		sub.resubscribe(0)
+
+		return
+	}
+
+	if value, ok := getExpires(res); ok {
+		expires = value
+	}
+
+	sub.mu.Lock()
+	sub.sd.ReceiveResponse(res)
+	if sub.state != sip.SubStateTerminated {
+		sub.schedule(expires)
+	}
+	sub.mu.Unlock()
+}
+
+// resubscribe creates new subscription with the new dialog after delay - RFC 6665 4.1.3.
+func (sub *ClientSubscription) resubscribe(delay time.Duration) {
+	sub.mu.Lock()
+	req := sip.CopyRequest(sub.req)
+	key := sub.key
+	sub.mu.Unlock()
+
+	s := sub.subscriber
+	s.mu.Lock()
+	delete(s.subs, key)
+	s.mu.Unlock()
+
+	callID := sip.CallID(util.RandString(32))
+	req.ReplaceHeaders(callID.Name(), []sip.Header{&callID})
+	if from, ok := req.From(); ok {
+		from.Params.Add("tag", sip.String{Str: util.RandString(10)})
+	}
+	if viaHop, ok := req.ViaHop(); ok {
+		viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+
+	timing.AfterFunc(delay, func() {
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), serverTimers(sub.subscriber.srv).TimerF)
+		defer cancel()
+
+		if err := sub.subscribe(ctx, req); err != nil {
+			sub.Log().Warnf("re-create subscription failed: %s", err)
+			sub.terminate(sip.SubReasonGiveUp)
+		}
+	})
+}
+
+func (sub *ClientSubscription) handleNotify(req sip.Request, ss *sip.SubscriptionState) {
+	sub.mu.Lock()
+	sub.state = ss.State
+	if ss.State != sip.SubStateTerminated && ss.Expires > 0 && ss.Expires < sub.expires {
+		sub.schedule(ss.Expires)
+	}
+	unsubscribing := sub.unsubscribing
+	sub.mu.Unlock()
+
+	if sub.handler != nil {
+		sub.handler(sub, req)
+	}
+
+	if ss.State != sip.SubStateTerminated {
+		return
+	}
+
+	sub.mu.Lock()
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+	sub.mu.Unlock()
+
+	if unsubscribing {
+		sub.terminate(ss.Reason)
+		return
+	}
+
+	switch ss.Reason {
+	case sip.SubReasonDeactivated, sip.SubReasonTimeout:
+		sub.Log().Debugf("subscription terminated with reason '%s', re-creating subscription", ss.Reason)
+		sub.resubscribe(0)
+	case sip.SubReasonProbation, sip.SubReasonGiveUp:
+		delay := time.Duration(ss.RetryAfter) * time.Second
+		sub.Log().Debugf("subscription terminated with reason '%s', re-creating subscription in %s", ss.Reason, delay)
+		sub.resubscribe(delay)
+	default:
+		sub.terminate(ss.Reason)
+	}
+}
+
+// Unsubscribe sends SUBSCRIBE with zero Expires, the subscription is terminated
+// with the final NOTIFY or after the transaction timeout.
+func (sub *ClientSubscription) Unsubscribe(ctx context.Context) error {
+	sub.mu.Lock()
+	sub.unsubscribing = true
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+	sub.mu.Unlock()
+
+	req, err := sub.newRequest(0)
+	if err != nil {
+		sub.terminate("")
+		return err
+	}
+
+	if _, err := sub.subscriber.srv.RequestWithContext(ctx, req); err != nil {
+		sub.terminate("")
+		return fmt.Errorf("unsubscribe: %w", err)
+	}
+
+	timing.AfterFunc(serverTimers(sub.subscriber.srv).TimerF, func() {
+		sub.terminate("")
+	})
+
+	return nil
+}
+
+func (sub *ClientSubscription) terminate(reason string) {
+	sub.doneOnce.Do(func() {
+		sub.mu.Lock()
+		sub.state = sip.SubStateTerminated
+		sub.reason = reason
+		if sub.timer != nil {
+			sub.timer.Stop()
+			sub.timer = nil
+		}
+		key := sub.key
+		sub.mu.Unlock()
+
+		s := sub.subscriber
+		s.mu.Lock()
+		if s.subs[key] == sub {
+			delete(s.subs, key)
+		}
+		s.mu.Unlock()
+		close(sub.done)
+
+		sub.Log().Debugf("subscription terminated, reason '%s'", reason)
+	})
+}
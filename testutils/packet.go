@@ -0,0 +1,57 @@
+package testutils
+
+import (
+	"net"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// MaxPacketSize is the size of the read buffer of the packet connection.
+const MaxPacketSize = 65535
+
+// ReadMessage reads SIP message from the packet connection.
+func ReadMessage(conn net.PacketConn, logger log.Logger) (sip.Message, net.Addr) {
+	buf := make([]byte, MaxPacketSize)
+	num, addr, err := conn.ReadFrom(buf)
+	Expect(err).ShouldNot(HaveOccurred())
+	msg, err := parser.ParseMessage(buf[:num], logger)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	return msg, addr
+}
+
+// ReadRequest reads messages from the packet connection until request of the method,
+// other messages are skipped.
+func ReadRequest(conn net.PacketConn, method sip.RequestMethod, logger log.Logger) (sip.Request, net.Addr) {
+	for {
+		msg, addr := ReadMessage(conn, logger)
+		if req, ok := msg.(sip.Request); ok && req.Method() == method {
+			return req, addr
+		}
+	}
+}
+
+// ReadResponse reads messages from the packet connection until response on request of the method,
+// 100 Trying and other messages are skipped.
+func ReadResponse(conn net.PacketConn, method sip.RequestMethod, logger log.Logger) sip.Response {
+	for {
+		msg, _ := ReadMessage(conn, logger)
+		res, ok := msg.(sip.Response)
+		if !ok || res.StatusCode() == 100 {
+			continue
+		}
+		if cseq, ok := res.CSeq(); ok && cseq.MethodName == method {
+			return res
+		}
+	}
+}
+
+// WriteMessage writes SIP message to the address through the packet connection.
+func WriteMessage(conn net.PacketConn, msg sip.Message, addr net.Addr) {
+	_, err := conn.WriteTo([]byte(msg.String()), addr)
+	Expect(err).ShouldNot(HaveOccurred())
+}
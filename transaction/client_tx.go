@@ -33,7 +33,12 @@ type clientTx struct {
 	closeOnce sync.Once
 }
 
-func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (ClientTx, error) {
+func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger, options ...TxOption) (ClientTx, error) {
+	optsHash := TxOptions{}
+	for _, opt := range options {
+		opt.ApplyTx(&optsHash)
+	}
+
 	origin = prepareClientRequest(origin)
 	key, err := MakeClientTxKey(origin)
 	if err != nil {
@@ -43,6 +48,7 @@ func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Clie
 	tx := new(clientTx)
 	tx.key = key
 	tx.tpl = tpl
+	tx.timers = optsHash.Timers.withDefaults()
 	// buffer chan - about ~10 retransmit responses
 	tx.responses = make(chan sip.Response, 64)
 	tx.errs = make(chan error, 64)
@@ -113,10 +119,10 @@ func (tx *clientTx) Init() error {
 		// If a reliable transport is being used, the client transaction SHOULD NOT
 		// start timer A (Timer A controls request retransmissions).
 		// Timer A - retransmission
-		tx.Log().Tracef("timer_a set to %v", Timer_A)
+		tx.Log().Tracef("timer_a set to %v", tx.timers.T1)
 
 		tx.mu.Lock()
-		tx.timer_a_time = Timer_A
+		tx.timer_a_time = tx.timers.T1
 
 		tx.timer_a = timing.AfterFunc(tx.timer_a_time, func() {
 			select {
@@ -134,15 +140,19 @@ func (tx *clientTx) Init() error {
 			tx.fsmMu.RUnlock()
 		})
 		// Timer D is set to 32 seconds for unreliable transports
-		tx.timer_d_time = Timer_D
+		tx.timer_d_time = tx.timers.TimerD
 		tx.mu.Unlock()
 	}
 
-	// Timer B - timeout
-	tx.Log().Tracef("timer_b set to %v", Timer_B)
+	// Timer B - timeout, Timer F for non-INVITE
+	timeout := tx.timers.TimerB
+	if !tx.Origin().IsInvite() {
+		timeout = tx.timers.TimerF
+	}
+	tx.Log().Tracef("timer_b set to %v", timeout)
 
 	tx.mu.Lock()
-	tx.timer_b = timing.AfterFunc(Timer_B, func() {
+	tx.timer_b = timing.AfterFunc(timeout, func() {
 		select {
 		case <-tx.done:
 			return
@@ -236,6 +246,9 @@ func (tx *clientTx) cancel() {
 	cancelRequest := sip.NewCancelRequest("", tx.Origin(), log.Fields{
 		"sent_at": time.Now(),
 	})
+	// RFC 3263 - 4, CANCEL goes to the same location as INVITE
+	cancelRequest.SetTransport(tx.Origin().Transport())
+	cancelRequest.SetDestination(tx.Origin().Destination())
 	if err := tx.tpl.Send(cancelRequest); err != nil {
 		var lastRespStr string
 		if lastResp != nil {
@@ -269,6 +282,8 @@ func (tx *clientTx) ack() {
 	ack := sip.NewAckRequest("", tx.Origin(), lastResp, "", log.Fields{
 		"sent_at": time.Now(),
 	})
+	ack.SetTransport(tx.Origin().Transport())
+	ack.SetDestination(tx.Origin().Destination())
 	err := tx.tpl.Send(ack)
 	if err != nil {
 		tx.Log().WithFields(log.Fields{
@@ -654,8 +669,8 @@ func (tx *clientTx) act_non_invite_resend() fsm.Input {
 
 	tx.timer_a_time *= 2
 	// For non-INVITE, cap timer A at T2 seconds.
-	if tx.timer_a_time > T2 {
-		tx.timer_a_time = T2
+	if tx.timer_a_time > tx.timers.T2 {
+		tx.timer_a_time = tx.timers.T2
 	}
 	tx.timer_a.Reset(tx.timer_a_time)
 
@@ -796,13 +811,13 @@ func (tx *clientTx) act_cancel_timeout() fsm.Input {
 
 	tx.cancel()
 
-	tx.Log().Tracef("timer_b set to %v", Timer_B)
+	tx.Log().Tracef("timer_b set to %v", tx.timers.TimerB)
 
 	tx.mu.Lock()
 	if tx.timer_b != nil {
 		tx.timer_b.Stop()
 	}
-	tx.timer_b = timing.AfterFunc(Timer_B, func() {
+	tx.timer_b = timing.AfterFunc(tx.timers.TimerB, func() {
 		select {
 		case <-tx.done:
 			return
@@ -897,9 +912,9 @@ func (tx *clientTx) act_passup_accept() fsm.Input {
 		tx.timer_b = nil
 	}
 
-	tx.Log().Tracef("timer_m set to %v", Timer_M)
+	tx.Log().Tracef("timer_m set to %v", tx.timers.TimerM)
 
-	tx.timer_m = timing.AfterFunc(Timer_M, func() {
+	tx.timer_m = timing.AfterFunc(tx.timers.TimerM, func() {
 		select {
 		case <-tx.done:
 			return
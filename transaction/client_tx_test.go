@@ -34,6 +34,21 @@ var _ = Describe("ClientTx", func() {
 		It("should has transport layer", func() {
 			Expect(txl.Transport()).To(Equal(tpl))
 		})
+
+		It("should derive timers from T1 of the request over the layer one", func() {
+			layer := transaction.NewLayer(tpl, testutils.NewLogrusLogger(),
+				transaction.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}))
+			defer func() {
+				layer.Cancel()
+				<-layer.Done()
+			}()
+
+			Expect(layer.Timers().TimerF).To(Equal(640 * time.Millisecond))
+			timers := layer.Timers(transaction.WithTimers(transaction.Timers{T1: 20 * time.Millisecond}))
+			Expect(timers.T1).To(Equal(20 * time.Millisecond))
+			Expect(timers.TimerF).To(Equal(1280 * time.Millisecond))
+			Expect(timers.T2).To(Equal(transaction.T2))
+		})
 	})
 
 	Context("sends INVITE request", func() {
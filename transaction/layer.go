@@ -2,6 +2,7 @@ package transaction
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/ghettovoice/gosip/log"
@@ -13,7 +14,8 @@ type Layer interface {
 	Cancel()
 	Done() <-chan struct{}
 	String() string
-	Request(req sip.Request) (sip.ClientTransaction, error)
+	// Request sends request through new client transaction, options override layer options.
+	Request(req sip.Request, options ...TxOption) (sip.ClientTransaction, error)
 	Respond(res sip.Response) (sip.ServerTransaction, error)
 	Transport() sip.Transport
 	// Requests returns channel with new incoming server transactions.
@@ -23,6 +25,8 @@ type Layer interface {
 	// Responses returns channel with not matched responses.
 	Responses() <-chan sip.Response
 	Errors() <-chan error
+	// Timers returns timer profile of the layer transactions created with the options.
+	Timers(options ...TxOption) Timers
 }
 
 type layer struct {
@@ -39,11 +43,24 @@ type layer struct {
 	txWg       sync.WaitGroup
 	serveTxCh  chan Tx
 	cancelOnce sync.Once
+	timers     Timers
+
+	loopDetection bool
+	// server transactions of requests outside of a dialog by merge key - RFC 3261 8.2.2.2
+	mergeKeys map[string]TxKey
+	mergeMu   sync.Mutex
 
 	log log.Logger
 }
 
-func NewLayer(tpl sip.Transport, logger log.Logger) Layer {
+func NewLayer(tpl sip.Transport, logger log.Logger, options ...LayerOption) Layer {
+	optsHash := LayerOptions{
+		LoopDetection: true,
+	}
+	for _, opt := range options {
+		opt.ApplyLayer(&optsHash)
+	}
+
 	txl := &layer{
 		tpl:          tpl,
 		transactions: newTransactionStore(),
@@ -56,6 +73,10 @@ func NewLayer(tpl sip.Transport, logger log.Logger) Layer {
 		done:      make(chan struct{}),
 		canceled:  make(chan struct{}),
 		serveTxCh: make(chan Tx),
+		timers:    optsHash.Timers,
+
+		loopDetection: optsHash.LoopDetection,
+		mergeKeys:     make(map[string]TxKey),
 	}
 	txl.log = logger.
 		WithPrefix("transaction.Layer").
@@ -98,6 +119,16 @@ func (txl *layer) Done() <-chan struct{} {
 	return txl.done
 }
 
+func (txl *layer) Timers(options ...TxOption) Timers {
+	optsHash := TxOptions{}
+	WithTimers(txl.timers).ApplyTx(&optsHash)
+	for _, opt := range options {
+		opt.ApplyTx(&optsHash)
+	}
+
+	return optsHash.Timers.withDefaults()
+}
+
 func (txl *layer) Requests() <-chan sip.ServerTransaction {
 	return txl.requests
 }
@@ -118,7 +149,7 @@ func (txl *layer) Transport() sip.Transport {
 	return txl.tpl
 }
 
-func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
+func (txl *layer) Request(req sip.Request, options ...TxOption) (sip.ClientTransaction, error) {
 	select {
 	case <-txl.canceled:
 		return nil, fmt.Errorf("transaction layer is canceled")
@@ -129,7 +160,10 @@ func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
 		return nil, fmt.Errorf("ACK request must be sent directly through transport")
 	}
 
-	tx, err := NewClientTx(req, txl.tpl, txl.Log())
+	opts := make([]TxOption, 0, len(options)+1)
+	opts = append(opts, WithTimers(txl.timers))
+	opts = append(opts, options...)
+	tx, err := NewClientTx(req, txl.tpl, txl.Log(), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -208,6 +242,9 @@ func (txl *layer) serveTransaction(tx Tx) {
 
 	defer func() {
 		txl.transactions.drop(tx.Key())
+		if _, ok := tx.(ServerTx); ok {
+			txl.forgetMergeKey(tx)
+		}
 
 		logger.Debug("transaction deleted")
 
@@ -284,13 +321,25 @@ func (txl *layer) handleRequest(req sip.Request, logger log.Logger) {
 		return
 	}
 
-	tx, err = NewServerTx(req, txl.tpl, txl.Log())
+	var (
+		loopReason string
+		looped     bool
+	)
+	if txl.loopDetection {
+		loopReason, looped = txl.detectLoop(req)
+	}
+
+	tx, err = NewServerTx(req, txl.tpl, txl.Log(), WithTimers(txl.timers))
 	if err != nil {
 		logger.Error(err)
 
 		return
 	}
 
+	if txl.loopDetection && !looped {
+		txl.putMergeKey(tx)
+	}
+
 	logger = log.AddFieldsFrom(logger, tx)
 	logger.Debug("new server transaction created")
 
@@ -306,6 +355,17 @@ func (txl *layer) handleRequest(req sip.Request, logger log.Logger) {
 	txl.txWg.Add(1)
 	go txl.serveTransaction(tx)
 
+	// looped request is answered by the transaction, so its retransmissions get the same response
+	if looped {
+		logger.Debugf("%s, respond '482 Loop Detected'", loopReason)
+
+		res := sip.NewResponseFromRequest("", req, 482, "Loop Detected", "")
+		if err := tx.Respond(res); err != nil {
+			logger.Error(fmt.Errorf("respond '482 Loop Detected' on %s: %w", loopReason, err))
+		}
+		return
+	}
+
 	// pass up request
 	logger.Trace("passing up SIP request...")
 
@@ -317,6 +377,98 @@ func (txl *layer) handleRequest(req sip.Request, logger log.Logger) {
 	}
 }
 
+// detectLoop checks that the request is a merged request - RFC 3261 8.2.2.2,
+// or the request sent by own client transaction came back - RFC 3261 16.3.
+func (txl *layer) detectLoop(req sip.Request) (string, bool) {
+	cseq, ok := req.CSeq()
+	if !ok {
+		return "", false
+	}
+
+	for _, header := range req.GetHeaders("Via") {
+		via, ok := header.(sip.ViaHeader)
+		if !ok {
+			continue
+		}
+		for _, hop := range via {
+			branch, ok := hop.Params.Get("branch")
+			if !ok || branch == nil || branch.String() == "" {
+				continue
+			}
+			key := TxKey(branch.String() + "__" + string(cseq.MethodName))
+			if tx, ok := txl.transactions.get(key); ok {
+				if _, ok := tx.(ClientTx); ok {
+					return "looped request", true
+				}
+			}
+		}
+	}
+
+	mergeKey, ok := makeMergeKey(req)
+	if !ok {
+		return "", false
+	}
+	key, err := MakeServerTxKey(req)
+	if err != nil {
+		return "", false
+	}
+
+	txl.mergeMu.Lock()
+	defer txl.mergeMu.Unlock()
+	if txKey, ok := txl.mergeKeys[mergeKey]; ok && txKey != key {
+		return "merged request", true
+	}
+
+	return "", false
+}
+
+func (txl *layer) putMergeKey(tx Tx) {
+	if mergeKey, ok := makeMergeKey(tx.Origin()); ok {
+		txl.mergeMu.Lock()
+		txl.mergeKeys[mergeKey] = tx.Key()
+		txl.mergeMu.Unlock()
+	}
+}
+
+func (txl *layer) forgetMergeKey(tx Tx) {
+	if mergeKey, ok := makeMergeKey(tx.Origin()); ok {
+		txl.mergeMu.Lock()
+		if txl.mergeKeys[mergeKey] == tx.Key() {
+			delete(txl.mergeKeys, mergeKey)
+		}
+		txl.mergeMu.Unlock()
+	}
+}
+
+// makeMergeKey builds key of the request outside of a dialog from From tag, Call-ID and CSeq.
+func makeMergeKey(req sip.Request) (string, bool) {
+	to, ok := req.To()
+	if !ok {
+		return "", false
+	}
+	if to.Params != nil && to.Params.Has("tag") {
+		return "", false
+	}
+	from, ok := req.From()
+	if !ok || from.Params == nil {
+		return "", false
+	}
+	fromTag, ok := from.Params.Get("tag")
+	if !ok || fromTag == nil {
+		return "", false
+	}
+	callID, ok := req.CallID()
+	if !ok {
+		return "", false
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return "", false
+	}
+
+	return strings.Join([]string{fromTag.String(), callID.Value(), cseq.Value()}, "__"), true
+}
+
 func (txl *layer) handleResponse(res sip.Response, logger log.Logger) {
 	select {
 	case <-txl.canceled:
@@ -0,0 +1,147 @@
+package transaction
+
+import (
+	"time"
+)
+
+// Timers is a set of transaction timer values - RFC 3261 17.
+// Zero fields are filled with defaults, Timer B/F/H/J/L/M default to 64*T1 of the set.
+type Timers struct {
+	T1     time.Duration
+	T2     time.Duration
+	T4     time.Duration
+	TimerB time.Duration
+	TimerD time.Duration
+	TimerF time.Duration
+	TimerH time.Duration
+	TimerJ time.Duration
+	TimerL time.Duration
+	TimerM time.Duration
+}
+
+// DefaultTimers returns timer values recommended by RFC 3261.
+func DefaultTimers() Timers {
+	return Timers{}.withDefaults()
+}
+
+func (t Timers) withDefaults() Timers {
+	if t.T1 <= 0 {
+		t.T1 = T1
+	}
+	if t.T2 <= 0 {
+		t.T2 = T2
+	}
+	if t.T4 <= 0 {
+		t.T4 = T4
+	}
+	if t.TimerB <= 0 {
+		t.TimerB = 64 * t.T1
+	}
+	if t.TimerD <= 0 {
+		t.TimerD = Timer_D
+	}
+	if t.TimerF <= 0 {
+		t.TimerF = 64 * t.T1
+	}
+	if t.TimerH <= 0 {
+		t.TimerH = 64 * t.T1
+	}
+	if t.TimerJ <= 0 {
+		t.TimerJ = 64 * t.T1
+	}
+	if t.TimerL <= 0 {
+		t.TimerL = 64 * t.T1
+	}
+	if t.TimerM <= 0 {
+		t.TimerM = 64 * t.T1
+	}
+	return t
+}
+
+// override returns t with non-zero values replaced from other.
+func (t Timers) override(other Timers) Timers {
+	if other.T1 > 0 {
+		t.T1 = other.T1
+	}
+	if other.T2 > 0 {
+		t.T2 = other.T2
+	}
+	if other.T4 > 0 {
+		t.T4 = other.T4
+	}
+	if other.TimerB > 0 {
+		t.TimerB = other.TimerB
+	}
+	if other.TimerD > 0 {
+		t.TimerD = other.TimerD
+	}
+	if other.TimerF > 0 {
+		t.TimerF = other.TimerF
+	}
+	if other.TimerH > 0 {
+		t.TimerH = other.TimerH
+	}
+	if other.TimerJ > 0 {
+		t.TimerJ = other.TimerJ
+	}
+	if other.TimerL > 0 {
+		t.TimerL = other.TimerL
+	}
+	if other.TimerM > 0 {
+		t.TimerM = other.TimerM
+	}
+	return t
+}
+
+type LayerOption interface {
+	ApplyLayer(opts *LayerOptions)
+}
+
+type LayerOptions struct {
+	Timers Timers
+	// LoopDetection enables 482 answers on merged and looped requests.
+	LoopDetection bool
+}
+
+type TxOption interface {
+	ApplyTx(opts *TxOptions)
+}
+
+type TxOptions struct {
+	Timers Timers
+}
+
+// WithTimers sets timer values of transactions.
+// Zero fields leave values of the layer on the transaction and defaults on the layer.
+func WithTimers(timers Timers) interface {
+	LayerOption
+	TxOption
+} {
+	return withTimers{timers}
+}
+
+// WithLoopDetection turns on or off detection of merged and looped requests - RFC 3261 8.2.2.2,
+// detection is on by default.
+func WithLoopDetection(enabled bool) LayerOption {
+	return withLoopDetection{enabled}
+}
+
+type withLoopDetection struct {
+	enabled bool
+}
+
+func (o withLoopDetection) ApplyLayer(opts *LayerOptions) {
+	opts.LoopDetection = o.enabled
+}
+
+type withTimers struct {
+	timers Timers
+}
+
+func (o withTimers) ApplyLayer(opts *LayerOptions) {
+	opts.Timers = opts.Timers.override(o.timers)
+}
+
+func (o withTimers) ApplyTx(opts *TxOptions) {
+	opts.Timers = opts.Timers.override(o.timers)
+}
@@ -39,7 +39,12 @@ type serverTx struct {
 	closeOnce sync.Once
 }
 
-func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (ServerTx, error) {
+func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger, options ...TxOption) (ServerTx, error) {
+	optsHash := TxOptions{}
+	for _, opt := range options {
+		opt.ApplyTx(&optsHash)
+	}
+
 	key, err := MakeServerTxKey(origin)
 	if err != nil {
 		return nil, err
@@ -48,6 +53,7 @@ func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Serv
 	tx := new(serverTx)
 	tx.key = key
 	tx.tpl = tpl
+	tx.timers = optsHash.Timers.withDefaults()
 	// about ~10 retransmits
 	tx.acks = make(chan sip.Request, 64)
 	tx.cancels = make(chan sip.Request, 64)
@@ -78,8 +84,8 @@ func (tx *serverTx) Init() error {
 	if tx.reliable {
 		tx.timer_i_time = 0
 	} else {
-		tx.timer_g_time = Timer_G
-		tx.timer_i_time = Timer_I
+		tx.timer_g_time = tx.timers.T1
+		tx.timer_i_time = tx.timers.T4
 	}
 
 	tx.mu.Unlock()
@@ -166,7 +172,11 @@ func (tx *serverTx) Respond(res sip.Response) error {
 	}
 
 	tx.mu.Lock()
-	tx.lastResp = res
+	// the sent final response is kept for retransmissions,
+	// later final responses are ignored by FSM except 2xx retransmissions
+	if tx.lastResp == nil || tx.lastResp.IsProvisional() || (res.IsSuccess() && tx.lastResp.IsSuccess()) {
+		tx.lastResp = res
+	}
 
 	if tx.timer_1xx != nil {
 		tx.timer_1xx.Stop()
@@ -575,8 +585,8 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 			})
 		} else {
 			tx.timer_g_time *= 2
-			if tx.timer_g_time > T2 {
-				tx.timer_g_time = T2
+			if tx.timer_g_time > tx.timers.T2 {
+				tx.timer_g_time = tx.timers.T2
 			}
 
 			tx.Log().Tracef("timer_g reset to %v", tx.timer_g_time)
@@ -588,9 +598,9 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 
 	tx.mu.Lock()
 	if tx.timer_h == nil {
-		tx.Log().Tracef("timer_h set to %v", Timer_H)
+		tx.Log().Tracef("timer_h set to %v", tx.timers.TimerH)
 
-		tx.timer_h = timing.AfterFunc(Timer_H, func() {
+		tx.timer_h = timing.AfterFunc(tx.timers.TimerH, func() {
 			select {
 			case <-tx.done:
 				return
@@ -633,9 +643,9 @@ func (tx *serverTx) act_respond_accept() fsm.Input {
 	}
 
 	tx.mu.Lock()
-	tx.Log().Tracef("timer_l set to %v", Timer_L)
+	tx.Log().Tracef("timer_l set to %v", tx.timers.TimerL)
 
-	tx.timer_l = timing.AfterFunc(Timer_L, func() {
+	tx.timer_l = timing.AfterFunc(tx.timers.TimerL, func() {
 		select {
 		case <-tx.done:
 			return
@@ -696,9 +706,9 @@ func (tx *serverTx) act_final() fsm.Input {
 
 	tx.mu.Lock()
 
-	tx.Log().Tracef("timer_j set to %v", Timer_J)
+	tx.Log().Tracef("timer_j set to %v", tx.timers.TimerJ)
 
-	tx.timer_j = timing.AfterFunc(Timer_J, func() {
+	tx.timer_j = timing.AfterFunc(tx.timers.TimerJ, func() {
 		select {
 		case <-tx.done:
 			return
@@ -785,9 +795,9 @@ func (tx *serverTx) act_confirm() fsm.Input {
 		tx.timer_h = nil
 	}
 
-	tx.Log().Tracef("timer_i set to %v", Timer_I)
+	tx.Log().Tracef("timer_i set to %v", tx.timers.T4)
 
-	tx.timer_i = timing.AfterFunc(Timer_I, func() {
+	tx.timer_i = timing.AfterFunc(tx.timers.T4, func() {
 		select {
 		case <-tx.done:
 			return
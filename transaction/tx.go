@@ -33,6 +33,7 @@ type commonTx struct {
 	origin   sip.Request
 	tpl      sip.Transport
 	lastResp sip.Response
+	timers   Timers
 
 	errs    chan error
 	lastErr error
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ghettovoice/gosip/log"
@@ -62,6 +63,9 @@ type connectionPool struct {
 	hmess chan sip.Message
 	herrs chan error
 
+	// options passed to connection handlers
+	options []ProtocolOption
+
 	hwg sync.WaitGroup
 	mu  sync.RWMutex
 
@@ -74,6 +78,7 @@ func NewConnectionPool(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) ConnectionPool {
 	pool := &connectionPool{
 		store:     make(map[ConnectionKey]ConnectionHandler),
@@ -86,6 +91,8 @@ func NewConnectionPool(
 		done:  make(chan struct{}),
 		hmess: make(chan sip.Message),
 		herrs: make(chan error),
+
+		options: options,
 	}
 
 	pool.log = logger.
@@ -301,6 +308,22 @@ func (pool *connectionPool) serveHandlers() {
 					pool.errs <- herr.Err
 				}
 
+				continue
+			} else if herr.FlowFailed() {
+				// keepalive pongs missed, drop the connection and report flow failure with connection details
+				logger.Debugf("connection flow failed: %s; drop it and pass the error up", herr)
+
+				if err := pool.Drop(handler.Key()); err != nil {
+					logger.Error(err)
+				}
+
+				select {
+				case <-pool.cancel:
+					return
+				case pool.errs <- herr:
+					logger.Trace("error passed up")
+				}
+
 				continue
 			} else if herr.Network() {
 				// connection broken or closed
@@ -343,6 +366,7 @@ func (pool *connectionPool) put(key ConnectionKey, conn Connection, ttl time.Dur
 		pool.herrs,
 		pool.msgMapper,
 		pool.Log(),
+		pool.options...,
 	)
 
 	logger := log.AddFieldsFrom(pool.Log(), handler)
@@ -409,6 +433,10 @@ type connectionHandler struct {
 	ttl    time.Duration
 	expiry time.Time
 
+	keepAlive KeepAliveOptions
+	// number of keepalive pings sent without pong
+	missedPongs int32
+
 	output     chan<- sip.Message
 	errs       chan<- error
 	cancelOnce sync.Once
@@ -425,7 +453,13 @@ func NewConnectionHandler(
 	errs chan<- error,
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) ConnectionHandler {
+	optsHash := ProtocolOptions{}
+	for _, opt := range options {
+		opt.ApplyProtocol(&optsHash)
+	}
+
 	handler := &connectionHandler{
 		connection: conn,
 		msgMapper:  msgMapper,
@@ -435,7 +469,8 @@ func NewConnectionHandler(
 		canceled: make(chan struct{}),
 		done:     make(chan struct{}),
 
-		ttl: ttl,
+		ttl:       ttl,
+		keepAlive: optsHash.KeepAlive,
 	}
 
 	handler.log = logger.
@@ -534,11 +569,17 @@ func (handler *connectionHandler) Serve() {
 func (handler *connectionHandler) readStream() {
 	msgs := make(chan sip.Message)
 	errs := make(chan error)
+	pings := make(chan struct{})
+	stop := make(chan struct{})
 	strPrs := parser.NewParser(msgs, errs, true, handler.Log())
 	raddr := handler.Connection().RemoteAddr().String()
+	if handler.keepAlive.Interval > 0 {
+		go handler.sendPings(raddr, stop)
+	}
 	//note-携程读取网络数据到msgs
 	go func() {
 		defer func() {
+			close(stop)
 			_ = handler.Connection().Close()
 			strPrs.Stop()
 			close(msgs)
@@ -566,12 +607,72 @@ func (handler *connectionHandler) readStream() {
 				return
 			}
 			data := buf[:num]
+			if isKeepAlive(data) {
+				handler.handleKeepAlive(data, raddr, pings)
+			}
+			// keepalive data is passed to the parser too, it skips empty lines before the start line
+			// and so a message whose header terminator was split across reads stays intact.
 			if _, err := strPrs.Write(data); err != nil {
 				handler.handleError(err, raddr)
 			}
 		}
 	}()
-	handler.pipeOutputs(raddr, msgs, errs)
+	handler.pipeOutputs(raddr, msgs, errs, pings)
+}
+
+// isKeepAlive checks that data consists of CRLF only - RFC 5626 3.5.1.
+func isKeepAlive(data []byte) bool {
+	return len(data) > 0 && len(bytes.Trim(data, "\r\n")) == 0
+}
+
+// handleKeepAlive answers double-CRLF ping with single CRLF pong and
+// accounts single CRLF as a pong to the own ping.
+func (handler *connectionHandler) handleKeepAlive(data []byte, raddr string, pings chan<- struct{}) {
+	if !bytes.Contains(data, []byte("\r\n\r\n")) {
+		handler.Log().Trace("keepalive pong received")
+
+		atomic.StoreInt32(&handler.missedPongs, 0)
+
+		return
+	}
+
+	handler.Log().Trace("keepalive ping received, send pong")
+
+	if _, err := handler.Connection().Write([]byte("\r\n")); err != nil {
+		handler.Log().Debugf("send keepalive pong failed: %s", err)
+	}
+
+	select {
+	case <-handler.canceled:
+	case pings <- struct{}{}:
+	}
+}
+
+// sendPings sends double-CRLF pings every keepalive interval until the stop
+// and fails the flow when too many pings were left without pong.
+func (handler *connectionHandler) sendPings(raddr string, stop <-chan struct{}) {
+	ticker := time.NewTicker(handler.keepAlive.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if missed := atomic.LoadInt32(&handler.missedPongs); int(missed) >= handler.keepAlive.MaxMissed {
+			handler.handleError(FlowError(fmt.Sprintf("%d keepalive pings left without pong", missed)), raddr)
+
+			return
+		}
+
+		atomic.AddInt32(&handler.missedPongs, 1)
+		if _, err := handler.Connection().Write([]byte("\r\n\r\n")); err != nil {
+			// read loop gets the error of broken connection
+			handler.Log().Debugf("send keepalive ping failed: %s", err)
+		}
+	}
 }
 
 func (handler *connectionHandler) readPacket() {
@@ -589,7 +690,12 @@ func (handler *connectionHandler) readPacket() {
 		if err != nil {
 			return
 		}
-		if len(bytes.Trim(buf[:num], "\x00")) == 0 {
+		if len(bytes.Trim(buf[:num], "\x00")) == 0 || isKeepAlive(buf[:num]) {
+			continue
+		}
+		if isStunBindingRequest(buf[:num]) {
+			handler.answerStun(buf[:num], raddr)
+
 			continue
 		}
 		cloned := make([]byte, num)
@@ -605,6 +711,22 @@ func (handler *connectionHandler) readPacket() {
 	}
 }
 
+// answerStun sends STUN binding response to the keepalive request - RFC 5626 4.4.2.
+func (handler *connectionHandler) answerStun(req []byte, raddr net.Addr) {
+	res, err := stunBindingResponse(req, raddr)
+	if err != nil {
+		handler.Log().Debugf("build STUN binding response failed: %s", err)
+
+		return
+	}
+
+	handler.Log().Tracef("STUN binding request received from %s, send response", raddr)
+
+	if _, err := handler.Connection().WriteTo(res, raddr); err != nil {
+		handler.Log().Debugf("send STUN binding response failed: %s", err)
+	}
+}
+
 func (handler *connectionHandler) readConnection() {
 	if handler.Connection().Streamed() {
 		handler.readStream()
@@ -613,7 +735,12 @@ func (handler *connectionHandler) readConnection() {
 	}
 }
 
-func (handler *connectionHandler) pipeOutputs(raddr string, msgs <-chan sip.Message, errs <-chan error) {
+func (handler *connectionHandler) pipeOutputs(
+	raddr string,
+	msgs <-chan sip.Message,
+	errs <-chan error,
+	pings <-chan struct{},
+) {
 	handler.Log().Debug("begin pipe outputs")
 	defer handler.Log().Debug("stop pipe outputs")
 
@@ -639,6 +766,9 @@ func (handler *connectionHandler) pipeOutputs(raddr string, msgs <-chan sip.Mess
 				return
 			}
 			handler.handleError(err, raddr)
+		case <-pings:
+			// keepalive pings keep the connection open
+			handler.refreshExpiry()
 		}
 	}
 }
@@ -694,6 +824,10 @@ func (handler *connectionHandler) handleMessage(msg sip.Message, raddr string) {
 	// pass up
 	handler.output <- msg
 
+	handler.refreshExpiry()
+}
+
+func (handler *connectionHandler) refreshExpiry() {
 	if !handler.Expiry().IsZero() {
 		handler.expiry = time.Now().Add(handler.ttl)
 		handler.timer.Reset(handler.ttl)
@@ -1,6 +1,7 @@
 package transport_test
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -115,6 +116,7 @@ var _ = Describe("ConnectionHandler", func() {
 
 	Context("serving connection", func() {
 		var ttl time.Duration = 0
+		var options []transport.ProtocolOption
 
 		BeforeEach(func() {
 			output = make(chan sip.Message)
@@ -124,6 +126,7 @@ var _ = Describe("ConnectionHandler", func() {
 			server = &testutils.MockConn{Conn: c2, LAddr: addr, RAddr: c2.RemoteAddr()}
 			conn = transport.NewConnection(server, "dummy", "tcp", logger)
 			wg = &sync.WaitGroup{}
+			options = nil
 		})
 		AfterEach(func() {
 			defer func() { recover() }()
@@ -136,7 +139,7 @@ var _ = Describe("ConnectionHandler", func() {
 			close(errs)
 		})
 		JustBeforeEach(func() {
-			handler = transport.NewConnectionHandler(conn, ttl, output, errs, nil, logger)
+			handler = transport.NewConnectionHandler(conn, ttl, output, errs, nil, logger, options...)
 			go handler.Serve()
 		})
 
@@ -180,6 +183,87 @@ var _ = Describe("ConnectionHandler", func() {
 			})
 		})
 
+		Context("when keepalive ping arrives", func() {
+			JustBeforeEach(func() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					testutils.WriteToConn(client, []byte("\r\n\r\n"))
+				}()
+			})
+
+			It("should answer with pong and keep parsing", func(done Done) {
+				buf := make([]byte, 16)
+				num, err := client.Read(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:num])).To(Equal("\r\n"))
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					testutils.WriteToConn(client, []byte(inviteMsg))
+				}()
+				testutils.AssertMessageArrived(output, inviteMsg, "pipe", addr.String())
+				close(done)
+			}, 3)
+		})
+
+		Context("with keepalive enabled", func() {
+			BeforeEach(func() {
+				ttl = 0
+				options = []transport.ProtocolOption{transport.WithKeepAlive(10*time.Millisecond, 2)}
+			})
+
+			It("should keep the flow while pongs arrive", func() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					buf := make([]byte, 16)
+					for {
+						num, err := client.Read(buf)
+						if err != nil {
+							return
+						}
+						if string(buf[:num]) == "\r\n\r\n" {
+							if _, err := client.Write([]byte("\r\n")); err != nil {
+								return
+							}
+						}
+					}
+				}()
+
+				Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+				client.Close()
+			})
+
+			It("should report flow failure when pongs are missed", func(done Done) {
+				pings := 0
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					buf := make([]byte, 16)
+					for {
+						num, err := client.Read(buf)
+						if err != nil {
+							return
+						}
+						if string(buf[:num]) == "\r\n\r\n" {
+							pings++
+						}
+					}
+				}()
+
+				var err error
+				Eventually(errs).Should(Receive(&err))
+				var flowErr transport.FlowError
+				Expect(errors.As(err, &flowErr)).To(BeTrue())
+				client.Close()
+				wg.Wait()
+				Expect(pings).To(Equal(2))
+				close(done)
+			}, 3)
+		})
+
 		Context("with TTL = 0", func() {
 			BeforeEach(func() {
 				ttl = 0
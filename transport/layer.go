@@ -40,18 +40,21 @@ var protocolFactory ProtocolFactory = func(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) (Protocol, error) {
 	switch strings.ToLower(network) {
 	case "udp":
-		return NewUdpProtocol(output, errs, cancel, msgMapper, logger), nil
+		return NewUdpProtocol(output, errs, cancel, msgMapper, logger, options...), nil
 	case "tcp":
-		return NewTcpProtocol(output, errs, cancel, msgMapper, logger), nil
+		return NewTcpProtocol(output, errs, cancel, msgMapper, logger, options...), nil
 	case "tls":
-		return NewTlsProtocol(output, errs, cancel, msgMapper, logger), nil
+		return NewTlsProtocol(output, errs, cancel, msgMapper, logger, options...), nil
 	case "ws":
-		return NewWsProtocol(output, errs, cancel, msgMapper, logger), nil
+		return NewWsProtocol(output, errs, cancel, msgMapper, logger, options...), nil
 	case "wss":
-		return NewWssProtocol(output, errs, cancel, msgMapper, logger), nil
+		return NewWssProtocol(output, errs, cancel, msgMapper, logger, options...), nil
+	case "mem":
+		return NewMemProtocol(DefaultSwitchboard, output, errs, cancel, msgMapper, logger, options...), nil
 	default:
 		return nil, UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported", network))
 	}
@@ -72,8 +75,10 @@ type layer struct {
 	protocols   *protocolStore
 	listenPorts map[string][]sip.Port
 	ip          net.IP
-	dnsResolver *net.Resolver
+	resolver    Resolver
 	msgMapper   sip.MessageMapper
+	udpMaxSize  int
+	keepAlive   KeepAliveOptions
 
 	msgs     chan sip.Message
 	errs     chan error
@@ -90,19 +95,40 @@ type layer struct {
 
 // NewLayer creates transport layer.
 // - ip - host IP
-// - dnsAddr - DNS server address, default is 127.0.0.1:53
+// - dnsResolver - DNS resolver used to locate SIP servers - RFC 3263
+// - options - layer options, override positional arguments if set
 func NewLayer(
 	ip net.IP,
 	dnsResolver *net.Resolver,
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...LayerOption,
 ) Layer {
+	optsHash := LayerOptions{
+		Options: Options{
+			MessageMapper: msgMapper,
+			Logger:        logger,
+		},
+		DNSResolver: dnsResolver,
+		UDPMaxSize:  DefaultUDPMaxSize,
+	}
+	for _, opt := range options {
+		opt.ApplyLayer(&optsHash)
+	}
+
+	resolver := optsHash.Resolver
+	if resolver == nil {
+		resolver = NewResolver(NewDNSResolver(optsHash.DNSResolver, ""))
+	}
+
 	tpl := &layer{
 		protocols:   newProtocolStore(),
 		listenPorts: make(map[string][]sip.Port),
 		ip:          ip,
-		dnsResolver: dnsResolver,
-		msgMapper:   msgMapper,
+		resolver:    resolver,
+		msgMapper:   optsHash.MessageMapper,
+		udpMaxSize:  optsHash.UDPMaxSize,
+		keepAlive:   optsHash.KeepAlive,
 
 		msgs:     make(chan sip.Message),
 		errs:     make(chan error),
@@ -112,7 +138,7 @@ func NewLayer(
 		done:     make(chan struct{}),
 	}
 
-	tpl.log = logger.
+	tpl.log = optsHash.Logger.
 		WithPrefix("transport.Layer").
 		WithFields(map[string]interface{}{
 			"transport_layer_ptr": fmt.Sprintf("%p", tpl),
@@ -223,80 +249,31 @@ func (tpl *layer) Send(msg sip.Message) error {
 	switch msg := msg.(type) {
 	// RFC 3261 - 18.1.1.
 	case sip.Request:
-		network := msg.Transport()
-		// rewrite sent-by transport
-		viaHop.Transport = strings.ToUpper(network)
-		viaHop.Host = tpl.ip.String()
-
-		protocol, err := tpl.getProtocol(network)
-		if err != nil {
-			return err
-		}
-
-		// rewrite sent-by port
-		if viaHop.Port == nil {
-			if ports, ok := tpl.listenPorts[network]; ok {
-				port := ports[rand.Intn(len(ports))]
-				viaHop.Port = &port
-			} else {
-				defPort := sip.DefaultPort(network)
-				viaHop.Port = &defPort
+		// RFC 3263 - 4, the request is located once, retransmissions are bound to the location
+		var locations []*Location
+		if location, ok := BoundLocation(msg); ok {
+			locations = []*Location{location}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultResolveTimeout)
+			found, err := ResolveRequest(ctx, tpl.resolver, msg)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("resolve %s: %w", msg.Destination(), err)
 			}
+			locations = found
 		}
 
-		target, err := NewTargetFromAddr(msg.Destination())
-		if err != nil {
-			return fmt.Errorf("build address target for %s: %w", msg.Destination(), err)
-		}
-
-		// dns srv lookup
-		if net.ParseIP(target.Host) == nil {
-			ctx := context.Background()
-			proto := strings.ToLower(network)
-			if _, addrs, err := tpl.dnsResolver.LookupSRV(ctx, "sip", proto, target.Host); err == nil && len(addrs) > 0 {
-				addr := addrs[0]
-				addrStr := fmt.Sprintf("%s:%d", addr.Target[:len(addr.Target)-1], addr.Port)
-				switch network {
-				case "UDP":
-					if addr, err := net.ResolveUDPAddr("udp", addrStr); err == nil {
-						port := sip.Port(addr.Port)
-						if addr.IP.To4() == nil {
-							target.Host = fmt.Sprintf("[%v]", addr.IP.String())
-						} else {
-							target.Host = addr.IP.String()
-						}
-						target.Port = &port
-					}
-				case "TLS":
-					fallthrough
-				case "WS":
-					fallthrough
-				case "WSS":
-					fallthrough
-				case "TCP":
-					if addr, err := net.ResolveTCPAddr("tcp", addrStr); err == nil {
-						port := sip.Port(addr.Port)
-						if addr.IP.To4() == nil {
-							target.Host = fmt.Sprintf("[%v]", addr.IP.String())
-						} else {
-							target.Host = addr.IP.String()
-						}
-						target.Port = &port
-					}
-				}
+		var err error
+		for i, location := range locations {
+			if err = tpl.sendRequest(location, viaHop, msg); err == nil {
+				return nil
+			}
+			if i < len(locations)-1 {
+				tpl.Log().WithFields(msg.Fields()).Debugf("%s, trying next location", err)
 			}
 		}
 
-		msg.Recipient().UriParams().Remove("transport")
-
-		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg)
-		logger.Debugf("sending SIP request:\n%s", msg)
-
-		if err = protocol.Send(target, msg); err != nil {
-			return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
-		}
-
-		return nil
+		return err
 		// RFC 3261 - 18.2.2.
 	case sip.Response:
 		// resolve protocol from Via
@@ -326,6 +303,62 @@ func (tpl *layer) Send(msg sip.Message) error {
 	}
 }
 
+// sendRequest sends request to the resolved location.
+// Request larger than the UDP size limit is sent over TCP to the same target,
+// UDP is used if the TCP connection fails - RFC 3261 18.1.1.
+func (tpl *layer) sendRequest(location *Location, viaHop *sip.ViaHop, msg sip.Request) error {
+	// the limit is checked against the whole serialized message as it is written to the network - RFC 3261 18.1.1
+	if strings.EqualFold(location.Transport, "UDP") && tpl.udpMaxSize > 0 && len(msg.String()) > tpl.udpMaxSize {
+		viaPort := viaHop.Port
+		err := tpl.send("TCP", location.Target, viaHop, msg)
+		if err == nil {
+			return nil
+		}
+
+		tpl.Log().WithFields(msg.Fields()).Debugf("%s, falling back to UDP", err)
+		viaHop.Port = viaPort
+	}
+
+	return tpl.send(location.Transport, location.Target, viaHop, msg)
+}
+
+// send sends request through the network protocol, the request is bound to the network and target
+// so retransmissions go to the same location.
+func (tpl *layer) send(network string, target *Target, viaHop *sip.ViaHop, msg sip.Request) error {
+	// rewrite sent-by transport
+	viaHop.Transport = strings.ToUpper(network)
+	viaHop.Host = tpl.ip.String()
+
+	protocol, err := tpl.getProtocol(network)
+	if err != nil {
+		return err
+	}
+
+	// rewrite sent-by port
+	if viaHop.Port == nil {
+		if ports, ok := tpl.listenPorts[protocol.Network()]; ok {
+			port := ports[rand.Intn(len(ports))]
+			viaHop.Port = &port
+		} else {
+			defPort := sip.DefaultPort(network)
+			viaHop.Port = &defPort
+		}
+	}
+
+	msg.SetTransport(strings.ToUpper(network))
+	msg.SetDestination(target.Addr())
+	msg.Recipient().UriParams().Remove("transport")
+
+	logger := log.AddFieldsFrom(tpl.Log(), protocol, msg)
+	logger.Debugf("sending SIP request:\n%s", msg)
+
+	if err = protocol.Send(target, msg); err != nil {
+		return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+	}
+
+	return nil
+}
+
 func (tpl *layer) getProtocol(network string) (Protocol, error) {
 	network = strings.ToLower(network)
 	return tpl.protocols.getOrPutNew(protocolKey(network), func() (Protocol, error) {
@@ -336,6 +369,7 @@ func (tpl *layer) getProtocol(network string) (Protocol, error) {
 			tpl.canceled,
 			tpl.msgMapper,
 			tpl.Log(),
+			withKeepAlive{tpl.keepAlive},
 		)
 	})
 }
@@ -3,6 +3,7 @@ package transport_test
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -231,6 +232,69 @@ var _ = Describe("TransportLayer", func() {
 			})
 		})
 
+		Context("when sends request larger than UDP size limit", func() {
+			var request sip.Request
+
+			BeforeEach(func() {
+				request = testutils.Request([]string{
+					"MESSAGE sip:bob@" + clientAddr + " SIP/2.0",
+					"Via: SIP/2.0/UDP " + localAddr1 + ";branch=" + sip.GenerateBranch(),
+					"To: \"Bob\" <sip:bob@far-far-away.com>",
+					"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+					"Call-ID: oversized-call-id",
+					"CSeq: 1 MESSAGE",
+					"Content-Length: 2000",
+					"",
+					strings.Repeat("a", 2000),
+				})
+			})
+
+			It("should send it over TCP", func(done Done) {
+				ln, err := net.Listen("tcp", clientAddr)
+				Expect(err).ToNot(HaveOccurred())
+				defer ln.Close()
+
+				twg := new(sync.WaitGroup)
+				twg.Add(1)
+				go func() {
+					defer twg.Done()
+					conn, err := ln.Accept()
+					Expect(err).ToNot(HaveOccurred())
+					defer conn.Close()
+					buf := make([]byte, 0, 4096)
+					chunk := make([]byte, 4096)
+					for len(buf) < 2000 {
+						num, err := conn.Read(chunk)
+						Expect(err).ToNot(HaveOccurred())
+						buf = append(buf, chunk[:num]...)
+					}
+					Expect(string(buf)).Should(HavePrefix("MESSAGE sip:bob@" + clientAddr + " SIP/2.0\r\nVia: SIP/2.0/TCP"))
+				}()
+
+				Expect(tpl.Send(request)).To(Succeed())
+				Expect(request.Transport()).Should(Equal("TCP"))
+
+				twg.Wait()
+				close(done)
+			}, 3)
+
+			It("should fall back to UDP if TCP connection fails", func(done Done) {
+				conn, err := net.ListenPacket("udp", clientAddr)
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+
+				Expect(tpl.Send(request)).To(Succeed())
+				Expect(request.Transport()).Should(Equal("UDP"))
+
+				buf := make([]byte, 4096)
+				num, _, err := conn.ReadFrom(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:num])).Should(HavePrefix("MESSAGE sip:bob@" + clientAddr + " SIP/2.0\r\nVia: SIP/2.0/UDP"))
+
+				close(done)
+			}, 3)
+		})
+
 		Context("when cancels", func() {
 			BeforeEach(func() {
 				time.Sleep(time.Millisecond)
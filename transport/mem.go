@@ -0,0 +1,397 @@
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// memQueueSize is the receive queue size of the mem endpoint,
+// messages are dropped when it is full as by the socket buffer.
+const memQueueSize = 1024
+
+// MemConditions describe impairments of the mem network applied to every sent message.
+// Delay is measured by the timing package, so the delivery is driven by timing.Elapse in MockMode.
+type MemConditions struct {
+	// Delay of the message delivery.
+	Delay time.Duration
+	// Jitter adds random delay in [0, Jitter) to the Delay, messages sent in a row are reordered.
+	Jitter time.Duration
+	// Loss is the probability in [0, 1] to drop the message.
+	Loss float64
+	// Duplicate is the probability in [0, 1] to deliver the message twice.
+	Duplicate float64
+	// Seed of the random source, the same seed gives the same impairments for the same message sequence.
+	Seed int64
+	// Filter returns false to drop the message sent from src to dst address.
+	Filter func(src, dst string, msg sip.Message) bool
+}
+
+// Switchboard connects mem protocol endpoints by the listen address,
+// so several transport layers in one process exchange messages without sockets.
+type Switchboard struct {
+	mu         sync.RWMutex
+	endpoints  map[string]*memEndpoint
+	conditions MemConditions
+	rand       *rand.Rand
+}
+
+// DefaultSwitchboard is used by the mem protocol of the default protocol factory.
+var DefaultSwitchboard = NewSwitchboard(MemConditions{})
+
+func NewSwitchboard(conditions MemConditions) *Switchboard {
+	return &Switchboard{
+		endpoints:  make(map[string]*memEndpoint),
+		conditions: conditions,
+		rand:       rand.New(rand.NewSource(conditions.Seed)),
+	}
+}
+
+// SetConditions replaces impairments of the network and reseeds the random source.
+func (sb *Switchboard) SetConditions(conditions MemConditions) {
+	sb.mu.Lock()
+	sb.conditions = conditions
+	sb.rand = rand.New(rand.NewSource(conditions.Seed))
+	sb.mu.Unlock()
+}
+
+func (sb *Switchboard) bind(ep *memEndpoint) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if _, ok := sb.endpoints[ep.addr]; ok {
+		return fmt.Errorf("address %s already in use", ep.addr)
+	}
+	sb.endpoints[ep.addr] = ep
+
+	return nil
+}
+
+func (sb *Switchboard) unbind(ep *memEndpoint) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.endpoints[ep.addr] == ep {
+		delete(sb.endpoints, ep.addr)
+	}
+}
+
+// lookup finds endpoint bound to the address or to the unspecified address with the same port.
+func (sb *Switchboard) lookup(addr string) (*memEndpoint, bool) {
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+
+	if ep, ok := sb.endpoints[addr]; ok {
+		return ep, true
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ep, ok := sb.endpoints[net.JoinHostPort("0.0.0.0", port)]
+
+	return ep, ok
+}
+
+// impair returns delays of the message copies to deliver, it is empty when the message is lost.
+func (sb *Switchboard) impair(src, dst string, msg sip.Message) []time.Duration {
+	sb.mu.RLock()
+	filter := sb.conditions.Filter
+	sb.mu.RUnlock()
+	if filter != nil && !filter(src, dst, msg) {
+		return nil
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	cond := sb.conditions
+	if cond.Loss > 0 && sb.rand.Float64() < cond.Loss {
+		return nil
+	}
+	copies := 1
+	if cond.Duplicate > 0 && sb.rand.Float64() < cond.Duplicate {
+		copies++
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = cond.Delay
+		if cond.Jitter > 0 {
+			delays[i] += time.Duration(sb.rand.Int63n(int64(cond.Jitter)))
+		}
+	}
+
+	return delays
+}
+
+func (sb *Switchboard) send(src, dst string, msg sip.Message) error {
+	ep, ok := sb.lookup(dst)
+	if !ok {
+		return fmt.Errorf("no mem endpoint at %s", dst)
+	}
+
+	pkt := memPacket{src: src, data: []byte(msg.String())}
+	for _, delay := range sb.impair(src, dst, msg) {
+		if delay <= 0 {
+			ep.enqueue(pkt)
+			continue
+		}
+		timing.AfterFunc(delay, func() {
+			ep.enqueue(pkt)
+		})
+	}
+
+	return nil
+}
+
+type memPacket struct {
+	src  string
+	data []byte
+}
+
+type memEndpoint struct {
+	addr     string
+	protocol *memProtocol
+	queue    chan memPacket
+}
+
+func (ep *memEndpoint) enqueue(pkt memPacket) {
+	select {
+	case ep.queue <- pkt:
+	default:
+		ep.protocol.Log().Warnf("mem endpoint %s queue is full, drop message from %s", ep.addr, pkt.src)
+	}
+}
+
+func (ep *memEndpoint) serve() {
+	defer ep.protocol.wg.Done()
+
+	for {
+		select {
+		case <-ep.protocol.cancel:
+			return
+		case pkt := <-ep.queue:
+			ep.protocol.receive(ep, pkt)
+		}
+	}
+}
+
+// mem protocol implementation, it is unreliable and not streamed as UDP.
+type memProtocol struct {
+	protocol
+	board     *Switchboard
+	output    chan<- sip.Message
+	cancel    <-chan struct{}
+	msgMapper sip.MessageMapper
+
+	mu        sync.RWMutex
+	endpoints []*memEndpoint
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func NewMemProtocol(
+	board *Switchboard,
+	output chan<- sip.Message,
+	errs chan<- error,
+	cancel <-chan struct{},
+	msgMapper sip.MessageMapper,
+	logger log.Logger,
+	options ...ProtocolOption,
+) Protocol {
+	p := new(memProtocol)
+	p.network = "mem"
+	p.reliable = false
+	p.streamed = false
+	p.log = logger.
+		WithPrefix("transport.Protocol").
+		WithFields(log.Fields{
+			"protocol_ptr": fmt.Sprintf("%p", p),
+		})
+	p.board = board
+	p.output = output
+	p.cancel = cancel
+	p.msgMapper = msgMapper
+	if p.msgMapper == nil {
+		p.msgMapper = func(msg sip.Message) sip.Message {
+			return msg
+		}
+	}
+	p.done = make(chan struct{})
+
+	go func() {
+		<-cancel
+		p.wg.Wait()
+
+		p.mu.Lock()
+		for _, ep := range p.endpoints {
+			p.board.unbind(ep)
+		}
+		p.endpoints = nil
+		p.mu.Unlock()
+
+		close(p.done)
+	}()
+
+	return p
+}
+
+// MemProtocolFactory returns protocol factory creating mem protocol on the switchboard,
+// other networks are created by the next factory.
+func MemProtocolFactory(board *Switchboard, next ProtocolFactory) ProtocolFactory {
+	return func(
+		network string,
+		output chan<- sip.Message,
+		errs chan<- error,
+		cancel <-chan struct{},
+		msgMapper sip.MessageMapper,
+		logger log.Logger,
+		options ...ProtocolOption,
+	) (Protocol, error) {
+		if network == "mem" {
+			return NewMemProtocol(board, output, errs, cancel, msgMapper, logger, options...), nil
+		}
+
+		return next(network, output, errs, cancel, msgMapper, logger, options...)
+	}
+}
+
+func (p *memProtocol) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *memProtocol) Listen(target *Target, options ...ListenOption) error {
+	target = FillTargetHostAndPort(p.Network(), target)
+
+	select {
+	case <-p.cancel:
+		return &ProtocolError{
+			fmt.Errorf("protocol is canceled"),
+			fmt.Sprintf("listen on %s %s address", p.Network(), target.Addr()),
+			fmt.Sprintf("%p", p),
+		}
+	default:
+	}
+
+	ep := &memEndpoint{
+		addr:     target.Addr(),
+		protocol: p,
+		queue:    make(chan memPacket, memQueueSize),
+	}
+	if err := p.board.bind(ep); err != nil {
+		return &ProtocolError{
+			err,
+			fmt.Sprintf("listen on %s %s address", p.Network(), target.Addr()),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("begin listening on %s %s", p.Network(), ep.addr)
+
+	p.mu.Lock()
+	p.endpoints = append(p.endpoints, ep)
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go ep.serve()
+
+	return nil
+}
+
+func (p *memProtocol) Send(target *Target, msg sip.Message) error {
+	target = FillTargetHostAndPort(p.Network(), target)
+
+	_, port, err := net.SplitHostPort(msg.Source())
+	if err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       "resolve source port",
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.mu.RLock()
+	var src *memEndpoint
+	for _, ep := range p.endpoints {
+		if _, epPort, _ := net.SplitHostPort(ep.addr); epPort == port {
+			src = ep
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	if src == nil {
+		return &ProtocolError{
+			fmt.Errorf("endpoint on port %s not found", port),
+			"search endpoint",
+			fmt.Sprintf("%p", p),
+		}
+	}
+
+	logger := log.AddFieldsFrom(p.Log(), msg)
+	logger.Tracef("writing SIP message to %s %s", p.Network(), target.Addr())
+
+	if err := p.board.send(src.addr, target.Addr(), msg); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("write SIP message to %s %s", p.Network(), target.Addr()),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	return nil
+}
+
+// receive parses the packet and passes message up as the UDP connection does - RFC 3261 18.2.1.
+func (p *memProtocol) receive(ep *memEndpoint, pkt memPacket) {
+	msg, err := parser.ParseMessage(pkt.data, p.Log())
+	if err != nil {
+		p.Log().Warnf("drop malformed message from %s: %s", pkt.src, err)
+		return
+	}
+
+	raddr := pkt.src
+	rhost, rport, _ := net.SplitHostPort(raddr)
+	msg.SetDestination(ep.addr)
+	if req, ok := msg.(sip.Request); ok {
+		viaHop, ok := req.ViaHop()
+		if !ok {
+			p.Log().Warn("ignore message without 'Via' header")
+			return
+		}
+
+		if rhost != "" && rhost != viaHop.Host {
+			viaHop.Params.Add("received", sip.String{Str: rhost})
+		}
+		// rfc3581
+		if viaHop.Params.Has("rport") {
+			viaHop.Params.Add("rport", sip.String{Str: rport})
+		} else {
+			port := sip.DefaultPort(p.network)
+			if viaHop.Port != nil {
+				port = *viaHop.Port
+			}
+			raddr = fmt.Sprintf("%s:%d", rhost, port)
+		}
+	}
+	msg.SetTransport(p.network)
+	msg.SetSource(raddr)
+
+	msg = p.msgMapper(msg.WithFields(log.Fields{
+		"received_at": time.Now(),
+	}))
+
+	select {
+	case <-p.cancel:
+	case p.output <- msg:
+	}
+}
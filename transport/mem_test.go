@@ -0,0 +1,132 @@
+package transport_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("MemProtocol", func() {
+	var (
+		board                *transport.Switchboard
+		output1, output2     chan sip.Message
+		cancel               chan struct{}
+		protocol1, protocol2 transport.Protocol
+	)
+
+	localTarget1 := transport.NewTarget("127.0.0.1", 9070)
+	localTarget2 := transport.NewTarget("127.0.0.1", 9071)
+	logger := testutils.NewLogrusLogger()
+
+	timing.MockMode = true
+
+	request := func() sip.Message {
+		msg, err := parser.ParseMessage([]byte("OPTIONS sip:bob@127.0.0.1:9071 SIP/2.0\r\n"+
+			"Via: SIP/2.0/MEM pc33.far-far-away.com:9070;branch=z9hG4bK776asdhds\r\n"+
+			"To: \"Bob\" <sip:bob@far-far-away.com>\r\n"+
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774\r\n"+
+			"Call-ID: cheesecake1729\r\n"+
+			"CSeq: 1 OPTIONS\r\n"+
+			"Content-Length: 0\r\n"+
+			"\r\n"), logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		return msg
+	}
+
+	BeforeEach(func() {
+		board = transport.NewSwitchboard(transport.MemConditions{})
+		output1 = make(chan sip.Message, 10)
+		output2 = make(chan sip.Message, 10)
+		cancel = make(chan struct{})
+		protocol1 = transport.NewMemProtocol(board, output1, nil, cancel, nil, logger)
+		protocol2 = transport.NewMemProtocol(board, output2, nil, cancel, nil, logger)
+		Expect(protocol1.Listen(localTarget1)).To(Succeed())
+		Expect(protocol2.Listen(localTarget2)).To(Succeed())
+	})
+	AfterEach(func(done Done) {
+		close(cancel)
+		<-protocol1.Done()
+		<-protocol2.Done()
+		close(done)
+	}, 3)
+
+	It("should not be reliable and streamed", func() {
+		Expect(protocol1.Network()).To(Equal("MEM"))
+		Expect(protocol1.Reliable()).To(BeFalse())
+		Expect(protocol1.Streamed()).To(BeFalse())
+	})
+
+	It("should not listen on the bound address", func() {
+		Expect(protocol2.Listen(localTarget1)).ToNot(Succeed())
+	})
+
+	It("should deliver message to the endpoint", func(done Done) {
+		defer close(done)
+
+		Expect(protocol1.Send(localTarget2, request())).To(Succeed())
+
+		var msg sip.Message
+		Eventually(output2).Should(Receive(&msg))
+		Expect(msg.Transport()).To(Equal("MEM"))
+		Expect(msg.Source()).To(Equal("127.0.0.1:9070"))
+		Expect(msg.Destination()).To(Equal(localTarget2.Addr()))
+		viaHop, ok := msg.ViaHop()
+		Expect(ok).To(BeTrue())
+		received, ok := viaHop.Params.Get("received")
+		Expect(ok).To(BeTrue())
+		Expect(received.String()).To(Equal("127.0.0.1"))
+	}, 3)
+
+	It("should fail to send to unknown address", func() {
+		Expect(protocol1.Send(transport.NewTarget("127.0.0.1", 9079), request())).ToNot(Succeed())
+	})
+
+	Context("with impaired network", func() {
+		It("should drop messages", func() {
+			board.SetConditions(transport.MemConditions{Loss: 1})
+
+			Expect(protocol1.Send(localTarget2, request())).To(Succeed())
+			Consistently(output2, 50*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should drop filtered messages", func() {
+			board.SetConditions(transport.MemConditions{
+				Filter: func(src, dst string, msg sip.Message) bool {
+					return dst != localTarget2.Addr()
+				},
+			})
+
+			Expect(protocol1.Send(localTarget2, request())).To(Succeed())
+			Consistently(output2, 50*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should duplicate messages", func(done Done) {
+			defer close(done)
+
+			board.SetConditions(transport.MemConditions{Duplicate: 1})
+
+			Expect(protocol1.Send(localTarget2, request())).To(Succeed())
+			Eventually(output2).Should(Receive())
+			Eventually(output2).Should(Receive())
+		}, 3)
+
+		It("should delay messages by the mock clock", func(done Done) {
+			defer close(done)
+
+			board.SetConditions(transport.MemConditions{Delay: time.Second})
+
+			Expect(protocol1.Send(localTarget2, request())).To(Succeed())
+			Consistently(output2, 50*time.Millisecond).ShouldNot(Receive())
+
+			timing.Elapse(time.Second)
+			Eventually(output2).Should(Receive())
+		}, 3)
+	})
+})
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"net"
+	"time"
 
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
@@ -20,6 +21,13 @@ type LayerOption interface {
 type LayerOptions struct {
 	Options
 	DNSResolver *net.Resolver
+	// Resolver locates next hop of requests that are not bound to a location yet,
+	// RFC 3263 resolver over DNSResolver is used if it is nil.
+	Resolver Resolver
+	// UDPMaxSize is the size in bytes of the whole serialized request, headers and body,
+	// above which UDP request is sent over TCP.
+	UDPMaxSize int
+	KeepAlive  KeepAliveOptions
 }
 
 type ProtocolOption interface {
@@ -28,6 +36,15 @@ type ProtocolOption interface {
 
 type ProtocolOptions struct {
 	Options
+	KeepAlive KeepAliveOptions
+}
+
+// KeepAliveOptions configures client-side CRLF keepalive of connection-oriented flows - RFC 5626 4.4.1.
+type KeepAliveOptions struct {
+	// Interval between pings, zero disables keepalive.
+	Interval time.Duration
+	// MaxMissed is the number of unanswered pings after which the flow is considered failed.
+	MaxMissed int
 }
 
 func WithMessageMapper(mapper sip.MessageMapper) interface {
@@ -80,6 +97,64 @@ func (o withDnsResolver) ApplyLayer(opts *LayerOptions) {
 	opts.DNSResolver = o.resolver
 }
 
+// WithResolver sets the server locator of the layer, i.e. the one shared with the SIP server.
+func WithResolver(resolver Resolver) LayerOption {
+	return withResolver{resolver}
+}
+
+type withResolver struct {
+	resolver Resolver
+}
+
+func (o withResolver) ApplyLayer(opts *LayerOptions) {
+	opts.Resolver = o.resolver
+}
+
+// DefaultUDPMaxSize is the request size limit of UDP when path MTU is unknown - RFC 3261 18.1.1.
+const DefaultUDPMaxSize = 1300
+
+// WithUDPMaxSize sets the size in bytes of the whole serialized request above which
+// UDP request is sent over TCP, zero or negative size disables switching.
+func WithUDPMaxSize(size int) LayerOption {
+	return withUDPMaxSize{size}
+}
+
+type withUDPMaxSize struct {
+	size int
+}
+
+func (o withUDPMaxSize) ApplyLayer(opts *LayerOptions) {
+	opts.UDPMaxSize = o.size
+}
+
+// DefaultKeepAliveMaxMissed is the number of unanswered keepalive pings after which the flow fails.
+const DefaultKeepAliveMaxMissed = 3
+
+// WithKeepAlive enables sending of double-CRLF pings over stream connections every interval.
+// Connections that miss maxMissed pongs are dropped and reported with FlowError,
+// zero or negative maxMissed means DefaultKeepAliveMaxMissed.
+func WithKeepAlive(interval time.Duration, maxMissed int) interface {
+	LayerOption
+	ProtocolOption
+} {
+	if maxMissed <= 0 {
+		maxMissed = DefaultKeepAliveMaxMissed
+	}
+	return withKeepAlive{KeepAliveOptions{interval, maxMissed}}
+}
+
+type withKeepAlive struct {
+	opts KeepAliveOptions
+}
+
+func (o withKeepAlive) ApplyLayer(opts *LayerOptions) {
+	opts.KeepAlive = o.opts
+}
+
+func (o withKeepAlive) ApplyProtocol(opts *ProtocolOptions) {
+	opts.KeepAlive = o.opts
+}
+
 // Listen method options
 type ListenOption interface {
 	ApplyListen(opts *ListenOptions)
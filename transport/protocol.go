@@ -32,6 +32,7 @@ type ProtocolFactory func(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) (Protocol, error)
 
 type protocol struct {
@@ -0,0 +1,523 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// NAPTR is DNS naming authority pointer record - RFC 3403.
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// DNSResolver performs DNS lookups required by RFC 3263 server location.
+// *net.Resolver satisfies it except NAPTR lookup, see NewDNSResolver.
+type DNSResolver interface {
+	LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewDNSResolver wraps net.Resolver with NAPTR lookup.
+// NAPTR queries are sent over UDP to the nameserver address,
+// the first nameserver from /etc/resolv.conf is used if it is empty.
+func NewDNSResolver(resolver *net.Resolver, nameserver string) DNSResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &dnsResolver{
+		Resolver:   resolver,
+		nameserver: nameserver,
+	}
+}
+
+type dnsResolver struct {
+	*net.Resolver
+	nameserver string
+}
+
+const dnsTypeNAPTR dnsmessage.Type = 35
+
+// DefaultResolveTimeout limits DNS queries and server location when the context has no deadline.
+const DefaultResolveTimeout = 5 * time.Second
+
+func (r *dnsResolver) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultResolveTimeout)
+		defer cancel()
+	}
+
+	qname, err := dnsmessage.NewName(dnsFQDN(name))
+	if err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+
+	id := uint16(rand.Int31n(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: dnsTypeNAPTR, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+
+	nameserver := r.nameserver
+	if nameserver == "" {
+		nameserver = systemNameserver()
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", nameserver)
+	if err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+	buf := make([]byte, 4096)
+	num, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:num]); err != nil {
+		return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+	}
+	if msg.Header.ID != id {
+		return nil, fmt.Errorf("lookup NAPTR %s: unexpected response ID", name)
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("lookup NAPTR %s: %s", name, msg.Header.RCode)
+	}
+
+	records := make([]*NAPTR, 0)
+	for _, answer := range msg.Answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || body.Type != dnsTypeNAPTR {
+			continue
+		}
+		record, err := parseNAPTR(body.Data)
+		if err != nil {
+			return nil, fmt.Errorf("lookup NAPTR %s: %w", name, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// parseNAPTR decodes NAPTR RDATA, replacement domain name is not compressed - RFC 3403 4.1.
+func parseNAPTR(data []byte) (*NAPTR, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("short NAPTR record")
+	}
+	record := &NAPTR{
+		Order:      binary.BigEndian.Uint16(data[0:2]),
+		Preference: binary.BigEndian.Uint16(data[2:4]),
+	}
+	offset := 4
+
+	readString := func() (string, error) {
+		if offset >= len(data) {
+			return "", fmt.Errorf("short NAPTR record")
+		}
+		size := int(data[offset])
+		offset++
+		if offset+size > len(data) {
+			return "", fmt.Errorf("short NAPTR record")
+		}
+		str := string(data[offset : offset+size])
+		offset += size
+
+		return str, nil
+	}
+
+	var err error
+	if record.Flags, err = readString(); err != nil {
+		return nil, err
+	}
+	if record.Service, err = readString(); err != nil {
+		return nil, err
+	}
+	if record.Regexp, err = readString(); err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, 0)
+	for {
+		if offset >= len(data) {
+			return nil, fmt.Errorf("short NAPTR record")
+		}
+		size := int(data[offset])
+		offset++
+		if size == 0 {
+			break
+		}
+		if offset+size > len(data) {
+			return nil, fmt.Errorf("short NAPTR record")
+		}
+		labels = append(labels, string(data[offset:offset+size]))
+		offset += size
+	}
+	record.Replacement = strings.Join(labels, ".") + "."
+
+	return record, nil
+}
+
+func systemNameserver() string {
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+
+	return "127.0.0.1:53"
+}
+
+func dnsFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+// Location is the resolved next hop of the request.
+type Location struct {
+	Transport string
+	Target    *Target
+}
+
+func (loc *Location) String() string {
+	if loc == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("transport.Location<%s %s>", loc.Transport, loc.Target.Addr())
+}
+
+// Resolver locates SIP servers by URI - RFC 3263 4.
+// Locations are returned in the order they should be tried.
+type Resolver interface {
+	Resolve(ctx context.Context, uri sip.Uri) ([]*Location, error)
+}
+
+// NewResolver creates RFC 3263 resolver: NAPTR, then SRV, then A/AAAA lookups.
+func NewResolver(dns DNSResolver) Resolver {
+	return &resolver{dns}
+}
+
+type resolver struct {
+	dns DNSResolver
+}
+
+// NAPTR services and SRV names of supported transports - RFC 3263 4.1, RFC 7118 6.
+var transportServices = []struct {
+	transport string
+	naptr     string
+	service   string
+	proto     string
+	secure    bool
+}{
+	{"UDP", "SIP+D2U", "sip", "udp", false},
+	{"TCP", "SIP+D2T", "sip", "tcp", false},
+	{"TLS", "SIPS+D2T", "sips", "tcp", true},
+	{"WS", "SIP+D2W", "sip", "ws", false},
+	{"WSS", "SIPS+D2W", "sips", "ws", true},
+}
+
+func (r *resolver) Resolve(ctx context.Context, uri sip.Uri) ([]*Location, error) {
+	host := uri.Host()
+	port := uri.Port()
+	secure := uri.IsEncrypted()
+
+	var transport string
+	if params := uri.UriParams(); params != nil {
+		if val, ok := params.Get("transport"); ok && val != nil && val.String() != "" {
+			transport = strings.ToUpper(val.String())
+		}
+	}
+	if secure {
+		switch transport {
+		case "TCP":
+			transport = "TLS"
+		case "WS":
+			transport = "WSS"
+		}
+	}
+
+	// numeric IP or explicit port - RFC 3263 4.1, 4.2
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip != nil || port != nil {
+		if transport == "" {
+			transport = defaultTransport(secure)
+		}
+		if port == nil {
+			p := sip.DefaultPort(transport)
+			port = &p
+		}
+		if ip != nil {
+			return []*Location{{transport, &Target{Host: formatIP(ip), Port: port}}}, nil
+		}
+
+		return r.lookupHost(ctx, transport, host, *port)
+	}
+
+	// explicit transport - RFC 3263 4.2
+	if transport != "" {
+		locations, err := r.lookupService(ctx, transport, srvName(transport, host))
+		if err != nil {
+			return nil, err
+		}
+		if len(locations) > 0 {
+			return locations, nil
+		}
+
+		return r.lookupHost(ctx, transport, host, sip.DefaultPort(transport))
+	}
+
+	// NAPTR - RFC 3263 4.1
+	if records, err := r.dns.LookupNAPTR(ctx, host); err == nil && len(records) > 0 {
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Order != records[j].Order {
+				return records[i].Order < records[j].Order
+			}
+			return records[i].Preference < records[j].Preference
+		})
+
+		locations := make([]*Location, 0)
+		for _, record := range records {
+			if !strings.EqualFold(record.Flags, "s") {
+				continue
+			}
+			for _, svc := range transportServices {
+				if !strings.EqualFold(record.Service, svc.naptr) || (secure && !svc.secure) {
+					continue
+				}
+				found, err := r.lookupService(ctx, svc.transport, record.Replacement)
+				if err != nil {
+					return nil, err
+				}
+				locations = append(locations, found...)
+			}
+		}
+		if len(locations) > 0 {
+			return locations, nil
+		}
+	}
+
+	// no NAPTR, SRV for each supported transport
+	locations := make([]*Location, 0)
+	for _, svc := range transportServices {
+		if secure && !svc.secure {
+			continue
+		}
+		found, err := r.lookupService(ctx, svc.transport, srvName(svc.transport, host))
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, found...)
+	}
+	if len(locations) > 0 {
+		return locations, nil
+	}
+
+	transport = defaultTransport(secure)
+
+	return r.lookupHost(ctx, transport, host, sip.DefaultPort(transport))
+}
+
+// lookupService resolves SRV name into locations ordered by priority and weight - RFC 2782.
+func (r *resolver) lookupService(ctx context.Context, transport, name string) ([]*Location, error) {
+	_, addrs, err := r.dns.LookupSRV(ctx, "", "", strings.TrimSuffix(name, "."))
+	if err != nil || len(addrs) == 0 {
+		// missing records are not an error of the server location
+		return nil, nil
+	}
+
+	locations := make([]*Location, 0)
+	for _, addr := range orderSRV(addrs) {
+		found, err := r.lookupHost(ctx, transport, strings.TrimSuffix(addr.Target, "."), sip.Port(addr.Port))
+		if err != nil {
+			continue
+		}
+		locations = append(locations, found...)
+	}
+
+	return locations, nil
+}
+
+func (r *resolver) lookupHost(ctx context.Context, transport, host string, port sip.Port) ([]*Location, error) {
+	addrs, err := r.dns.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("lookup %s: no addresses", host)
+	}
+
+	locations := make([]*Location, 0, len(addrs))
+	for _, addr := range addrs {
+		p := port
+		locations = append(locations, &Location{transport, &Target{Host: formatIP(addr.IP), Port: &p}})
+	}
+
+	return locations, nil
+}
+
+// orderSRV sorts records by priority and picks records of the same priority
+// randomly in proportion to the weight - RFC 2782.
+func orderSRV(addrs []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(addrs))
+	copy(sorted, addrs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		group := sorted[start:end]
+		for len(group) > 0 {
+			total := 0
+			for _, addr := range group {
+				total += int(addr.Weight)
+			}
+			n := 0
+			if total > 0 {
+				pick := rand.Intn(total + 1)
+				for i, addr := range group {
+					pick -= int(addr.Weight)
+					if pick <= 0 {
+						n = i
+						break
+					}
+				}
+			}
+			ordered = append(ordered, group[n])
+			group = append(group[:n:n], group[n+1:]...)
+		}
+
+		start = end
+	}
+
+	return ordered
+}
+
+func srvName(transport, host string) string {
+	for _, svc := range transportServices {
+		if svc.transport == transport {
+			return fmt.Sprintf("_%s._%s.%s", svc.service, svc.proto, host)
+		}
+	}
+
+	return fmt.Sprintf("_sip._%s.%s", strings.ToLower(transport), host)
+}
+
+func defaultTransport(secure bool) string {
+	if secure {
+		return "TLS"
+	}
+
+	return "UDP"
+}
+
+func formatIP(ip net.IP) string {
+	if ip.To4() == nil {
+		return fmt.Sprintf("[%v]", ip.String())
+	}
+
+	return ip.String()
+}
+
+// BoundLocation returns the location the request is bound to.
+// Request is bound when its destination is a numeric address, such request is sent without DNS lookups.
+func BoundLocation(req sip.Request) (*Location, bool) {
+	target, err := NewTargetFromAddr(req.Destination())
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(target.Host)
+	if ip == nil {
+		return nil, false
+	}
+	target.Host = formatIP(ip)
+
+	return &Location{req.Transport(), target}, true
+}
+
+// ResolveRequest locates next hop of the request: the first Route or Request-URI.
+// Destination set explicitly on the request takes precedence over the URI.
+func ResolveRequest(ctx context.Context, resolver Resolver, req sip.Request) ([]*Location, error) {
+	dest := req.Destination()
+
+	uri := nextHopUri(req)
+	if uri != nil {
+		port := sip.DefaultPort(req.Transport())
+		if uri.FPort != nil {
+			port = *uri.FPort
+		}
+		if fmt.Sprintf("%v:%v", uri.FHost, port) == dest {
+			return resolver.Resolve(ctx, uri)
+		}
+	}
+
+	target, err := NewTargetFromAddr(dest)
+	if err != nil {
+		return nil, fmt.Errorf("build address target for %s: %w", dest, err)
+	}
+
+	return resolver.Resolve(ctx, &sip.SipUri{
+		FHost:      target.Host,
+		FPort:      target.Port,
+		FUriParams: sip.NewParams().Add("transport", sip.String{Str: strings.ToLower(req.Transport())}),
+	})
+}
+
+func nextHopUri(req sip.Request) *sip.SipUri {
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			uri, _ := route.Addresses[0].(*sip.SipUri)
+			return uri
+		}
+	}
+	uri, _ := req.Recipient().(*sip.SipUri)
+
+	return uri
+}
@@ -0,0 +1,180 @@
+package transport_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+type memoryDNS struct {
+	naptr map[string][]*transport.NAPTR
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (dns *memoryDNS) LookupNAPTR(ctx context.Context, name string) ([]*transport.NAPTR, error) {
+	if records, ok := dns.naptr[name]; ok {
+		return records, nil
+	}
+	return nil, fmt.Errorf("no NAPTR records for %s", name)
+}
+
+func (dns *memoryDNS) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if records, ok := dns.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, fmt.Errorf("no SRV records for %s", name)
+}
+
+func (dns *memoryDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := dns.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+var _ = Describe("Resolver", func() {
+	var dns *memoryDNS
+	var resolver transport.Resolver
+
+	addrs := func(locations []*transport.Location) []string {
+		result := make([]string, 0, len(locations))
+		for _, loc := range locations {
+			result = append(result, loc.Transport+" "+loc.Target.Addr())
+		}
+		return result
+	}
+	resolve := func(uri string) []string {
+		u, err := parser.ParseSipUri(uri)
+		Expect(err).ShouldNot(HaveOccurred())
+		locations, err := resolver.Resolve(context.Background(), &u)
+		Expect(err).ShouldNot(HaveOccurred())
+		return addrs(locations)
+	}
+
+	BeforeEach(func() {
+		dns = &memoryDNS{
+			naptr: map[string][]*transport.NAPTR{
+				"example.com": {
+					{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com."},
+					{Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com."},
+					{Order: 30, Preference: 10, Flags: "s", Service: "SIP+D2X", Replacement: "_sip._x.example.com."},
+				},
+			},
+			srv: map[string][]*net.SRV{
+				"_sip._udp.example.com": {
+					{Target: "backup.example.com.", Port: 5070, Priority: 20, Weight: 0},
+					{Target: "sip.example.com.", Port: 5060, Priority: 10, Weight: 0},
+				},
+				"_sip._tcp.example.com": {
+					{Target: "sip.example.com.", Port: 5060, Priority: 10, Weight: 0},
+				},
+				"_sip._udp.example.org": {
+					{Target: "sip.example.org.", Port: 5080, Priority: 10, Weight: 0},
+				},
+				"_sips._tcp.example.org": {
+					{Target: "sip.example.org.", Port: 5081, Priority: 10, Weight: 0},
+				},
+			},
+			hosts: map[string][]string{
+				"sip.example.com":    {"192.0.2.1"},
+				"backup.example.com": {"192.0.2.2"},
+				"sip.example.org":    {"192.0.2.3"},
+				"example.net":        {"192.0.2.4", "2001:db8::4"},
+			},
+		}
+		resolver = transport.NewResolver(dns)
+	})
+
+	It("should use numeric IP address as is", func() {
+		Expect(resolve("sip:bob@192.0.2.10")).Should(Equal([]string{"UDP 192.0.2.10:5060"}))
+		Expect(resolve("sips:bob@192.0.2.10:5555")).Should(Equal([]string{"TLS 192.0.2.10:5555"}))
+	})
+
+	It("should lookup address records when port is explicit", func() {
+		Expect(resolve("sip:bob@example.net:5090;transport=tcp")).Should(Equal([]string{
+			"TCP 192.0.2.4:5090",
+			"TCP [2001:db8::4]:5090",
+		}))
+	})
+
+	It("should lookup SRV records of explicit transport", func() {
+		Expect(resolve("sip:bob@example.com;transport=udp")).Should(Equal([]string{
+			"UDP 192.0.2.1:5060",
+			"UDP 192.0.2.2:5070",
+		}))
+	})
+
+	It("should order transports by NAPTR records", func() {
+		Expect(resolve("sip:bob@example.com")).Should(Equal([]string{
+			"TCP 192.0.2.1:5060",
+			"UDP 192.0.2.1:5060",
+			"UDP 192.0.2.2:5070",
+		}))
+	})
+
+	It("should lookup SRV records of every transport without NAPTR", func() {
+		Expect(resolve("sip:bob@example.org")).Should(Equal([]string{
+			"UDP 192.0.2.3:5080",
+			"TLS 192.0.2.3:5081",
+		}))
+		Expect(resolve("sips:bob@example.org")).Should(Equal([]string{
+			"TLS 192.0.2.3:5081",
+		}))
+	})
+
+	It("should fallback to address records with default port", func() {
+		Expect(resolve("sip:bob@example.net")).Should(Equal([]string{
+			"UDP 192.0.2.4:5060",
+			"UDP [2001:db8::4]:5060",
+		}))
+	})
+
+	It("should prefer destination set on the request", func() {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		})
+		req.SetDestination("192.0.2.20:5062")
+		locations, err := transport.ResolveRequest(context.Background(), resolver, req)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(addrs(locations)).Should(Equal([]string{"UDP 192.0.2.20:5062"}))
+	})
+
+	It("should bind request with numeric destination only", func() {
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@example.com;transport=tcp SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		})
+		_, ok := transport.BoundLocation(req)
+		Expect(ok).Should(BeFalse())
+
+		req.SetDestination("2001:db8::20:5062")
+		_, ok = transport.BoundLocation(req)
+		Expect(ok).Should(BeFalse())
+
+		req.SetDestination("[2001:db8::20]:5062")
+		location, ok := transport.BoundLocation(req)
+		Expect(ok).Should(BeTrue())
+		Expect(addrs([]*transport.Location{location})).Should(Equal([]string{"TCP [2001:db8::20]:5062"}))
+	})
+})
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// STUN keepalive support for UDP flows - RFC 5626 4.4.2, RFC 5389.
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunXorMappedAddress = 0x0020
+)
+
+// isStunBindingRequest checks that data is a STUN binding request.
+func isStunBindingRequest(data []byte) bool {
+	return len(data) >= stunHeaderSize &&
+		binary.BigEndian.Uint16(data[0:2]) == stunBindingRequest &&
+		binary.BigEndian.Uint32(data[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(data[2:4]))+stunHeaderSize == len(data)
+}
+
+// stunBindingResponse builds binding success response to the request received from raddr
+// with the XOR-MAPPED-ADDRESS attribute.
+func stunBindingResponse(req []byte, raddr net.Addr) ([]byte, error) {
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported STUN mapped address %s", raddr)
+	}
+
+	var family byte
+	ip := udpAddr.IP.To4()
+	if ip != nil {
+		family = 0x01
+	} else {
+		family = 0x02
+		ip = udpAddr.IP.To16()
+	}
+
+	res := make([]byte, stunHeaderSize+4+4+len(ip))
+	binary.BigEndian.PutUint16(res[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(res[2:4], uint16(len(res)-stunHeaderSize))
+	// magic cookie and transaction ID are copied from the request
+	copy(res[4:stunHeaderSize], req[4:stunHeaderSize])
+
+	attr := res[stunHeaderSize:]
+	binary.BigEndian.PutUint16(attr[0:2], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(4+len(ip)))
+	attr[5] = family
+	binary.BigEndian.PutUint16(attr[6:8], uint16(udpAddr.Port)^uint16(stunMagicCookie>>16))
+	// IPv4 address is XOR'ed with magic cookie, IPv6 - with magic cookie and transaction ID
+	for i := range ip {
+		attr[8+i] = ip[i] ^ res[4+i]
+	}
+
+	return res, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
@@ -35,6 +36,7 @@ func NewTcpProtocol(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) Protocol {
 	p := new(tcpProtocol)
 	p.network = "tcp"
@@ -48,7 +50,7 @@ func NewTcpProtocol(
 		})
 	// TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
-	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log(), options...)
 	p.listen = p.defaultListen
 	p.dial = p.defaultDial
 	p.resolveAddr = p.defaultResolveAddr
@@ -62,8 +64,13 @@ func (p *tcpProtocol) defaultListen(addr *net.TCPAddr, options ...ListenOption)
 	return net.ListenTCP(p.network, addr)
 }
 
+// DefaultDialTimeout limits TCP connection establishment,
+// so UDP requests switched to TCP by size fall back to UDP in time.
+const DefaultDialTimeout = 5 * time.Second
+
 func (p *tcpProtocol) defaultDial(addr *net.TCPAddr) (net.Conn, error) {
-	return net.DialTCP(p.network, nil, addr)
+	d := net.Dialer{Timeout: DefaultDialTimeout}
+	return d.Dial(p.network, addr.String())
 }
 
 func (p *tcpProtocol) defaultResolveAddr(addr string) (*net.TCPAddr, error) {
@@ -20,6 +20,7 @@ func NewTlsProtocol(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) Protocol {
 	p := new(tlsProtocol)
 	p.network = "tls"
@@ -33,7 +34,7 @@ func NewTlsProtocol(
 		})
 	//TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
-	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log(), options...)
 	p.listen = func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error) {
 		if len(options) == 0 {
 			return net.ListenTCP("tcp", addr)
@@ -131,6 +131,10 @@ func isCanceled(err error) bool {
 	}
 	return false
 }
+func isFlowFailed(err error) bool {
+	var flowErr FlowError
+	return errors.As(err, &flowErr)
+}
 func isExpired(err error) bool {
 	var expiryErr sip.ExpireError
 	if errors.As(err, &expiryErr) {
@@ -190,6 +194,14 @@ func (err ExpireError) Canceled() bool  { return false }
 func (err ExpireError) Expired() bool   { return true }
 func (err ExpireError) Error() string   { return "transport.ExpireError: " + string(err) }
 
+// FlowError reports connection flow failure detected by keepalive - RFC 5626 4.4.
+type FlowError string
+
+func (err FlowError) Network() bool   { return true }
+func (err FlowError) Timeout() bool   { return true }
+func (err FlowError) Temporary() bool { return false }
+func (err FlowError) Error() string   { return "transport.FlowError: " + string(err) }
+
 // Net Protocol level error
 type ProtocolError struct {
 	Err      error
@@ -226,12 +238,13 @@ type ConnectionHandlerError struct {
 	RAddr      string
 }
 
-func (err *ConnectionHandlerError) Unwrap() error   { return err.Err }
-func (err *ConnectionHandlerError) Network() bool   { return isNetwork(err.Err) }
-func (err *ConnectionHandlerError) Timeout() bool   { return isTimeout(err.Err) }
-func (err *ConnectionHandlerError) Temporary() bool { return isTemporary(err.Err) }
-func (err *ConnectionHandlerError) Canceled() bool  { return isCanceled(err.Err) }
-func (err *ConnectionHandlerError) Expired() bool   { return isExpired(err.Err) }
+func (err *ConnectionHandlerError) Unwrap() error    { return err.Err }
+func (err *ConnectionHandlerError) Network() bool    { return isNetwork(err.Err) }
+func (err *ConnectionHandlerError) Timeout() bool    { return isTimeout(err.Err) }
+func (err *ConnectionHandlerError) Temporary() bool  { return isTemporary(err.Err) }
+func (err *ConnectionHandlerError) Canceled() bool   { return isCanceled(err.Err) }
+func (err *ConnectionHandlerError) Expired() bool    { return isExpired(err.Err) }
+func (err *ConnectionHandlerError) FlowFailed() bool { return isFlowFailed(err.Err) }
 func (err *ConnectionHandlerError) EOF() bool {
 	if err.Err == io.EOF {
 		return true
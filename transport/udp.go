@@ -21,6 +21,7 @@ func NewUdpProtocol(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) Protocol {
 	p := new(udpProtocol)
 	p.network = "udp"
@@ -32,7 +33,7 @@ func NewUdpProtocol(
 			"protocol_ptr": fmt.Sprintf("%p", p),
 		})
 	// TODO: add separate errs chan to listen errors from pool for reconnection?
-	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log(), options...)
 
 	return p
 }
@@ -1,6 +1,7 @@
 package transport_test
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
@@ -129,6 +130,38 @@ var _ = Describe("UdpProtocol", func() {
 			time.Sleep(time.Millisecond)
 		})
 
+		Context("when client sends STUN binding request", func() {
+			It("should answer with binding success response", func(done Done) {
+				client, err := net.Dial(network, localTarget1.Addr())
+				Expect(err).ToNot(HaveOccurred())
+				defer client.Close()
+
+				req := make([]byte, 20)
+				binary.BigEndian.PutUint16(req[0:2], 0x0001)
+				binary.BigEndian.PutUint32(req[4:8], 0x2112A442)
+				copy(req[8:], "transaction1")
+				_, err = client.Write(req)
+				Expect(err).ToNot(HaveOccurred())
+
+				res := make([]byte, 64)
+				num, err := client.Read(res)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(num).To(Equal(32))
+				Expect(binary.BigEndian.Uint16(res[0:2])).To(Equal(uint16(0x0101)))
+				Expect(res[4:20]).To(Equal(req[4:20]))
+				By("XOR-MAPPED-ADDRESS holds client address")
+				Expect(binary.BigEndian.Uint16(res[20:22])).To(Equal(uint16(0x0020)))
+				port := binary.BigEndian.Uint16(res[26:28]) ^ 0x2112
+				Expect(int(port)).To(Equal(client.LocalAddr().(*net.UDPAddr).Port))
+				ip := make(net.IP, 4)
+				for i := range ip {
+					ip[i] = res[28+i] ^ req[4+i]
+				}
+				Expect(ip.Equal(client.LocalAddr().(*net.UDPAddr).IP)).To(BeTrue())
+				close(done)
+			}, 3)
+		})
+
 		Context("when 3 clients connects and sends data", func() {
 			BeforeEach(func() {
 				client1 = testutils.CreateClient(network, localTarget1.Addr(), clientAddr1)
@@ -121,6 +121,7 @@ func NewWsProtocol(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) Protocol {
 	p := new(wsProtocol)
 	p.network = "ws"
@@ -134,7 +135,7 @@ func NewWsProtocol(
 		})
 	//TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
-	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log(), options...)
 	p.listen = p.defaultListen
 	p.resolveAddr = p.defaultResolveAddr
 	p.dialer.Protocols = []string{wsSubProtocol}
@@ -21,6 +21,7 @@ func NewWssProtocol(
 	cancel <-chan struct{},
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...ProtocolOption,
 ) Protocol {
 	p := new(wssProtocol)
 	p.network = "wss"
@@ -34,7 +35,7 @@ func NewWssProtocol(
 		})
 	//TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.listeners = NewListenerPool(p.conns, errs, cancel, p.Log())
-	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log(), options...)
 	p.listen = func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error) {
 		if len(options) == 0 {
 			return net.ListenTCP("tcp", addr)